@@ -38,6 +38,7 @@ func main() {
 	}()
 	// 解析命令行参数
 	flag.StringVar(&moduleName, "module", "gogs", "golang module name")
+	flag.BoolVar(&withContext, "context", false, "generate context.Context aware services for target packages")
 	flag.Parse()
 	log.Infof("Set module name: %s", moduleName)
 	packages := []string{"base/cluster"}
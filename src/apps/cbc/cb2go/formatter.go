@@ -160,6 +160,9 @@ func formatScript(script *ast.Script) {
 			printAttrs(&buff, service)
 			buff.WriteString(fmt.Sprintf("service %s {\n", service.OriginName()))
 			for _, method := range service.MethodList {
+				for _, attr := range method.Attrs() {
+					buff.WriteString(fmt.Sprintf("\t%s\n", attr.OriginName()))
+				}
 				tmp := "\t%" +
 					fmt.Sprintf("-%d", service.MaxMethodFirst) +
 					"s %" +
@@ -24,6 +24,9 @@ import (
 
 var moduleName string
 
+// withContext 是否为目标包生成带context.Context的服务接口,内置的集群包不受影响
+var withContext bool
+
 // 包名映射的引入包的go代码
 var packageMapping = map[string]string{
 	"network.":  `import "gogs/base/cluster/network"`,
@@ -35,6 +38,7 @@ var packageMapping = map[string]string{
 	"time.":     `import "time"`,
 	"bits.":     `import "math/bits"`,
 	"io":        `import "io"`,
+	"context.":  `import "context"`,
 }
 
 // cblang内置类型对应的golang表示
@@ -183,6 +187,7 @@ type Gen4Go struct {
 	buff             bytes.Buffer       // 缓冲区
 	tpl              *template.Template // 模板
 	gen              bool
+	context          bool // 当前代码的服务接口是否带context.Context
 }
 
 // NewGen4Go 新建一个golang代码生成器
@@ -208,6 +213,11 @@ func NewGen4Go() (gen *Gen4Go, err error) {
 		"printCommentsToLine": gen.printCommentsToLine,
 		"marshalType":         gen.marshalType,
 		"unmarshalType":       gen.unmarshalType,
+		"withContext":         gen.withContext,
+		"ctxArg":              gen.ctxArg,
+		"idempotent":          cblang.IsIdempotent,
+		"futureType":          gen.futureType,
+		"callArgs":            gen.callArgs,
 	}
 	gen.tpl, err = template.New("golang").Funcs(functions).Parse(tpl4go)
 	return
@@ -1133,13 +1143,34 @@ func (gen *Gen4Go) defaultVal(expr ast.Expr) string {
 	return "unknown"
 }
 
-// params 根据参数生成函数声明的入参列表
+// withContext 当前代码的服务接口是否带context.Context
+func (gen *Gen4Go) withContext() bool {
+	return gen.context
+}
+
+// ctxArg 发起调用时使用的上下文,不带context.Context的接口使用context.Background()
+func (gen *Gen4Go) ctxArg() string {
+	if gen.context {
+		return "ctx"
+	}
+	return "context.Background()"
+}
+
+// params 根据参数生成函数声明的入参列表,带context.Context时第一个参数为ctx
 func (gen *Gen4Go) params(params []*ast.Param) string {
 	if len(params) == 0 {
+		if gen.context {
+			return "(ctx context.Context)"
+		}
 		return "()"
 	}
 	var buff bytes.Buffer
-	buff.WriteString(fmt.Sprintf("(arg0 %s", gen.typeName(params[0].Type)))
+	if gen.context {
+		buff.WriteString("(ctx context.Context, ")
+	} else {
+		buff.WriteString("(")
+	}
+	buff.WriteString(fmt.Sprintf("arg0 %s", gen.typeName(params[0].Type)))
 	for i := 1; i < len(params); i++ {
 		buff.WriteString(fmt.Sprintf(",arg%d %s", i, gen.typeName(params[i].Type)))
 	}
@@ -1161,13 +1192,20 @@ func (gen *Gen4Go) returnParams(params []*ast.Param) string {
 	return buff.String()
 }
 
-// callParams 根据参数生成函数的调用参数列表
+// callParams 根据参数生成函数的调用参数列表,带context.Context时第一个参数为ctx
 func (gen *Gen4Go) callParams(params []*ast.Param) string {
 	if len(params) == 0 {
+		if gen.context {
+			return "(ctx)"
+		}
 		return "()"
 	}
 	var buff bytes.Buffer
-	buff.WriteString("(param0")
+	if gen.context {
+		buff.WriteString("(ctx, param0")
+	} else {
+		buff.WriteString("(param0")
+	}
 	for i := 1; i < len(params); i++ {
 		buff.WriteString(fmt.Sprintf(",param%d", i))
 	}
@@ -1190,6 +1228,29 @@ func (gen *Gen4Go) returnArgs(method *ast.Method) string {
 	return buff.String()
 }
 
+// futureType 异步调用结果的类型,无返回值时为struct{},一个返回值时为其类型,多个返回值时为生成的结果结构
+func (gen *Gen4Go) futureType(service string, method *ast.Method) string {
+	switch len(method.Return) {
+	case 0:
+		return "struct{}"
+	case 1:
+		return gen.typeName(method.Return[0].Type)
+	}
+	return service + strings.Title(method.Name()) + "Result"
+}
+
+// callArgs 根据参数生成转发调用的参数列表,带context.Context时第一个参数为ctx
+func (gen *Gen4Go) callArgs(params []*ast.Param) string {
+	var args []string
+	if gen.context {
+		args = append(args, "ctx")
+	}
+	for i := range params {
+		args = append(args, fmt.Sprintf("arg%d", i))
+	}
+	return "(" + strings.Join(args, ", ") + ")"
+}
+
 // returnErr .
 func (gen *Gen4Go) returnErr(params []*ast.Param) string {
 	if len(params) == 0 {
@@ -1315,6 +1376,9 @@ func (gen *Gen4Go) VisitPackage(pkg *ast.Package) ast.Node {
 // VisitScript 访问代码
 func (gen *Gen4Go) VisitScript(script *ast.Script) ast.Node {
 	gen.buff.Reset()
+	// 内置的集群包由框架代码直接调用,始终生成不带context.Context的接口
+	name := script.Package().Name()
+	gen.context = withContext && name != "base/cluster" && name != "base/cluster/network"
 	// 默认的一些代码
 	if err := gen.tpl.ExecuteTemplate(&gen.buff, "script", script); err != nil {
 		cberrors.Panic(err.Error())
@@ -56,6 +56,17 @@ func (val {{$Enum}}) Error() string {
     return fmt.Sprintf("Unknown{{$Enum}}(%d)",val)
 }
 
+// ErrorCode is an autogenerated method, implementing cluster.ICodeError
+func (val {{$Enum}}) ErrorCode() (string, int32) {
+    return "{{.Path}}", int32(val)
+}
+
+func init() {
+    cluster.RegisterErrorCode("{{.Path}}", func(code int32) error {
+        return {{$Enum}}(code)
+    })
+}
+
 // Unmarshal{{$Enum}} is an autogenerated function, reading the enum from a byte slice
 func Unmarshal{{$Enum}}(data []byte) ({{$Enum}}, error) {
 	if len(data) != 4 {
@@ -344,9 +355,39 @@ func New{{$Table}}() *{{$Table}} {
 // {{$Service}}TypeName a unique name of the service
 const {{$Service}}TypeName = "{{.Path}}"
 
+func init() {
+    cluster.RegisterMethods({{$Service}}TypeName, {{range .Methods}}
+        &cluster.MethodDesc{ID: {{.ID}}, Name: "{{symbol .Name}}", OneWay: {{not .Return}}, Idempotent: {{idempotent .}}},{{end}}
+    )
+}
+
 // I{{$Service}} is an autogenerated interface
 type I{{$Service}} interface {
 {{range .Methods}}    {{symbol .Name}}{{params .Params}}{{returnParams .Return}}{{"\n"}}{{end}}}
+{{range .Methods}}{{if gt .ReturnParams 1}}{{$Name := symbol .Name}}
+// {{$Service}}{{$Name}}Result return values of {{$Service}}#{{$Name}}, the result of {{$Name}}Async
+type {{$Service}}{{$Name}}Result struct {
+{{range .Return}}    Ret{{.ID}} {{typeName .Type}}
+{{end}}}
+{{end}}{{end}}
+{{range .Methods}}{{if .Return}}{{$Name := symbol .Name}}{{$single := eq (len .Return) 1}}
+// decode{{$Service}}{{$Name}} decode the return of {{$Service}}#{{$Name}} into the result of {{$Name}}Async
+func decode{{$Service}}{{$Name}}(callReturn *network.Return) (result {{futureType $Service .}}, err error) {
+    if err = cluster.ReturnError(callReturn); err != nil {
+        return
+    }
+    if len(callReturn.Params) != {{.ReturnParams}} {
+        err = cberrors.New("{{$Service}}#{{$Name}} expect {{.ReturnParams}} return params but got: %d", len(callReturn.Params))
+        return
+    }
+    {{range .Return}} {{if $single}}result{{else}}result.Ret{{.ID}}{{end}}, err = {{unmarshalType .Type}}(callReturn.Params[{{.ID}}])
+    if err != nil {
+        err = cberrors.New("unmarshal {{$Service}}#{{$Name}} return{{.ID}} {{typeName .Type}} err: %s", err)
+        return
+    }
+    {{end}}return
+}
+{{end}}{{end}}
 
 //{{$Service}}Builder service builder used for building {{$Service}} service
 type {{$Service}}Builder struct {
@@ -404,6 +445,7 @@ type {{$Service}}Service struct {
     typename string
     timeout time.Duration
     context interface{}
+    middlewares *cluster.Middlewares
 }
 
 // String implementing fmt.Stringer
@@ -426,25 +468,62 @@ func (service *{{$Service}}Service) Type() string {
     return service.typename
 }
 
+// Middlewares middlewares of the owner
+func (service *{{$Service}}Service) Middlewares() *cluster.Middlewares {
+    return service.middlewares
+}
+
+// SetMiddlewares set middlewares of the owner
+func (service *{{$Service}}Service) SetMiddlewares(middlewares *cluster.Middlewares) {
+    service.middlewares = middlewares
+}
+
 // Context service context
 func (service *{{$Service}}Service) Context() interface{} {
     return service.context
 }
 
+// Start forwards to I{{$Service}} if it implements cluster.IServiceStarter
+func (service *{{$Service}}Service) Start(ctx context.Context) error {
+    if starter, ok := service.I{{$Service}}.(cluster.IServiceStarter); ok {
+        return starter.Start(ctx)
+    }
+    return nil
+}
+
+// Stop forwards to I{{$Service}} if it implements cluster.IServiceStopper
+func (service *{{$Service}}Service) Stop(ctx context.Context) error {
+    if stopper, ok := service.I{{$Service}}.(cluster.IServiceStopper); ok {
+        return stopper.Stop(ctx)
+    }
+    return nil
+}
+
+// Health forwards to I{{$Service}} if it implements cluster.IServiceHealth
+func (service *{{$Service}}Service) Health() cluster.HealthStatus {
+    if health, ok := service.I{{$Service}}.(cluster.IServiceHealth); ok {
+        return health.Health()
+    }
+    return cluster.HealthStatusHealthy
+}
+
 // Call the specified method of the service
+// on failure of a method with return values, callReturn carries the error back to the caller
+// panics and logging are handled by the interceptors of cluster.Serve
 func (service *{{$Service}}Service) Call(call *network.Call) (callReturn *network.Return, err error) {
+    wait := true
     defer func(){
-        if e := recover(); e != nil {
-            err = cberrors.New(e.(error).Error())
-        }
-		if err != nil {
-			log.Errorf("{{$Service}}Service#Call err: %s", err.Error())
+		if err != nil && wait {
+			callReturn = cluster.ErrorReturn(call, err)
 		}
     }()
-    switch call.MethodID { {{range .Methods}}
+    {{if withContext}} ctx, cancel := cluster.CallContext(call)
+    defer cancel()
+    {{end}}    switch call.MethodID { {{range .Methods}}
    		case {{.ID}}:  {{$Name := symbol .Name}}
 		// {{$Name}}
-        if len(call.Params) != {{.InputParams}} {
+        {{if not .Return}} wait = false
+        {{end}}if len(call.Params) != {{.InputParams}} {
             err = cberrors.New("{{$Service}}::{{$Name}} expect {{.InputParams}} params but got :%d", len(call.Params))
             return
         }
@@ -480,34 +559,50 @@ func (service *{{$Service}}Service){{$Name}}{{params .Params}}{{returnParams .Re
 {{range .Params}} param{{.ID}} := {{marshalType .Type}}(arg{{.ID}})
     call.Params = append(call.Params, param{{.ID}})
     {{end}}
-	{{if .Return}} future := make(chan *network.Return,1)
-    go func(){
-        callReturn, err1 := service.Call(call)
-        if err1 == nil {
-            future <- callReturn
-        }
-    }()
-    select {
-        case callReturn := <- future:
-            if len(callReturn.Params) != {{.ReturnParams}} {
-                err = cberrors.New("{{$Service}}Service#{{$Name}} expect {{.ReturnParams}} return params but got: %d", len(callReturn.Params))
-                return
-            }
-            {{range .Return}} ret{{.ID}}, err = {{unmarshalType .Type}}(callReturn.Params[{{.ID}}])
-            if err != nil {
-                err = cberrors.New("unmarshal {{$Service}}Service#{{$Name}} return{{.ID}} {{typeName .Type}} err: %s", err)
-                return
-            }
-            {{end}}case <- time.After(service.timeout):
-            err = cluster.ErrTimeout
-            return
+    {{if withContext}} cluster.ContextToCall(ctx, call)
+    {{end}}
+	{{if .Return}} var callReturn *network.Return
+    callReturn, err = cluster.ServeLocal(service, call)
+    if err != nil {
+        return
+    }
+    if err = cluster.ReturnError(callReturn); err != nil {
+        return
+    }
+    if len(callReturn.Params) != {{.ReturnParams}} {
+        err = cberrors.New("{{$Service}}Service#{{$Name}} expect {{.ReturnParams}} return params but got: %d", len(callReturn.Params))
+        return
+    }
+    {{range .Return}} ret{{.ID}}, err = {{unmarshalType .Type}}(callReturn.Params[{{.ID}}])
+    if err != nil {
+        err = cberrors.New("unmarshal {{$Service}}Service#{{$Name}} return{{.ID}} {{typeName .Type}} err: %s", err)
+        return
     }
+    {{end}}
     {{else}}
     go func(){ 
-		_, _ = service.Call(call) 
+		_, _ = cluster.Serve(service, call) 
 	}()
     {{end}}return
 }
+
+// {{$Name}}Async asynchronous {{$Name}} of service {{$Service}}, the result is delivered by the future
+func (service *{{$Service}}Service){{$Name}}Async{{params .Params}} *cluster.Future[{{futureType $Service .}}] {
+    {{if .Return}} call := &network.Call{
+        ServiceID: uint32(service.id),
+        MethodID: {{.ID}},
+    }
+    {{range .Params}} param{{.ID}} := {{marshalType .Type}}(arg{{.ID}})
+    call.Params = append(call.Params, param{{.ID}})
+    {{end}}
+    {{if withContext}} cluster.ContextToCall(ctx, call)
+    {{end}}return cluster.Then(cluster.ServeAsync(service, call), cluster.InlineExecutor, decode{{$Service}}{{$Name}})
+    {{else}} if err := service.{{$Name}}{{callArgs .Params}}; err != nil {
+        return cluster.Failed[struct{}](err)
+    }
+    return cluster.Completed(struct{}{})
+    {{end}}
+}
 {{end}}
 
 
@@ -569,28 +664,31 @@ func (service *{{$Service}}RemoteService) Call(call *network.Call) (callReturn *
     switch call.MethodID { 
 	{{range .Methods}} {{$Name := .Name}} case {{.ID}}:
 		// {{$Name}}
-        {{if .Return}} var future cluster.Future
-        future, err = service.agent.Wait(service, call, service.timeout)
+        span := cluster.StartCallSpan(context.Background(), call, "{{$Service}}#{{$Name}}")
+        defer func() {
+            span.Finish(err)
+        }()
+        {{if .Return}} callReturn, err = cluster.Invoke(context.Background(), service, call, &cluster.CallOptions{
+            Name: "{{$Service}}#{{$Name}}",
+            Timeout: service.timeout,
+            Idempotent: {{idempotent .}},
+        })
         if err != nil {
-            err = cberrors.New("call {{$Service}}RemoteService#{{$Name}} err: %s", err)
             return
         }
-        result := <-future
-        if result.Timeout {
-            err = cluster.ErrTimeout
+        if callReturn.Status != network.ReturnStatusOK {
             return
         }
-        callReturn = result.CallReturn
         if len(callReturn.Params) != {{.ReturnParams}} {
             err = cberrors.New("{{$Service}}RemoteService#{{$Name}} expect {{.ReturnParams}} return params but got: %d", len(callReturn.Params))
             return
         }
         return
-        {{else}} err = service.agent.Post(service,call)
-        if err != nil {
-            err = cberrors.New("post {{$Service}}RemoteService#{{$Name}} err: %s", err)
-            return
-        }
+        {{else}} _, err = cluster.Invoke(context.Background(), service, call, &cluster.CallOptions{
+            Name: "{{$Service}}#{{$Name}}",
+            Timeout: service.timeout,
+            OneWay: true,
+        })
         return 
 		{{end}}{{end}} }
     err = cberrors.New("unknown {{$Service}}RemoteService#%d method", call.MethodID)
@@ -608,18 +706,22 @@ func (service *{{$Service}}RemoteService){{$Name}}{{params .Params}}{{returnPara
     {{range .Params}} param{{.ID}} := {{marshalType .Type}}(arg{{.ID}})
     call.Params = append(call.Params, param{{.ID}})
     {{end}}
-    {{if .Return}} var future cluster.Future
-    future,err = service.agent.Wait(service, call, service.timeout)
+    span := cluster.StartCallSpan({{ctxArg}}, call, "{{$Service}}#{{$Name}}")
+    defer func() {
+        span.Finish(err)
+    }()
+    {{if .Return}} var callReturn *network.Return
+    callReturn, err = cluster.Invoke({{ctxArg}}, service, call, &cluster.CallOptions{
+        Name: "{{$Service}}#{{$Name}}",
+        Timeout: service.timeout,
+        Idempotent: {{idempotent .}},
+    })
     if err != nil {
-        err = cberrors.New("call {{$Service}}RemoteService#{{$Name}} err: %s" ,err)
         return
     }
-    result := <-future
-    if result.Timeout {
-        err = cluster.ErrTimeout
+    if err = cluster.ReturnError(callReturn); err != nil {
         return
     }
-    callReturn := result.CallReturn
     if len(callReturn.Params) != {{.ReturnParams}} {
         err = cberrors.New("{{$Service}}RemoteService#{{$Name}} expect {{.ReturnParams}} return params but got :%d", len(callReturn.Params))
         return
@@ -629,13 +731,33 @@ func (service *{{$Service}}RemoteService){{$Name}}{{params .Params}}{{returnPara
         err = cberrors.New("unmarshal {{$Service}}RemoteService#{{$Name}} return{{.ID}} {{typeName .Type}} err: %s", err)
         return
     }
-	{{end}} {{else}} err = service.agent.Post(service, call)
-    if err != nil {
-        err = cberrors.New("post {{$Service}}RemoteService#{{$Name}} err: %s", err)
-        return
-    }
+	{{end}} {{else}} _, err = cluster.Invoke({{ctxArg}}, service, call, &cluster.CallOptions{
+        Name: "{{$Service}}#{{$Name}}",
+        Timeout: service.timeout,
+        OneWay: true,
+    })
 	{{end}} return
 }
+
+// {{$Name}}Async asynchronous {{$Name}} of remote service, the result is decoded and delivered by the future when the return arrives
+func (service *{{$Service}}RemoteService){{$Name}}Async{{params .Params}} *cluster.Future[{{futureType $Service .}}] {
+    call := &network.Call{
+        ServiceID: uint32(service.rid),
+        MethodID: {{.ID}},
+    }
+    {{range .Params}} param{{.ID}} := {{marshalType .Type}}(arg{{.ID}})
+    call.Params = append(call.Params, param{{.ID}})
+    {{end}}
+    span := cluster.StartCallSpan({{ctxArg}}, call, "{{$Service}}#{{$Name}}")
+    return cluster.InvokeAsync[{{futureType $Service .}}]({{ctxArg}}, service, call, &cluster.CallOptions{
+        Name: "{{$Service}}#{{$Name}}",
+        Timeout: service.timeout,
+        {{if .Return}}Idempotent: {{idempotent .}},
+    }, span, decode{{$Service}}{{$Name}})
+    {{else}}OneWay: true,
+    }, span, nil)
+    {{end}}
+}
 {{end}}
 
 {{end}}
@@ -8,24 +8,9 @@
 package main
 
 import (
-	"gogs/base/config"
-	"gogs/base/etcd"
 	"gogs/game"
 )
 
 func main() {
-	config.Preload()
-	config.ServerType = etcd.ServerTypeGame
-	config.With(
-		config.KeyEtcd,
-		config.KeyLog,
-		config.KeyRPC,
-		config.KeyGame,
-	)
-	config.LoadGlobalConfig("game.yml")
-	config.Adjust(
-		config.SetEtcdServiceType(config.ServerType),
-		config.SetEtcdServiceID(config.ServerID),
-	)
 	game.Main()
 }
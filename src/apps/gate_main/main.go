@@ -8,20 +8,9 @@
 package main
 
 import (
-	"gogs/base/config"
-	"gogs/base/etcd"
 	"gogs/gate"
 )
 
 func main() {
-	config.Preload()
-	config.ServerType = etcd.ServerTypeGate
-	config.With(
-		config.KeyEtcd,
-		config.KeyLog,
-		config.KeyRPC,
-		config.KeyGate,
-	)
-	config.LoadGlobalConfig("gate.yml")
 	gate.Main()
 }
@@ -1,11 +1,16 @@
 // -------------------------------------------
-// @file      : client_agent.go
+// @file      : main.go
 // @author    : 蔡波
 // @contact   : caibo923@gmail.com
-// @time      : 2024/1/5 上午12:06
+// @time      : 2024/2/7 上午10:50
 // -------------------------------------------
 
-package model
+package main
 
-type DBUser struct {
+import (
+	"gogs/login"
+)
+
+func main() {
+	login.Main()
 }
@@ -8,18 +8,9 @@
 package main
 
 import (
-	"gogs/base/config"
-	"gogs/base/etcd"
 	"gogs/simulator"
 )
 
 func main() {
-	config.ServerType = etcd.ServerTypeGame
-	config.With(
-		config.KeyLog,
-		config.KeyRPC,
-		config.KeySimulator,
-	)
-	config.LoadGlobalConfig("simulator.yml")
 	simulator.Main()
 }
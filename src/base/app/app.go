@@ -0,0 +1,318 @@
+// -------------------------------------------
+// @file      : app.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/5 上午10:30
+// -------------------------------------------
+
+package app
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"gogs/base/cberrors"
+	"gogs/base/cluster"
+	"gogs/base/config"
+	"gogs/base/etcd"
+	log "gogs/base/logger"
+	"gogs/base/metrics"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultPhaseTimeout 阶段未设置超时时,启动和关闭各自的最长执行时间
+const DefaultPhaseTimeout = 30 * time.Second
+
+// Phase 启动和关闭的一个阶段,按添加顺序启动,按相反顺序关闭
+type Phase struct {
+	Name    string                          // 阶段名字
+	Start   func(ctx context.Context) error // 启动,可以为nil
+	Stop    func(ctx context.Context) error // 关闭,可以为nil,只有启动成功的阶段才会关闭
+	Timeout time.Duration                   // 启动和关闭各自的最长执行时间,0时使用DefaultPhaseTimeout
+}
+
+// App 服务器进程的启动框架
+// 声明依赖的配置、组件和服务构造器,按顺序添加启动阶段后调用Run
+// Run读取配置并初始化日志,然后按顺序启动各阶段,收到SIGTERM或SIGINT后按相反顺序关闭,收到SIGHUP时重新加载配置
+type App struct {
+	serverType string                             // 服务器类型
+	configFile string                             // 配置文件名,为空时不读取配置
+	configKeys []string                           // 使用的配置
+	logPath    func() string                      // 日志文件路径,配置读取后调用
+	builders   map[string]cluster.IServiceBuilder // 服务构造器集合
+	phases     []*Phase                           // 启动阶段
+	reloads    []func() error                     // 重新加载配置后的回调
+	exitOnce   sync.Once                          // 保证只关闭一次退出通道
+	exit       chan struct{}                      // 主动退出的信号
+}
+
+// New 新建服务器进程的启动框架,serverType为集群中的服务器类型
+func New(serverType string) *App {
+	return &App{
+		serverType: serverType,
+		builders:   make(map[string]cluster.IServiceBuilder),
+		exit:       make(chan struct{}),
+	}
+}
+
+// Config 声明使用的配置和配置文件名,配置在base.yml之后读取
+func (app *App) Config(filename string, keys ...string) *App {
+	app.configFile = filename
+	app.configKeys = keys
+	return app
+}
+
+// Log 声明日志文件路径,path在配置读取后调用
+func (app *App) Log(path func() string) *App {
+	app.logPath = path
+	return app
+}
+
+// Builder 注册服务构造器,通过Builders传给集群服务器
+func (app *App) Builder(name string, builder cluster.IServiceBuilder) *App {
+	app.builders[name] = builder
+	return app
+}
+
+// Builders 已注册的服务构造器集合
+func (app *App) Builders() map[string]cluster.IServiceBuilder {
+	return app.builders
+}
+
+// Phase 添加启动阶段
+func (app *App) Phase(phase Phase) *App {
+	app.phases = append(app.phases, &phase)
+	return app
+}
+
+// Etcd 添加etcd阶段,以服务器类型和ID注册到etcd,关闭时注销
+// 需要先于etcd注册的工作,例如网关开始监听和设置对外地址,应添加在此阶段之前
+func (app *App) Etcd() *App {
+	return app.Phase(Phase{
+		Name: "etcd",
+		Start: func(ctx context.Context) error {
+			etcdConfig := config.GetEtcdConfig()
+			if etcdConfig == nil {
+				return cberrors.New("unable to find etcd config")
+			}
+			config.Adjust(
+				config.SetEtcdServiceType(config.ServerType),
+				config.SetEtcdServiceID(config.ServerID),
+			)
+			return etcd.Init(etcdConfig, nil)
+		},
+		Stop: func(ctx context.Context) error {
+			etcd.Exit()
+			return nil
+		},
+	})
+}
+
+// Mongo 添加mongodb阶段,connect和disconnect由使用者提供
+func (app *App) Mongo(connect func() error, disconnect func()) *App {
+	return app.Phase(Phase{
+		Name: "mongo",
+		Start: func(ctx context.Context) error {
+			return connect()
+		},
+		Stop: func(ctx context.Context) error {
+			disconnect()
+			return nil
+		},
+	})
+}
+
+// Metrics 添加指标服务阶段,addr在启动时调用,为空时不启动,监听失败只记录日志
+func (app *App) Metrics(addr func() string) *App {
+	var server *http.Server
+	return app.Phase(Phase{
+		Name: "metrics",
+		Start: func(ctx context.Context) error {
+			if addr() == "" {
+				return nil
+			}
+			var err error
+			if server, err = metrics.Serve(addr()); err != nil {
+				log.Errorf("metrics serve err:%s", err)
+			}
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			if server == nil {
+				return nil
+			}
+			return server.Shutdown(ctx)
+		},
+	})
+}
+
+// Cluster 添加加入集群阶段,依赖etcd
+// newMembership在启动时调用,返回的集群成员管理接收etcd节点事件并连接集群中的其他服务器
+func (app *App) Cluster(newMembership func() *cluster.Membership) *App {
+	var membership *cluster.Membership
+	return app.Phase(Phase{
+		Name: "cluster",
+		Start: func(ctx context.Context) error {
+			membership = newMembership()
+			etcd.SetServiceCallback(membership.OnNodeEvent)
+			membership.Start()
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			membership.Stop()
+			return nil
+		},
+	})
+}
+
+// OnReload 收到SIGHUP并重新读取配置后回调
+func (app *App) OnReload(reload func() error) *App {
+	app.reloads = append(app.reloads, reload)
+	return app
+}
+
+// Stop 主动退出,Run按相反顺序关闭已启动的阶段后返回
+func (app *App) Stop() {
+	app.exitOnce.Do(func() {
+		close(app.exit)
+	})
+}
+
+// Run 读取配置,初始化日志,启动各阶段并等待退出信号,某个阶段启动失败时关闭已启动的阶段并返回错误
+func (app *App) Run() error {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	config.Preload()
+	config.ServerType = app.serverType
+	if app.configFile != "" {
+		config.With(app.configKeys...)
+		config.LoadGlobalConfig(app.configFile)
+	}
+	if err := app.initLog(); err != nil {
+		return err
+	}
+	defer func() {
+		// 等待异步日志写入完成
+		_ = log.Close()
+	}()
+	return app.serve()
+}
+
+// initLog 根据日志配置初始化日志
+func (app *App) initLog() error {
+	logConfig := config.GetLogConfig()
+	if logConfig == nil {
+		return cberrors.New("unable to find log config")
+	}
+	options := []log.Option{
+		log.SetIsOpenFile(logConfig.IsOpenFile),
+		log.SetIsOpenErrorFile(logConfig.IsOpenErrorFile),
+		log.SetIsOpenConsole(logConfig.IsOpenConsole),
+		log.SetIsAsync(logConfig.IsAsync),
+		log.SetMaxFileSize(int(logConfig.Maxsize)),
+		log.SetStacktrace(zap.PanicLevel),
+	}
+	if app.logPath != nil {
+		options = append(options, log.SetFilename(app.logPath()))
+	}
+	log.Init(options...)
+	return nil
+}
+
+// serve 启动各阶段,等待退出信号后关闭,启动期间收到的信号在启动完成后处理
+func (app *App) serve() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	started, err := app.start()
+	if err == nil {
+		app.wait(signals)
+	}
+	app.stop(started)
+	return err
+}
+
+// start 按顺序启动各阶段,返回启动成功的阶段数
+func (app *App) start() (int, error) {
+	for i, phase := range app.phases {
+		if phase.Start == nil {
+			continue
+		}
+		begin := time.Now()
+		if err := phase.run(phase.Start); err != nil {
+			log.Errorf("%s phase: %s start failed: %s", app.serverType, phase.Name, err)
+			return i, cberrors.New("phase: %s start failed: %v", phase.Name, err)
+		}
+		log.Infof("%s phase: %s started in %s", app.serverType, phase.Name, time.Since(begin))
+	}
+	return len(app.phases), nil
+}
+
+// stop 按相反顺序关闭前started个阶段,关闭失败或超时只记录日志,继续关闭之前的阶段
+func (app *App) stop(started int) {
+	for i := started - 1; i >= 0; i-- {
+		phase := app.phases[i]
+		if phase.Stop == nil {
+			continue
+		}
+		begin := time.Now()
+		if err := phase.run(phase.Stop); err != nil {
+			log.Errorf("%s phase: %s stop failed: %s", app.serverType, phase.Name, err)
+			continue
+		}
+		log.Infof("%s phase: %s stopped in %s", app.serverType, phase.Name, time.Since(begin))
+	}
+}
+
+// run 在超时内执行阶段的启动或关闭,崩溃时返回错误
+func (phase *Phase) run(fn func(ctx context.Context) error) error {
+	timeout := phase.Timeout
+	if timeout <= 0 {
+		timeout = DefaultPhaseTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := cluster.Async(func() (struct{}, error) {
+		return struct{}{}, fn(ctx)
+	}).Wait(context.Background(), timeout)
+	return err
+}
+
+// wait 等待退出信号,收到SIGHUP时重新加载配置
+func (app *App) wait(signals <-chan os.Signal) {
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				log.Warn("\033[043;1m[SIGHUP]\033[0m")
+				app.reload()
+				continue
+			}
+			log.Warnf("\033[043;1m[%v, quit]\033[0m", sig)
+			return
+		case <-app.exit:
+			log.Warn("\033[043;1m[stop, quit]\033[0m")
+			return
+		}
+	}
+}
+
+// reload 重新读取配置并回调,失败只记录日志
+func (app *App) reload() {
+	if app.configFile != "" {
+		if err := config.ReloadGlobalConfig(app.configFile); err != nil {
+			log.Errorf("%s reload config err: %s", app.serverType, err)
+			return
+		}
+	}
+	for _, reload := range app.reloads {
+		if err := reload(); err != nil {
+			log.Errorf("%s reload err: %s", app.serverType, err)
+		}
+	}
+	log.Infof("%s reloaded", app.serverType)
+}
@@ -0,0 +1,140 @@
+// -------------------------------------------
+// @file      : app_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/5 下午3:40
+// -------------------------------------------
+
+package app
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// recorder 记录阶段的启动和关闭顺序
+type recorder struct {
+	sync.Mutex
+	events []string
+}
+
+func (r *recorder) record(event string) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.events)
+}
+
+func (r *recorder) take() []string {
+	r.Lock()
+	defer r.Unlock()
+	events := r.events
+	r.events = nil
+	return events
+}
+
+// phase 记录启动和关闭的阶段,start不为nil时代替默认的启动
+func (r *recorder) phase(name string, start func(ctx context.Context) error) Phase {
+	if start == nil {
+		start = func(ctx context.Context) error {
+			r.record("start:" + name)
+			return nil
+		}
+	}
+	return Phase{
+		Name:  name,
+		Start: start,
+		Stop: func(ctx context.Context) error {
+			r.record("stop:" + name)
+			return nil
+		},
+		Timeout: 100 * time.Millisecond,
+	}
+}
+
+func TestAppPhases(t *testing.T) {
+	r := &recorder{}
+	app := New("TEST").
+		Phase(r.phase("a", nil)).
+		Phase(r.phase("b", nil)).
+		OnReload(func() error {
+			r.record("reload")
+			return nil
+		})
+	done := make(chan error, 1)
+	go func() {
+		done <- app.serve()
+	}()
+	deadline := time.Now().Add(time.Second)
+	for r.count() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if events := r.take(); !reflect.DeepEqual(events, []string{"start:a", "start:b"}) {
+		t.Fatalf("unexpected start events: %v", events)
+	}
+
+	// SIGHUP只重新加载,不退出
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(time.Second)
+	for r.count() < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if events := r.take(); !reflect.DeepEqual(events, []string{"reload"}) {
+		t.Fatalf("unexpected reload events: %v", events)
+	}
+
+	app.Stop()
+	app.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("app not stopped")
+	}
+	if events := r.take(); !reflect.DeepEqual(events, []string{"stop:b", "stop:a"}) {
+		t.Fatalf("unexpected stop events: %v", events)
+	}
+}
+
+func TestAppStartFailure(t *testing.T) {
+	failures := map[string]func(ctx context.Context) error{
+		"error": func(ctx context.Context) error {
+			return errors.New("failed")
+		},
+		"panic": func(ctx context.Context) error {
+			panic("boom")
+		},
+		"timeout": func(ctx context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		},
+	}
+	for name, start := range failures {
+		r := &recorder{}
+		app := New("TEST").
+			Phase(r.phase("a", nil)).
+			Phase(r.phase("b", start)).
+			Phase(r.phase("c", nil))
+		if err := app.serve(); err == nil {
+			t.Fatalf("%s: app started", name)
+		}
+		// 只关闭已启动成功的阶段
+		if events := r.take(); !reflect.DeepEqual(events, []string{"start:a", "stop:a"}) {
+			t.Fatalf("%s: unexpected events: %v", name, events)
+		}
+	}
+}
@@ -8,8 +8,9 @@
 package cblang
 
 const (
-	cblangPackage    = "base/cblang"
-	cblangAttrTarget = "AttrTarget"
-	cblangAttrStruct = "Struct"
-	cblangAttrError  = "Error"
+	cblangPackage        = "base/cblang"
+	cblangAttrTarget     = "AttrTarget"
+	cblangAttrStruct     = "Struct"
+	cblangAttrError      = "Error"
+	cblangAttrIdempotent = "Idempotent"
 )
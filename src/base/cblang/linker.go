@@ -357,6 +357,10 @@ func (linker *serviceLinker) unwind(service *ast.Service, stack []*ast.Service)
 		s := base.Ref.(*ast.Service)
 		for _, method := range s.Methods {
 			old, err := service.CopyMethod(method)
+			if err == nil && IsIdempotent(method) {
+				// 复制的函数沿用父协议函数的幂等标记
+				markAsIdempotent(old)
+			}
 			if err != nil {
 				if old != nil {
 					linker.errorf(Pos(service),
@@ -389,6 +393,7 @@ type attrLinker struct {
 	attrTarget       map[string]int32 // 指定为cblang包中的AttrStruct枚举类型解析后的字典
 	attrStruct       ast.Expr         // 指定为cblang包中的Struct类型
 	attrError        ast.Expr         // 指定为cblang包中的Error类型
+	attrIdempotent   ast.Expr         // 指定为cblang包中的Idempotent类型
 }
 
 // VisitPackage	访问包
@@ -425,6 +430,10 @@ func (linker *attrLinker) VisitPackage(pkg *ast.Package) ast.Node {
 		if linker.attrError == nil {
 			linker.errorf(Pos(pkg), "inner error: can't found cblang.Error attribute type")
 		}
+		linker.attrIdempotent = pkg.Types[cblangAttrIdempotent]
+		if linker.attrIdempotent == nil {
+			linker.errorf(Pos(pkg), "inner error: can't found cblang.Idempotent attribute type")
+		}
 	} else {
 		attrStruct, err := linker.Type(cblangPackage, cblangAttrStruct)
 		if err != nil {
@@ -436,6 +445,11 @@ func (linker *attrLinker) VisitPackage(pkg *ast.Package) ast.Node {
 			linker.errorf(Pos(pkg), "inner error: can't found cblang.Error attribute type. err:%v", err)
 		}
 		linker.attrError = attrError
+		attrIdempotent, err := linker.Type(cblangPackage, cblangAttrIdempotent)
+		if err != nil {
+			linker.errorf(Pos(pkg), "inner error: can't found cblang.Idempotent attribute type. err:%v", err)
+		}
+		linker.attrIdempotent = attrIdempotent
 	}
 	// 轮询访问包中代码
 	for _, script := range pkg.Scripts {
@@ -598,6 +612,10 @@ func (linker *attrLinker) VisitService(service *ast.Service) ast.Node {
 
 // VisitMethod 访问函数
 func (linker *attrLinker) VisitMethod(method *ast.Method) ast.Node {
+	// 如果函数的属性中有 类型引用为内置 cblang.Idempotent类型 则认为此函数是幂等的 并标记
+	if len(ast.GetAttrs(method, linker.attrIdempotent)) > 0 {
+		markAsIdempotent(method)
+	}
 	// 确保各属性的目标与 挂载的目标节点类型相符
 	for _, attr := range method.Attrs() {
 		target := linker.EvalAttrUsage(attr)
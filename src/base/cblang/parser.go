@@ -631,6 +631,9 @@ func (parser *Parser) parseService() {
 		}
 		// 附加位置
 		attachPos(method, methodName.Pos)
+		// 函数名前的属性属于函数,暂存起来避免被参数取走
+		methodAttrs := parser.attrs
+		parser.attrs = nil
 		// 取函数参数列表
 		parser.expect('(')
 		next := parser.Peek()
@@ -698,6 +701,7 @@ func (parser *Parser) parseService() {
 		// 给函数附加注释和属性
 		parser.parseComments()
 		parser.attachComments(method)
+		parser.attrs = append(methodAttrs, parser.attrs...)
 		parser.attachAttrs(method)
 	}
 	parser.expect('}')
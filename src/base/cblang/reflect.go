@@ -71,6 +71,17 @@ func markAsError(enum *ast.Enum) {
 	enum.NewExtra("isError", true)
 }
 
+// IsIdempotent 检查函数是不是幂等的
+func IsIdempotent(method *ast.Method) bool {
+	_, ok := method.Extra("isIdempotent")
+	return ok
+}
+
+// markAsIdempotent 将函数标记为幂等
+func markAsIdempotent(method *ast.Method) {
+	method.NewExtra("isIdempotent", true)
+}
+
 func markAsFlower(enum *ast.Enum) {
 	enum.NewExtra("isFlower", true)
 }
@@ -85,7 +96,8 @@ func (compiler *Compiler) EvalAttrUsage(attr *ast.Attr) int32 {
 	// 对属性求值
 	ea := &evalAttr{}
 	attr.Accept(ea)
-	if attr.Name() != ".cblang.Struct" && attr.Name() != ".cblang.Error" && attr.Name() != ".Struct" {
+	if attr.Name() != ".cblang.Struct" && attr.Name() != ".cblang.Error" &&
+		attr.Name() != ".cblang.Idempotent" && attr.Name() != ".Struct" {
 		log.Debugf("evalAttr: %v for %s, result: %v", attr.Name(), attr.Parent(), ea.values)
 	}
 
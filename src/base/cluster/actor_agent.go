@@ -8,6 +8,7 @@
 package cluster
 
 import (
+	"context"
 	"gogs/base/cberrors"
 	"gogs/base/cluster/network"
 	"time"
@@ -33,14 +34,20 @@ func (agent *ActorAgent) Name() string {
 	return agent.name
 }
 
+// Middlewares implement IMiddlewareAgent
+func (agent *ActorAgent) Middlewares() *Middlewares {
+	return agent.system.Middlewares
+}
+
 // Post implement IAgent
 func (agent *ActorAgent) Post(service IService, call *network.Call) error {
 	return agent.system.Post(agent, call)
 }
 
 // Wait implement IAgent
-func (agent *ActorAgent) Wait(service IService, call *network.Call, timeout time.Duration) (Future, error) {
-	return agent.system.Wait(agent, call, timeout)
+func (agent *ActorAgent) Wait(ctx context.Context, service IService, call *network.Call, timeout time.Duration,
+	complete func(result *ReturnVal)) error {
+	return agent.system.Wait(ctx, agent, call, timeout, complete)
 }
 
 // Write implement IAgent
@@ -90,6 +97,11 @@ func (agent *ActorAgent) Handler() network.ISessionHandler {
 	return nil
 }
 
+// RTT implement network.ISession
+func (agent *ActorAgent) RTT() time.Duration {
+	return 0
+}
+
 // RemoteAddr implement network.ISession
 func (agent *ActorAgent) RemoteAddr() string {
 	return ""
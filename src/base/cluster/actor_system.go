@@ -14,6 +14,7 @@ import (
 	"gogs/base/config"
 	log "gogs/base/logger"
 	"gogs/base/mongodb"
+	"sort"
 	"sync"
 	"sync/atomic"
 )
@@ -33,13 +34,14 @@ type ActorSystem struct {
 	db           *mongodb.MongoClient       // 数据库
 }
 
-// NewActorSystem 新建角色系统
-func NewActorSystem(name string, builders map[string]IServiceBuilder, localAddr string) (*ActorSystem, error) {
+// NewActorSystem 新建角色系统,transport为nil时使用tcp
+func NewActorSystem(name string, builders map[string]IServiceBuilder, localAddr string, transport network.ITransport) (*ActorSystem, error) {
 	systemName := fmt.Sprintf("%s:ActorSystem", name)
+	host := NewHost(localAddr, transport)
 	system := &ActorSystem{
-		RPC:        NewRPC(),
+		RPC:        host.RPC,
 		name:       systemName,
-		host:       NewHost(localAddr),
+		host:       host,
 		builders:   builders,
 		actors:     make(map[string]IActor),
 		neighbors:  make(map[string]IActorSystem),
@@ -82,11 +84,13 @@ func NewActorSystem(name string, builders map[string]IServiceBuilder, localAddr
 		return true
 	}
 	system.host.ListenServiceType(ActorSystemTypeName, listener)
+	actorSystems.Store(system, struct{}{})
 	return system, nil
 }
 
 // Close 关闭角色系统
 func (system *ActorSystem) Close() {
+	actorSystems.Delete(system)
 	system.actorLock.Lock()
 	defer system.actorLock.Unlock()
 	for _, actor := range system.actors {
@@ -122,6 +126,52 @@ func (system *ActorSystem) DelActor(actor IActor) {
 	}
 }
 
+// Actors 角色信息,typename不为空时只返回该类型的角色,按名字排序
+func (system *ActorSystem) Actors(typename string) []*ActorInfo {
+	system.actorLock.RLock()
+	infos := make([]*ActorInfo, 0, len(system.actors))
+	for _, actor := range system.actors {
+		if typename != "" && actor.Type() != typename {
+			continue
+		}
+		_, remote := actor.Service().(IRemoteService)
+		infos = append(infos, &ActorInfo{
+			Name:      actor.Name(),
+			Type:      actor.Type(),
+			ID:        actor.ID(),
+			ServiceID: actor.Service().ID(),
+			Remote:    remote,
+		})
+	}
+	system.actorLock.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// SaveActor 立即保存指定角色的上下文,保存期间持有角色的分组锁
+func (system *ActorSystem) SaveActor(name string) error {
+	actor, ok := system.GetActor(name)
+	if !ok {
+		return cberrors.New("actor not found: %s", name)
+	}
+	if _, ok = actor.Service().(IRemoteService); ok {
+		return cberrors.New("actor: %s is remote, save it on its own system", name)
+	}
+	context := actor.Context()
+	if context == nil {
+		return nil
+	}
+	actor.Lock()
+	defer actor.Unlock()
+	if err := context.Save(system.db); err != nil {
+		return cberrors.New("actor: %s save context err: %s", name, err)
+	}
+	log.Infof("actor: %s save context", name)
+	return nil
+}
+
 // GetActor 获取指定名字的角色
 func (system *ActorSystem) GetActor(name string) (IActor, bool) {
 	system.actorLock.RLock()
@@ -146,7 +196,7 @@ func (system *ActorSystem) NewActor(name ActorName, context IActorContext) (IAct
 		locker := &system.groupLocks[serviceID%ID(len(system.groupLocks))]
 		actor := newBaseActor(system, &name, locker, context)
 		context.SetActor(actor)
-		service, err := builder.NewService(nameStr, serviceID, context)
+		service, err := newService(builder, system.Middlewares, nameStr, serviceID, context)
 		if err != nil {
 			return nil, err
 		}
@@ -195,8 +245,8 @@ func (system *ActorSystem) ActorInvoke(msg *ActorMsg) (*network.Return, Err, err
 	if err != nil {
 		return nil, ErrUnmarshal, err
 	}
-	callReturn, err := actor.Service().Call(call)
-	if err != nil {
+	callReturn, err := system.serveCall(actor.Service(), call, msg.Header)
+	if err != nil && callReturn == nil {
 		return nil, ErrSystem, err
 	}
 	if callReturn == nil {
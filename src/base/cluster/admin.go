@@ -0,0 +1,279 @@
+// -------------------------------------------
+// @file      : admin.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/29 上午10:20
+// -------------------------------------------
+
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gogs/base/cberrors"
+	log "gogs/base/logger"
+	"gogs/base/metrics"
+	"net"
+	"net/http"
+	"runtime/pprof"
+	"strconv"
+)
+
+// ServiceInfo 服务信息
+type ServiceInfo struct {
+	ID       ID     `json:"id"`                 // 服务ID
+	RemoteID ID     `json:"remoteID,omitempty"` // 远程服务在其本地的ID
+	Name     string `json:"name"`               // 服务名字
+	Type     string `json:"type"`               // 服务类型
+	Health   string `json:"health,omitempty"`   // 本地服务的健康状态
+}
+
+// newServiceInfo 获取服务信息
+func newServiceInfo(service IService) *ServiceInfo {
+	info := &ServiceInfo{
+		ID:   service.ID(),
+		Name: service.Name(),
+		Type: service.Type(),
+	}
+	if remote, ok := service.(IRemoteService); ok {
+		info.RemoteID = remote.RemoteID()
+	} else {
+		info.Health = ServiceHealth(service).String()
+	}
+	return info
+}
+
+// NeighborInfo 邻居节点信息
+type NeighborInfo struct {
+	Name     string         `json:"name"`     // 会话名字,即对端地址
+	Status   string         `json:"status"`   // 会话状态
+	RTT      string         `json:"rtt"`      // 最近一次心跳测得的往返时延
+	Services []*ServiceInfo `json:"services"` // 邻居节点上的远程服务
+}
+
+// ActorInfo 角色信息
+type ActorInfo struct {
+	Name      string `json:"name"`      // 角色名字
+	Type      string `json:"type"`      // 角色类型
+	ID        int64  `json:"id"`        // 角色ID
+	ServiceID ID     `json:"serviceID"` // 角色服务ID
+	Remote    bool   `json:"remote"`    // 是否在邻居角色系统上
+}
+
+// AgentInfo 网关代理信息
+type AgentInfo struct {
+	UserID     int64  `json:"userID"`     // 用户ID
+	SessionID  int64  `json:"sessionID"`  // 网关会话ID
+	Session    string `json:"session"`    // 会话名字
+	Status     string `json:"status"`     // 会话状态
+	RTT        string `json:"rtt"`        // 最近一次心跳测得的往返时延
+	GameServer string `json:"gameServer"` // 登录的游戏服
+}
+
+// Admin 调试服务器,以json输出集群服务器的运行状态,并提供踢人、存盘和协程转储等运维操作
+// 查询使用GET,操作使用POST,同时在/metrics输出指标
+type Admin struct {
+	host   *Host          // 集群服务器
+	system *ActorSystem   // 角色系统,可以为nil
+	gate   *Gate          // 网关,可以为nil
+	mux    *http.ServeMux // 路由
+}
+
+// NewAdmin 新建挂载到集群服务器的调试服务器
+func NewAdmin(host *Host) *Admin {
+	admin := &Admin{
+		host: host,
+		mux:  http.NewServeMux(),
+	}
+	admin.mux.HandleFunc("/debug/", admin.index)
+	admin.mux.HandleFunc("/debug/neighbors", admin.get(func(r *http.Request) (interface{}, error) {
+		return admin.host.Neighbors(), nil
+	}))
+	admin.mux.HandleFunc("/debug/services", admin.get(func(r *http.Request) (interface{}, error) {
+		return admin.host.LocalServices(), nil
+	}))
+	admin.mux.HandleFunc("/debug/builders", admin.get(func(r *http.Request) (interface{}, error) {
+		return admin.host.Builders(), nil
+	}))
+	admin.mux.HandleFunc("/debug/listeners", admin.get(func(r *http.Request) (interface{}, error) {
+		return admin.host.ListenerStats(), nil
+	}))
+	admin.mux.HandleFunc("/debug/actors", admin.get(admin.actors))
+	admin.mux.HandleFunc("/debug/agents", admin.get(admin.agents))
+	admin.mux.HandleFunc("/debug/kick", admin.post(admin.kick))
+	admin.mux.HandleFunc("/debug/save", admin.post(admin.save))
+	admin.mux.HandleFunc("/debug/goroutines", admin.goroutines)
+	admin.mux.HandleFunc("/debug/health", admin.health)
+	admin.mux.Handle("/metrics", metrics.Handler())
+	return admin
+}
+
+// WithActorSystem 挂载角色系统,可以查询角色和存盘
+func (admin *Admin) WithActorSystem(system *ActorSystem) *Admin {
+	admin.system = system
+	return admin
+}
+
+// WithGate 挂载网关,可以查询网关代理和踢人
+func (admin *Admin) WithGate(gate *Gate) *Admin {
+	admin.gate = gate
+	return admin
+}
+
+// ServeHTTP implements http.Handler
+func (admin *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	admin.mux.ServeHTTP(w, r)
+}
+
+// Serve 监听addr并启动调试服务器,监听失败时返回错误,返回的服务器用于关闭
+// 调试接口没有鉴权,只应监听内网或本机地址
+func (admin *Admin) Serve(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: admin}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("admin server: %s err: %s", addr, err)
+		}
+	}()
+	log.Infof("admin server listen on: %s", listener.Addr())
+	return server, nil
+}
+
+// errNotAttached 调试服务器未挂载对应的组件
+var errNotAttached = errors.New("not attached to this server")
+
+// index 列出所有接口
+func (admin *Admin) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/debug/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = fmt.Fprint(w, `GET  /debug/neighbors              neighbors, session status and their remote services
+GET  /debug/services               local services
+GET  /debug/builders               registered service builders
+GET  /debug/listeners              service status listeners
+GET  /debug/actors?type=           actors in actor system
+GET  /debug/agents                 logged in gate agents by user id
+POST /debug/kick?userID=&message=  kick user from gate
+POST /debug/save?actor=            save actor context now
+GET  /debug/goroutines?debug=2     dump goroutines, debug=1 groups identical stacks
+GET  /debug/health                 worst health of local services, 503 when unhealthy
+GET  /metrics                      metrics in prometheus text format
+`)
+}
+
+// get 只允许GET的查询接口,结果以json输出
+func (admin *Admin) get(f func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result, err := f(r)
+		writeResult(w, result, err)
+	}
+}
+
+// post 只允许POST的操作接口,成功时输出ok
+func (admin *Admin) post(f func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		err := f(r)
+		if err == nil {
+			log.Infof("admin %s from %s", r.URL, r.RemoteAddr)
+		}
+		writeResult(w, "ok", err)
+	}
+}
+
+// writeResult 以json输出结果,组件未挂载时返回404,其他错误返回400
+func writeResult(w http.ResponseWriter, result interface{}, err error) {
+	if errors.Is(err, errNotAttached) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(result); err != nil {
+		log.Warnf("admin write result err: %s", err)
+	}
+}
+
+// actors 角色系统中的角色
+func (admin *Admin) actors(r *http.Request) (interface{}, error) {
+	if admin.system == nil {
+		return nil, errNotAttached
+	}
+	return admin.system.Actors(r.URL.Query().Get("type")), nil
+}
+
+// agents 网关上已登录的代理
+func (admin *Admin) agents(r *http.Request) (interface{}, error) {
+	if admin.gate == nil {
+		return nil, errNotAttached
+	}
+	return admin.gate.Agents(), nil
+}
+
+// kick 踢用户下线
+func (admin *Admin) kick(r *http.Request) error {
+	if admin.gate == nil {
+		return errNotAttached
+	}
+	userID, err := strconv.ParseInt(r.URL.Query().Get("userID"), 10, 64)
+	if err != nil {
+		return cberrors.New("invalid userID: %s", err)
+	}
+	message := r.URL.Query().Get("message")
+	if message == "" {
+		message = "kicked by admin"
+	}
+	return admin.gate.Kick(userID, message)
+}
+
+// save 立即保存角色上下文
+func (admin *Admin) save(r *http.Request) error {
+	if admin.system == nil {
+		return errNotAttached
+	}
+	name := r.URL.Query().Get("actor")
+	if name == "" {
+		return cberrors.New("actor required")
+	}
+	return admin.system.SaveActor(name)
+}
+
+// goroutines 转储所有协程的调用栈
+func (admin *Admin) goroutines(w http.ResponseWriter, r *http.Request) {
+	debug, err := strconv.Atoi(r.URL.Query().Get("debug"))
+	if err != nil || debug < 1 {
+		debug = 2
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err = pprof.Lookup("goroutine").WriteTo(w, debug); err != nil {
+		log.Warnf("admin dump goroutines err: %s", err)
+	}
+}
+
+// health 本地服务中最差的健康状态,不健康时返回503,用于负载均衡和容器的健康检查
+func (admin *Admin) health(w http.ResponseWriter, r *http.Request) {
+	status := admin.host.Health()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if status == HealthStatusUnhealthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = fmt.Fprintln(w, status)
+}
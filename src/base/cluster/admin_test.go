@@ -0,0 +1,110 @@
+// -------------------------------------------
+// @file      : admin_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/12 上午10:40
+// -------------------------------------------
+
+package cluster
+
+import (
+	"gogs/base/cluster/network"
+	"gogs/base/mongodb"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// localService 测试用的本地服务,不实现远程服务的方法
+type localService struct {
+	IService
+}
+
+// saveContext 测试用的角色上下文,记录存盘次数
+type saveContext struct {
+	NilActorContext
+	saves int32
+}
+
+func (ctx *saveContext) Save(*mongodb.MongoClient) error {
+	atomic.AddInt32(&ctx.saves, 1)
+	return nil
+}
+
+// request 向调试服务器发起请求,返回状态码和内容
+func request(admin *Admin, method, target string) (int, string) {
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestAdminMethods(t *testing.T) {
+	initTestConfig()
+	host := NewHost("admin:1", network.NewMemoryTransport())
+	defer host.Close()
+	admin := NewAdmin(host)
+	for _, c := range []struct {
+		method, target string
+		code           int
+	}{
+		{http.MethodGet, "/debug/services", http.StatusOK},
+		{http.MethodPost, "/debug/services", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/debug/kick?userID=1", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/debug/save?actor=a:user@1", http.StatusMethodNotAllowed},
+		// 未挂载角色系统和网关
+		{http.MethodGet, "/debug/actors", http.StatusNotFound},
+		{http.MethodGet, "/debug/agents", http.StatusNotFound},
+		{http.MethodPost, "/debug/kick?userID=1", http.StatusNotFound},
+		{http.MethodPost, "/debug/save?actor=a:user@1", http.StatusNotFound},
+		{http.MethodGet, "/debug/unknown", http.StatusNotFound},
+	} {
+		if code, body := request(admin, c.method, c.target); code != c.code {
+			t.Fatalf("%s %s: %d %s, expect: %d", c.method, c.target, code, body, c.code)
+		}
+	}
+}
+
+func TestAdminKickAndSave(t *testing.T) {
+	initTestConfig()
+	host := NewHost("admin:2", network.NewMemoryTransport())
+	defer host.Close()
+	gate := &Gate{name: "Gate:1", agents: make(map[int64]*GateAgent)}
+	session := &closeSession{recordSession: recordSession{name: "client:1"}, closed: make(chan struct{})}
+	gate.agents[1] = &GateAgent{Gate: gate, session: session, userID: 1}
+	system := &ActorSystem{name: "a", actors: make(map[string]IActor)}
+	context := &saveContext{}
+	actor := newBaseActor(system, &ActorName{SystemName: "a", Type: "user", ID: 1}, &sync.Mutex{}, context)
+	actor.service = &localService{&testService{typename: "user", name: actor.Name(), id: 1}}
+	system.actors[actor.Name()] = actor
+	admin := NewAdmin(host).WithGate(gate).WithActorSystem(system)
+
+	if code, body := request(admin, http.MethodPost, "/debug/kick?userID=1"); code != http.StatusOK || !strings.Contains(body, "ok") {
+		t.Fatalf("kick: %d %s", code, body)
+	}
+	select {
+	case <-session.closed:
+	default:
+		t.Fatal("kicked session not closed")
+	}
+	for _, target := range []string{"/debug/kick?userID=2", "/debug/kick?userID=x"} {
+		if code, _ := request(admin, http.MethodPost, target); code != http.StatusBadRequest {
+			t.Fatalf("%s: %d", target, code)
+		}
+	}
+
+	if code, body := request(admin, http.MethodPost, "/debug/save?actor="+actor.Name()); code != http.StatusOK ||
+		atomic.LoadInt32(&context.saves) != 1 {
+		t.Fatalf("save: %d %s saves: %d", code, body, context.saves)
+	}
+	for _, target := range []string{"/debug/save", "/debug/save?actor=a:user@2"} {
+		if code, _ := request(admin, http.MethodPost, target); code != http.StatusBadRequest {
+			t.Fatalf("%s: %d", target, code)
+		}
+	}
+	if code, body := request(admin, http.MethodGet, "/debug/actors"); code != http.StatusOK || !strings.Contains(body, actor.Name()) {
+		t.Fatalf("actors: %d %s", code, body)
+	}
+}
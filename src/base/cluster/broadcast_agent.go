@@ -0,0 +1,97 @@
+// -------------------------------------------
+// @file      : broadcast_agent.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/3 上午11:25
+// -------------------------------------------
+
+package cluster
+
+import (
+	"context"
+	"gogs/base/cberrors"
+	"gogs/base/cluster/network"
+	"time"
+)
+
+// Audience 广播的接收者,同时满足各条件的用户,条件都为空时为所有在线用户
+type Audience struct {
+	UserIDs []int64 // 指定用户
+	Game    string  // 登录在指定游戏服的用户
+	Topic   string  // 订阅了指定主题的用户
+}
+
+// BroadcastAgent Game 和 GateServerRemoteService 的中间层
+// 用于 Game 向多个 client 调用无返回值的接口
+// 调用只序列化一次,通过 GateServerRemoteService 的 Broadcast 接口发送给每个网关,由网关转发给符合条件的用户
+type BroadcastAgent struct {
+	game     *Game
+	audience *Audience
+}
+
+func newBroadcastAgent(game *Game, audience *Audience) *BroadcastAgent {
+	return &BroadcastAgent{
+		game:     game,
+		audience: audience,
+	}
+}
+
+// Session implement IAgent
+func (agent *BroadcastAgent) Session() network.ISession {
+	return nil
+}
+
+// Middlewares implement IMiddlewareAgent
+func (agent *BroadcastAgent) Middlewares() *Middlewares {
+	return agent.game.Middlewares
+}
+
+// Post implement IAgent
+func (agent *BroadcastAgent) Post(service IService, call *network.Call) error {
+	return agent.game.Post(agent, call)
+}
+
+// Wait implement IAgent
+func (agent *BroadcastAgent) Wait(ctx context.Context, service IService, call *network.Call, timeout time.Duration,
+	complete func(result *ReturnVal)) error {
+	return cberrors.New("broadcast to %s can not wait for return", agent.Name())
+}
+
+// Write implement IAgent
+func (agent *BroadcastAgent) Write(msg *network.Message) error {
+	return agent.game.broadcast(agent.audience, msg)
+}
+
+// DriverType implement network.ISession
+func (agent *BroadcastAgent) DriverType() network.DriverType {
+	return network.DriverTypeHost
+}
+
+// Status implement network.ISession
+func (agent *BroadcastAgent) Status() network.SessionStatus {
+	return network.SessionStatusInConnected
+}
+
+// Handler implement network.ISession
+func (agent *BroadcastAgent) Handler() network.ISessionHandler {
+	return nil
+}
+
+// RTT implement network.ISession
+func (agent *BroadcastAgent) RTT() time.Duration {
+	return 0
+}
+
+// Close implement network.ISession
+func (agent *BroadcastAgent) Close() {
+}
+
+// Name implement network.ISession
+func (agent *BroadcastAgent) Name() string {
+	return "broadcast remote"
+}
+
+// RemoteAddr implement network.ISession
+func (agent *BroadcastAgent) RemoteAddr() string {
+	return ""
+}
@@ -0,0 +1,110 @@
+// -------------------------------------------
+// @file      : broadcast_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/3 下午4:10
+// -------------------------------------------
+
+package cluster
+
+import (
+	"gogs/base/cluster/network"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordSession 测试用的会话,记录写入的消息
+type recordSession struct {
+	sync.Mutex
+	name     string
+	messages []*network.Message
+}
+
+func (session *recordSession) Write(msg *network.Message) error {
+	session.Lock()
+	defer session.Unlock()
+	session.messages = append(session.messages, msg)
+	return nil
+}
+
+func (session *recordSession) Status() network.SessionStatus    { return network.SessionStatusInConnected }
+func (session *recordSession) DriverType() network.DriverType   { return network.DriverTypeGate }
+func (session *recordSession) Close()                           {}
+func (session *recordSession) Handler() network.ISessionHandler { return nil }
+func (session *recordSession) Name() string                     { return session.name }
+func (session *recordSession) RTT() time.Duration               { return 0 }
+
+// received 会话收到的消息数,并清空记录
+func (session *recordSession) received() int {
+	session.Lock()
+	defer session.Unlock()
+	n := len(session.messages)
+	session.messages = nil
+	return n
+}
+
+func TestGateBroadcast(t *testing.T) {
+	initTestConfig()
+	gate := &Gate{
+		name:   "Gate:1",
+		agents: make(map[int64]*GateAgent),
+		topics: make(map[string]map[int64]struct{}),
+	}
+	builder := NewGameServerBuilder(nil)
+	games := map[string]IGameServer{
+		"Game:1": builder.NewRemoteService(nil, "Game:1", 1, 1, nil).(IGameServer),
+		"Game:2": builder.NewRemoteService(nil, "Game:2", 2, 2, nil).(IGameServer),
+	}
+	sessions := make(map[int64]*recordSession)
+	for userID, game := range map[int64]string{1: "Game:1", 2: "Game:1", 3: "Game:2"} {
+		session := &recordSession{name: game}
+		sessions[userID] = session
+		gate.agents[userID] = &GateAgent{Gate: gate, session: session, userID: userID, gameServer: games[game]}
+	}
+	expect := func(what string, users ...int64) {
+		t.Helper()
+		want := make(map[int64]bool)
+		for _, userID := range users {
+			want[userID] = true
+		}
+		for userID, session := range sessions {
+			n := session.received()
+			if want[userID] && n != 1 || !want[userID] && n != 0 {
+				t.Fatalf("%s: user %d received %d messages", what, userID, n)
+			}
+		}
+	}
+	msg := &BroadcastMsg{Type: network.MessageTypeCall, Data: []byte("hello")}
+
+	_ = gate.Broadcast(msg)
+	expect("all", 1, 2, 3)
+	_ = gate.Broadcast(&BroadcastMsg{Game: "Game:1", Type: msg.Type, Data: msg.Data})
+	expect("game", 1, 2)
+	_ = gate.Broadcast(&BroadcastMsg{UserIDs: []int64{1, 3, 4}, Type: msg.Type, Data: msg.Data})
+	expect("users", 1, 3)
+
+	if err := gate.Subscribe(&SubscribeMsg{UserID: 4, Topic: "world", Subscribe: true}); err == nil {
+		t.Fatal("offline user subscribed")
+	}
+	for _, userID := range []int64{2, 3} {
+		if err := gate.Subscribe(&SubscribeMsg{UserID: userID, Topic: "world", Subscribe: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = gate.Broadcast(&BroadcastMsg{Topic: "world", Type: msg.Type, Data: msg.Data})
+	expect("topic", 2, 3)
+	_ = gate.Broadcast(&BroadcastMsg{Topic: "world", Game: "Game:2", Type: msg.Type, Data: msg.Data})
+	expect("topic and game", 3)
+	_ = gate.Broadcast(&BroadcastMsg{Topic: "guild", Type: msg.Type, Data: msg.Data})
+	expect("unknown topic")
+
+	// 取消订阅和断线后不再收到主题消息
+	_ = gate.Subscribe(&SubscribeMsg{UserID: 2, Topic: "world"})
+	gate.sessionStatusChanged(gate.agents[3], network.SessionStatusClosed)
+	_ = gate.Broadcast(&BroadcastMsg{Topic: "world", Type: msg.Type, Data: msg.Data})
+	expect("after unsubscribe")
+	if len(gate.topics) != 0 {
+		t.Fatalf("topics not cleaned: %v", gate.topics)
+	}
+}
@@ -15,6 +15,7 @@ import (
 type ClientAgent struct {
 	clientService IRemoteService                          // 挂载客户端API的远程服务
 	sessionID     int64                                   // 会话ID
+	gate          string                                  // 会话所在的网关名字
 	userID        int64                                   // 玩家ID
 	actor         IActor                                  // 用户角色
 	DBSave        func(client *mongodb.MongoClient) error // 存盘
@@ -42,6 +43,11 @@ func (agent *ClientAgent) SetClientService(client IRemoteService) {
 	agent.clientService = client
 }
 
+// Gate 获取会话所在的网关名字
+func (agent *ClientAgent) Gate() string {
+	return agent.gate
+}
+
 // SessionID 获取会话ID
 func (agent *ClientAgent) SessionID() int64 {
 	return agent.sessionID
@@ -0,0 +1,101 @@
+// -------------------------------------------
+// @file      : errors.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/23 下午3:20
+// -------------------------------------------
+
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"gogs/base/cluster/network"
+	"sync"
+)
+
+// ICodeError 错误码枚举,@cblang.Error标注的枚举自动实现
+type ICodeError interface {
+	error
+	ErrorCode() (string, int32) // 枚举的类型路径和错误码
+}
+
+var (
+	errorDecoders    = make(map[string]func(code int32) error) // 错误码枚举解析函数,类型路径索引
+	errorDecoderLock sync.RWMutex                              // 解析函数读写锁
+)
+
+// RegisterErrorCode 注册错误码枚举,生成代码在init中调用,远程调用返回的错误码据此还原为枚举
+func RegisterErrorCode(errorType string, decode func(code int32) error) {
+	errorDecoderLock.Lock()
+	defer errorDecoderLock.Unlock()
+	errorDecoders[errorType] = decode
+}
+
+// RemoteError 远程调用失败,错误码枚举未注册或处理失败时返回
+type RemoteError struct {
+	Status    network.ReturnStatus // 返回状态
+	ErrorType string               // 错误码枚举的类型路径
+	Code      int32                // 错误码
+	Message   string               // 错误信息
+}
+
+// Error implements error
+func (err *RemoteError) Error() string {
+	if err.Status == network.ReturnStatusCode {
+		return fmt.Sprintf("remote %s %s(%d): %s", err.Status, err.ErrorType, err.Code, err.Message)
+	}
+	return fmt.Sprintf("remote %s: %s", err.Status, err.Message)
+}
+
+// PanicError 将处理函数崩溃时recover得到的值转换为错误
+func PanicError(e interface{}) error {
+	return &RemoteError{
+		Status:  network.ReturnStatusPanic,
+		Message: fmt.Sprint(e),
+	}
+}
+
+// ErrorReturn 将处理调用的错误转换为返回,错误码枚举和远程错误保留其状态和错误码
+func ErrorReturn(call *network.Call, err error) *network.Return {
+	callReturn := &network.Return{
+		ID:        call.ID,
+		ServiceID: call.ServiceID,
+		Status:    network.ReturnStatusError,
+		Message:   err.Error(),
+	}
+	var remote *RemoteError
+	var code ICodeError
+	if errors.As(err, &remote) {
+		callReturn.Status = remote.Status
+		callReturn.ErrorType = remote.ErrorType
+		callReturn.Code = remote.Code
+		callReturn.Message = remote.Message
+	} else if errors.As(err, &code) {
+		callReturn.Status = network.ReturnStatusCode
+		callReturn.ErrorType, callReturn.Code = code.ErrorCode()
+	}
+	return callReturn
+}
+
+// ReturnError 获取返回携带的错误,成功时返回nil
+// 已注册的错误码枚举还原为枚举值,可以直接与枚举比较,其他情况返回*RemoteError
+func ReturnError(callReturn *network.Return) error {
+	if callReturn.Status == network.ReturnStatusOK {
+		return nil
+	}
+	if callReturn.Status == network.ReturnStatusCode {
+		errorDecoderLock.RLock()
+		decode, ok := errorDecoders[callReturn.ErrorType]
+		errorDecoderLock.RUnlock()
+		if ok {
+			return decode(callReturn.Code)
+		}
+	}
+	return &RemoteError{
+		Status:    callReturn.Status,
+		ErrorType: callReturn.ErrorType,
+		Code:      callReturn.Code,
+		Message:   callReturn.Message,
+	}
+}
@@ -0,0 +1,280 @@
+// -------------------------------------------
+// @file      : future.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/2 上午10:40
+// -------------------------------------------
+
+package cluster
+
+import (
+	"context"
+	"gogs/base/cberrors"
+	"sync"
+	"time"
+)
+
+// IExecutor 异步回调的执行者
+type IExecutor interface {
+	Execute(task func()) // 执行任务
+}
+
+// ExecutorFunc 函数形式的执行者
+type ExecutorFunc func(task func())
+
+// Execute implements IExecutor
+func (f ExecutorFunc) Execute(task func()) {
+	f(task)
+}
+
+// InlineExecutor 在完成结果的协程中直接执行,回调不能阻塞
+var InlineExecutor IExecutor = ExecutorFunc(func(task func()) {
+	task()
+})
+
+// GoExecutor 每个任务在新协程中执行
+var GoExecutor IExecutor = ExecutorFunc(func(task func()) {
+	go task()
+})
+
+// ActorExecutor 在新协程中持有角色锁执行,回调与角色上的其他调用互斥
+func ActorExecutor(actor IActor) IExecutor {
+	return ExecutorFunc(func(task func()) {
+		go func() {
+			actor.Lock()
+			defer actor.Unlock()
+			task()
+		}()
+	})
+}
+
+// Future 类型化的异步结果,只完成一次,完成后可以多次读取
+type Future[T any] struct {
+	mutex     sync.Mutex    // 保护回调列表
+	done      chan struct{} // 完成信号
+	value     T             // 结果
+	err       error         // 错误
+	callbacks []func()      // 完成后派发的回调
+}
+
+// NewFuture 新建未完成的异步结果
+func NewFuture[T any]() *Future[T] {
+	return &Future[T]{
+		done: make(chan struct{}),
+	}
+}
+
+// Completed 新建已成功的异步结果
+func Completed[T any](value T) *Future[T] {
+	future := NewFuture[T]()
+	future.Complete(value, nil)
+	return future
+}
+
+// Failed 新建已失败的异步结果
+func Failed[T any](err error) *Future[T] {
+	future := NewFuture[T]()
+	var zero T
+	future.Complete(zero, err)
+	return future
+}
+
+// Async 在新协程中执行函数,返回其结果,函数崩溃时以错误完成
+func Async[T any](fn func() (T, error)) *Future[T] {
+	future := NewFuture[T]()
+	go func() {
+		future.Complete(safeCall(fn))
+	}()
+	return future
+}
+
+// safeCall 调用函数,崩溃时返回错误
+func safeCall[T any](fn func() (T, error)) (value T, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = cberrors.New("async panic: %v", e)
+		}
+	}()
+	return fn()
+}
+
+// Complete 写入结果,只有第一次写入生效,返回是否生效
+func (future *Future[T]) Complete(value T, err error) bool {
+	future.mutex.Lock()
+	select {
+	case <-future.done:
+		future.mutex.Unlock()
+		return false
+	default:
+	}
+	future.value = value
+	future.err = err
+	close(future.done)
+	callbacks := future.callbacks
+	future.callbacks = nil
+	future.mutex.Unlock()
+	for _, callback := range callbacks {
+		callback()
+	}
+	return true
+}
+
+// Done 完成信号
+func (future *Future[T]) Done() <-chan struct{} {
+	return future.done
+}
+
+// Get 等待结果
+func (future *Future[T]) Get() (T, error) {
+	<-future.done
+	return future.value, future.err
+}
+
+// Wait 等待结果,超时返回ErrTimeout,ctx先结束时返回ctx的错误
+func (future *Future[T]) Wait(ctx context.Context, timeout time.Duration) (T, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var zero T
+	select {
+	case <-future.done:
+		return future.value, future.err
+	case <-timer.C:
+		return zero, ErrTimeout
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// OnComplete 完成后在执行者上回调,已完成时立即派发,executor为nil时使用InlineExecutor
+func (future *Future[T]) OnComplete(executor IExecutor, callback func(value T, err error)) {
+	if executor == nil {
+		executor = InlineExecutor
+	}
+	task := func() {
+		executor.Execute(func() {
+			callback(future.value, future.err)
+		})
+	}
+	future.mutex.Lock()
+	select {
+	case <-future.done:
+		future.mutex.Unlock()
+		task()
+	default:
+		future.callbacks = append(future.callbacks, task)
+		future.mutex.Unlock()
+	}
+}
+
+// Then 成功后在执行者上转换结果,失败时不调用fn直接传递错误
+func Then[T, R any](future *Future[T], executor IExecutor, fn func(value T) (R, error)) *Future[R] {
+	next := NewFuture[R]()
+	future.OnComplete(executor, func(value T, err error) {
+		if err != nil {
+			var zero R
+			next.Complete(zero, err)
+			return
+		}
+		next.Complete(fn(value))
+	})
+	return next
+}
+
+// Result 一个异步结果的值和错误
+type Result[T any] struct {
+	Value T     // 结果
+	Err   error // 错误
+}
+
+// WhenAll 全部成功后完成,结果与参数顺序一致,任一失败时以该错误立即完成
+func WhenAll[T any](futures ...*Future[T]) *Future[[]T] {
+	all := NewFuture[[]T]()
+	values := make([]T, len(futures))
+	if len(futures) == 0 {
+		all.Complete(values, nil)
+		return all
+	}
+	var mutex sync.Mutex
+	remain := len(futures)
+	for i, future := range futures {
+		i := i
+		future.OnComplete(InlineExecutor, func(value T, err error) {
+			if err != nil {
+				all.Complete(nil, err)
+				return
+			}
+			mutex.Lock()
+			values[i] = value
+			remain--
+			finished := remain == 0
+			mutex.Unlock()
+			if finished {
+				all.Complete(values, nil)
+			}
+		})
+	}
+	return all
+}
+
+// WhenAllSettled 全部完成后完成,结果与参数顺序一致,包含失败的结果
+func WhenAllSettled[T any](futures ...*Future[T]) *Future[[]Result[T]] {
+	all := NewFuture[[]Result[T]]()
+	results := make([]Result[T], len(futures))
+	if len(futures) == 0 {
+		all.Complete(results, nil)
+		return all
+	}
+	var mutex sync.Mutex
+	remain := len(futures)
+	for i, future := range futures {
+		i := i
+		future.OnComplete(InlineExecutor, func(value T, err error) {
+			mutex.Lock()
+			results[i] = Result[T]{Value: value, Err: err}
+			remain--
+			finished := remain == 0
+			mutex.Unlock()
+			if finished {
+				all.Complete(results, nil)
+			}
+		})
+	}
+	return all
+}
+
+// WhenAny 任一成功时以其结果完成,全部失败时以最后一个错误完成
+func WhenAny[T any](futures ...*Future[T]) *Future[T] {
+	first := NewFuture[T]()
+	if len(futures) == 0 {
+		var zero T
+		first.Complete(zero, cberrors.New("when any without futures"))
+		return first
+	}
+	var mutex sync.Mutex
+	remain := len(futures)
+	for _, future := range futures {
+		future.OnComplete(InlineExecutor, func(value T, err error) {
+			if err == nil {
+				first.Complete(value, nil)
+				return
+			}
+			mutex.Lock()
+			remain--
+			failed := remain == 0
+			mutex.Unlock()
+			if failed {
+				first.Complete(value, err)
+			}
+		})
+	}
+	return first
+}
+
+// FanOut 对每个目标发起一次异步调用,全部完成后返回各自的结果,例如向所有游戏服发起的广播查询
+func FanOut[S, T any](targets []S, call func(target S) *Future[T]) *Future[[]Result[T]] {
+	futures := make([]*Future[T], 0, len(targets))
+	for _, target := range targets {
+		futures = append(futures, call(target))
+	}
+	return WhenAllSettled(futures...)
+}
@@ -0,0 +1,109 @@
+// -------------------------------------------
+// @file      : future_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/2 下午3:05
+// -------------------------------------------
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFuture(t *testing.T) {
+	future := NewFuture[int]()
+	if _, err := future.Wait(context.Background(), 10*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("unexpected wait result: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := future.Wait(ctx, time.Second); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected wait result: %v", err)
+	}
+
+	// 回调在指定的执行者上执行,完成前后注册的回调都会被调用
+	executed := make(chan string, 2)
+	executor := ExecutorFunc(func(task func()) {
+		go task()
+	})
+	future.OnComplete(executor, func(value int, err error) {
+		executed <- "before:" + strconv.Itoa(value)
+	})
+	next := Then(future, executor, func(value int) (string, error) {
+		return strconv.Itoa(value * 2), nil
+	})
+	if !future.Complete(21, nil) || future.Complete(0, errors.New("again")) {
+		t.Fatal("future completed twice")
+	}
+	future.OnComplete(nil, func(value int, err error) {
+		executed <- "after:" + strconv.Itoa(value)
+	})
+	if value, err := next.Get(); err != nil || value != "42" {
+		t.Fatalf("unexpected then result: %s %v", value, err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-executed:
+		case <-time.After(time.Second):
+			t.Fatal("callback not executed")
+		}
+	}
+
+	// 失败时不调用转换函数
+	failed := Then(Failed[int](ErrTimeout), nil, func(value int) (int, error) {
+		t.Fatal("then called on failure")
+		return 0, nil
+	})
+	if _, err := failed.Get(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("unexpected then error: %v", err)
+	}
+
+	if _, err := Async(func() (int, error) { panic("boom") }).Get(); err == nil {
+		t.Fatal("async panic not reported")
+	}
+}
+
+func TestFutureCombinators(t *testing.T) {
+	slow := func(value int, err error) *Future[int] {
+		return Async(func() (int, error) {
+			time.Sleep(time.Duration(value) * time.Millisecond)
+			return value, err
+		})
+	}
+	values, err := WhenAll(slow(30, nil), slow(10, nil), Completed(20)).Get()
+	if err != nil || len(values) != 3 || values[0] != 30 || values[1] != 10 || values[2] != 20 {
+		t.Fatalf("unexpected when all result: %v %v", values, err)
+	}
+	if _, err = WhenAll(slow(1000, nil), Failed[int](ErrTimeout)).Wait(context.Background(), 500*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("when all not failed fast: %v", err)
+	}
+	if values, err = WhenAll[int]().Get(); err != nil || len(values) != 0 {
+		t.Fatalf("unexpected empty when all result: %v %v", values, err)
+	}
+
+	value, err := WhenAny(slow(50, nil), slow(10, errors.New("fail")), slow(20, nil)).Get()
+	if err != nil || value != 20 {
+		t.Fatalf("unexpected when any result: %d %v", value, err)
+	}
+	if _, err = WhenAny(Failed[int](errors.New("a")), Failed[int](ErrTimeout)).Get(); err == nil {
+		t.Fatal("when any succeeded without success")
+	}
+
+	results, err := FanOut([]int{10, 20, 30}, func(target int) *Future[int] {
+		if target == 20 {
+			return Failed[int](ErrTimeout)
+		}
+		return slow(target, nil)
+	}).Get()
+	if err != nil || len(results) != 3 {
+		t.Fatalf("unexpected fan out result: %v %v", results, err)
+	}
+	if results[0].Value != 10 || results[0].Err != nil || !errors.Is(results[1].Err, ErrTimeout) || results[2].Value != 30 {
+		t.Fatalf("unexpected fan out result: %v", results)
+	}
+}
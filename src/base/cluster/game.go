@@ -11,7 +11,6 @@ import (
 	"fmt"
 	"gogs/base/cberrors"
 	"gogs/base/cluster/network"
-	"gogs/base/etcd"
 	log "gogs/base/logger"
 	"sync"
 	"sync/atomic"
@@ -30,15 +29,15 @@ type Game struct {
 	serverName      string                     // 服务器名字
 }
 
-// NewGame 新建游戏服务器
-func NewGame(name string, builders map[string]IServiceBuilder, localAddr string) (
+// NewGame 新建游戏服务器,transport为nil时使用tcp
+func NewGame(name string, builders map[string]IServiceBuilder, localAddr string, transport network.ITransport) (
 	*Game, error) {
-	actorSystem, err := NewActorSystem(name, builders, localAddr)
+	actorSystem, err := NewActorSystem(name, builders, localAddr, transport)
 	if err != nil {
 		return nil, err
 	}
 	game := &Game{
-		RPC:             NewRPC(),
+		RPC:             actorSystem.host.RPC,
 		ActorSystem:     actorSystem,
 		Host:            actorSystem.host,
 		gateServers:     make(map[string]IGateServer),
@@ -80,14 +79,14 @@ func NewGame(name string, builders map[string]IServiceBuilder, localAddr string)
 	return game, nil
 }
 
-// Shutdown 关闭服务器
+// Shutdown 关闭服务器,etcd由启动框架在之后注销
 func (game *Game) Shutdown() {
 	log.Infof("%s shutdown start:", game.serverName)
+	// 游戏服与集群服务器共用远程调用管理器,关闭集群服务器时等待进行中的调用
 	log.Infof("%s:Host closing...", game.serverName)
 	game.Host.Close()
 	log.Infof("%s:ActorSystem closing...", game.serverName)
 	game.ActorSystem.Close()
-	etcd.Exit()
 	log.Infof("%s shutdown finished.", game.serverName)
 }
 
@@ -96,6 +95,11 @@ func (game *Game) newServiceID() ID {
 	return ID(atomic.AddUint32(&game.idgen, 1))
 }
 
+// NewAdmin 新建游戏服务器的调试服务器,可以查询角色和存盘
+func (game *Game) NewAdmin() *Admin {
+	return NewAdmin(game.Host).WithActorSystem(game.ActorSystem)
+}
+
 // Name 服务器名字
 func (game *Game) Name() string {
 	return game.serverName
@@ -110,10 +114,9 @@ func (game *Game) Login(ntf *UserLoginNtf, ci *ClientInfo) (int64, Err, error) {
 		log.Errorf("unable to find gate server: %s", ntf.Gate)
 		return 0, ErrGateNotFound, nil
 	}
-	clientType := "client"
-	builder, ok := game.builders[clientType]
+	builder, ok := game.builders[game.UserServiceName]
 	if !ok {
-		log.Errorf("unable to find client type builder: %s", clientType)
+		log.Errorf("unable to find client type builder: %s", game.UserServiceName)
 		return 0, ErrSystem, nil
 	}
 	// 角色名字
@@ -128,6 +131,7 @@ func (game *Game) Login(ntf *UserLoginNtf, ci *ClientInfo) (int64, Err, error) {
 	actor, ok := game.ActorSystem.GetActor(name.String())
 	if !ok {
 		clientAgent = NewClientAgent(ntf.SessionID, ntf.UserID)
+		clientAgent.gate = ntf.Gate
 		var err error
 		actor, err = game.ActorSystem.NewActor(name, clientAgent)
 		if actor == nil {
@@ -136,32 +140,84 @@ func (game *Game) Login(ntf *UserLoginNtf, ci *ClientInfo) (int64, Err, error) {
 		}
 	} else {
 		clientAgent = actor.Context().(*ClientAgent)
-		clientAgent.sessionID = ntf.SessionID
 	}
 	game.Lock()
-	defer game.Unlock()
+	// 用户仍在线时记下旧会话,新会话替换后踢掉,旧会话关闭时的登出因会话不一致被忽略
+	var kick *KickMsg
+	oldGate := clientAgent.gate
+	if clientAgent.clientService != nil && (oldGate != ntf.Gate || clientAgent.sessionID != ntf.SessionID) {
+		kick = &KickMsg{
+			UserID:    clientAgent.userID,
+			SessionID: clientAgent.sessionID,
+			Reason:    network.KickReasonDuplicateLogin,
+			Message:   "login on another session",
+		}
+	}
+	clientAgent.sessionID = ntf.SessionID
+	clientAgent.gate = ntf.Gate
 	remoteService := builder.NewRemoteService(newTunnelAgent(game, clientAgent.userID, gateServer),
 		actor.Name(),
 		game.newServiceID(),
 		0,
 		nil)
 	clientAgent.SetClientService(remoteService)
+	oldGateServer, ok := game.gateServers[oldGate]
+	game.Unlock()
+	if kick != nil {
+		if ok {
+			go game.kickSession(oldGate, oldGateServer, kick)
+		} else {
+			log.Warnf("%s duplicate login, old gate: %s not found", clientAgent, oldGate)
+		}
+	}
 	return clientAgent.UserID(), ErrOK, nil
 }
 
+// kickSession 通过旧会话所在的网关踢掉旧会话
+func (game *Game) kickSession(gate string, gateServer IGateServer, kick *KickMsg) {
+	log.Infof("user: %d duplicate login, kick session: %d on gate: %s", kick.UserID, kick.SessionID, gate)
+	if err := gateServer.KickSession(kick); err != nil {
+		log.Warnf("user: %d kick session: %d on gate: %s err: %s", kick.UserID, kick.SessionID, gate, err)
+	}
+}
+
+// Online 当前在线人数,即挂载了客户端服务的用户角色数
+func (game *Game) Online() int64 {
+	system := game.ActorSystem
+	system.actorLock.RLock()
+	agents := make([]*ClientAgent, 0, len(system.actors))
+	for _, actor := range system.actors {
+		if clientAgent, ok := actor.Context().(*ClientAgent); ok {
+			agents = append(agents, clientAgent)
+		}
+	}
+	system.actorLock.RUnlock()
+	game.RLock()
+	defer game.RUnlock()
+	var online int64
+	for _, clientAgent := range agents {
+		if clientAgent.clientService != nil {
+			online++
+		}
+	}
+	return online
+}
+
 // Logout 登出
 func (game *Game) Logout(ntf *UserLoginNtf) error {
 	actorName := fmt.Sprintf("%s:%s@%d", game.ActorSystem.name, game.UserServiceName, ntf.UserID)
 	if actor, ok := game.ActorSystem.GetActor(actorName); ok {
 		clientAgent := actor.Context().(*ClientAgent)
-		if clientAgent.sessionID != ntf.SessionID {
-			log.Infof("%s logout %s %s", clientAgent, clientAgent.sessionID, ntf.SessionID)
+		game.Lock()
+		defer game.Unlock()
+		// 会话ID由各网关分别生成,需要同时比较网关
+		if clientAgent.gate != ntf.Gate || clientAgent.sessionID != ntf.SessionID {
+			log.Infof("%s logout %s:%d, current %s:%d", clientAgent, ntf.Gate, ntf.SessionID,
+				clientAgent.gate, clientAgent.sessionID)
 			return nil
 		}
 		log.Infof("%s logout", clientAgent)
-		game.Lock()
 		clientAgent.SetClientService(nil)
-		game.Unlock()
 	}
 	return nil
 }
@@ -185,13 +241,12 @@ func (game *Game) Tunnel(msg *TunnelMsg) error {
 		if err != nil {
 			return err
 		}
-		// 调用角色方法
-		callReturn, err := actor.Service().Call(call)
-		if err != nil {
-			return err
-		}
+		// 调用角色方法,调用本身没有追踪头时沿用网关转发的追踪头
+		// 客户端的时钟不可信,不使用其期限
+		call.Deadline = 0
+		callReturn, err := game.serveCall(actor.Service(), call, msg.Header)
 		if callReturn == nil {
-			return nil
+			return err
 		}
 		data := callReturn.Marshal()
 		if clientService, ok := clientAgent.ClientService(); ok {
@@ -199,12 +254,124 @@ func (game *Game) Tunnel(msg *TunnelMsg) error {
 				Type: network.MessageTypeReturn,
 				Data: data,
 			}
-			err = clientService.Agent().Write(msg)
-			if err != nil {
-				return err
+			if err1 := clientService.Agent().Write(msg); err1 != nil {
+				return err1
 			}
-			return nil
+			return err
 		}
 	}
 	return cberrors.New("actor not found: %s", actorName)
 }
+
+// Broadcast 新建向符合条件的用户广播的客户端服务,只能调用其无返回值的方法,audience为nil时为所有在线用户
+// 例如向本游戏服的所有用户广播: game.Broadcast(&Audience{Game: game.Name()})
+func (game *Game) Broadcast(audience *Audience) (IRemoteService, error) {
+	builder, ok := game.builders[game.UserServiceName]
+	if !ok {
+		return nil, cberrors.New("unable to find client type builder: %s", game.UserServiceName)
+	}
+	if audience == nil {
+		audience = &Audience{}
+	}
+	return builder.NewRemoteService(newBroadcastAgent(game, audience), "broadcast", game.newServiceID(), 0, nil), nil
+}
+
+// Subscribe 为本游戏服上的用户订阅广播主题,订阅保存在用户所在的网关,断线后失效
+func (game *Game) Subscribe(userID int64, topic string) error {
+	return game.subscribe(userID, topic, true)
+}
+
+// Unsubscribe 为本游戏服上的用户取消订阅广播主题
+func (game *Game) Unsubscribe(userID int64, topic string) error {
+	return game.subscribe(userID, topic, false)
+}
+
+// subscribe 通过用户所在的网关订阅或取消订阅
+func (game *Game) subscribe(userID int64, topic string, subscribe bool) error {
+	gateServer, ok := game.userGate(userID)
+	if !ok {
+		return cberrors.New("user: %d not online on game: %s", userID, game.serverName)
+	}
+	return gateServer.Subscribe(&SubscribeMsg{
+		UserID:    userID,
+		Topic:     topic,
+		Subscribe: subscribe,
+	})
+}
+
+// userGate 本游戏服上在线用户所在的网关
+func (game *Game) userGate(userID int64) (IGateServer, bool) {
+	actorName := fmt.Sprintf("%s:%s@%d", game.ActorSystem.name, game.UserServiceName, userID)
+	actor, ok := game.ActorSystem.GetActor(actorName)
+	if !ok {
+		return nil, false
+	}
+	clientAgent, ok := actor.Context().(*ClientAgent)
+	if !ok {
+		return nil, false
+	}
+	game.RLock()
+	defer game.RUnlock()
+	clientService, ok := clientAgent.ClientService()
+	if !ok {
+		return nil, false
+	}
+	tunnel, ok := clientService.Agent().(*TunnelAgent)
+	if !ok {
+		return nil, false
+	}
+	return tunnel.gateServer, true
+}
+
+// broadcast 将消息按网关分组发送,每个网关只发送一次
+// 指定用户时,本游戏服上的用户只发送给其所在的网关,其他用户发送给所有网关,由网关过滤
+func (game *Game) broadcast(audience *Audience, msg *network.Message) error {
+	game.RLock()
+	gateServers := make(map[string]IGateServer, len(game.gateServers))
+	for name, gateServer := range game.gateServers {
+		gateServers[name] = gateServer
+	}
+	game.RUnlock()
+	targets := make(map[string][]int64, len(gateServers))
+	if len(audience.UserIDs) > 0 {
+		var others []int64
+		for _, userID := range audience.UserIDs {
+			gateServer, ok := game.userGate(userID)
+			if !ok {
+				others = append(others, userID)
+				continue
+			}
+			if service, ok := gateServer.(IService); ok {
+				targets[service.Name()] = append(targets[service.Name()], userID)
+			}
+		}
+		if len(others) > 0 {
+			for name := range gateServers {
+				targets[name] = append(targets[name], others...)
+			}
+		}
+	} else {
+		for name := range gateServers {
+			targets[name] = nil
+		}
+	}
+	var err error
+	for name, userIDs := range targets {
+		gateServer, ok := gateServers[name]
+		if !ok {
+			continue
+		}
+		err1 := gateServer.Broadcast(&BroadcastMsg{
+			UserIDs: userIDs,
+			Game:    audience.Game,
+			Topic:   audience.Topic,
+			Type:    msg.Type,
+			Data:    msg.Data,
+		})
+		if err1 != nil {
+			log.Warnf("broadcast to gate server: %s err: %s", name, err1)
+			err = err1
+		}
+	}
+	return err
+}
@@ -10,38 +10,48 @@ package cluster
 import (
 	"gogs/base/cberrors"
 	"gogs/base/cluster/network"
+	"gogs/base/config"
 	log "gogs/base/logger"
+	"sort"
 	"sync"
 	"sync/atomic"
 )
 
 // Gate 网关服务器
 type Gate struct {
-	*RPC                              // RPC管理器
-	sync.RWMutex                      // 读写锁
-	name         string               // 网关名字
-	host         *Host                // 集群服务器
-	gameServers  map[ID]IService      // Game以GameServer形式,保存在Gate
-	agents       map[int64]*GateAgent // GateAgent列表,通过UserID索引
+	*RPC                                       // RPC管理器
+	sync.RWMutex                               // 读写锁
+	name         string                        // 网关名字
+	host         *Host                         // 集群服务器
+	gameServers  *Router                       // Game以GameServer形式,保存在Gate,登录时按策略选择
+	agents       map[int64]*GateAgent          // GateAgent列表,通过UserID索引
+	topics       map[string]map[int64]struct{} // 广播主题的订阅用户,通过主题索引
 	builder      IServiceBuilder
-	idgen        int64 // session userID generator
+	driver       *network.GateDriver // 对客户端的网关驱动
+	idgen        int64               // session userID generator
 }
 
 // NewGate 新建网关 localAddr本地对客户端监听地址,hostAddr集群节点地址
-func NewGate(name, localAddr, hostAddr string, builder IServiceBuilder, protocol network.ProtocolType) (*Gate, error) {
+// transport对客户端的传输层,hostTransport集群节点的传输层,为nil时使用tcp,security对客户端的传输安全选项
+func NewGate(name, localAddr, hostAddr string, builder IServiceBuilder, transport, hostTransport network.ITransport,
+	security *network.Security) (*Gate, error) {
+	// 为网关创建集群节点服务器,与网关共用远程调用管理器
+	host := NewHost(hostAddr, hostTransport)
 	gate := &Gate{
+		RPC:         host.RPC,
 		name:        name,
-		gameServers: make(map[ID]IService),
+		host:        host,
+		gameServers: NewRouter(nil, EtcdNodeState),
 		agents:      make(map[int64]*GateAgent),
+		topics:      make(map[string]map[int64]struct{}),
 		builder:     builder,
 	}
-	// 为网关创建集群节点服务器
-	gate.host = NewHost(hostAddr)
 	// 注册GateDriver
 	sessionHandlerBuilder := func(session network.ISession) (network.ISessionHandler, error) {
 		return newGateAgent(gate, session, gate.GenSessionID())
 	}
-	err := gate.host.Node.NewDriver(network.NewGateDriver(localAddr, sessionHandlerBuilder, protocol))
+	gate.driver = network.NewGateDriver(localAddr, sessionHandlerBuilder, transport, security)
+	err := gate.host.Node.NewDriver(gate.driver)
 	if err != nil {
 		return nil, err
 	}
@@ -53,15 +63,13 @@ func NewGate(name, localAddr, hostAddr string, builder IServiceBuilder, protocol
 	}
 	// 在集群内通过服务类型监听GameServer服务
 	listener := func(service IService, status network.ServiceStatus) bool {
-		gate.Lock()
-		defer gate.Unlock()
 		if status == network.ServiceStatusOnline {
-			gate.gameServers[service.ID()] = service
+			gate.gameServers.Add(service)
 			log.Infof("service GameServerRemoteService online name: %s, type: %s, id: %d, remote: %d",
 				service.Name(), service.Type(), service.ID(), service.(IRemoteService).RemoteID())
-			log.Infof("service GameServerRemoteService list: %v", gate.gameServers)
+			log.Infof("service GameServerRemoteService list: %v", gate.gameServers.Services())
 		} else {
-			delete(gate.gameServers, service.ID())
+			gate.gameServers.Remove(service)
 			log.Infof("service GameServerRemoteService offline name: %s, type: %s, id: %d, remote: %d",
 				service.Name(), service.Type(), service.ID(), service.(IRemoteService).RemoteID())
 		}
@@ -84,8 +92,9 @@ func NewGate(name, localAddr, hostAddr string, builder IServiceBuilder, protocol
 	return gate, nil
 }
 
-// Close 关闭网关
+// Close 关闭网关,停止接受新连接,等待客户端进行中的调用返回,再通知客户端关闭并断开
 func (gate *Gate) Close() {
+	gate.driver.StopAccept()
 	gate.host.Close()
 }
 
@@ -99,6 +108,47 @@ func (gate *Gate) Name() string {
 	return gate.name
 }
 
+// NewAdmin 新建网关的调试服务器,可以查询网关代理和踢人
+func (gate *Gate) NewAdmin() *Admin {
+	return NewAdmin(gate.host).WithGate(gate)
+}
+
+// NewMembership 新建网关的集群成员管理,网关按规则接受游戏服等的连接
+func (gate *Gate) NewMembership(serverType string, serverID int64, rules MembershipRules) *Membership {
+	return NewMembership(gate.host, serverType, serverID, rules)
+}
+
+// RouteServices 注册只用于构造远程服务的构造器,返回在集群中该类型的服务里按策略选择的路由,例如网关登录前鉴权的登录服
+func (gate *Gate) RouteServices(builder IServiceBuilder, policy IRoutePolicy) (*Router, error) {
+	if _, err := gate.host.RegisterBuilder(builder); err != nil {
+		return nil, err
+	}
+	router := NewRouter(policy, EtcdNodeState)
+	gate.host.ListenServiceType(builder.ServiceType(), func(service IService, status network.ServiceStatus) bool {
+		if status == network.ServiceStatusOnline {
+			router.Add(service)
+		} else {
+			router.Remove(service)
+		}
+		return true
+	})
+	return router, nil
+}
+
+// PickGameServer 按路由策略选择一个可用的游戏服,返回其服务器ID,用于为新用户分配游戏服
+func (gate *Gate) PickGameServer(key int64) (int64, error) {
+	node, err := gate.gameServers.pick(key)
+	if err != nil {
+		return 0, err
+	}
+	return node.ServerID, nil
+}
+
+// SetRoutePolicy 设置登录时选择游戏服的路由策略
+func (gate *Gate) SetRoutePolicy(policy IRoutePolicy) {
+	gate.gameServers.SetPolicy(policy)
+}
+
 // GenSessionID 生成唯一会话ID
 func (gate *Gate) GenSessionID() int64 {
 	return atomic.AddInt64(&gate.idgen, 1)
@@ -109,9 +159,24 @@ func (gate *Gate) sessionStatusChanged(agent *GateAgent, status network.SessionS
 	gate.Lock()
 	defer gate.Unlock()
 	if status == network.SessionStatusInConnected {
+		// 同一网关上重复登录时踢掉旧会话
+		if old, ok := gate.agents[agent.userID]; ok && old != agent {
+			gate.kickReplaced(old)
+		}
 		gate.agents[agent.userID] = agent
 	} else {
+		// 已被新会话替换时不能删除新会话
+		if gate.agents[agent.userID] != agent {
+			return
+		}
 		delete(gate.agents, agent.userID)
+		// 断线后订阅失效
+		for topic, users := range gate.topics {
+			delete(users, agent.userID)
+			if len(users) == 0 {
+				delete(gate.topics, topic)
+			}
+		}
 	}
 }
 
@@ -120,23 +185,115 @@ func (gate *Gate) Login(agent *GateAgent, ntf *UserLoginNtf, ci *ClientInfo) (Er
 	ntf.SessionID = agent.sessionID
 	ntf.Gate = gate.name
 
+	var userID int64
+	code := ErrOK
+	login := func(service IService) error {
+		gameServer := service.(IGameServer)
+		var err error
+		userID, code, err = gameServer.Login(ntf, ci)
+		if err != nil || code != ErrOK {
+			return cberrors.New("call GameServer#Login(%s) code: %s, err: %v", gameServer, code, err)
+		}
+		agent.gameServer = gameServer
+		return nil
+	}
+	var err error
+	if ntf.ServerID != 0 {
+		// 指定了游戏服时不经过路由策略
+		var service IService
+		if service, err = gate.gameServers.PickServer(ntf.ServerID); err == nil {
+			err = login(service)
+		}
+	} else {
+		// 按用户ID路由,新用户没有用户ID时按账号ID
+		key := ntf.UserID
+		if key == 0 {
+			key = ntf.AccountID
+		}
+		err = gate.gameServers.Do(key, login)
+	}
+	if err != nil {
+		return code, err
+	}
+	agent.userID = userID
+	// 签发恢复令牌,断线后在恢复窗口内重连不需要重新登录
+	if session, ok := agent.session.(*network.GateSession); ok && config.ResumeGrace() > 0 {
+		if err = session.EnableResume(); err != nil {
+			log.Warnf("gate: %s enable resume for %s err: %s", gate, session, err)
+		}
+	}
+	go gate.sessionStatusChanged(agent, network.SessionStatusInConnected)
+	return ErrOK, nil
+}
+
+// Agents 已登录的网关代理信息,按用户ID排序
+func (gate *Gate) Agents() []*AgentInfo {
+	gate.RLock()
+	infos := make([]*AgentInfo, 0, len(gate.agents))
+	for userID, agent := range gate.agents {
+		info := &AgentInfo{
+			UserID:    userID,
+			SessionID: agent.sessionID,
+			Session:   agent.session.Name(),
+			Status:    agent.session.Status().String(),
+			RTT:       agent.session.RTT().String(),
+		}
+		if service, ok := agent.gameServer.(IService); ok {
+			info.GameServer = service.Name()
+		}
+		infos = append(infos, info)
+	}
+	gate.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].UserID < infos[j].UserID
+	})
+	return infos
+}
+
+// Kick 将指定用户踢下线,通知客户端后断开连接
+func (gate *Gate) Kick(userID int64, message string) error {
+	gate.RLock()
+	agent, ok := gate.agents[userID]
+	gate.RUnlock()
+	if !ok {
+		return cberrors.New("user: %d not found on gate: %s", userID, gate)
+	}
+	log.Infof("gate: %s kick user: %d, session: %s, message: %s", gate, userID, agent.session.Name(), message)
+	if session, ok := agent.session.(*network.GateSession); ok {
+		return session.Kick(network.KickReasonKicked, message)
+	}
+	agent.session.Close()
+	return nil
+}
+
+// KickSession 用户在其他会话登录后,游戏服通知踢掉旧会话,旧会话已关闭或已被替换时忽略
+func (gate *Gate) KickSession(msg *KickMsg) error {
 	gate.Lock()
 	defer gate.Unlock()
-	// TODO 这里
-	for _, service := range gate.gameServers {
-		if ntf.ServerID == 0 || GetIDByName(service.Name()) == ntf.ServerID {
-			gameServer := service.(IGameServer)
-			userID, code, err := gameServer.Login(ntf, ci)
-			if err != nil || code != ErrOK {
-				return code, cberrors.New("call GameServer#Login(%s) code: %s, err: %v", gameServer, code, err)
+	agent, ok := gate.agents[msg.UserID]
+	if !ok || agent.sessionID != msg.SessionID {
+		log.Infof("gate: %s kick user: %d session: %d not found", gate, msg.UserID, msg.SessionID)
+		return nil
+	}
+	gate.kickReplaced(agent)
+	log.Infof("gate: %s kick user: %d, session: %s, reason: %s, message: %s",
+		gate, msg.UserID, agent.session.Name(), msg.Reason, msg.Message)
+	return nil
+}
+
+// kickReplaced 踢掉被新会话替换的旧会话,旧会话不再转发调用,关闭时不通知游戏服登出
+// 需要持有写锁,会话关闭时会回调sessionStatusChanged,因此异步踢下线
+func (gate *Gate) kickReplaced(agent *GateAgent) {
+	atomic.StoreInt32(&agent.replaced, 1)
+	go func() {
+		if session, ok := agent.session.(*network.GateSession); ok {
+			if err := session.Kick(network.KickReasonDuplicateLogin, "login on another session"); err != nil {
+				log.Debugf("gate: %s kick replaced session: %s err: %s", gate, session, err)
 			}
-			agent.gameServer = gameServer
-			agent.userID = userID
-			go gate.sessionStatusChanged(agent, network.SessionStatusInConnected)
-			return ErrOK, nil
+			return
 		}
-	}
-	return ErrOK, cberrors.New("unable to find game server: %d", ntf.ServerID)
+		agent.session.Close()
+	}()
 }
 
 // Tunnel 转发从Game->Client的消息,通过UserID找到对应的Session
@@ -152,3 +309,95 @@ func (gate *Gate) Tunnel(msg *TunnelMsg) error {
 	}
 	return nil
 }
+
+// Broadcast 将同一份消息发送给同时满足各条件的已登录用户,消息只构造一次
+func (gate *Gate) Broadcast(msg *BroadcastMsg) error {
+	message := &network.Message{
+		Type: msg.Type,
+		Data: msg.Data,
+	}
+	gate.RLock()
+	agents := gate.audience(msg)
+	gate.RUnlock()
+	for _, agent := range agents {
+		if err := agent.session.Write(message); err != nil {
+			log.Debugf("gate: %s broadcast to user: %d err: %s", gate, agent.userID, err)
+		}
+	}
+	return nil
+}
+
+// audience 广播消息的接收者,需要持有读锁
+func (gate *Gate) audience(msg *BroadcastMsg) []*GateAgent {
+	var subscribers map[int64]struct{}
+	if msg.Topic != "" {
+		var ok bool
+		if subscribers, ok = gate.topics[msg.Topic]; !ok {
+			return nil
+		}
+	}
+	match := func(agent *GateAgent) bool {
+		if subscribers != nil {
+			if _, ok := subscribers[agent.userID]; !ok {
+				return false
+			}
+		}
+		if msg.Game != "" {
+			service, ok := agent.gameServer.(IService)
+			if !ok || service.Name() != msg.Game {
+				return false
+			}
+		}
+		return true
+	}
+	var agents []*GateAgent
+	switch {
+	case len(msg.UserIDs) > 0:
+		agents = make([]*GateAgent, 0, len(msg.UserIDs))
+		for _, userID := range msg.UserIDs {
+			if agent, ok := gate.agents[userID]; ok && match(agent) {
+				agents = append(agents, agent)
+			}
+		}
+	case subscribers != nil:
+		agents = make([]*GateAgent, 0, len(subscribers))
+		for userID := range subscribers {
+			if agent, ok := gate.agents[userID]; ok && match(agent) {
+				agents = append(agents, agent)
+			}
+		}
+	default:
+		agents = make([]*GateAgent, 0, len(gate.agents))
+		for _, agent := range gate.agents {
+			if match(agent) {
+				agents = append(agents, agent)
+			}
+		}
+	}
+	return agents
+}
+
+// Subscribe 已登录用户订阅或取消订阅广播主题
+func (gate *Gate) Subscribe(msg *SubscribeMsg) error {
+	gate.Lock()
+	defer gate.Unlock()
+	if !msg.Subscribe {
+		if users, ok := gate.topics[msg.Topic]; ok {
+			delete(users, msg.UserID)
+			if len(users) == 0 {
+				delete(gate.topics, msg.Topic)
+			}
+		}
+		return nil
+	}
+	if _, ok := gate.agents[msg.UserID]; !ok {
+		return cberrors.New("user: %d not found on gate: %s", msg.UserID, gate)
+	}
+	users, ok := gate.topics[msg.Topic]
+	if !ok {
+		users = make(map[int64]struct{})
+		gate.topics[msg.Topic] = users
+	}
+	users[msg.UserID] = struct{}{}
+	return nil
+}
@@ -8,8 +8,11 @@
 package cluster
 
 import (
+	"context"
+	"fmt"
 	"gogs/base/cluster/network"
 	log "gogs/base/logger"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,6 +32,7 @@ type GateAgent struct {
 	session    network.ISession // 网关会话
 	sessionID  int64            // 网关会话ID
 	userID     int64            // 用户id
+	replaced   int32            // 是否已被新会话替换,替换后关闭时不通知游戏服登出
 }
 
 // newGateAgent 新建网关远程代理
@@ -41,7 +45,7 @@ func newGateAgent(gate *Gate, session network.ISession, sessionID int64) (*GateA
 	}
 	// 网关本地服务的上下文存的这个 GateAgent
 	var err error
-	remote.service, err = gate.builder.NewService(session.Name(), gateID, remote)
+	remote.service, err = newService(gate.builder, gate.Middlewares, session.Name(), gateID, remote)
 	return remote, err
 }
 
@@ -59,14 +63,20 @@ func (agent *GateAgent) Session() network.ISession {
 	return agent.session
 }
 
+// Middlewares implements IMiddlewareAgent
+func (agent *GateAgent) Middlewares() *Middlewares {
+	return agent.Gate.Middlewares
+}
+
 // Post implements IAgent
 func (agent *GateAgent) Post(service IService, call *network.Call) error {
 	return agent.Gate.Post(agent.session, call)
 }
 
 // Wait implements IAgent
-func (agent *GateAgent) Wait(service IService, call *network.Call, timeout time.Duration) (Future, error) {
-	return agent.Gate.Wait(agent.session, call, timeout)
+func (agent *GateAgent) Wait(ctx context.Context, service IService, call *network.Call, timeout time.Duration,
+	complete func(result *ReturnVal)) error {
+	return agent.Gate.Wait(ctx, agent.session, call, timeout, complete)
 }
 
 // Write implements IAgent
@@ -78,6 +88,10 @@ func (agent *GateAgent) Write(msg *network.Message) error {
 func (agent *GateAgent) SessionStatusChanged(status network.SessionStatus) {
 	if status == network.SessionStatusClosed && agent.gameServer != nil {
 		agent.Gate.sessionStatusChanged(agent, status)
+		if atomic.LoadInt32(&agent.replaced) == 1 {
+			log.Infof("replaced session: %s closed, user: %d", agent.session, agent.userID)
+			return
+		}
 		rProxyMsg := &UserLoginNtf{
 			UserID:    agent.userID,
 			SessionID: agent.sessionID,
@@ -87,6 +101,14 @@ func (agent *GateAgent) SessionStatusChanged(status network.SessionStatus) {
 	}
 }
 
+// traceCaller 客户端调用的发起方身份,登录后为用户ID,否则为会话名
+func (agent *GateAgent) traceCaller() string {
+	if agent.gameServer != nil {
+		return fmt.Sprintf("user:%d@%s", agent.userID, TraceCaller())
+	}
+	return fmt.Sprintf("%s@%s", agent.session.Name(), TraceCaller())
+}
+
 // Read implements network.ISessionHandler
 func (agent *GateAgent) Read(session network.ISession, msg *network.Message) {
 	switch msg.Type {
@@ -104,16 +126,19 @@ func (agent *GateAgent) handleCall(data []byte) {
 		log.Warnf("unmarshal call from %s err: %s", agent.session, err)
 		return
 	}
-	log.Infof("handle rpc call id: %d serviceID: %d methodID: %d from %s",
-		call.ID, call.ServiceID, call.MethodID, agent.session)
+	// 客户端的追踪头不可信,由网关重建并填写发起方身份
+	call.Header = clientTraceHeader(call.Header, agent.traceCaller())
+	log.Infof("handle rpc call id: %d serviceID: %d methodID: %d from %s trace: %s",
+		call.ID, call.ServiceID, call.MethodID, agent.session, Traceparent(call.Header))
 	switch ID(call.ServiceID) {
 	case gateID:
+		// 客户端的时钟不可信,不使用其期限
+		call.Deadline = 0
 		var callReturn *network.Return
-		callReturn, err = agent.service.Call(call)
+		callReturn, err = agent.Gate.serveCall(agent.service, call, nil)
 		if err != nil {
 			log.Warnf("handle rpc call id: %d serviceID: %d methodID: %d from %s err: %s",
 				call.ID, call.ServiceID, call.MethodID, agent.session, err)
-			return
 		}
 		if callReturn == nil {
 			return
@@ -130,11 +155,16 @@ func (agent *GateAgent) handleCall(data []byte) {
 			return
 		}
 	case gameID:
+		if atomic.LoadInt32(&agent.replaced) == 1 {
+			log.Infof("call %v from a replaced session: %s", call, agent.session)
+			return
+		}
 		if agent.gameServer != nil {
 			tunnelMsg := &TunnelMsg{
 				UserID: agent.userID,
 				Type:   network.MessageTypeCall,
-				Data:   data,
+				Data:   call.Marshal(),
+				Header: call.Header,
 			}
 			err = agent.gameServer.Tunnel(tunnelMsg)
 			if err != nil {
@@ -153,7 +183,7 @@ func (agent *GateAgent) handleCall(data []byte) {
 // handleReturn 处理对远程服务的调用返回
 func (agent *GateAgent) handleReturn(data []byte) {
 	gameServer := agent.gameServer
-	if gameServer == nil {
+	if gameServer == nil || atomic.LoadInt32(&agent.replaced) == 1 {
 		return
 	}
 	tunnelMsg := &TunnelMsg{
@@ -8,10 +8,12 @@
 package cluster
 
 import (
+	"context"
 	"gogs/base/cberrors"
 	"gogs/base/cluster/network"
 	"gogs/base/config"
 	log "gogs/base/logger"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -28,42 +30,56 @@ type Host struct {
 	neighbors               map[string]*Neighbor            // 集群中的邻居集合,通过Session.Name索引
 	localServiceMutex       sync.RWMutex                    // 本地服务集合 读写锁
 	localServices           map[ID]IService                 // 本地服务集合,通过ID索引
+	localCalls              map[ID]*sync.WaitGroup          // 本地服务进行中的集群调用,通过ID索引,移除服务时等待
 	builderMutex            sync.RWMutex                    // 服务构造器集合 读写锁
 	builders                map[string]IServiceBuilder      // 服务构造器集合,通过ServiceType索引
 	localServiceEvents      chan *eventServiceStatusChanged // 本地服务状态变更事件通道
 	registryExit            chan struct{}                   // 关闭服务注册的信号
+	registry                *registry                       // 已发布的本地服务注册表
 }
 
-// NewHost 新建集群服务器
-func NewHost(localAddr string) *Host {
+// NewHost 新建集群服务器,transport为nil时使用tcp
+func NewHost(localAddr string, transport network.ITransport) *Host {
 	host := &Host{
 		RPC:                    NewRPC(),
 		ServiceStatusPublisher: NewServiceStatusPublisher(),
 		Node:                   network.NewNode(),
 		localServices:          make(map[ID]IService),
+		localCalls:             make(map[ID]*sync.WaitGroup),
 		neighbors:              make(map[string]*Neighbor),
 		builders:               make(map[string]IServiceBuilder),
 		localServiceEvents:     make(chan *eventServiceStatusChanged),
 		registryExit:           make(chan struct{}, 1),
+		registry:               newRegistry(),
 	}
 	_ = host.Node.NewDriver(
 		network.NewHostDriver(
 			localAddr,
 			func(session network.ISession) (network.ISessionHandler, error) {
 				return NewClusterRemote(host, session), nil
-			}))
+			},
+			transport))
 
+	// 启动定时器,定时向邻居节点注册服务,并发送注册表摘要
+	host.wg.Add(1)
 	go func() {
-		// 启动定时器,定时向邻居节点注册服务
-		host.wg.Add(1)
+		defer host.wg.Done()
 		ticker := time.Tick(config.ClusterRegistryInterval())
-		for range ticker {
-			if !host.tryServiceRegistry() {
-				break
+		var digest <-chan time.Time
+		if interval := config.ClusterRegistryDigest(); interval > 0 {
+			digest = time.Tick(interval)
+		}
+		for {
+			select {
+			case <-ticker:
+				if !host.tryServiceRegistry() {
+					log.Debug("Host service registry ticker exit")
+					return
+				}
+			case <-digest:
+				host.sendDigest()
 			}
 		}
-		log.Debug("Host service registry ticker exit")
-		host.wg.Done()
 	}()
 	return host
 }
@@ -111,23 +127,7 @@ DoRegistry:
 		}
 		content = append(content, registry)
 	}
-	srd := &network.ServiceRegistryData{
-		Data: content,
-	}
-	data := srd.Marshal()
-	msg := &network.Message{
-		Type: network.MessageTypeRegistry,
-		Data: data,
-	}
-	host.neighborMutex.RLock()
-	defer host.neighborMutex.RUnlock()
-	for _, neighbor := range host.neighbors {
-		err := neighbor.agent.Write(msg)
-		if err != nil {
-			log.Errorf("neighbors agent write msg err: %s", err)
-		}
-	}
-	log.Info("Host service registry data sent")
+	host.publish(content)
 	return true
 }
 
@@ -141,79 +141,17 @@ func (host *Host) newID() ID {
 	}
 }
 
-// handleServiceRegistry 处理来自邻居节点的服务注册消息
-func (host *Host) handleServiceRegistry(remote *HostAgent, srd *network.ServiceRegistryData) {
-	host.neighborMutex.Lock()
-	defer host.neighborMutex.Unlock()
-	if neighbor, ok := host.neighbors[remote.Name()]; ok {
-		for _, registry := range srd.Data {
-			if registry.Add {
-				// 服务注册
-				if service, ok := neighbor.services[registry.ServiceName]; ok {
-					if service.RemoteID() != ID(registry.ServiceID) || service.Type() != registry.ServiceType {
-						delete(neighbor.services, registry.ServiceName)
-						delete(neighbor.servicesByID, service.RemoteID())
-						host.ServiceStatusChanged(service, network.ServiceStatusOffline)
-					} else {
-						continue
-					}
-				}
-				host.builderMutex.RLock()
-				builder, ok := host.builders[registry.ServiceType]
-				host.builderMutex.RUnlock()
-				if ok {
-					remoteService := builder.NewRemoteService(
-						remote, registry.ServiceName, host.newID(), ID(registry.ServiceID), nil,
-					)
-					neighbor.services[registry.ServiceName] = remoteService
-					neighbor.servicesByID[remoteService.RemoteID()] = remoteService
-					host.ServiceStatusChanged(remoteService, network.ServiceStatusOnline)
-					continue
-				}
-			} else {
-				// 服务注销
-				if service, ok := neighbor.services[registry.ServiceName]; ok {
-					if service.RemoteID() == ID(registry.ServiceID) && service.Type() == registry.ServiceType {
-						delete(neighbor.services, registry.ServiceName)
-						delete(neighbor.servicesByID, service.RemoteID())
-						host.ServiceStatusChanged(service, network.ServiceStatusOffline)
-					}
-				}
-			}
-		}
-	}
-}
-
 // sessionStatusChanged 会话状态变更
 func (host *Host) sessionStatusChanged(remote *HostAgent, status network.SessionStatus) {
 	switch status {
 	case network.SessionStatusInConnected, network.SessionStatusOutConnected:
-		// 邻居节点连接成功
+		// 邻居节点连接成功,在注册表锁内加入邻居并发送全量快照,之后的增量都排在快照之后
+		host.registry.Lock()
 		host.neighborMutex.Lock()
 		host.neighbors[remote.Name()] = NewNeighbor(remote)
 		host.neighborMutex.Unlock()
-		// 向邻居节点注册本地服务
-		var content []*network.ServiceRegistry
-		host.localServiceMutex.RLock()
-		for _, service := range host.localServices {
-			registry := &network.ServiceRegistry{
-				Add:         true,
-				ServiceID:   uint32(service.ID()),
-				ServiceType: service.Type(),
-				ServiceName: service.Name(),
-			}
-			content = append(content, registry)
-		}
-		host.localServiceMutex.RUnlock()
-		srd := &network.ServiceRegistryData{
-			Data: content,
-		}
-		data := srd.Marshal()
-		msg := &network.Message{
-			Type: network.MessageTypeRegistry,
-			Data: data,
-		}
-		err := remote.Write(msg)
+		err := remote.Write(host.snapshotLocked())
+		host.registry.Unlock()
 		if err != nil {
 			log.Errorf("agent:%s  write msg err: %s", remote, err)
 		}
@@ -227,12 +165,19 @@ func (host *Host) sessionStatusChanged(remote *HostAgent, status network.Session
 
 // handleCall 处理来自对本地服务的调用
 func (host *Host) handleCall(call *network.Call) (*network.Return, error) {
+	// 持有读锁时计入进行中的调用,调用期间不持有锁,处理函数可以新建和移除服务
 	host.localServiceMutex.RLock()
-	defer host.localServiceMutex.RUnlock()
-	if service, ok := host.localServices[ID(call.ServiceID)]; ok {
-		return service.Call(call)
+	service, ok := host.localServices[ID(call.ServiceID)]
+	calls := host.localCalls[ID(call.ServiceID)]
+	if ok {
+		calls.Add(1)
+	}
+	host.localServiceMutex.RUnlock()
+	if !ok {
+		return ErrorReturn(call, ErrUnknownService), cberrors.New("local service not found: %d", call.ServiceID)
 	}
-	return nil, cberrors.New("local service not found: %d", call.ServiceID)
+	defer calls.Done()
+	return host.serveCall(service, call, nil)
 }
 
 // RegisterBuilder 注册服务构造器
@@ -286,12 +231,17 @@ func (host *Host) NewService(serviceType string, name string, context interface{
 	if !ok {
 		return nil, cberrors.New("service builder not found for type: %s", serviceType)
 	}
-	service, err := builder.NewService(name, host.newID(), context)
+	service, err := newService(builder, host.Middlewares, name, host.newID(), context)
 	if err != nil {
 		return nil, err
 	}
+	// 启动成功后才加入本地服务并公布上线
+	if err = startService(service); err != nil {
+		return nil, cberrors.New("start service: %s failed: %v", name, err)
+	}
 	host.localServiceMutex.Lock()
 	host.localServices[service.ID()] = service
+	host.localCalls[service.ID()] = &sync.WaitGroup{}
 	host.localServiceMutex.Unlock()
 	host.localServiceEvents <- &eventServiceStatusChanged{
 		service: service,
@@ -302,6 +252,151 @@ func (host *Host) NewService(serviceType string, name string, context interface{
 	return service, nil
 }
 
+// RemoveService 下线并移除指定名字的本地服务,等待进行中的调用结束后调用服务的停止钩子
+func (host *Host) RemoveService(name string) error {
+	host.localServiceMutex.RLock()
+	var found IService
+	for _, service := range host.localServices {
+		if service.Name() == name {
+			found = service
+			break
+		}
+	}
+	host.localServiceMutex.RUnlock()
+	if found == nil {
+		return cberrors.New("local service not found: %s", name)
+	}
+	return host.removeService(found)
+}
+
+// removeService 移除并下线本地服务,然后停止服务
+func (host *Host) removeService(service IService) error {
+	// 移除后的调用找不到服务,之前的调用已计入进行中的调用
+	host.localServiceMutex.Lock()
+	_, ok := host.localServices[service.ID()]
+	calls := host.localCalls[service.ID()]
+	delete(host.localServices, service.ID())
+	delete(host.localCalls, service.ID())
+	host.localServiceMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	host.localServiceEvents <- &eventServiceStatusChanged{
+		service: service,
+		status:  network.ServiceStatusOffline,
+	}
+	host.ServiceStatusChanged(service, network.ServiceStatusOffline)
+	log.Infof("local service offline name: %s, type: %s, id: %d", service.Name(), service.Type(), service.ID())
+	// 等待进行中的调用结束,最长等待config.ServiceTimeout,处理函数移除自身时不会死锁
+	drained := make(chan struct{})
+	go func() {
+		calls.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(config.ServiceTimeout()):
+		log.Warnf("local service: %s calls not drained in %s", service.Name(), config.ServiceTimeout())
+	}
+	if err := stopService(service); err != nil {
+		return cberrors.New("stop service: %s failed: %v", service.Name(), err)
+	}
+	return nil
+}
+
+// startService 调用服务的启动钩子,最长等待config.ServiceTimeout
+func startService(service IService) error {
+	starter, ok := service.(IServiceStarter)
+	if !ok {
+		return nil
+	}
+	return runHook(starter.Start)
+}
+
+// stopService 调用服务的停止钩子,最长等待config.ServiceTimeout
+func stopService(service IService) error {
+	stopper, ok := service.(IServiceStopper)
+	if !ok {
+		return nil
+	}
+	return runHook(stopper.Stop)
+}
+
+// runHook 执行生命周期钩子,钩子忽略ctx时超时也会返回
+func runHook(hook func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.ServiceTimeout())
+	defer cancel()
+	_, err := Async(func() (struct{}, error) {
+		return struct{}{}, hook(ctx)
+	}).Wait(ctx, config.ServiceTimeout())
+	return err
+}
+
+// hasLocalService 本地是否有指定名字的服务
+func (host *Host) hasLocalService(name string) bool {
+	host.localServiceMutex.RLock()
+	defer host.localServiceMutex.RUnlock()
+	for _, service := range host.localServices {
+		if service.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalServices 本地服务信息,按ID排序
+func (host *Host) LocalServices() []*ServiceInfo {
+	host.localServiceMutex.RLock()
+	infos := make([]*ServiceInfo, 0, len(host.localServices))
+	for _, service := range host.localServices {
+		infos = append(infos, newServiceInfo(service))
+	}
+	host.localServiceMutex.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Neighbors 邻居节点信息及其上的远程服务,按名字排序
+func (host *Host) Neighbors() []*NeighborInfo {
+	host.neighborMutex.RLock()
+	infos := make([]*NeighborInfo, 0, len(host.neighbors))
+	for name, neighbor := range host.neighbors {
+		session := neighbor.agent.Session()
+		info := &NeighborInfo{
+			Name:     name,
+			Status:   session.Status().String(),
+			RTT:      session.RTT().String(),
+			Services: make([]*ServiceInfo, 0, len(neighbor.services)),
+		}
+		for _, service := range neighbor.services {
+			info.Services = append(info.Services, newServiceInfo(service))
+		}
+		sort.Slice(info.Services, func(i, j int) bool {
+			return info.Services[i].Name < info.Services[j].Name
+		})
+		infos = append(infos, info)
+	}
+	host.neighborMutex.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// Builders 已注册的服务构造器类型,按名字排序
+func (host *Host) Builders() []string {
+	host.builderMutex.RLock()
+	types := make([]string, 0, len(host.builders))
+	for serviceType := range host.builders {
+		types = append(types, serviceType)
+	}
+	host.builderMutex.RUnlock()
+	sort.Strings(types)
+	return types
+}
+
 // NewLocalService 新建本地服务
 func (host *Host) NewLocalService(serviceType string, name string) (IService, error) {
 	return host.NewService(serviceType, name, nil)
@@ -312,14 +407,40 @@ func (host *Host) Close() {
 	host.AllLocalServiceOffline()
 	host.registryExit <- struct{}{}
 	host.wg.Wait()
+	// 等待进行中的远程调用返回后关闭网络层
+	if !host.WaitPending(config.ShutdownTimeout()) {
+		log.Warnf("host close wait pending rpc timeout, pending: %d", host.Pending())
+	}
+	host.Node.Close()
 }
 
-// AllLocalServiceOffline 关闭所有本地服务
+// AllLocalServiceOffline 关闭所有本地服务,按启动的相反顺序下线并停止,等待全部停止后返回
 func (host *Host) AllLocalServiceOffline() {
+	host.localServiceMutex.RLock()
+	services := make([]IService, 0, len(host.localServices))
+	for _, service := range host.localServices {
+		services = append(services, service)
+	}
+	host.localServiceMutex.RUnlock()
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].ID() > services[j].ID()
+	})
+	for _, service := range services {
+		if err := host.removeService(service); err != nil {
+			log.Errorf("local service offline error: %v", err)
+		}
+	}
+}
+
+// Health 本地服务中最差的健康状态
+func (host *Host) Health() HealthStatus {
+	host.localServiceMutex.RLock()
+	defer host.localServiceMutex.RUnlock()
+	status := HealthStatusHealthy
 	for _, service := range host.localServices {
-		host.localServiceEvents <- &eventServiceStatusChanged{
-			service: service,
-			status:  network.ServiceStatusOffline,
+		if health := ServiceHealth(service); health > status {
+			status = health
 		}
 	}
+	return status
 }
@@ -8,6 +8,7 @@
 package cluster
 
 import (
+	"context"
 	"gogs/base/cluster/network"
 	log "gogs/base/logger"
 	"time"
@@ -45,14 +46,20 @@ func (agent *HostAgent) Session() network.ISession {
 	return agent.session
 }
 
+// Middlewares implements IMiddlewareAgent
+func (agent *HostAgent) Middlewares() *Middlewares {
+	return agent.Host.Middlewares
+}
+
 // Post implements IAgent
 func (agent *HostAgent) Post(service IService, call *network.Call) error {
 	return agent.Host.Post(agent.session, call)
 }
 
 // Wait implements IAgent
-func (agent *HostAgent) Wait(service IService, call *network.Call, timeout time.Duration) (Future, error) {
-	return agent.Host.Wait(agent.session, call, timeout)
+func (agent *HostAgent) Wait(ctx context.Context, service IService, call *network.Call, timeout time.Duration,
+	complete func(result *ReturnVal)) error {
+	return agent.Host.Wait(ctx, agent.session, call, timeout, complete)
 }
 
 // Write implements IAgent
@@ -69,8 +76,12 @@ func (agent *HostAgent) SessionStatusChanged(status network.SessionStatus) {
 func (agent *HostAgent) Read(session network.ISession, msg *network.Message) {
 	switch msg.Type {
 	case network.MessageTypeRegistry:
-		// 处理来自邻居节点的服务状态变更通知
-		go agent.handleServiceRegistry(msg.Data)
+		// 处理来自邻居节点的服务状态变更通知,必须按序处理
+		agent.handleServiceRegistry(msg.Data)
+	case network.MessageTypeRegistrySync:
+		agent.Host.sendSnapshot(agent)
+	case network.MessageTypeRegistryDigest:
+		agent.handleRegistryDigest(msg.Data)
 	case network.MessageTypeCall:
 		go agent.handleCall(msg.Data)
 	case network.MessageTypeReturn:
@@ -83,10 +94,21 @@ func (agent *HostAgent) handleServiceRegistry(data []byte) {
 	srd, err := network.UnmarshalServiceRegistryData(data)
 	if err != nil {
 		log.Warnf("unmarshal service registry data from %s err: %s", agent.session, err)
+		return
 	}
 	agent.Host.handleServiceRegistry(agent, srd)
 }
 
+// handleRegistryDigest 处理来自邻居节点的服务注册摘要
+func (agent *HostAgent) handleRegistryDigest(data []byte) {
+	digest, err := network.UnmarshalRegistryDigest(data)
+	if err != nil {
+		log.Warnf("unmarshal registry digest from %s err: %s", agent.session, err)
+		return
+	}
+	agent.Host.handleRegistryDigest(agent, digest)
+}
+
 // handleCall 处理来自对本地服务的调用
 func (agent *HostAgent) handleCall(data []byte) {
 	call, err := network.UnmarshalCall(data)
@@ -0,0 +1,188 @@
+// -------------------------------------------
+// @file      : interceptor.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/25 下午4:10
+// -------------------------------------------
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"gogs/base/cluster/network"
+	log "gogs/base/logger"
+	"sync"
+	"time"
+)
+
+// MethodDesc 服务函数的描述,生成代码在init中注册
+type MethodDesc struct {
+	ID         uint32 // 函数ID
+	Name       string // 函数名字
+	OneWay     bool   // 是否没有返回值
+	Idempotent bool   // 是否幂等
+}
+
+var (
+	methodDescs    = make(map[string]map[uint32]*MethodDesc) // 函数描述,服务类型和函数ID索引
+	methodDescLock sync.RWMutex                              // 函数描述读写锁
+)
+
+// RegisterMethods 注册服务类型的函数描述
+func RegisterMethods(serviceType string, methods ...*MethodDesc) {
+	methodDescLock.Lock()
+	defer methodDescLock.Unlock()
+	descs, ok := methodDescs[serviceType]
+	if !ok {
+		descs = make(map[uint32]*MethodDesc)
+		methodDescs[serviceType] = descs
+	}
+	for _, method := range methods {
+		descs[method.ID] = method
+	}
+}
+
+// LookupMethod 查找服务类型的函数描述
+func LookupMethod(serviceType string, methodID uint32) (*MethodDesc, bool) {
+	methodDescLock.RLock()
+	defer methodDescLock.RUnlock()
+	method, ok := methodDescs[serviceType][methodID]
+	return method, ok
+}
+
+// methodName 调用的名字 服务类型#函数名字,函数未注册时使用函数ID
+func methodName(serviceType string, methodID uint32) string {
+	if method, ok := LookupMethod(serviceType, methodID); ok {
+		return serviceType + "#" + method.Name
+	}
+	return fmt.Sprintf("%s#%d", serviceType, methodID)
+}
+
+// CallInfo 拦截器获取的调用信息
+type CallInfo struct {
+	ServiceType string        // 服务类型
+	ServiceName string        // 服务名字
+	MethodID    uint32        // 函数ID
+	Method      string        // 函数名字,未注册时为空
+	OneWay      bool          // 是否没有返回值
+	Params      [][]byte      // 序列化后的参数
+	Caller      string        // 调用方 服务器类型:服务器ID,服务端取自追踪头,客户端为本进程
+	Start       time.Time     // 开始时间
+	Duration    time.Duration // 耗时,next返回后填写
+	Call        *network.Call // 调用
+}
+
+// String implements fmt.Stringer
+func (info *CallInfo) String() string {
+	if info.Method != "" {
+		return fmt.Sprintf("%s#%s", info.ServiceType, info.Method)
+	}
+	return fmt.Sprintf("%s#%d", info.ServiceType, info.MethodID)
+}
+
+// newCallInfo 新建调用信息
+func newCallInfo(service IService, call *network.Call, caller string) *CallInfo {
+	info := &CallInfo{
+		ServiceType: service.Type(),
+		ServiceName: service.Name(),
+		MethodID:    call.MethodID,
+		Params:      call.Params,
+		Caller:      caller,
+		Start:       time.Now(),
+		Call:        call,
+	}
+	if method, ok := LookupMethod(info.ServiceType, call.MethodID); ok {
+		info.Method = method.Name
+		info.OneWay = method.OneWay
+	}
+	return info
+}
+
+// ServerInterceptor 服务端拦截器,包装每一个本地服务的调用,调用next继续处理
+type ServerInterceptor func(info *CallInfo, next func() (*network.Return, error)) (*network.Return, error)
+
+// ClientInterceptor 客户端拦截器,包装每一个发出的调用,调用next继续发送
+type ClientInterceptor func(ctx context.Context, info *CallInfo,
+	next func(ctx context.Context) (*network.Return, error)) (*network.Return, error)
+
+// ServerInterceptorMiddleware 将服务端拦截器转换为服务端中间件
+func ServerInterceptorMiddleware(interceptor ServerInterceptor) ServerMiddleware {
+	return func(next Handler) Handler {
+		return func(service IService, call *network.Call) (*network.Return, error) {
+			var caller string
+			if call.Header != nil {
+				caller = call.Header.Caller
+			}
+			info := newCallInfo(service, call, caller)
+			return interceptor(info, func() (*network.Return, error) {
+				callReturn, err := next(service, call)
+				info.Duration = time.Since(info.Start)
+				return callReturn, err
+			})
+		}
+	}
+}
+
+// ClientInterceptorMiddleware 将客户端拦截器转换为客户端中间件
+func ClientInterceptorMiddleware(interceptor ClientInterceptor) ClientMiddleware {
+	return func(next Invoker) Invoker {
+		return func(ctx context.Context, service IRemoteService, call *network.Call, opts *CallOptions) (*network.Return, error) {
+			info := newCallInfo(service, call, TraceCaller())
+			info.OneWay = opts.OneWay
+			return interceptor(ctx, info, func(ctx context.Context) (*network.Return, error) {
+				callReturn, err := next(ctx, service, call, opts)
+				info.Duration = time.Since(info.Start)
+				return callReturn, err
+			})
+		}
+	}
+}
+
+// UseServerInterceptor 注册服务端拦截器,在默认的指标、恢复、限流和日志拦截器之后按注册顺序由外向内执行
+func (middlewares *Middlewares) UseServerInterceptor(interceptors ...ServerInterceptor) {
+	for _, interceptor := range interceptors {
+		middlewares.UseServerMiddleware(ServerInterceptorMiddleware(interceptor))
+	}
+}
+
+// UseClientInterceptor 注册客户端拦截器,在默认的指标、重试、熔断和隔离中间件之后按注册顺序由外向内执行
+func (middlewares *Middlewares) UseClientInterceptor(interceptors ...ClientInterceptor) {
+	for _, interceptor := range interceptors {
+		middlewares.UseClientMiddleware(ClientInterceptorMiddleware(interceptor))
+	}
+}
+
+// RecoveryInterceptor 将处理函数的崩溃转换为错误,有返回值的函数将错误返回给调用方
+func RecoveryInterceptor(info *CallInfo, next func() (*network.Return, error)) (callReturn *network.Return, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = PanicError(e)
+			log.Errorf("%s from %s panic: %v", info, info.Caller, e)
+			if !info.OneWay {
+				callReturn = ErrorReturn(info.Call, err)
+			}
+		}
+	}()
+	return next()
+}
+
+// LogInterceptor 记录处理失败的调用
+func LogInterceptor(info *CallInfo, next func() (*network.Return, error)) (*network.Return, error) {
+	callReturn, err := next()
+	if err != nil {
+		log.Errorf("%s from %s err: %s", info, info.Caller, err)
+	}
+	return callReturn, err
+}
+
+// SlowCallInterceptor 记录处理时间超过threshold的调用
+func SlowCallInterceptor(threshold time.Duration) ServerInterceptor {
+	return func(info *CallInfo, next func() (*network.Return, error)) (*network.Return, error) {
+		callReturn, err := next()
+		if info.Duration > threshold {
+			log.Warnf("slow call %s on %s from %s cost: %s", info, info.ServiceName, info.Caller, info.Duration)
+		}
+		return callReturn, err
+	}
+}
@@ -0,0 +1,115 @@
+// -------------------------------------------
+// @file      : kick_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/7 上午10:30
+// -------------------------------------------
+
+package cluster
+
+import (
+	"gogs/base/cluster/network"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closeSession 测试用的会话,记录是否被关闭
+type closeSession struct {
+	recordSession
+	closed chan struct{}
+}
+
+func (session *closeSession) Close() {
+	close(session.closed)
+}
+
+// logoutRecorder 测试用的游戏服,记录登出的会话
+type logoutRecorder struct {
+	sync.Mutex
+	logouts []int64
+}
+
+func (game *logoutRecorder) Login(ntf *UserLoginNtf, ci *ClientInfo) (int64, Err, error) {
+	return ntf.UserID, ErrOK, nil
+}
+
+func (game *logoutRecorder) Logout(ntf *UserLoginNtf) error {
+	game.Lock()
+	defer game.Unlock()
+	game.logouts = append(game.logouts, ntf.SessionID)
+	return nil
+}
+
+func (game *logoutRecorder) Tunnel(msg *TunnelMsg) error {
+	return nil
+}
+
+func (game *logoutRecorder) count() int {
+	game.Lock()
+	defer game.Unlock()
+	return len(game.logouts)
+}
+
+func TestGateKickSession(t *testing.T) {
+	initTestConfig()
+	gate := &Gate{
+		name:   "Gate:1",
+		agents: make(map[int64]*GateAgent),
+		topics: make(map[string]map[int64]struct{}),
+	}
+	game := &logoutRecorder{}
+	newAgent := func(sessionID int64) *GateAgent {
+		session := &closeSession{recordSession: recordSession{name: "session"}, closed: make(chan struct{})}
+		return &GateAgent{Gate: gate, session: session, sessionID: sessionID, userID: 7, gameServer: game}
+	}
+	waitClosed := func(agent *GateAgent) {
+		t.Helper()
+		select {
+		case <-agent.session.(*closeSession).closed:
+		case <-time.After(time.Second):
+			t.Fatalf("session: %d not closed", agent.sessionID)
+		}
+	}
+	first := newAgent(1)
+	gate.sessionStatusChanged(first, network.SessionStatusInConnected)
+
+	// 会话不一致时说明旧会话已经关闭,忽略
+	if err := gate.KickSession(&KickMsg{UserID: 7, SessionID: 2, Reason: network.KickReasonDuplicateLogin}); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&first.replaced) != 0 {
+		t.Fatal("mismatched session kicked")
+	}
+
+	// 同一网关上重复登录,旧会话被踢掉,关闭时不删除新会话也不登出
+	second := newAgent(2)
+	gate.sessionStatusChanged(second, network.SessionStatusInConnected)
+	waitClosed(first)
+	first.SessionStatusChanged(network.SessionStatusClosed)
+	if gate.agents[7] != second {
+		t.Fatal("new session removed by replaced session")
+	}
+	if n := game.count(); n != 0 {
+		t.Fatalf("replaced session logout: %d", n)
+	}
+
+	// 在其他网关登录后,游戏服通知踢掉旧会话
+	if err := gate.KickSession(&KickMsg{UserID: 7, SessionID: 2, Reason: network.KickReasonDuplicateLogin}); err != nil {
+		t.Fatal(err)
+	}
+	waitClosed(second)
+	second.SessionStatusChanged(network.SessionStatusClosed)
+	if _, ok := gate.agents[7]; ok || game.count() != 0 {
+		t.Fatalf("kicked session not removed or logout: %d", game.count())
+	}
+
+	// 正常断线时登出
+	third := newAgent(3)
+	gate.sessionStatusChanged(third, network.SessionStatusInConnected)
+	third.SessionStatusChanged(network.SessionStatusClosed)
+	if n := game.count(); n != 1 {
+		t.Fatalf("logout count: %d", n)
+	}
+}
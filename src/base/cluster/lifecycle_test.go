@@ -0,0 +1,230 @@
+// -------------------------------------------
+// @file      : lifecycle_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/4 上午10:20
+// -------------------------------------------
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"gogs/base/cluster/network"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lifecycleService 测试用的带生命周期钩子的服务
+type lifecycleService struct {
+	testService
+	builder *lifecycleBuilder
+	health  HealthStatus
+}
+
+func (service *lifecycleService) Start(ctx context.Context) error {
+	if service.name == "Fail" {
+		return errors.New("start failed")
+	}
+	service.builder.record("start:" + service.name)
+	return nil
+}
+
+func (service *lifecycleService) Stop(ctx context.Context) error {
+	service.builder.record("stop:" + service.name)
+	return nil
+}
+
+func (service *lifecycleService) Health() HealthStatus {
+	return service.health
+}
+
+// lifecycleBuilder 测试用的服务构造器,记录钩子的调用顺序
+type lifecycleBuilder struct {
+	sync.Mutex
+	events []string
+}
+
+func (builder *lifecycleBuilder) ServiceType() string { return "Lifecycle" }
+
+func (builder *lifecycleBuilder) NewService(name string, id ID, context interface{}) (IService, error) {
+	service := &lifecycleService{testService: testService{typename: "Lifecycle", name: name, id: id}, builder: builder}
+	if health, ok := context.(HealthStatus); ok {
+		service.health = health
+	}
+	return service, nil
+}
+
+func (builder *lifecycleBuilder) NewRemoteService(remote IAgent, name string, lid ID, rid ID, context interface{}) IRemoteService {
+	return &testService{typename: "Lifecycle", name: name, id: lid, remoteID: rid, agent: remote}
+}
+
+func (builder *lifecycleBuilder) record(event string) {
+	builder.Lock()
+	defer builder.Unlock()
+	builder.events = append(builder.events, event)
+}
+
+// take 记录的事件,并清空记录
+func (builder *lifecycleBuilder) take() []string {
+	builder.Lock()
+	defer builder.Unlock()
+	events := builder.events
+	builder.events = nil
+	return events
+}
+
+func TestServiceLifecycle(t *testing.T) {
+	initTestConfig()
+	transport := network.NewMemoryTransport()
+	a := NewHost("a:1", transport)
+	b := NewHost("b:1", transport)
+	defer b.Close()
+	builder := &lifecycleBuilder{}
+	for _, host := range []*Host{a, b} {
+		if _, err := host.RegisterBuilder(builder); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "a listening", func() bool {
+		_, err := b.Connect("a:1")
+		return err == nil
+	})
+
+	// 启动失败的服务不会上线
+	if _, err := a.NewService("Lifecycle", "Fail", nil); err == nil || a.hasLocalService("Fail") {
+		t.Fatal("service online after start failed")
+	}
+	for _, name := range []string{"A", "B"} {
+		if _, err := a.NewService("Lifecycle", name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.NewService("Lifecycle", "C", HealthStatusDegraded); err != nil {
+		t.Fatal(err)
+	}
+	if events := builder.take(); !reflect.DeepEqual(events, []string{"start:A", "start:B", "start:C"}) {
+		t.Fatalf("unexpected start events: %v", events)
+	}
+	if status := a.Health(); status != HealthStatusDegraded {
+		t.Fatalf("unexpected host health: %s", status)
+	}
+	waitFor(t, "b sees remote services", func() bool {
+		return remoteOnline(b, "A") && remoteOnline(b, "B") && remoteOnline(b, "C")
+	})
+
+	// 移除服务时下线并停止
+	if err := a.RemoveService("C"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RemoveService("C"); err == nil {
+		t.Fatal("removed unknown service")
+	}
+	if events := builder.take(); !reflect.DeepEqual(events, []string{"stop:C"}) {
+		t.Fatalf("unexpected stop events: %v", events)
+	}
+	if status := a.Health(); status != HealthStatusHealthy {
+		t.Fatalf("unexpected host health: %s", status)
+	}
+	waitFor(t, "b drops removed service", func() bool { return !remoteOnline(b, "C") })
+
+	// 关闭时按启动的相反顺序停止
+	a.Close()
+	if events := builder.take(); !reflect.DeepEqual(events, []string{"stop:B", "stop:A"}) {
+		t.Fatalf("unexpected close events: %v", events)
+	}
+	if len(a.LocalServices()) != 0 {
+		t.Fatal("local services alive after close")
+	}
+}
+
+// drainService 测试用的服务,调用中新建服务后阻塞到release关闭,记录是否已停止
+type drainService struct {
+	blockService
+	builder *drainBuilder
+	stopped int32
+}
+
+func (service *drainService) Call(call *network.Call) (*network.Return, error) {
+	service.builder.entered <- struct{}{}
+	if _, err := service.builder.host.NewService("Lifecycle", "Nested", nil); err != nil {
+		return nil, err
+	}
+	return service.blockService.Call(call)
+}
+
+func (service *drainService) Stop(ctx context.Context) error {
+	atomic.StoreInt32(&service.stopped, 1)
+	return nil
+}
+
+type drainBuilder struct {
+	testBuilder
+	host    *Host
+	entered chan struct{}
+	release chan struct{}
+	service *drainService
+}
+
+func (builder *drainBuilder) NewService(name string, id ID, context interface{}) (IService, error) {
+	builder.service = &drainService{blockService: blockService{
+		testService: testService{typename: builder.ServiceType(), name: name, id: id},
+		release:     builder.release,
+	}, builder: builder}
+	return builder.service, nil
+}
+
+func TestRemoveServiceDrainsCalls(t *testing.T) {
+	initTestConfig()
+	host := NewHost("drain:1", network.NewMemoryTransport())
+	defer host.Close()
+	builder := &drainBuilder{testBuilder: "Drain", host: host, entered: make(chan struct{}, 1), release: make(chan struct{})}
+	for _, b := range []IServiceBuilder{builder, &lifecycleBuilder{}} {
+		if _, err := host.RegisterBuilder(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service, err := host.NewService("Drain", "Drain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		_, err := host.handleCall(&network.Call{ID: 1, ServiceID: uint32(service.ID())})
+		served <- err
+	}()
+	<-builder.entered
+	// 处理调用时不持有服务集合的锁,可以新建服务
+	waitFor(t, "nested service online", func() bool { return host.hasLocalService("Nested") })
+
+	removed := make(chan error, 1)
+	go func() {
+		removed <- host.RemoveService("Drain")
+	}()
+	waitFor(t, "service removed", func() bool { return !host.hasLocalService("Drain") })
+	// 移除后的调用找不到服务,进行中的调用结束前不停止服务
+	if _, err = host.handleCall(&network.Call{ID: 2, ServiceID: uint32(service.ID())}); err == nil {
+		t.Fatal("call served by removed service")
+	}
+	select {
+	case err = <-removed:
+		t.Fatalf("removed before call finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if atomic.LoadInt32(&builder.service.stopped) != 0 {
+		t.Fatal("service stopped while serving call")
+	}
+	close(builder.release)
+	if err = <-served; err != nil {
+		t.Fatal(err)
+	}
+	if err = <-removed; err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&builder.service.stopped) != 1 {
+		t.Fatal("service not stopped after calls drained")
+	}
+}
@@ -0,0 +1,296 @@
+// -------------------------------------------
+// @file      : membership.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/30 上午10:10
+// -------------------------------------------
+
+package cluster
+
+import (
+	"fmt"
+	"gogs/base/cberrors"
+	"gogs/base/cluster/network"
+	"gogs/base/config"
+	"gogs/base/etcd"
+	log "gogs/base/logger"
+	"time"
+)
+
+// membershipEventCache 成员事件通道大小,通道满时丢弃事件,由定时对账补齐
+const membershipEventCache = 256
+
+// MembershipRules 声明各类型服务器需要主动连接的服务器类型,通过服务器类型索引
+// 被连接的类型需要配置在本地etcd的depList中才能被发现
+type MembershipRules map[string][]string
+
+// DefaultMembershipRules 默认规则,游戏服和登录服连接网关,网关只接受连接
+var DefaultMembershipRules = MembershipRules{
+	etcd.ServerTypeGame:  {etcd.ServerTypeGate},
+	etcd.ServerTypeLogin: {etcd.ServerTypeGate},
+}
+
+// connects 类型from是否声明了连接类型to
+func (rules MembershipRules) connects(from, to string) bool {
+	for _, t := range rules[from] {
+		if t == to {
+			return true
+		}
+	}
+	return false
+}
+
+// peerTypes 与本地类型相互连接的所有类型,dial表示是否由本地主动连接
+func (rules MembershipRules) peerTypes(local string) map[string]bool {
+	types := make(map[string]bool)
+	for _, t := range rules[local] {
+		types[t] = true
+	}
+	for from := range rules {
+		if rules.connects(from, local) && !types[from] {
+			types[from] = false
+		}
+	}
+	return types
+}
+
+// dial 本地是否应主动连接对端,双方互相声明时只由名字较小的一方连接,避免同一对服务器之间同时发起内连和外连
+func (rules MembershipRules) dial(localType, localName, remoteType, remoteName string) bool {
+	if !rules.connects(localType, remoteType) {
+		return false
+	}
+	if rules.connects(remoteType, localType) {
+		return localName < remoteName
+	}
+	return true
+}
+
+// memberName 集群成员名字,与服务器名字格式一致
+func memberName(serverType string, serverID int64) string {
+	return fmt.Sprintf("%s:%d", serverType, serverID)
+}
+
+// IDiscovery 集群成员的发现来源
+type IDiscovery interface {
+	GetDepListByType(t string) ([]etcd.NodeInfo, error) // 获取指定类型的所有节点
+}
+
+// etcdDiscovery 通过全局etcd组件发现成员
+type etcdDiscovery struct{}
+
+// GetDepListByType implements IDiscovery
+func (etcdDiscovery) GetDepListByType(t string) ([]etcd.NodeInfo, error) {
+	if !etcd.IsInit() {
+		return nil, cberrors.New("etcd not init")
+	}
+	return etcd.GetDepListByType(t)
+}
+
+// member 集群成员
+type member struct {
+	serverType string // 服务器类型
+	url        string // 连接地址,同时也是集群会话的名字
+	dial       bool   // 是否由本地主动连接
+}
+
+// Membership 集群成员管理,根据etcd的节点事件维护本地与其他服务器之间的集群会话
+// 按规则主动连接对端,定时与etcd全量对账,补连缺失的会话并关闭已下线节点的会话
+// 外连会话断开后由会话自身的心跳重连,这里只负责会话的创建和关闭
+type Membership struct {
+	host       *Host                // 集群服务器
+	serverType string               // 本地服务器类型
+	name       string               // 本地服务器名字
+	rules      MembershipRules      // 连接规则
+	discovery  IDiscovery           // 成员发现来源
+	handler    etcd.EventHandler    // 额外的节点事件处理器,可以为nil
+	events     chan *etcd.NodeEvent // 节点事件通道
+	members    map[string]*member   // 当前成员,通过成员名字索引,只在事件循环中访问
+	exit       chan struct{}        // 关闭信号
+	done       chan struct{}        // 事件循环退出信号
+}
+
+// NewMembership 新建集群成员管理,需要将OnNodeEvent注册到etcd组件并调用Start启动
+func NewMembership(host *Host, serverType string, serverID int64, rules MembershipRules) *Membership {
+	return &Membership{
+		host:       host,
+		serverType: serverType,
+		name:       memberName(serverType, serverID),
+		rules:      rules,
+		discovery:  etcdDiscovery{},
+		events:     make(chan *etcd.NodeEvent, membershipEventCache),
+		members:    make(map[string]*member),
+		exit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// WithDiscovery 替换成员发现来源
+func (membership *Membership) WithDiscovery(discovery IDiscovery) *Membership {
+	membership.discovery = discovery
+	return membership
+}
+
+// WithHandler 设置额外的节点事件处理器,在etcd组件的回调中同步调用
+func (membership *Membership) WithHandler(handler etcd.EventHandler) *Membership {
+	membership.handler = handler
+	return membership
+}
+
+// OnNodeEvent 节点事件处理器,注册到etcd组件
+// etcd组件持锁回调,这里只把事件投递到事件循环,不能阻塞也不能回查etcd
+func (membership *Membership) OnNodeEvent(event *etcd.NodeEvent) {
+	if membership.handler != nil {
+		membership.handler(event)
+	}
+	select {
+	case membership.events <- event:
+	default:
+		log.Warnf("membership: %s event channel full, drop event: %s node: %v", membership.name, event.Event, event.Node)
+	}
+}
+
+// Start 全量对账一次后启动事件循环
+func (membership *Membership) Start() {
+	go membership.loop()
+}
+
+// Stop 停止事件循环,已建立的会话由集群服务器关闭
+func (membership *Membership) Stop() {
+	close(membership.exit)
+	<-membership.done
+}
+
+// loop 事件循环
+func (membership *Membership) loop() {
+	defer close(membership.done)
+	membership.sync()
+	// 对账间隔为0时只处理事件
+	var tick <-chan time.Time
+	if interval := config.MembershipSync(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case event := <-membership.events:
+			membership.handleEvent(event)
+		case <-tick:
+			membership.sync()
+		case <-membership.exit:
+			return
+		}
+	}
+}
+
+// handleEvent 处理节点事件
+func (membership *Membership) handleEvent(event *etcd.NodeEvent) {
+	if _, ok := membership.rules.peerTypes(membership.serverType)[event.Node.GetType()]; !ok {
+		return
+	}
+	name := memberName(event.Node.GetType(), event.Node.GetID())
+	if name == membership.name {
+		return
+	}
+	switch event.Event {
+	case etcd.EventAdd, etcd.EventUpdate:
+		membership.join(name, &member{
+			serverType: event.Node.GetType(),
+			url:        event.Node.GetConnectURL(),
+			dial:       membership.rules.dial(membership.serverType, membership.name, event.Node.GetType(), name),
+		})
+	case etcd.EventDelete:
+		membership.leave(name)
+	default:
+		log.Errorf("membership: %s unknown etcd event: %+v", membership.name, event)
+	}
+}
+
+// join 成员上线或更新,地址变更时关闭旧地址的会话
+func (membership *Membership) join(name string, m *member) {
+	if old, ok := membership.members[name]; ok && old.url != m.url {
+		membership.closeSession(name, old.url)
+	}
+	membership.members[name] = m
+	if m.dial {
+		membership.connect(name, m.url)
+	}
+}
+
+// leave 成员下线,关闭与其之间的会话,邻居随会话关闭移除
+func (membership *Membership) leave(name string) {
+	m, ok := membership.members[name]
+	if !ok {
+		return
+	}
+	delete(membership.members, name)
+	membership.closeSession(name, m.url)
+}
+
+// sync 与发现来源全量对账,补上漏掉的事件
+// 主动连接的类型发现失败时跳过本次对账,避免误关会话,只接受连接的类型不在depList中时保留已知成员
+func (membership *Membership) sync() {
+	members := make(map[string]*member)
+	for t, dial := range membership.rules.peerTypes(membership.serverType) {
+		nodes, err := membership.discovery.GetDepListByType(t)
+		if err != nil {
+			if dial {
+				log.Warnf("membership: %s discover: %s err: %s", membership.name, t, err)
+				return
+			}
+			for name, m := range membership.members {
+				if m.serverType == t {
+					members[name] = m
+				}
+			}
+			continue
+		}
+		for _, node := range nodes {
+			name := memberName(node.GetType(), node.GetID())
+			if name == membership.name {
+				continue
+			}
+			members[name] = &member{
+				serverType: t,
+				url:        node.GetConnectURL(),
+				dial:       membership.rules.dial(membership.serverType, membership.name, t, name),
+			}
+		}
+	}
+	for name, old := range membership.members {
+		if m, ok := members[name]; !ok || m.url != old.url {
+			membership.closeSession(name, old.url)
+		}
+	}
+	membership.members = members
+	for name, m := range members {
+		if m.dial {
+			membership.connect(name, m.url)
+		}
+	}
+}
+
+// connect 会话不存在时连接成员,已存在的外连会话断开后会自行重连
+func (membership *Membership) connect(name, url string) {
+	if url == "" {
+		log.Warnf("membership: %s member: %s has no connect url", membership.name, name)
+		return
+	}
+	if _, ok := membership.host.Node.GetSession(network.DriverTypeHost, url); ok {
+		return
+	}
+	log.Infof("membership: %s connect member: %s url: %s", membership.name, name, url)
+	if _, err := membership.host.Connect(url); err != nil {
+		log.Errorf("membership: %s connect member: %s url: %s err: %s", membership.name, name, url, err)
+	}
+}
+
+// closeSession 关闭与成员之间的会话,不论内连还是外连
+func (membership *Membership) closeSession(name, url string) {
+	session, ok := membership.host.Node.GetSession(network.DriverTypeHost, url)
+	if !ok {
+		return
+	}
+	log.Infof("membership: %s close member: %s session: %s", membership.name, name, session)
+	session.Close()
+}
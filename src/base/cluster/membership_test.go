@@ -0,0 +1,152 @@
+// -------------------------------------------
+// @file      : membership_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/30 下午2:40
+// -------------------------------------------
+
+package cluster
+
+import (
+	"gogs/base/cberrors"
+	"gogs/base/cluster/network"
+	"gogs/base/config"
+	"gogs/base/etcd"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDiscovery 以类型索引节点列表的成员发现来源,不存在的类型视为不在depList中
+type fakeDiscovery map[string][]etcd.NodeInfo
+
+func (discovery fakeDiscovery) GetDepListByType(t string) ([]etcd.NodeInfo, error) {
+	nodes, ok := discovery[t]
+	if !ok {
+		return nil, cberrors.New("dependence not found. type:%s", t)
+	}
+	return nodes, nil
+}
+
+func newNodeInfo(serverType string, serverID int64, addr string) etcd.NodeInfo {
+	return etcd.NodeInfo{
+		etcd.NodeInfoKeyType:     serverType,
+		etcd.NodeInfoKeyID:       serverID,
+		etcd.NodeInfoKeyAddrList: []interface{}{addr},
+	}
+}
+
+var testConfigOnce sync.Once
+
+// initTestConfig 使用默认配置,缩短服务注册间隔,对端还未开始监听时外连失败后由会话心跳重连
+func initTestConfig() {
+	testConfigOnce.Do(func() {
+		config.With(config.KeyRPC, config.KeyLog)
+		config.GetRPCConfig().ClusterRegistryInterval = 1
+		config.GetRPCConfig().HostSessionHeartbeat = 1
+	})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// neighbors 已连接的邻居数量,name不为空时只统计该邻居
+func neighbors(host *Host, name string) int {
+	host.neighborMutex.RLock()
+	defer host.neighborMutex.RUnlock()
+	if name == "" {
+		return len(host.neighbors)
+	}
+	if _, ok := host.neighbors[name]; ok {
+		return 1
+	}
+	return 0
+}
+
+func hasSession(host *Host, name string) bool {
+	_, ok := host.Node.GetSession(network.DriverTypeHost, name)
+	return ok
+}
+
+func TestMembershipRulesDial(t *testing.T) {
+	rules := MembershipRules{
+		etcd.ServerTypeGame:  {etcd.ServerTypeGate, etcd.ServerTypeGame},
+		etcd.ServerTypeLogin: {etcd.ServerTypeGate},
+	}
+	cases := []struct {
+		localType, localName, remoteType, remoteName string
+		dial                                         bool
+	}{
+		{etcd.ServerTypeGame, "GAME:1", etcd.ServerTypeGate, "GATE:1", true},
+		{etcd.ServerTypeGate, "GATE:1", etcd.ServerTypeGame, "GAME:1", false},
+		{etcd.ServerTypeLogin, "LOGIN:1", etcd.ServerTypeGame, "GAME:1", false},
+		{etcd.ServerTypeGame, "GAME:1", etcd.ServerTypeGame, "GAME:2", true},
+		{etcd.ServerTypeGame, "GAME:2", etcd.ServerTypeGame, "GAME:1", false},
+	}
+	for _, c := range cases {
+		if dial := rules.dial(c.localType, c.localName, c.remoteType, c.remoteName); dial != c.dial {
+			t.Errorf("%s -> %s dial: %v, expect: %v", c.localName, c.remoteName, dial, c.dial)
+		}
+	}
+	peers := rules.peerTypes(etcd.ServerTypeGate)
+	if len(peers) != 2 || peers[etcd.ServerTypeGame] || peers[etcd.ServerTypeLogin] {
+		t.Errorf("unexpected gate peer types: %v", peers)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	initTestConfig()
+	transport := network.NewMemoryTransport()
+	gate := NewHost("gate:1", transport)
+	defer gate.Close()
+	game := NewHost("game:1", transport)
+	defer game.Close()
+
+	gameNode := newNodeInfo(etcd.ServerTypeGame, 1, "game:1")
+	gateNode := newNodeInfo(etcd.ServerTypeGate, 1, "gate:1")
+	gameDiscovery := fakeDiscovery{etcd.ServerTypeGate: {gateNode}}
+	gameMembership := NewMembership(game, etcd.ServerTypeGame, 1, DefaultMembershipRules).WithDiscovery(gameDiscovery)
+	// 网关的depList中没有登录服,对账时跳过
+	gateMembership := NewMembership(gate, etcd.ServerTypeGate, 1, DefaultMembershipRules).
+		WithDiscovery(fakeDiscovery{etcd.ServerTypeGame: {gameNode}})
+
+	// 游戏服连接网关,网关以游戏服的监听地址命名内连会话
+	gameMembership.sync()
+	gateMembership.sync()
+	waitFor(t, "game connected to gate", func() bool {
+		return neighbors(game, "gate:1") == 1 && neighbors(gate, "game:1") == 1
+	})
+	// 重复的事件和对账不会建立新的连接
+	gameMembership.handleEvent(&etcd.NodeEvent{Node: gateNode, Event: etcd.EventAdd})
+	gameMembership.sync()
+	gateMembership.sync()
+	if neighbors(game, "") != 1 || neighbors(gate, "") != 1 {
+		t.Fatalf("unexpected neighbors, game: %d gate: %d", neighbors(game, ""), neighbors(gate, ""))
+	}
+
+	// 网关下线,游戏服关闭会话并移除邻居
+	delete(gameDiscovery, etcd.ServerTypeGate)
+	gameMembership.handleEvent(&etcd.NodeEvent{Node: gateNode, Event: etcd.EventDelete})
+	waitFor(t, "game removed gate", func() bool {
+		return !hasSession(game, "gate:1") && neighbors(game, "") == 0
+	})
+
+	// 网关重新上线后由对账补连,地址变更的旧成员由对账关闭
+	gameDiscovery[etcd.ServerTypeGate] = []etcd.NodeInfo{gateNode}
+	gameMembership.sync()
+	waitFor(t, "game reconnected to gate", func() bool {
+		return neighbors(game, "gate:1") == 1
+	})
+	gameDiscovery[etcd.ServerTypeGate] = []etcd.NodeInfo{newNodeInfo(etcd.ServerTypeGate, 1, "gate:2")}
+	gameMembership.sync()
+	waitFor(t, "game closed stale gate", func() bool {
+		return !hasSession(game, "gate:1")
+	})
+}
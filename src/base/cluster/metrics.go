@@ -0,0 +1,77 @@
+// -------------------------------------------
+// @file      : metrics.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/26 下午4:00
+// -------------------------------------------
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"gogs/base/cluster/network"
+	"gogs/base/metrics"
+	"strconv"
+	"sync"
+)
+
+var (
+	serverDuration = metrics.NewHistogramVec("gogs_rpc_server_duration_seconds",
+		"Time spent handling calls to local services.", nil, "service", "method")
+	clientDuration = metrics.NewHistogramVec("gogs_rpc_client_duration_seconds",
+		"Time spent waiting for calls to remote services, including retries.", nil, "service", "method")
+	clientTimeouts = metrics.NewCounterVec("gogs_rpc_client_timeouts_total",
+		"Calls to remote services that timed out.", "service", "method")
+	pendingCalls = metrics.NewGauge("gogs_rpc_pending_calls",
+		"Calls waiting for return, i.e. live rpc monitors.")
+	actorCount = metrics.NewGaugeVecFunc("gogs_actors",
+		"Actors held by actor systems.", []string{"system"}, collectActors)
+	actorSystems sync.Map // 未关闭的角色系统集合,抓取指标时遍历
+)
+
+func init() {
+	metrics.MustRegister(serverDuration, clientDuration, clientTimeouts, pendingCalls, actorCount)
+}
+
+// methodLabel 指标的函数标签,函数未注册时使用函数ID
+func methodLabel(info *CallInfo) string {
+	if info.Method != "" {
+		return info.Method
+	}
+	return strconv.FormatUint(uint64(info.MethodID), 10)
+}
+
+// MetricsInterceptor 按服务类型和函数统计本地服务的处理耗时
+func MetricsInterceptor(info *CallInfo, next func() (*network.Return, error)) (*network.Return, error) {
+	callReturn, err := next()
+	serverDuration.With(info.ServiceType, methodLabel(info)).ObserveDuration(info.Duration)
+	return callReturn, err
+}
+
+// ClientMetricsInterceptor 按服务类型和函数统计远程调用的等待耗时和超时次数,只投递的调用不统计
+func ClientMetricsInterceptor(ctx context.Context, info *CallInfo,
+	next func(ctx context.Context) (*network.Return, error)) (*network.Return, error) {
+	callReturn, err := next(ctx)
+	if info.OneWay {
+		return callReturn, err
+	}
+	method := methodLabel(info)
+	clientDuration.With(info.ServiceType, method).ObserveDuration(info.Duration)
+	if errors.Is(err, ErrTimeout) {
+		clientTimeouts.With(info.ServiceType, method).Inc()
+	}
+	return callReturn, err
+}
+
+// collectActors 统计各角色系统中的角色数量
+func collectActors(set func(float64, ...string)) {
+	actorSystems.Range(func(key, _ interface{}) bool {
+		system := key.(*ActorSystem)
+		system.actorLock.RLock()
+		count := len(system.actors)
+		system.actorLock.RUnlock()
+		set(float64(count), system.name)
+		return true
+	})
+}
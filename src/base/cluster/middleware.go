@@ -0,0 +1,455 @@
+// -------------------------------------------
+// @file      : middleware.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/25 上午10:40
+// -------------------------------------------
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"gogs/base/cberrors"
+	"gogs/base/cluster/network"
+	"gogs/base/config"
+	log "gogs/base/logger"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CallOptions 发起远程调用的选项,由生成代码填写
+type CallOptions struct {
+	Name       string        // 调用名字,服务类型#函数名字
+	Timeout    time.Duration // 超时时间
+	Idempotent bool          // 是否幂等,@cblang.Idempotent标注的函数失败时可以重试
+	OneWay     bool          // 是否没有返回值,只投递不等待
+}
+
+// Invoker 发起远程调用,OneWay时返回值为nil
+type Invoker func(ctx context.Context, service IRemoteService, call *network.Call, opts *CallOptions) (*network.Return, error)
+
+// ClientMiddleware 客户端中间件,包装IAgent的Post和Wait
+type ClientMiddleware func(next Invoker) Invoker
+
+// Handler 处理本地服务的调用
+type Handler func(service IService, call *network.Call) (*network.Return, error)
+
+// ServerMiddleware 服务端中间件,包装本地服务的Call
+type ServerMiddleware func(next Handler) Handler
+
+// Middlewares 调用中间件,每个远程调用管理器一份,同一集群服务器上的游戏服、网关和角色系统共用
+type Middlewares struct {
+	client      []ClientMiddleware // 客户端中间件,按注册顺序由外向内执行
+	server      []ServerMiddleware // 服务端中间件,按注册顺序由外向内执行
+	clientChain atomic.Value       // 组装好的客户端调用链 Invoker
+	serverChain atomic.Value       // 组装好的服务端调用链 Handler
+	lock        sync.Mutex         // 中间件注册锁
+	once        sync.Once          // 按配置注册默认中间件
+}
+
+// defaultMiddlewares 不属于任何集群服务器的调用使用的中间件,只有默认中间件
+var defaultMiddlewares = NewMiddlewares()
+
+// NewMiddlewares 新建调用中间件,默认中间件在第一次使用时按配置注册
+func NewMiddlewares() *Middlewares {
+	return &Middlewares{}
+}
+
+// UseClientMiddleware 注册客户端中间件,指标和按配置创建的重试、熔断和隔离中间件最先注册
+func (middlewares *Middlewares) UseClientMiddleware(client ...ClientMiddleware) {
+	middlewares.once.Do(middlewares.useDefaults)
+	middlewares.lock.Lock()
+	defer middlewares.lock.Unlock()
+	middlewares.client = append(middlewares.client, client...)
+	var chain Invoker = invoke
+	for i := len(middlewares.client) - 1; i >= 0; i-- {
+		chain = middlewares.client[i](chain)
+	}
+	middlewares.clientChain.Store(chain)
+}
+
+// UseServerMiddleware 注册服务端中间件,默认的指标、恢复、限流和日志中间件最先注册
+func (middlewares *Middlewares) UseServerMiddleware(server ...ServerMiddleware) {
+	middlewares.once.Do(middlewares.useDefaults)
+	middlewares.lock.Lock()
+	defer middlewares.lock.Unlock()
+	middlewares.server = append(middlewares.server, server...)
+	var chain Handler = handle
+	for i := len(middlewares.server) - 1; i >= 0; i-- {
+		chain = middlewares.server[i](chain)
+	}
+	middlewares.serverChain.Store(chain)
+}
+
+// useDefaults 按配置注册默认中间件,指标在最外层,统计包括重试在内的耗时
+// 重试在指标之内,每次重试都经过熔断和隔离,熔断和隔离的状态在每份中间件内独立
+func (middlewares *Middlewares) useDefaults() {
+	client := []ClientMiddleware{ClientInterceptorMiddleware(ClientMetricsInterceptor)}
+	if config.RetryMax() > 0 {
+		client = append(client, RetryMiddleware(config.RetryMax(), config.RetryBackoff(), config.RetryBackoffMax()))
+	}
+	if config.BreakerThreshold() > 0 {
+		client = append(client, BreakerMiddleware(config.BreakerThreshold(), config.BreakerTimeout()))
+	}
+	if config.BulkheadLimit() > 0 {
+		client = append(client, BulkheadMiddleware(config.BulkheadLimit()))
+	}
+	// 指标在最外层,崩溃的调用也统计耗时,恢复之后是限流,被限流拒绝的调用不记录日志
+	server := []ServerMiddleware{
+		ServerInterceptorMiddleware(MetricsInterceptor),
+		ServerInterceptorMiddleware(RecoveryInterceptor),
+	}
+	if config.RateLimit() > 0 {
+		server = append(server, RateLimitMiddleware(config.RateLimit(), config.RateBurst()))
+	}
+	server = append(server, ServerInterceptorMiddleware(LogInterceptor))
+	if config.SlowCall() > 0 {
+		server = append(server, ServerInterceptorMiddleware(SlowCallInterceptor(config.SlowCall())))
+	}
+	middlewares.lock.Lock()
+	defer middlewares.lock.Unlock()
+	middlewares.client = append(client, middlewares.client...)
+	middlewares.server = append(server, middlewares.server...)
+}
+
+// IMiddlewareAgent 属于集群服务器的代理,经过代理发起的调用经过所属服务器注册的中间件
+type IMiddlewareAgent interface {
+	Middlewares() *Middlewares // 所属服务器的调用中间件
+}
+
+// Invoke 经过客户端中间件发起远程调用,生成代码的远程服务通过此函数调用
+// 中间件取自远程服务代理所属的服务器,代理不属于任何服务器时只经过默认中间件
+func Invoke(ctx context.Context, service IRemoteService, call *network.Call, opts *CallOptions) (*network.Return, error) {
+	if agent, ok := service.Agent().(IMiddlewareAgent); ok {
+		return agent.Middlewares().Invoke(ctx, service, call, opts)
+	}
+	return defaultMiddlewares.Invoke(ctx, service, call, opts)
+}
+
+// Invoke 经过客户端中间件发起远程调用
+func (middlewares *Middlewares) Invoke(ctx context.Context, service IRemoteService, call *network.Call, opts *CallOptions) (*network.Return, error) {
+	chain, ok := middlewares.clientChain.Load().(Invoker)
+	if !ok {
+		middlewares.UseClientMiddleware()
+		chain = middlewares.clientChain.Load().(Invoker)
+	}
+	return chain(ctx, service, call, opts)
+}
+
+// invoke 调用链的末端,通过服务的代理发起调用并等待结果
+func invoke(ctx context.Context, service IRemoteService, call *network.Call, opts *CallOptions) (*network.Return, error) {
+	if opts.OneWay {
+		if err := service.Agent().Post(service, call); err != nil {
+			return nil, cberrors.New("post %s err: %s", opts.Name, err)
+		}
+		return nil, nil
+	}
+	future := make(ReturnFuture, 1)
+	err := service.Agent().Wait(ctx, service, call, opts.Timeout, func(result *ReturnVal) {
+		future <- result
+	})
+	if err != nil {
+		return nil, cberrors.New("call %s err: %s", opts.Name, err)
+	}
+	return returnResult(<-future)
+}
+
+// returnResult 监控器的结果转换为调用返回,超时和取消转换为错误
+func returnResult(result *ReturnVal) (*network.Return, error) {
+	if result.Timeout {
+		return nil, ErrTimeout
+	}
+	if result.Canceled {
+		return nil, context.Canceled
+	}
+	return result.CallReturn, nil
+}
+
+// InvokeAsync 异步发起远程调用,生成代码的远程服务的异步函数通过此函数调用
+// 监控器在返回、超时或取消时直接以decode解码的结果完成Future,不占用等待协程,decode在收到返回的协程中执行
+// 异步调用不经过客户端中间件,不重试也不受熔断和隔离限制,span为调用方开始的发起方跨度,完成时结束
+func InvokeAsync[T any](ctx context.Context, service IRemoteService, call *network.Call, opts *CallOptions, span *Span,
+	decode func(callReturn *network.Return) (T, error)) *Future[T] {
+	future := NewFuture[T]()
+	complete := func(value T, err error) {
+		if future.Complete(value, err) {
+			span.Finish(err)
+		}
+	}
+	var zero T
+	if opts.OneWay {
+		_, err := Invoke(ctx, service, call, opts)
+		complete(zero, err)
+		return future
+	}
+	err := service.Agent().Wait(ctx, service, call, opts.Timeout, func(result *ReturnVal) {
+		callReturn, err := returnResult(result)
+		if err != nil {
+			complete(zero, err)
+			return
+		}
+		complete(decode(callReturn))
+	})
+	if err != nil {
+		complete(zero, cberrors.New("call %s err: %s", opts.Name, err))
+	}
+	return future
+}
+
+// IMiddlewareService 生成代码的本地服务,新建时由所属服务器设置中间件,被直接调用时经过这些中间件
+type IMiddlewareService interface {
+	Middlewares() *Middlewares               // 所属服务器的调用中间件
+	SetMiddlewares(middlewares *Middlewares) // 设置所属服务器的调用中间件
+}
+
+// newService 新建本地服务并设置所属服务器的中间件,须在服务启动前设置
+func newService(builder IServiceBuilder, middlewares *Middlewares, name string, id ID, context interface{}) (IService, error) {
+	service, err := builder.NewService(name, id, context)
+	if err != nil {
+		return service, err
+	}
+	if s, ok := service.(IMiddlewareService); ok {
+		s.SetMiddlewares(middlewares)
+	}
+	return service, nil
+}
+
+// serviceMiddlewares 本地服务所属服务器的中间件,不属于任何服务器时为默认中间件
+func serviceMiddlewares(service IService) *Middlewares {
+	if s, ok := service.(IMiddlewareService); ok {
+		if middlewares := s.Middlewares(); middlewares != nil {
+			return middlewares
+		}
+	}
+	return defaultMiddlewares
+}
+
+// Serve 经过服务端中间件处理本地服务的调用,生成代码的本地服务被直接调用时通过此函数调用
+// 中间件取自本地服务所属的服务器,不属于任何服务器时只经过默认中间件
+func Serve(service IService, call *network.Call) (*network.Return, error) {
+	return serviceMiddlewares(service).Serve(service, call)
+}
+
+// Serve 经过服务端中间件处理本地服务的调用
+func (middlewares *Middlewares) Serve(service IService, call *network.Call) (*network.Return, error) {
+	chain, ok := middlewares.serverChain.Load().(Handler)
+	if !ok {
+		middlewares.UseServerMiddleware()
+		chain = middlewares.serverChain.Load().(Handler)
+	}
+	return chain(service, call)
+}
+
+// ServeLocal 在当前协程中经过服务端中间件处理本地服务的调用,生成代码的本地服务被直接调用时通过此函数调用
+// 与远程调用一致,服务返回的错误在结果中,由ReturnError解析,调用的期限由处理函数的上下文获取
+func ServeLocal(service IService, call *network.Call) (*network.Return, error) {
+	callReturn, err := Serve(service, call)
+	if callReturn == nil {
+		if err == nil {
+			err = cberrors.New("serve %s#%d without return", service, call.MethodID)
+		}
+		return nil, err
+	}
+	return callReturn, nil
+}
+
+// ServeAsync 在新协程中经过服务端中间件处理本地服务的调用,生成代码的本地服务的异步函数通过此函数调用
+func ServeAsync(service IService, call *network.Call) *Future[*network.Return] {
+	return Async(func() (*network.Return, error) {
+		return ServeLocal(service, call)
+	})
+}
+
+// handle 调用链的末端,调用本地服务
+func handle(service IService, call *network.Call) (*network.Return, error) {
+	return service.Call(call)
+}
+
+// remoteKey 熔断和隔离时区分对端的标识,只处理集群节点之间的调用,按会话区分对端进程
+func remoteKey(service IRemoteService) (string, bool) {
+	if agent, ok := service.Agent().(*HostAgent); ok {
+		return agent.Name(), true
+	}
+	return "", false
+}
+
+// retryable 调用失败后是否可以重试,只重试超时和发送失败,对端返回的错误和本地拒绝的调用不重试
+func retryable(err error) bool {
+	var remote *RemoteError
+	var code ICodeError
+	switch {
+	case errors.Is(err, ErrTimeout):
+		return true
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.As(err, &remote), errors.As(err, &code):
+		return false
+	}
+	return true
+}
+
+// RetryMiddleware 幂等函数超时或发送失败时重试,最多重试max次
+// 退避时间从backoff开始每次翻倍,不超过maxBackoff,并在一半范围内随机抖动
+func RetryMiddleware(max int, backoff, maxBackoff time.Duration) ClientMiddleware {
+	return func(next Invoker) Invoker {
+		return func(ctx context.Context, service IRemoteService, call *network.Call, opts *CallOptions) (*network.Return, error) {
+			callReturn, err := next(ctx, service, call, opts)
+			if !opts.Idempotent || opts.OneWay {
+				return callReturn, err
+			}
+			delay := backoff
+			for i := 0; i < max && err != nil && retryable(err); i++ {
+				wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+				log.Debugf("retry %s to %s after %s, attempt: %d, err: %s", opts.Name, service, wait, i+1, err)
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, ctx.Err()
+				}
+				callReturn, err = next(ctx, service, call, opts)
+				if delay *= 2; delay > maxBackoff {
+					delay = maxBackoff
+				}
+			}
+			return callReturn, err
+		}
+	}
+}
+
+// breaker 单个对端的熔断器
+type breaker struct {
+	sync.Mutex
+	failures  int       // 连续超时次数
+	openUntil time.Time // 熔断结束时间
+	probing   bool      // 熔断结束后是否已有试探调用在进行
+}
+
+// allow 是否允许发起调用,熔断结束后只放行一个试探调用
+func (b *breaker) allow(threshold int) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.failures < threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// report 报告调用结果,连续超时达到阈值时熔断
+// 调用方取消的调用没有结果,只结束试探,不改变连续超时次数,熔断结束后下一个调用继续试探
+func (b *breaker) report(err error, threshold int, openTimeout time.Duration) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.probing = false
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if !errors.Is(err, ErrTimeout) {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures >= threshold {
+		b.openUntil = time.Now().Add(openTimeout)
+		return true
+	}
+	return false
+}
+
+// BreakerMiddleware 对端熔断,对同一对端连续超时threshold次后熔断openTimeout时间,期间调用直接返回ErrCircuitOpen
+// 熔断结束后放行一个试探调用,成功则恢复,超时则继续熔断
+func BreakerMiddleware(threshold int, openTimeout time.Duration) ClientMiddleware {
+	var breakers sync.Map
+	return func(next Invoker) Invoker {
+		return func(ctx context.Context, service IRemoteService, call *network.Call, opts *CallOptions) (*network.Return, error) {
+			key, ok := remoteKey(service)
+			if !ok || opts.OneWay {
+				return next(ctx, service, call, opts)
+			}
+			value, _ := breakers.LoadOrStore(key, &breaker{})
+			b := value.(*breaker)
+			if !b.allow(threshold) {
+				return nil, ErrCircuitOpen
+			}
+			callReturn, err := next(ctx, service, call, opts)
+			if b.report(err, threshold, openTimeout) {
+				log.Warnf("circuit open for %s after %d consecutive timeouts, last call: %s", key, threshold, opts.Name)
+			}
+			return callReturn, err
+		}
+	}
+}
+
+// BulkheadMiddleware 限制对同一对端进行中的调用数,超过limit时直接返回ErrOverload
+func BulkheadMiddleware(limit int) ClientMiddleware {
+	var counters sync.Map
+	return func(next Invoker) Invoker {
+		return func(ctx context.Context, service IRemoteService, call *network.Call, opts *CallOptions) (*network.Return, error) {
+			key, ok := remoteKey(service)
+			if !ok || opts.OneWay {
+				return next(ctx, service, call, opts)
+			}
+			value, _ := counters.LoadOrStore(key, new(int64))
+			counter := value.(*int64)
+			if atomic.AddInt64(counter, 1) > int64(limit) {
+				atomic.AddInt64(counter, -1)
+				return nil, ErrOverload
+			}
+			defer atomic.AddInt64(counter, -1)
+			return next(ctx, service, call, opts)
+		}
+	}
+}
+
+// tokenBucket 令牌桶
+type tokenBucket struct {
+	sync.Mutex
+	tokens float64   // 当前令牌数
+	last   time.Time // 上次补充令牌的时间
+}
+
+// take 按速率补充令牌后取出一个令牌,没有令牌时返回false
+func (bucket *tokenBucket) take(rate, burst float64) bool {
+	bucket.Lock()
+	defer bucket.Unlock()
+	now := time.Now()
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rate
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// RateLimitMiddleware 按服务类型限制每秒处理的调用数,burst为允许的突发调用数,小于rate时取rate
+// 超过限制的调用不再处理,直接返回ErrRateLimited
+func RateLimitMiddleware(rate, burst int) ServerMiddleware {
+	if burst < rate {
+		burst = rate
+	}
+	var buckets sync.Map
+	return func(next Handler) Handler {
+		return func(service IService, call *network.Call) (*network.Return, error) {
+			value, _ := buckets.LoadOrStore(service.Type(), &tokenBucket{
+				tokens: float64(burst),
+				last:   time.Now(),
+			})
+			if !value.(*tokenBucket).take(float64(rate), float64(burst)) {
+				return ErrorReturn(call, ErrRateLimited), ErrRateLimited
+			}
+			return next(service, call)
+		}
+	}
+}
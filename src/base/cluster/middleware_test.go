@@ -0,0 +1,249 @@
+// -------------------------------------------
+// @file      : middleware_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/11 下午2:30
+// -------------------------------------------
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"gogs/base/cluster/network"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hostService 测试用的远程服务,属于集群会话代理,熔断和隔离按会话名字区分对端
+func hostService(name string) *testService {
+	return &testService{typename: "Test", name: "Test", id: 1, remoteID: 1,
+		agent: NewClusterRemote(nil, &recordSession{name: name})}
+}
+
+// testInvoker 测试用的调用链末端,依次返回results中的错误,用完后返回nil
+type testInvoker struct {
+	calls   int32
+	results []error
+	block   chan struct{} // 不为nil时阻塞到关闭
+	entered chan struct{} // 不为nil时进入调用后通知
+}
+
+func (invoker *testInvoker) invoke(ctx context.Context, service IRemoteService, call *network.Call,
+	opts *CallOptions) (*network.Return, error) {
+	n := atomic.AddInt32(&invoker.calls, 1)
+	if invoker.entered != nil {
+		invoker.entered <- struct{}{}
+	}
+	if invoker.block != nil {
+		<-invoker.block
+	}
+	if int(n) <= len(invoker.results) && invoker.results[n-1] != nil {
+		return nil, invoker.results[n-1]
+	}
+	return &network.Return{ID: call.ID}, nil
+}
+
+func TestRetryMiddleware(t *testing.T) {
+	service := hostService("game:1")
+	retry := RetryMiddleware(3, time.Millisecond, 4*time.Millisecond)
+
+	// 非幂等函数不重试
+	invoker := &testInvoker{results: []error{ErrTimeout, ErrTimeout}}
+	opts := &CallOptions{Name: "Test#1"}
+	if _, err := retry(invoker.invoke)(context.Background(), service, &network.Call{}, opts); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if invoker.calls != 1 {
+		t.Fatalf("non idempotent call retried: %d", invoker.calls)
+	}
+
+	// 幂等函数超时后重试直到成功
+	invoker = &testInvoker{results: []error{ErrTimeout, ErrTimeout}}
+	opts.Idempotent = true
+	if _, err := retry(invoker.invoke)(context.Background(), service, &network.Call{}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if invoker.calls != 3 {
+		t.Fatalf("idempotent call invoked %d times, expect 3", invoker.calls)
+	}
+
+	// 对端返回的错误不重试
+	invoker = &testInvoker{results: []error{&RemoteError{Status: network.ReturnStatusError}}}
+	if _, err := retry(invoker.invoke)(context.Background(), service, &network.Call{}, opts); err == nil {
+		t.Fatal("remote error lost")
+	}
+	if invoker.calls != 1 {
+		t.Fatalf("remote error retried: %d", invoker.calls)
+	}
+
+	// 退避期间ctx取消时立即返回
+	invoker = &testInvoker{results: []error{ErrTimeout}}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	slow := RetryMiddleware(3, time.Minute, time.Minute)
+	if _, err := slow(invoker.invoke)(ctx, service, &network.Call{}, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second || invoker.calls != 1 {
+		t.Fatalf("retry ignored ctx, elapsed: %s calls: %d", elapsed, invoker.calls)
+	}
+}
+
+func TestBreakerMiddleware(t *testing.T) {
+	service := hostService("game:1")
+	opts := &CallOptions{Name: "Test#1"}
+	invoker := &testInvoker{results: []error{ErrTimeout, ErrTimeout}}
+	breaker := BreakerMiddleware(2, 50*time.Millisecond)(invoker.invoke)
+	call := func(ctx context.Context) error {
+		_, err := breaker(ctx, service, &network.Call{}, opts)
+		return err
+	}
+
+	// 连续超时达到阈值后熔断,不再发起调用
+	for i := 0; i < 2; i++ {
+		if err := call(context.Background()); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	if err := call(context.Background()); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("circuit not open: %v", err)
+	}
+	if invoker.calls != 2 {
+		t.Fatalf("open circuit invoked: %d", invoker.calls)
+	}
+	// 其他对端不受影响
+	if _, err := breaker(context.Background(), hostService("game:2"), &network.Call{}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// 熔断结束后只放行一个试探调用,试探被取消时没有结果,继续试探
+	time.Sleep(60 * time.Millisecond)
+	invoker.results = append(invoker.results, nil, context.Canceled)
+	invoker.block, invoker.entered = make(chan struct{}), make(chan struct{}, 1)
+	probed := make(chan error, 1)
+	go func() {
+		probed <- call(context.Background())
+	}()
+	<-invoker.entered
+	if err := call(context.Background()); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second call passed while probing: %v", err)
+	}
+	close(invoker.block)
+	if err := <-probed; !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected probe err: %v", err)
+	}
+
+	// 取消的试探不关闭熔断,下一个调用仍是唯一的试探
+	invoker.block = make(chan struct{})
+	go func() {
+		probed <- call(context.Background())
+	}()
+	<-invoker.entered
+	if err := call(context.Background()); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("canceled probe closed the circuit: %v", err)
+	}
+	close(invoker.block)
+	if err := <-probed; err != nil {
+		t.Fatalf("unexpected probe err: %v", err)
+	}
+	// 试探成功后恢复
+	invoker.block, invoker.entered = nil, nil
+	if err := call(context.Background()); err != nil {
+		t.Fatalf("circuit not closed after probe: %v", err)
+	}
+}
+
+func TestBulkheadMiddleware(t *testing.T) {
+	service := hostService("game:1")
+	opts := &CallOptions{Name: "Test#1"}
+	invoker := &testInvoker{block: make(chan struct{}), entered: make(chan struct{}, 1)}
+	bulkhead := BulkheadMiddleware(1)(invoker.invoke)
+	done := make(chan error, 1)
+	go func() {
+		_, err := bulkhead(context.Background(), service, &network.Call{}, opts)
+		done <- err
+	}()
+	<-invoker.entered
+	// 超过进行中的调用上限直接拒绝
+	if _, err := bulkhead(context.Background(), service, &network.Call{}, opts); !errors.Is(err, ErrOverload) {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	close(invoker.block)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bulkhead(context.Background(), service, &network.Call{}, opts); err != nil {
+		t.Fatalf("call rejected after release: %v", err)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	service := &countService{testService: testService{typename: "Test", name: "Test", id: 1}}
+	limit := RateLimitMiddleware(1, 2)(handle)
+	for i := 0; i < 2; i++ {
+		if _, err := limit(service, &network.Call{ID: uint32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 突发调用用完令牌后拒绝,错误随返回告知调用方
+	callReturn, err := limit(service, &network.Call{ID: 3})
+	if !errors.Is(err, ErrRateLimited) || callReturn == nil || callReturn.Status == network.ReturnStatusOK {
+		t.Fatalf("unexpected result: %+v err: %v", callReturn, err)
+	}
+	if calls := atomic.LoadInt32(&service.calls); calls != 2 {
+		t.Fatalf("service handled %d calls, expect 2", calls)
+	}
+}
+
+// middlewareService 测试用的本地服务,与生成代码一样保存所属服务器的中间件
+type middlewareService struct {
+	countService
+	middlewares *Middlewares
+}
+
+func (service *middlewareService) Middlewares() *Middlewares { return service.middlewares }
+func (service *middlewareService) SetMiddlewares(middlewares *Middlewares) {
+	service.middlewares = middlewares
+}
+
+type middlewareBuilder struct {
+	testBuilder
+}
+
+func (builder middlewareBuilder) NewService(name string, id ID, context interface{}) (IService, error) {
+	return &middlewareService{countService: countService{testService: testService{typename: builder.ServiceType(), name: name, id: id}}}, nil
+}
+
+func TestServeLocalMiddlewares(t *testing.T) {
+	initTestConfig()
+	var served int32
+	middlewares := NewMiddlewares()
+	middlewares.UseServerMiddleware(func(next Handler) Handler {
+		return func(service IService, call *network.Call) (*network.Return, error) {
+			atomic.AddInt32(&served, 1)
+			return next(service, call)
+		}
+	})
+	// 直接调用本地服务时经过所属服务器注册的中间件
+	service, err := newService(middlewareBuilder{"Test"}, middlewares, "Test", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ServeLocal(service, &network.Call{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if served != 1 || service.(*middlewareService).calls != 1 {
+		t.Fatalf("served: %d calls: %d", served, service.(*middlewareService).calls)
+	}
+	// 不属于任何服务器的服务只经过默认中间件
+	other, _ := middlewareBuilder{"Test"}.NewService("Other", 2, nil)
+	if _, err = ServeLocal(other, &network.Call{ID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if served != 1 || other.(*middlewareService).calls != 1 {
+		t.Fatalf("served: %d calls: %d", served, other.(*middlewareService).calls)
+	}
+}
@@ -7,11 +7,17 @@
 
 package cluster
 
+import "gogs/base/cluster/network"
+
 // Neighbor 集群中的邻居
 type Neighbor struct {
 	agent        *HostAgent
-	services     map[string]IRemoteService // 按名字索引的邻居节点上的远程服务
-	servicesByID map[ID]IRemoteService     // 按ID索引的邻居节点上的远程服务
+	services     map[string]IRemoteService           // 按名字索引的邻居节点上的远程服务
+	servicesByID map[ID]IRemoteService               // 按ID索引的邻居节点上的远程服务
+	registry     map[string]*network.ServiceRegistry // 邻居已发布的全部服务,包括本地没有构造器的类型,用于摘要校验
+	epoch        int64                               // 邻居注册表的纪元
+	seq          uint64                              // 已应用的最新序号
+	syncing      bool                                // 是否正在等待全量快照
 }
 
 // NewNeighbor 新建邻居节点
@@ -20,5 +26,12 @@ func NewNeighbor(agent *HostAgent) *Neighbor {
 		agent:        agent,
 		services:     make(map[string]IRemoteService),
 		servicesByID: make(map[ID]IRemoteService),
+		registry:     make(map[string]*network.ServiceRegistry),
 	}
 }
+
+// removeService 移除远程服务
+func (neighbor *Neighbor) removeService(service IRemoteService) {
+	delete(neighbor.services, service.Name())
+	delete(neighbor.servicesByID, service.RemoteID())
+}
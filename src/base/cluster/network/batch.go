@@ -0,0 +1,69 @@
+// -------------------------------------------
+// @file      : batch.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/15 下午4:05
+// -------------------------------------------
+
+package network
+
+import "gogs/base/cberrors"
+
+// mergeMessages 从发送队列中取出已缓存的消息,与first合并为一个批量消息
+// 最多合并max个,队列中没有更多消息时直接返回first
+// 遇到踢下线消息时停止合并,第二个返回值表示本次发送包含踢下线消息,发送后应关闭连接
+func mergeMessages(first *Message, cached *sendQueue, max int) (*Message, bool) {
+	kicked := first.Type == MessageTypeKick
+	if kicked || max < 2 {
+		return first, kicked
+	}
+	batch := &MessageBatch{
+		Messages: []*Message{first},
+	}
+	for len(batch.Messages) < max {
+		msg := cached.poll()
+		if msg == nil {
+			break
+		}
+		batch.Messages = append(batch.Messages, msg)
+		if msg.Type == MessageTypeKick {
+			kicked = true
+			break
+		}
+	}
+	if len(batch.Messages) == 1 {
+		return first, kicked
+	}
+	return &Message{
+		Type: MessageTypeBatch,
+		Data: batch.Marshal(),
+	}, kicked
+}
+
+// flushMessages 非阻塞地发送队列中剩余的消息,用于关闭前清空发送队列
+func flushMessages(stream *Stream, cached *sendQueue) {
+	for msg := cached.poll(); msg != nil; msg = cached.poll() {
+		if err := stream.WriteMessage(msg); err != nil {
+			return
+		}
+	}
+}
+
+// dispatchMessage 将读取到的消息交给read处理,批量消息拆开后按顺序逐个处理
+func dispatchMessage(msg *Message, read func(*Message)) error {
+	if msg.Type != MessageTypeBatch {
+		read(msg)
+		return nil
+	}
+	batch, err := UnmarshalMessageBatch(msg.Data)
+	if err != nil {
+		return err
+	}
+	if batch == nil {
+		return cberrors.New("receive empty batch message")
+	}
+	for _, m := range batch.Messages {
+		read(m)
+	}
+	return nil
+}
@@ -14,6 +14,7 @@ import (
 	"hash/crc32"
 	"runtime"
 	"sync"
+	"sync/atomic"
 )
 
 // ClientDriver 客户端驱动
@@ -24,25 +25,37 @@ type ClientDriver struct {
 	mutexGroup            []sync.Mutex              // 会话互斥锁列表
 	sessionHandlerBuilder SessionHandlerBuilder     // 会话处理器构造器
 	name                  string                    // 驱动名字
-	protocol              ProtocolType              // 协议类型
+	transport             ITransport                // 传输层
+	security              *Security                 // 传输安全选项
 }
 
-// NewClientDriver 新建客户端驱动
-func NewClientDriver(remoteAddr string, builder SessionHandlerBuilder, protocol ProtocolType) *ClientDriver {
+// NewClientDriver 新建客户端驱动,transport为nil时使用明文tcp,security为nil时不加密
+func NewClientDriver(remoteAddr string, builder SessionHandlerBuilder, transport ITransport, security *Security) *ClientDriver {
 	driver := &ClientDriver{
 		remoteAddr:            remoteAddr,
 		userSessions:          make(map[string]*ClientSession),
 		mutexGroup:            make([]sync.Mutex, runtime.NumCPU()),
 		sessionHandlerBuilder: builder,
 		name:                  fmt.Sprintf("ClientDriver(%s)", remoteAddr),
-		protocol:              protocol,
+		transport:             defaultTransport(transport),
+		security:              security,
 	}
+	trackDriver(driver)
 	return driver
 }
 
-// Close 关闭驱动
+// Close 关闭驱动,关闭所有会话
 func (driver *ClientDriver) Close() {
-
+	untrackDriver(driver)
+	driver.RLock()
+	sessions := make([]*ClientSession, 0, len(driver.userSessions))
+	for _, session := range driver.userSessions {
+		sessions = append(sessions, session)
+	}
+	driver.RUnlock()
+	for _, session := range sessions {
+		session.Close()
+	}
 }
 
 // String 获取客户端驱动名字 ClientDriver(remoteAddr)
@@ -62,7 +75,7 @@ func (driver *ClientDriver) Type() DriverType {
 
 // Protocol 获取协议类型
 func (driver *ClientDriver) Protocol() ProtocolType {
-	return driver.protocol
+	return driver.transport.Protocol()
 }
 
 // SetBuilder 设置会话处理器构造器
@@ -96,6 +109,17 @@ func (driver *ClientDriver) GetSession(name string) (ISession, bool) {
 	return session, ok
 }
 
+// Sessions 所有会话
+func (driver *ClientDriver) Sessions() []ISession {
+	driver.RLock()
+	defer driver.RUnlock()
+	sessions := make([]ISession, 0, len(driver.userSessions))
+	for _, session := range driver.userSessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
 // DelSession 删除指定的会话
 func (driver *ClientDriver) DelSession(session ISession) {
 	driver.Lock()
@@ -119,17 +143,21 @@ func (driver *ClientDriver) NewSession(name string, ct ConnectionType) (ISession
 	driver.RUnlock()
 	// 创建会话
 	session := &ClientSession{
-		driver:   driver,
-		name:     name,
-		status:   SessionStatusDisconnected,
-		cached:   make(chan *Message, config.ClientSessionCache()),
-		protocol: driver.protocol,
+		driver:    driver,
+		name:      name,
+		status:    SessionStatusDisconnected,
+		heartbeat: newHeartbeat(),
 	}
+	session.cached = newSendQueue(config.ClientSessionCache(), OverflowPolicy(config.ClientSessionOverflow()),
+		config.OverflowTimeout(), session.disconnect)
 	handler, err := driver.sessionHandlerBuilder(session)
 	if err != nil {
 		return nil, err
 	}
 	session.handler = handler
+	session.heartbeat.ack = func() uint64 {
+		return atomic.LoadUint64(&session.lastSeq)
+	}
 	// 异步连接会话
 	go session.connect()
 	driver.Lock()
@@ -8,11 +8,14 @@
 package network
 
 import (
+	"crypto/ecdh"
 	"fmt"
-	"github.com/gorilla/websocket"
 	"gogs/base/cberrors"
+	"gogs/base/config"
 	log "gogs/base/logger"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 // ClientSession 客户端会话
@@ -21,12 +24,17 @@ type ClientSession struct {
 	handler   ISessionHandler // 会话处理器
 	name      string          // 会话名字,在driver中唯一
 	key       []byte          // AES加密密钥
-	conn      net.Conn        // tcp连接
-	websocket *websocket.Conn // websocket连接
+	conn      net.Conn        // 连接
 	exit      chan struct{}   // 关闭信号
-	cached    chan *Message   // 发送消息队列
+	cached    *sendQueue      // 发送消息队列
 	status    SessionStatus   // 状态
-	protocol  ProtocolType    // 协议类型
+	compress  CompressType    // 协商后的压缩算法
+	batch     bool            // 协商后是否启用批量消息
+	heartbeat *heartbeat      // 心跳
+	token     *ResumeToken    // 网关签发的恢复会话令牌
+	lastSeq   uint64          // 已收到的最大消息序号
+	lostAt    time.Time       // 连接断开时间,恢复窗口内自动重连
+	closed    int32           // 是否已关闭,关闭后不再重连
 }
 
 // String implements fmt.Stringer
@@ -49,9 +57,22 @@ func (session *ClientSession) DriverType() DriverType {
 	return session.driver.Type()
 }
 
+// RTT implements ISession
+func (session *ClientSession) RTT() time.Duration {
+	return session.heartbeat.RTT()
+}
+
 // Close implements ISession
 func (session *ClientSession) Close() {
+	atomic.StoreInt32(&session.closed, 1)
 	session.disconnect()
+	// 加锁回调
+	session.driver.lock(session, func() {
+		if session.status != SessionStatusClosed {
+			session.status = SessionStatusClosed
+			session.handler.SessionStatusChanged(session.status)
+		}
+	})
 	session.driver.DelSession(session)
 }
 
@@ -62,51 +83,65 @@ func (session *ClientSession) Handler() ISessionHandler {
 
 // disconnect 断开连接
 func (session *ClientSession) disconnect() {
-	if session.protocol == ProtocolTCP && session.conn != nil {
-		_ = session.conn.Close()
-	} else if session.protocol == ProtocolWebsocket && session.websocket != nil {
-		_ = session.websocket.Close()
-	}
 	// 加锁回调
 	session.driver.lock(session, func() {
+		if session.conn != nil {
+			_ = session.conn.Close()
+		}
 		switch session.status {
 		case SessionStatusOutConnected, SessionStatusConnecting:
 			if session.exit != nil {
 				close(session.exit)
 			}
 			session.conn = nil
-			session.websocket = nil
 			session.key = nil
 			session.exit = nil
 			session.status = SessionStatusDisconnected
 			session.handler.SessionStatusChanged(session.status)
+			session.reconnect()
 		}
 	})
 }
 
-// outConnection 外连后的设置
-func (session *ClientSession) outConnection(key []byte, conn net.Conn, websocketConn *websocket.Conn) chan struct{} {
+// reconnect 持有恢复令牌时在恢复窗口内自动重连,调用方持有会话锁
+func (session *ClientSession) reconnect() {
+	if session.token == nil || atomic.LoadInt32(&session.closed) == 1 {
+		return
+	}
+	if session.lostAt.IsZero() {
+		session.lostAt = time.Now()
+	}
+	if time.Since(session.lostAt) > config.ResumeGrace() {
+		log.Infof("client session: %s resume timeout", session)
+		session.token = nil
+		session.lostAt = time.Time{}
+		return
+	}
+	time.AfterFunc(config.ResumeRetryInterval(), session.connect)
+}
+
+// outConnection 外连后的设置,返回关闭信号和收发使用的消息流
+func (session *ClientSession) outConnection(key []byte, hs *Handshake, conn net.Conn) (chan struct{}, *Stream, *Stream) {
 	var exit chan struct{}
+	var recv, send *Stream
 	// 加锁回调
 	session.driver.lock(session, func() {
 		switch session.status {
 		case SessionStatusDisconnected, SessionStatusConnecting:
-			if session.protocol == ProtocolWebsocket {
-				session.websocket = websocketConn
-			} else if session.protocol == ProtocolTCP {
-				session.conn = conn
-			} else {
-				cberrors.Panic("unsupported protocol: %s", session.protocol)
-			}
 			session.conn = conn
 			session.key = key
+			session.compress = hs.Compress
+			session.batch = hs.Batch
 			session.status = SessionStatusOutConnected
 			session.exit = make(chan struct{})
-			session.handler.SessionStatusChanged(session.status)
+			session.lostAt = time.Time{}
+			session.heartbeat.reset()
 			exit = session.exit
+			recv, send = session.newStream(), session.newStream()
+			session.handler.SessionStatusChanged(session.status)
 		}
 	})
-	return exit
+	return exit, recv, send
 }
 
 // connect 连接
@@ -124,34 +159,22 @@ func (session *ClientSession) connect() {
 		return
 	}
 	// 连接
-	var conn net.Conn
-	var err error
-	var stream *Stream
-	var websocketConn *websocket.Conn
-	switch session.driver.protocol {
-	case ProtocolTCP:
-		conn, err = net.Dial("tcp", session.driver.remoteAddr)
-		if err != nil {
-			log.Errorf("client session: %s dial: %s err: %s", session, session.driver.remoteAddr, err)
-			session.disconnect()
-			return
-		}
-		stream = NewStream(conn, conn)
-	case ProtocolWebsocket:
-		websocketConn, _, err = websocket.DefaultDialer.Dial(session.driver.remoteAddr, nil)
-		if err != nil {
-			log.Errorf("client session: %s dial: %s err: %s", session, session.driver.remoteAddr, err)
-			session.disconnect()
-			return
-		}
-		stream = NewWebsocketStream(websocketConn)
-	default:
-		cberrors.Panic("unsupported protocol: %s", session.driver.protocol)
-	}
-	// TODO 密钥交换
-	_ = stream
-	var key []byte
-	exit := session.outConnection(key, conn, websocketConn)
+	conn, err := session.driver.transport.Dial(session.driver.remoteAddr)
+	if err != nil {
+		log.Errorf("client session: %s dial: %s err: %s", session, session.driver.remoteAddr, err)
+		session.disconnect()
+		return
+	}
+	stream := NewStream(conn, conn).measure(DriverTypeClient)
+	// 握手协商会话参数,启用加密时同时交换密钥
+	hs, key, err := session.handshake(stream)
+	if err != nil {
+		log.Errorf("client session: %s handshake err: %s", session, err)
+		_ = conn.Close()
+		session.disconnect()
+		return
+	}
+	exit, recv, send := session.outConnection(key, hs, conn)
 	if exit == nil {
 		log.Debugf("client session: %s drop out connection: %s", session, conn)
 		session.disconnect()
@@ -159,65 +182,171 @@ func (session *ClientSession) connect() {
 	}
 	log.Infof("client session: %s connected", session)
 	// 启动会话
-	go session.recvLoop()
-	go session.sendLoop()
+	go session.recvLoop(recv)
+	go session.sendLoop(send, exit)
+	go session.heartbeat.loop(session, exit, session.disconnect)
 }
 
-// recvLoop 接收循环
-func (session *ClientSession) recvLoop() {
-	var stream *Stream
-	if session.protocol == ProtocolTCP {
-		stream = NewStream(session.conn, session.conn)
-	} else if session.protocol == ProtocolWebsocket {
-		stream = NewWebsocketStream(session.websocket)
-	} else {
-		cberrors.Panic("unsupported protocol: %s", session.protocol)
+// handshake 向网关发送握手消息,返回网关应答的协商结果和交换得到的AES密钥
+func (session *ClientSession) handshake(stream *Stream) (*Handshake, []byte, error) {
+	local := localHandshake(session.name)
+	local.AckSeq = atomic.LoadUint64(&session.lastSeq)
+	var private *ecdh.PrivateKey
+	var err error
+	if session.driver.security.encrypt() {
+		private, err = newKeyPair()
+		if err != nil {
+			return nil, nil, err
+		}
+		local.PublicKey = private.PublicKey().Bytes()
+	}
+	// 恢复会话时只发送令牌ID和绑定本次公钥的签名,不发送令牌密钥
+	session.driver.lock(session, func() {
+		if session.token != nil {
+			local.ResumeID = session.token.ID
+			local.ResumeMAC = resumeMAC(session.token, local.AckSeq, local.PublicKey)
+		}
+	})
+	msg := NewMessage()
+	msg.Type = MessageTypeHandshake
+	msg.Data = local.Marshal()
+	if err = WriteMessage(stream, msg); err != nil {
+		return nil, nil, err
+	}
+	msg, err = ReadMessage(stream)
+	if err != nil {
+		return nil, nil, err
+	}
+	if msg.Type != MessageTypeAccept {
+		return nil, nil, cberrors.New("handshake rejected: %s", msg.Type)
+	}
+	hs, err := UnmarshalHandshake(msg.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hs == nil {
+		return nil, nil, cberrors.New("handshake empty accept")
+	}
+	if local.ResumeID != "" && !hs.Resumed {
+		// 网关已无法恢复原会话,作为新会话重新登录
+		log.Infof("client session: %s resume rejected", session)
+		session.driver.lock(session, func() {
+			session.token = nil
+		})
+		atomic.StoreUint64(&session.lastSeq, 0)
 	}
+	if private == nil {
+		return hs, nil, nil
+	}
+	// 要求加密但网关未返回公钥,不降级为明文
+	if len(hs.PublicKey) == 0 {
+		return nil, nil, cberrors.New("gate not support encryption")
+	}
+	// 固定了网关签名公钥时校验签名,拒绝被中间人替换的公钥
+	if gateKey := session.driver.security.GateKey; gateKey != nil && !verifyHandshake(gateKey, hs.PublicKey, local.PublicKey, hs.Signature) {
+		return nil, nil, cberrors.New("gate handshake signature mismatch")
+	}
+	key, err := deriveKey(private, hs.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hs, key, nil
+}
+
+// newStream 根据协商结果创建消息流
+func (session *ClientSession) newStream() *Stream {
+	stream := NewStream(session.conn, session.conn).measure(DriverTypeClient)
+	if err := stream.SetCompress(session.compress); err != nil {
+		log.Errorf("client session: %s set compress err: %s", session, err)
+	}
+	if session.key != nil {
+		if err := stream.SetCipher(session.key, directionClient, directionGate); err != nil {
+			log.Errorf("client session: %s set cipher err: %s", session, err)
+		}
+	}
+	return stream
+}
+
+// recvLoop 接收循环
+func (session *ClientSession) recvLoop(stream *Stream) {
 	for {
-		msg, err := ReadMessage(stream)
+		msg, err := stream.ReadMessage()
+		if err == nil {
+			session.heartbeat.received()
+			// 通知处理器,读取到一个或一批消息
+			err = dispatchMessage(msg, session.read)
+		}
 		if err != nil {
 			session.disconnect()
 			log.Errorf("client session: %s read message err: %s", session, err)
 			break
 		}
-		session.handler.Read(session, msg)
 	}
 }
 
-// sendLoop 发送循环
-func (session *ClientSession) sendLoop() {
-	var stream *Stream
-	if session.protocol == ProtocolTCP {
-		stream = NewStream(session.conn, session.conn)
-	} else if session.protocol == ProtocolWebsocket {
-		stream = NewWebsocketStream(session.websocket)
-	} else {
-		cberrors.Panic("unsupported protocol: %s", session.protocol)
+// read 处理读取到的一个消息,恢复会话时重放的重复消息按序号丢弃
+func (session *ClientSession) read(msg *Message) {
+	if session.heartbeat.handle(session, msg) {
+		return
 	}
+	if msg.Type == MessageTypeResume {
+		// 登录和每次恢复会话后网关签发新令牌,替换旧令牌
+		token, err := UnmarshalResumeToken(msg.Data)
+		if err != nil || token == nil || token.ID == "" {
+			log.Errorf("client session: %s unmarshal resume token err: %v", session, err)
+			return
+		}
+		session.driver.lock(session, func() {
+			session.token = token
+		})
+		return
+	}
+	if msg.Seq > 0 {
+		if msg.Seq <= atomic.LoadUint64(&session.lastSeq) {
+			return
+		}
+		atomic.StoreUint64(&session.lastSeq, msg.Seq)
+	}
+	session.handler.Read(session, msg)
+}
+
+// sendLoop 发送循环
+func (session *ClientSession) sendLoop(stream *Stream, exit chan struct{}) {
+	batch := 0
+	session.driver.lock(session, func() {
+		if session.batch {
+			batch = config.SessionBatch()
+		}
+	})
 	for {
-		select {
-		case msg := <-session.cached:
-			err := WriteMessage(stream, msg)
-			if err != nil {
-				session.disconnect()
-				log.Errorf("client session: %s write message err: %s", session, err)
-				return
-			}
-		case <-session.exit:
+		msg, ok := session.cached.next(exit, nil)
+		if !ok {
+			return
+		}
+		// 合并队列中已缓存的消息一起发送
+		msg, _ = mergeMessages(msg, session.cached, batch)
+		err := stream.WriteMessage(msg)
+		if err != nil {
+			session.disconnect()
+			log.Errorf("client session: %s write message err: %s", session, err)
 			return
 		}
+		session.heartbeat.sent()
 	}
 }
 
 // Write 发送一个Message
 func (session *ClientSession) Write(msg *Message) error {
-	if session.status == SessionStatusClosed {
+	if atomic.LoadInt32(&session.closed) == 1 {
 		return cberrors.New("client session: %s closed", session)
 	}
-	select {
-	case session.cached <- msg:
-		return nil
-	default:
-		return cberrors.New("client session: %s sending queue overflow: %d", session, len(session.cached))
+	if err := session.cached.push(msg); err != nil {
+		return cberrors.New("client session: %s %s", session, err)
 	}
+	return nil
+}
+
+// QueueStats implements IQueueStats
+func (session *ClientSession) QueueStats() QueueStats {
+	return session.cached.stats()
 }
@@ -0,0 +1,112 @@
+// -------------------------------------------
+// @file      : compress.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/15 下午3:20
+// -------------------------------------------
+
+package network
+
+import (
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"gogs/base/cberrors"
+	"gogs/base/config"
+	"sync"
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder    *zstd.Decoder // 解码器,第一次解压时按配置的最大消息大小创建
+	zstdOnce       sync.Once
+	zstdErr        error
+)
+
+// getZstdDecoder 获取zstd解码器,解压后超过最大消息大小的帧直接返回错误,不分配内存
+func getZstdDecoder() (*zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		var options []zstd.DOption
+		if max := config.MaxMessageSize(); max > 0 {
+			options = append(options, zstd.WithDecoderMaxMemory(uint64(max)))
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, options...)
+	})
+	return zstdDecoder, zstdErr
+}
+
+// ICompressor 消息压缩器
+type ICompressor interface {
+	Compress(data []byte) ([]byte, error)   // 压缩
+	Decompress(data []byte) ([]byte, error) // 解压
+}
+
+// snappyCompressor snappy压缩器
+type snappyCompressor struct{}
+
+// Compress implements ICompressor
+func (c snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+// Decompress implements ICompressor
+// 解压前检查头部声明的长度,超过最大消息大小时不解压
+func (c snappyCompressor) Decompress(data []byte) ([]byte, error) {
+	size, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if max := config.MaxMessageSize(); max > 0 && size > max {
+		return nil, cberrors.New("snappy decoded size: %d exceeds max message size: %d", size, max)
+	}
+	return snappy.Decode(nil, data)
+}
+
+// zstdCompressor zstd压缩器,编解码器全局共享,EncodeAll和DecodeAll线程安全
+type zstdCompressor struct{}
+
+// Compress implements ICompressor
+func (c zstdCompressor) Compress(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+// Decompress implements ICompressor
+func (c zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	decoder, err := getZstdDecoder()
+	if err != nil {
+		return nil, err
+	}
+	return decoder.DecodeAll(data, nil)
+}
+
+// NewCompressor 获取指定算法的压缩器,不压缩时返回nil
+func NewCompressor(compressType CompressType) (ICompressor, error) {
+	switch compressType {
+	case CompressTypeNone:
+		return nil, nil
+	case CompressTypeSnappy:
+		return snappyCompressor{}, nil
+	case CompressTypeZstd:
+		return zstdCompressor{}, nil
+	}
+	return nil, cberrors.New("unsupported compress type: %d", compressType)
+}
+
+// localHandshake 根据本地配置生成握手数据
+func localHandshake(whoAmI string) *Handshake {
+	return &Handshake{
+		WhoAmI:   whoAmI,
+		Compress: CompressType(config.Compress()),
+		Batch:    config.SessionBatch() > 1,
+	}
+}
+
+// negotiate 应答方根据本地配置和发起方的握手数据协商会话参数
+// 压缩算法必须双方一致才启用,批量消息需要双方都支持
+func negotiate(whoAmI string, remote *Handshake) *Handshake {
+	local := localHandshake(whoAmI)
+	if local.Compress != remote.Compress {
+		local.Compress = CompressTypeNone
+	}
+	local.Batch = local.Batch && remote.Batch
+	return local
+}
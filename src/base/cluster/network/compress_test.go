@@ -0,0 +1,234 @@
+// -------------------------------------------
+// @file      : compress_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/9 下午2:30
+// -------------------------------------------
+
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"gogs/base/config"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordHandler 测试用的会话处理器,记录收到的消息
+type recordHandler struct {
+	messages chan *Message
+}
+
+func (handler *recordHandler) Read(_ ISession, msg *Message)      { handler.messages <- msg }
+func (handler *recordHandler) SessionStatusChanged(SessionStatus) {}
+
+// testPair 通过进程内传输层连接的网关会话和客户端会话
+type testPair struct {
+	transport *MemoryTransport
+	gate      *GateDriver
+	client    *ClientSession
+	session   *GateSession
+	received  chan *Message // 网关会话收到的消息
+}
+
+// newTestPair 启动网关并建立一个客户端会话,测试结束时关闭
+func newTestPair(t *testing.T, security *Security) *testPair {
+	pair := &testPair{
+		transport: NewMemoryTransport(),
+		received:  make(chan *Message, 16),
+	}
+	sessions := make(chan ISession, 1)
+	pair.gate = NewGateDriver("gate", func(session ISession) (ISessionHandler, error) {
+		sessions <- session
+		return &recordHandler{messages: pair.received}, nil
+	}, pair.transport, security)
+	t.Cleanup(pair.gate.Close)
+	waitUntil(t, "gate listen", func() bool {
+		pair.gate.RLock()
+		defer pair.gate.RUnlock()
+		return pair.gate.listener != nil
+	})
+	clientDriver := NewClientDriver("gate", func(session ISession) (ISessionHandler, error) {
+		return &testHandler{}, nil
+	}, pair.transport, security)
+	t.Cleanup(clientDriver.Close)
+	session, err := clientDriver.NewSession("1", ConnectionTypeOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair.client = session.(*ClientSession)
+	select {
+	case s := <-sessions:
+		pair.session = s.(*GateSession)
+	case <-time.After(5 * time.Second):
+		t.Fatal("gate session not created")
+	}
+	return pair
+}
+
+// receive 等待网关会话收到一个消息
+func (pair *testPair) receive(t *testing.T) *Message {
+	select {
+	case msg := <-pair.received:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+	return nil
+}
+
+var testConfigOnce sync.Once
+
+// initTestConfig 初始化测试使用的配置,只初始化一次
+func initTestConfig() {
+	testConfigOnce.Do(func() {
+		config.With(config.KeyRPC, config.KeyLog)
+	})
+}
+
+// setConfig 修改一项配置,测试结束时恢复
+// 只写入修改的字段,避免和会话后台读取的其他配置竞争
+func setConfig[T any](t *testing.T, field *T, value T) {
+	old := *field
+	*field = value
+	t.Cleanup(func() {
+		*field = old
+	})
+}
+
+// rpcConfig 测试使用的rpc配置
+func rpcConfig() *config.RPCConfig {
+	initTestConfig()
+	return config.GetRPCConfig()
+}
+
+func TestCompressNegotiate(t *testing.T) {
+	for _, compressType := range []CompressType{CompressTypeSnappy, CompressTypeZstd} {
+		t.Run(compressType.String(), func(t *testing.T) {
+			setConfig(t, &rpcConfig().Compress, int32(compressType))
+			pair := newTestPair(t, &Security{})
+			pair.session.Lock()
+			negotiated := pair.session.compress
+			pair.session.Unlock()
+			if negotiated != compressType {
+				t.Fatalf("negotiated compress: %s, expect: %s", negotiated, compressType)
+			}
+			data := bytes.Repeat([]byte("gogs"), 1024)
+			if err := pair.client.Write(&Message{Type: MessageTypeCall, Data: data}); err != nil {
+				t.Fatal(err)
+			}
+			if msg := pair.receive(t); !bytes.Equal(msg.Data, data) || msg.Compressed {
+				t.Fatalf("unexpected message: %s compressed: %v len: %d", msg.Type, msg.Compressed, len(msg.Data))
+			}
+		})
+	}
+}
+
+func TestCompressMismatch(t *testing.T) {
+	setConfig(t, &rpcConfig().Compress, int32(CompressTypeSnappy))
+	remote := localHandshake("client")
+	remote.Compress = CompressTypeZstd
+	if hs := negotiate("gate", remote); hs.Compress != CompressTypeNone {
+		t.Fatalf("mismatched compress negotiated: %s", hs.Compress)
+	}
+
+	// 网关应答的握手中不启用压缩
+	pair := newTestPair(t, &Security{})
+	conn, err := pair.transport.Dial("gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream := NewStream(conn, conn)
+	if err = WriteMessage(stream, &Message{Type: MessageTypeHandshake, Data: remote.Marshal()}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ReadMessage(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := UnmarshalHandshake(msg.Data)
+	if err != nil || msg.Type != MessageTypeAccept || hs.Compress != CompressTypeNone {
+		t.Fatalf("unexpected answer: %s %+v err: %v", msg.Type, hs, err)
+	}
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	initTestConfig()
+	queue := newSendQueue(8, OverflowPolicyReject, 0, nil)
+	var sent []*Message
+	for i := 0; i < 4; i++ {
+		msg := &Message{Type: MessageTypeCall, Data: bytes.Repeat([]byte{byte(i)}, 64*(i+1))}
+		sent = append(sent, msg)
+		if err := queue.push(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch, kicked := mergeMessages(queue.poll(), queue, 8)
+	if kicked || batch.Type != MessageTypeBatch {
+		t.Fatalf("messages not merged: %s", batch.Type)
+	}
+
+	// 批量消息压缩后写入一帧,读取后拆开得到原消息
+	var buf bytes.Buffer
+	stream := NewStream(&buf, &buf)
+	if err := stream.SetCompress(CompressTypeZstd); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.WriteMessage(batch); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := stream.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []*Message
+	if err = dispatchMessage(msg, func(m *Message) { received = append(received, m) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != len(sent) {
+		t.Fatalf("received %d messages, expect %d", len(received), len(sent))
+	}
+	for i, m := range received {
+		if m.Type != sent[i].Type || !bytes.Equal(m.Data, sent[i].Data) {
+			t.Fatalf("message %d mismatch", i)
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	setConfig(t, &rpcConfig().MaxMessageSize, 1<<20)
+	// snappy头部声明2GB
+	claimed := make([]byte, binary.MaxVarintLen64)
+	snappyFrame := append(claimed[:binary.PutUvarint(claimed, 1<<31)], 0, 0, 0, 0)
+	// zstd单段帧,头部声明1TB的内容大小
+	zstdFrame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0xe0}
+	zstdFrame = binary.LittleEndian.AppendUint64(zstdFrame, 1<<40)
+	zstdFrame = append(zstdFrame, 0x01, 0x00, 0x00)
+
+	for compressType, frame := range map[CompressType][]byte{
+		CompressTypeSnappy: snappyFrame,
+		CompressTypeZstd:   zstdFrame,
+	} {
+		var buf bytes.Buffer
+		stream := NewStream(&buf, &buf)
+		if err := stream.SetCompress(compressType); err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteMessage(stream, &Message{Type: MessageTypeCall, Data: frame, Compressed: true}); err != nil {
+			t.Fatal(err)
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := stream.ReadMessage(); err == nil {
+			t.Fatalf("%s frame claiming huge size accepted", compressType)
+		}
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+			t.Fatalf("%s allocated %d bytes for a huge frame", compressType, allocated)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// -------------------------------------------
+// @file      : flow.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/20 下午2:15
+// -------------------------------------------
+
+package network
+
+import (
+	"gogs/base/cberrors"
+	"sync/atomic"
+)
+
+// flowControl 基于信用的流量控制,用于集群节点之间
+// 发送方每发送一帧消耗一个信用,信用耗尽时暂停发送,消息积压在发送队列中由溢出策略处理
+// 接收方每收到一帧记录一个待归还信用,累计到窗口一半时通过信用消息归还给发送方
+type flowControl struct {
+	sendWindow int32         // 对端的接收窗口,0表示不限制发送
+	recvWindow int32         // 本地的接收窗口,0表示不归还信用
+	credits    int32         // 剩余发送信用
+	pending    int32         // 待归还给对端的信用
+	refill     chan struct{} // 收到对端归还的信用
+	notify     chan struct{} // 有待归还的信用
+}
+
+// newFlowControl 新建流量控制
+func newFlowControl() *flowControl {
+	return &flowControl{
+		refill: make(chan struct{}, 1),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// signal 非阻塞通知
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// reset 连接建立时重置窗口和信用
+func (flow *flowControl) reset(sendWindow, recvWindow uint32) {
+	atomic.StoreInt32(&flow.sendWindow, int32(sendWindow))
+	atomic.StoreInt32(&flow.recvWindow, int32(recvWindow))
+	atomic.StoreInt32(&flow.credits, int32(sendWindow))
+	atomic.StoreInt32(&flow.pending, 0)
+}
+
+// received 收到一帧消息,待归还信用累计到窗口一半时通知发送循环归还
+func (flow *flowControl) received() {
+	window := atomic.LoadInt32(&flow.recvWindow)
+	if window <= 0 {
+		return
+	}
+	threshold := window / 2
+	if threshold < 1 {
+		threshold = 1
+	}
+	if atomic.AddInt32(&flow.pending, 1) >= threshold {
+		signal(flow.notify)
+	}
+}
+
+// granted 对端归还信用
+func (flow *flowControl) granted(count uint32) {
+	atomic.AddInt32(&flow.credits, int32(count))
+	signal(flow.refill)
+}
+
+// take 取出待归还的信用
+func (flow *flowControl) take() uint32 {
+	return uint32(atomic.SwapInt32(&flow.pending, 0))
+}
+
+// acquire 获取一个发送信用,信用耗尽时等待对端归还
+// 等待期间调用flush归还本地的待归还信用,避免双方同时耗尽信用时死锁,exit关闭时返回错误
+func (flow *flowControl) acquire(exit <-chan struct{}, flush func() error) error {
+	if atomic.LoadInt32(&flow.sendWindow) <= 0 {
+		return nil
+	}
+	for {
+		credits := atomic.LoadInt32(&flow.credits)
+		if credits > 0 {
+			if atomic.CompareAndSwapInt32(&flow.credits, credits, credits-1) {
+				return nil
+			}
+			continue
+		}
+		select {
+		case <-flow.refill:
+		case <-flow.notify:
+			if err := flush(); err != nil {
+				return err
+			}
+		case <-exit:
+			return cberrors.New("flow control exit while waiting credit")
+		}
+	}
+}
+
+// message 生成归还信用的消息,没有待归还的信用时返回nil
+func (flow *flowControl) message() *Message {
+	count := flow.take()
+	if count == 0 {
+		return nil
+	}
+	credit := &Credit{
+		Count: count,
+	}
+	return &Message{
+		Type: MessageTypeCredit,
+		Data: credit.Marshal(),
+	}
+}
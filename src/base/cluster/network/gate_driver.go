@@ -8,52 +8,109 @@
 package network
 
 import (
+	"errors"
 	"fmt"
-	"github.com/gorilla/websocket"
 	"gogs/base/cberrors"
 	"gogs/base/config"
 	log "gogs/base/logger"
 	"net"
-	"net/http"
 	"runtime"
 	"sync"
 	"time"
 )
 
-// upgrader websocket默认参数
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
 // GateDriver 网关驱动
 type GateDriver struct {
 	sync.RWMutex
 	localAddr             string                  // 本地地址
 	remotes               map[string]*GateSession // 远程会话
+	resumes               map[string]*GateSession // 可恢复的会话,恢复令牌ID索引
 	mutexGroup            []sync.Mutex            // 会话互斥锁列表
 	sessionHandlerBuilder SessionHandlerBuilder   // 会话处理器构造器
 	name                  string                  // 驱动名字
-	protocol              ProtocolType            // 协议类型
+	transport             ITransport              // 传输层
+	security              *Security               // 传输安全选项
+	listener              net.Listener            // 监听器
+	closing               bool                    // 是否已停止接受新连接
 }
 
-// NewGateDriver 新建网关驱动
-func NewGateDriver(localAddr string, builder SessionHandlerBuilder, protocol ProtocolType) *GateDriver {
+// NewGateDriver 新建网关驱动,transport为nil时使用明文tcp,security为nil时不加密
+func NewGateDriver(localAddr string, builder SessionHandlerBuilder, transport ITransport, security *Security) *GateDriver {
 	driver := &GateDriver{
 		localAddr:             localAddr,
 		remotes:               make(map[string]*GateSession),
+		resumes:               make(map[string]*GateSession),
 		mutexGroup:            make([]sync.Mutex, runtime.NumCPU()),
 		sessionHandlerBuilder: builder,
 		name:                  fmt.Sprintf("GateDriver(%s)", localAddr),
-		protocol:              protocol,
+		transport:             defaultTransport(transport),
+		security:              security,
 	}
 	go driver.run()
+	trackDriver(driver)
 	return driver
 }
 
-// Close 关闭驱动
+// Close 关闭驱动,停止接受新连接,通知所有客户端服务器关闭,发送完已缓存的消息后断开
+// 超过关闭等待时间仍未断开的会话强制关闭
 func (driver *GateDriver) Close() {
+	untrackDriver(driver)
+	driver.StopAccept()
+	driver.RLock()
+	sessions := make([]*GateSession, 0, len(driver.remotes))
+	for _, session := range driver.remotes {
+		sessions = append(sessions, session)
+	}
+	driver.RUnlock()
+	log.Infof("driver: %s closing, sessions: %d", driver, len(sessions))
+	for _, session := range sessions {
+		if err := session.Kick(KickReasonShutdown, "server shutdown"); err != nil {
+			log.Warnf("driver: %s kick session err: %s", driver, err)
+		}
+	}
+	timer := time.NewTimer(config.ShutdownTimeout())
+	defer timer.Stop()
+	for _, session := range sessions {
+		select {
+		case <-session.exit:
+		case <-timer.C:
+			log.Warnf("driver: %s close timeout, force close sessions", driver)
+			for _, s := range sessions {
+				s.Close()
+			}
+			return
+		}
+	}
+}
+
+// StopAccept 停止接受新连接,关闭监听器,已建立的会话不受影响
+func (driver *GateDriver) StopAccept() {
+	driver.Lock()
+	driver.closing = true
+	listener := driver.listener
+	driver.listener = nil
+	driver.Unlock()
+	if listener != nil {
+		_ = listener.Close()
+	}
+}
+
+// isClosing 是否已停止接受新连接
+func (driver *GateDriver) isClosing() bool {
+	driver.RLock()
+	defer driver.RUnlock()
+	return driver.closing
+}
+
+// setListener 保存监听器,已停止接受新连接时返回false
+func (driver *GateDriver) setListener(listener net.Listener) bool {
+	driver.Lock()
+	defer driver.Unlock()
+	if driver.closing {
+		return false
+	}
+	driver.listener = listener
+	return true
 }
 
 // String 获取网关驱动名字 GateDriver(localAddr)
@@ -78,7 +135,7 @@ func (driver *GateDriver) Type() DriverType {
 
 // Protocol 协议类型
 func (driver *GateDriver) Protocol() ProtocolType {
-	return driver.protocol
+	return driver.transport.Protocol()
 }
 
 // GetSession 获取指定名字的会话
@@ -94,6 +151,17 @@ func (driver *GateDriver) NewSession(name string, connectionType ConnectionType)
 	return nil, cberrors.New("gate driver: %s not support manual new channel", driver)
 }
 
+// Sessions 所有会话,包括断线后等待恢复的会话
+func (driver *GateDriver) Sessions() []ISession {
+	driver.RLock()
+	defer driver.RUnlock()
+	sessions := make([]ISession, 0, len(driver.remotes))
+	for _, session := range driver.remotes {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
 // DelSession 删除指定的会话
 func (driver *GateDriver) DelSession(channel ISession) {
 	driver.Lock()
@@ -103,81 +171,148 @@ func (driver *GateDriver) DelSession(channel ISession) {
 	}
 }
 
+// addResume 登记可恢复的会话
+func (driver *GateDriver) addResume(id string, session *GateSession) {
+	driver.Lock()
+	defer driver.Unlock()
+	driver.resumes[id] = session
+}
+
+// delResume 删除可恢复的会话
+func (driver *GateDriver) delResume(id string) {
+	driver.Lock()
+	defer driver.Unlock()
+	delete(driver.resumes, id)
+}
+
+// getResume 通过恢复令牌ID获取会话
+func (driver *GateDriver) getResume(id string) (*GateSession, bool) {
+	driver.RLock()
+	defer driver.RUnlock()
+	session, ok := driver.resumes[id]
+	return session, ok
+}
+
 // run 启动网关驱动
 func (driver *GateDriver) run() {
-	switch driver.protocol {
-	case ProtocolTCP:
-		driver.runTCP()
-	case ProtocolWebsocket:
-		http.HandleFunc("/gate", driver.handleAcceptWebsocket)
-		driver.runWebsocket()
-	default:
-		cberrors.Panic("unsupported protocol: %s", driver.protocol)
-	}
-}
-
-// runTCP 以tcp协议启动网关驱动
-func (driver *GateDriver) runTCP() {
-	// 启动监听
-	log.Infof("start tcp listen: %s", driver.localAddr)
-	listener, err := net.Listen("tcp", driver.localAddr)
+	if driver.isClosing() {
+		return
+	}
+	log.Infof("start gate listen: %s protocol: %d", driver.localAddr, driver.Protocol())
+	listener, err := driver.transport.Listen(driver.localAddr)
 	if err != nil {
-		log.Errorf("tcp listen: %s err: %s", driver.localAddr, err)
+		log.Errorf("gate listen: %s err: %s", driver.localAddr, err)
 		time.AfterFunc(config.ListenRetryInterval(), driver.run)
 		return
 	}
+	if !driver.setListener(listener) {
+		_ = listener.Close()
+		return
+	}
+	driver.serve(listener)
+}
+
+// serve 在监听器上接受连接
+func (driver *GateDriver) serve(listener net.Listener) {
 	for {
-		var conn net.Conn
-		conn, err = listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Errorf("tcp accept: %s err: %s", driver.localAddr, err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Errorf("driver: %s accept err: %s", driver, err)
 			continue
 		}
-		stream := NewStream(conn, conn)
-		go driver.handleAccept(stream, conn, nil)
+		go driver.handleAccept(conn)
 	}
 }
 
-// handleAcceptTCP 处理新连接
-func (driver *GateDriver) handleAccept(stream *Stream, conn net.Conn, websocketConn *websocket.Conn) {
-	// TODO 交换密钥
-	// msg, err := ReadMessage(stream)
-	var key []byte
-	channel, err := driver.newGateSession(key, conn, websocketConn)
+// handleAccept 处理新连接
+func (driver *GateDriver) handleAccept(conn net.Conn) {
+	stream := NewStream(conn, conn).measure(DriverTypeGate)
+	// 第一个必须是握手消息
+	msg, err := ReadMessage(stream)
 	if err != nil {
-		log.Errorf("driver: %s new channel: %s err: %s", driver, conn.RemoteAddr(), err)
+		log.Errorf("driver: %s read handshake err: %s", driver, err)
 		_ = conn.Close()
 		return
 	}
-	log.Infof("driver: %s new channel: %s", driver, channel)
-	// websocket 特殊处理
-	if driver.protocol == ProtocolWebsocket {
-		<-channel.exit
+	if msg.Type != MessageTypeHandshake {
+		log.Errorf("driver: %s except handshake message, but got: %s", driver, msg.Type)
+		_ = conn.Close()
+		return
 	}
-}
-
-// runWebsocket 以websocket协议启动网关驱动
-func (driver *GateDriver) runWebsocket() {
-	log.Infof("start websocket listen: %s", driver.localAddr)
-	if err := http.ListenAndServe(driver.localAddr, nil); err != nil {
-		log.Errorf("websocket listen: %s err: %s", driver.localAddr, err)
-		time.AfterFunc(config.ListenRetryInterval(), driver.run)
+	remote, err := UnmarshalHandshake(msg.Data)
+	if err != nil || remote == nil {
+		log.Errorf("driver: %s invalid handshake: %v", driver, err)
+		_ = conn.Close()
 		return
 	}
-}
-
-// handleAcceptWebSocket 处理新的websocket连接
-func (driver *GateDriver) handleAcceptWebsocket(w http.ResponseWriter, r *http.Request) {
-	websocketConn, err := upgrader.Upgrade(w, r, nil)
+	// 协商压缩和批量参数,交换密钥,在会话开始收发前应答
+	hs := negotiate(driver.name, remote)
+	key, err := driver.exchangeKey(remote, hs)
 	if err != nil {
-		log.Errorf("websocket upgrade: %s err: %s", driver.localAddr, err)
+		log.Errorf("driver: %s exchange key err: %s", driver, err)
+		msg.Type = MessageTypeReject
+		msg.Data = nil
+		_ = WriteMessage(stream, msg)
+		_ = conn.Close()
 		return
 	}
-	defer func() {
-		if err = websocketConn.Close(); err != nil {
-			log.Errorf("websocket close remote: %s err: %s", websocketConn.RemoteAddr(), err)
+	// 携带恢复令牌时尝试恢复原会话,失败时建立新会话
+	var resumed *GateSession
+	if remote.ResumeID != "" {
+		if session, ok := driver.getResume(remote.ResumeID); ok {
+			if err = session.resume(remote); err != nil {
+				log.Warnf("driver: %s resume session err: %s", driver, err)
+			} else {
+				resumed = session
+				hs.Resumed = true
+			}
 		}
-	}()
-	stream := NewWebsocketStream(websocketConn)
-	go driver.handleAccept(stream, nil, websocketConn)
+	}
+	msg.Type = MessageTypeAccept
+	msg.Data = hs.Marshal()
+	if err = WriteMessage(stream, msg); err != nil {
+		log.Errorf("driver: %s write handshake err: %s", driver, err)
+		_ = conn.Close()
+		return
+	}
+	var channel *GateSession
+	if resumed != nil {
+		channel = resumed
+		err = resumed.reattach(key, hs, conn, remote.AckSeq)
+	} else {
+		channel, err = driver.newGateSession(key, hs, conn)
+	}
+	if err != nil {
+		log.Errorf("driver: %s new channel err: %s", driver, err)
+		_ = conn.Close()
+		return
+	}
+	log.Infof("driver: %s new channel: %s", driver, channel)
+}
+
+// exchangeKey 密钥交换,启用加密时生成本地密钥对,公钥随应答返回,返回计算得到的AES密钥
+// 配置了签名私钥时对双方公钥签名,客户端据此确认公钥来自网关
+func (driver *GateDriver) exchangeKey(remote, hs *Handshake) ([]byte, error) {
+	if !driver.security.encrypt() {
+		return nil, nil
+	}
+	if len(remote.PublicKey) == 0 {
+		return nil, cberrors.New("encryption required but public key missing")
+	}
+	private, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	key, err := deriveKey(private, remote.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	hs.PublicKey = private.PublicKey().Bytes()
+	if driver.security.SignKey != nil {
+		hs.Signature = signHandshake(driver.security.SignKey, hs.PublicKey, remote.PublicKey)
+	}
+	return key, nil
 }
@@ -8,40 +8,57 @@
 package network
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"github.com/gorilla/websocket"
 	"gogs/base/cberrors"
 	"gogs/base/config"
 	log "gogs/base/logger"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // GateSession 网关会话
+// 登录后签发恢复令牌,连接断开时会话等待恢复,恢复窗口内携带令牌的新连接可以重新接管会话
 type GateSession struct {
-	conn          net.Conn        // tcp连接
-	websocketConn *websocket.Conn // websocket连接
-	driver        *GateDriver     // 所属驱动
-	status        SessionStatus   // 状态
-	handler       ISessionHandler // 会话处理器
-	cached        chan *Message   // 发送消息队列
-	name          string          // 会话名字
-	key           []byte          // AES密钥
-	exit          chan struct{}   // 结束信号
+	sync.Mutex                 // 保护连接切换,消息序号和重放缓冲区
+	writeLock  sync.Mutex      // 保证已编号的消息按序号写入发送队列
+	conn       net.Conn        // 连接
+	driver     *GateDriver     // 所属驱动
+	status     SessionStatus   // 状态
+	handler    ISessionHandler // 会话处理器
+	cached     *sendQueue      // 发送消息队列
+	name       string          // 会话名字
+	key        []byte          // AES密钥
+	exit       chan struct{}   // 结束信号,会话关闭时关闭
+	done       chan struct{}   // 当前连接的结束信号,连接断开时关闭,等待恢复时为nil
+	closeOnce  sync.Once       // 保证只关闭一次
+	kicked     int32           // 是否已踢下线,踢下线后不再接受新消息
+	compress   CompressType    // 协商后的压缩算法
+	batch      bool            // 协商后是否启用批量消息
+	heartbeat  *heartbeat      // 心跳
+	token      *ResumeToken    // 恢复会话令牌,为nil时连接断开直接关闭会话
+	seq        uint64          // 最后发送的消息序号
+	replay     *replayBuffer   // 重放缓冲区
+	grace      *time.Timer     // 恢复窗口定时器
 }
 
 // newGateSession 新建网关会话
-func (driver *GateDriver) newGateSession(key []byte, conn net.Conn, websocketConn *websocket.Conn) (*GateSession, error) {
+func (driver *GateDriver) newGateSession(key []byte, hs *Handshake, conn net.Conn) (*GateSession, error) {
 	remoteAddr := conn.RemoteAddr().String()
 	session := &GateSession{
-		conn:          conn,
-		websocketConn: websocketConn,
-		driver:        driver,
-		status:        SessionStatusInConnected,
-		cached:        make(chan *Message, config.GateSessionCache()),
-		name:          fmt.Sprintf("GateSession(%s->%s)", remoteAddr, driver.localAddr),
-		key:           key,
-		exit:          make(chan struct{}, 1),
+		driver:    driver,
+		status:    SessionStatusInConnected,
+		name:      fmt.Sprintf("GateSession(%s->%s)", remoteAddr, driver.localAddr),
+		exit:      make(chan struct{}),
+		heartbeat: newHeartbeat(),
 	}
+	session.cached = newSendQueue(config.GateSessionCache(), OverflowPolicy(config.GateSessionOverflow()),
+		config.OverflowTimeout(), session.disconnect)
+	session.heartbeat.acked = session.acked
 	// 创建会话处理器
 	handler, err := driver.sessionHandlerBuilder(session)
 	if err != nil {
@@ -49,14 +66,20 @@ func (driver *GateDriver) newGateSession(key []byte, conn net.Conn, websocketCon
 	}
 	session.handler = handler
 	// 启动发送和接收
-	go session.recvLoop()
-	go session.sendLoop()
+	session.Lock()
+	err = session.attach(key, hs, conn, 0)
+	// 收发循环已启动,状态可能被并发修改
+	status := session.status
+	session.Unlock()
+	if err != nil {
+		return nil, err
+	}
 	// 加入到所属驱动
 	driver.Lock()
-	driver.remotes[remoteAddr] = session
+	driver.remotes[session.name] = session
 	driver.Unlock()
 	// 通知处理器,会话状态变更
-	session.handler.SessionStatusChanged(session.status)
+	session.handler.SessionStatusChanged(status)
 	return session, nil
 }
 
@@ -72,14 +95,250 @@ func (session *GateSession) Name() string {
 
 // Close 关闭会话
 func (session *GateSession) Close() {
-	// 修改状态
-	session.status = SessionStatusClosed
-	// 关闭连接
-	_ = session.conn.Close()
-	// 取消注册
-	session.driver.DelSession(session)
-	// 通知处理器,会话状态变更
-	session.handler.SessionStatusChanged(session.status)
+	session.closeOnce.Do(func() {
+		session.Lock()
+		// 修改状态
+		session.status = SessionStatusClosed
+		if session.grace != nil {
+			session.grace.Stop()
+			session.grace = nil
+		}
+		// 关闭连接
+		session.detach()
+		// 取消注册
+		if session.token != nil {
+			session.driver.delResume(session.token.ID)
+		}
+		session.Unlock()
+		close(session.exit)
+		session.driver.DelSession(session)
+		// 通知处理器,会话状态变更
+		session.handler.SessionStatusChanged(session.status)
+	})
+}
+
+// Kick 踢下线,已缓存的消息和踢下线通知发送完后关闭连接,等待恢复的会话直接关闭
+func (session *GateSession) Kick(reason KickReason, message string) error {
+	if !atomic.CompareAndSwapInt32(&session.kicked, 0, 1) {
+		return cberrors.New("gate session: %s already kicked", session)
+	}
+	kick := &Kick{
+		Reason:  reason,
+		Message: message,
+	}
+	msg := &Message{
+		Type: MessageTypeKick,
+		Data: kick.Marshal(),
+	}
+	session.Lock()
+	if session.done == nil {
+		session.Unlock()
+		session.Close()
+		return nil
+	}
+	if session.cached.offer(msg) {
+		session.Unlock()
+		return nil
+	}
+	session.Unlock()
+	// 发送队列已满,无法通知,直接关闭
+	session.Close()
+	return cberrors.New("gate session: %s sending queue overflow: %d, kick directly", session, session.cached.len())
+}
+
+// EnableResume 启用会话恢复,签发恢复令牌并通过会话消息流下发给客户端
+// 之后发送的消息带序号并保存到重放缓冲区,连接断开后在恢复窗口内等待客户端重连
+func (session *GateSession) EnableResume() error {
+	if config.ResumeGrace() <= 0 {
+		return cberrors.New("gate session: %s resume disabled", session)
+	}
+	session.Lock()
+	if session.token != nil {
+		session.Unlock()
+		return nil
+	}
+	session.replay = newReplayBuffer(config.ResumeBuffer())
+	msg, err := session.renewToken()
+	session.Unlock()
+	if err != nil {
+		return err
+	}
+	return session.Write(msg)
+}
+
+// renewToken 签发新的恢复令牌替换旧令牌,返回下发令牌的消息,调用方持有锁
+// 令牌只通过会话消息流下发,启用加密时不会以明文出现在握手中
+func (session *GateSession) renewToken() (*Message, error) {
+	if session.status == SessionStatusClosed {
+		return nil, cberrors.New("gate session: %s closed", session)
+	}
+	token, err := newResumeToken()
+	if err != nil {
+		return nil, err
+	}
+	if session.token != nil {
+		session.driver.delResume(session.token.ID)
+	}
+	session.token = token
+	session.driver.addResume(token.ID, session)
+	return &Message{
+		Type: MessageTypeResume,
+		Data: token.Marshal(),
+	}, nil
+}
+
+// newResumeToken 生成随机恢复令牌
+func newResumeToken() (*ResumeToken, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	token := &ResumeToken{
+		ID:     hex.EncodeToString(id),
+		Secret: make([]byte, 32),
+	}
+	if _, err := rand.Read(token.Secret); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// attach 绑定连接并启动收发循环,先重放客户端未收到的消息,调用方持有锁
+func (session *GateSession) attach(key []byte, hs *Handshake, conn net.Conn, ackSeq uint64) error {
+	if session.status == SessionStatusClosed {
+		return cberrors.New("gate session: %s closed", session)
+	}
+	var pending []*Message
+	if session.replay != nil {
+		var ok bool
+		if pending, ok = session.replay.since(ackSeq); !ok {
+			return cberrors.New("gate session: %s replay buffer overflow, ack: %d", session, ackSeq)
+		}
+		session.replay.ack(ackSeq)
+	}
+	if session.grace != nil {
+		session.grace.Stop()
+		session.grace = nil
+	}
+	session.conn = conn
+	session.key = key
+	session.compress = hs.Compress
+	session.batch = hs.Batch
+	session.status = SessionStatusInConnected
+	done := make(chan struct{})
+	session.done = done
+	session.heartbeat.reset()
+	go session.recvLoop(session.newStream(), done)
+	go session.sendLoop(session.newStream(), done, pending)
+	go session.heartbeat.loop(session, done, func() {
+		session.lost(done)
+	})
+	return nil
+}
+
+// detach 关闭当前连接并停止收发循环,调用方持有锁
+func (session *GateSession) detach() {
+	if session.conn != nil {
+		_ = session.conn.Close()
+	}
+	if session.done != nil {
+		close(session.done)
+		session.done = nil
+	}
+	session.conn = nil
+}
+
+// wait 断开当前连接等待恢复,恢复窗口超时后关闭会话,调用方持有锁
+func (session *GateSession) wait() {
+	session.detach()
+	session.status = SessionStatusDisconnected
+	if session.grace != nil {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(config.ResumeGrace(), func() {
+		session.Lock()
+		expired := session.grace == timer
+		session.Unlock()
+		if expired {
+			log.Infof("%s session: %s resume timeout", session.driver, session)
+			session.Close()
+		}
+	})
+	session.grace = timer
+}
+
+// lost 连接断开,已签发令牌的会话等待恢复,否则关闭会话
+func (session *GateSession) lost(done chan struct{}) {
+	session.Lock()
+	if session.done != done {
+		// 连接已被替换或已断开
+		session.Unlock()
+		return
+	}
+	if session.token == nil || session.status == SessionStatusClosed || atomic.LoadInt32(&session.kicked) == 1 {
+		session.Unlock()
+		session.Close()
+		return
+	}
+	session.wait()
+	session.Unlock()
+	log.Infof("%s session: %s lost connection, wait resume: %s", session.driver, session, config.ResumeGrace())
+	session.handler.SessionStatusChanged(SessionStatusDisconnected)
+}
+
+// resume 新连接携带令牌恢复会话,验证恢复签名后断开旧连接并检查重放缓冲区是否完整
+// 签名错误时保留原会话,重放缓冲区不完整时关闭会话,客户端需要重新登录
+func (session *GateSession) resume(remote *Handshake) error {
+	ackSeq := remote.AckSeq
+	session.Lock()
+	if session.status == SessionStatusClosed {
+		session.Unlock()
+		return cberrors.New("gate session: %s closed", session)
+	}
+	if session.token == nil || !hmac.Equal(remote.ResumeMAC, resumeMAC(session.token, ackSeq, remote.PublicKey)) {
+		session.Unlock()
+		return cberrors.New("gate session: %s invalid resume mac", session)
+	}
+	// 旧连接可能是尚未发现的半开连接
+	session.wait()
+	// 等待恢复期间的消息只保存在重放缓冲区
+	session.cached.drain()
+	_, ok := session.replay.since(ackSeq)
+	session.Unlock()
+	if !ok {
+		session.Close()
+		return cberrors.New("gate session: %s replay buffer overflow, ack: %d", session, ackSeq)
+	}
+	return nil
+}
+
+// reattach 恢复会话时绑定新连接,并签发新的恢复令牌,旧令牌随即失效
+// 新令牌未送达客户端时连接再次断开,客户端需要重新登录
+func (session *GateSession) reattach(key []byte, hs *Handshake, conn net.Conn, ackSeq uint64) error {
+	session.Lock()
+	err := session.attach(key, hs, conn, ackSeq)
+	var msg *Message
+	if err == nil {
+		msg, err = session.renewToken()
+	}
+	session.Unlock()
+	if err != nil {
+		session.Close()
+		return err
+	}
+	log.Infof("%s session: %s resumed, ack: %d", session.driver, session, ackSeq)
+	session.handler.SessionStatusChanged(SessionStatusInConnected)
+	return session.Write(msg)
+}
+
+// acked 客户端确认收到的消息从重放缓冲区删除
+func (session *GateSession) acked(seq uint64) {
+	session.Lock()
+	defer session.Unlock()
+	if session.replay != nil {
+		session.replay.ack(seq)
+	}
 }
 
 // Handler 获取会话处理器
@@ -92,11 +351,49 @@ func (session *GateSession) Write(msg *Message) error {
 	if session.status == SessionStatusClosed {
 		return cberrors.New("cluster session: %s closed", session)
 	}
-	select {
-	case session.cached <- msg:
+	if atomic.LoadInt32(&session.kicked) == 1 {
+		return cberrors.New("cluster session: %s kicked", session)
+	}
+	// 已编号的消息按序号写入发送队列,乱序时客户端会丢弃序号较小的消息
+	if replayable(msg.Type) {
+		session.writeLock.Lock()
+		defer session.writeLock.Unlock()
+	}
+	session.Lock()
+	// 启用恢复后为消息编号并保存到重放缓冲区
+	if session.replay != nil && replayable(msg.Type) {
+		session.seq++
+		m := *msg
+		m.Seq = session.seq
+		msg = &m
+		session.replay.push(msg)
+	}
+	done := session.done
+	session.Unlock()
+	if done == nil {
+		// 等待恢复,消息在恢复后从重放缓冲区发送
 		return nil
-	default:
-		return cberrors.New("cluster session: %s sending queue overflow: %d", session, len(session.cached))
+	}
+	// 阻塞策略可能等待到超时,不持有会话锁
+	if err := session.cached.push(msg); err != nil {
+		return cberrors.New("gate session: %s %s", session, err)
+	}
+	return nil
+}
+
+// QueueStats implements IQueueStats
+func (session *GateSession) QueueStats() QueueStats {
+	return session.cached.stats()
+}
+
+// disconnect 断开发送过慢的连接,可恢复的会话等待恢复
+func (session *GateSession) disconnect() {
+	session.Lock()
+	done := session.done
+	session.Unlock()
+	if done != nil {
+		log.Warnf("%s session: %s slow consumer, disconnect", session.driver, session)
+		session.lost(done)
 	}
 }
 
@@ -116,45 +413,79 @@ func (session *GateSession) DriverType() DriverType {
 	return session.driver.Type()
 }
 
+// RTT 最近一次心跳测得的往返时延
+func (session *GateSession) RTT() time.Duration {
+	return session.heartbeat.RTT()
+}
+
+// newStream 根据协商结果创建消息流
+func (session *GateSession) newStream() *Stream {
+	stream := NewStream(session.conn, session.conn).measure(DriverTypeGate)
+	if err := stream.SetCompress(session.compress); err != nil {
+		log.Errorf("session: %s set compress err: %s", session, err)
+	}
+	if session.key != nil {
+		if err := stream.SetCipher(session.key, directionGate, directionClient); err != nil {
+			log.Errorf("session: %s set cipher err: %s", session, err)
+		}
+	}
+	return stream
+}
+
 // recvLoop 接收循环
-func (session *GateSession) recvLoop() {
-	var stream *Stream
-	if session.driver.protocol == ProtocolTCP {
-		stream = NewStream(session.conn, session.conn)
-	} else {
-		stream = NewWebsocketStream(session.websocketConn)
+func (session *GateSession) recvLoop(stream *Stream, done chan struct{}) {
+	read := func(msg *Message) {
+		if !session.heartbeat.handle(session, msg) {
+			session.handler.Read(session, msg)
+		}
 	}
 	for {
-		msg, err := ReadMessage(stream)
+		msg, err := stream.ReadMessage()
 		log.Infof("session: %s recv msg: %+v", session, msg)
+		if err == nil {
+			session.heartbeat.received()
+			// 通知处理器,读取到一个或一批消息
+			err = dispatchMessage(msg, read)
+		}
 		if err != nil {
-			session.Close()
+			session.lost(done)
 			log.Debugf("%s session: %s recv loop err: %s", session.driver, session, err)
 			break
 		}
-		// 通知处理器,读取到一个消息
-		session.handler.Read(session, msg)
 	}
-	// 关闭信号
-	session.exit <- struct{}{}
 }
 
-// sendLoop 发送循环
-func (session *GateSession) sendLoop() {
-	var stream *Stream
-	if session.driver.protocol == ProtocolTCP {
-		stream = NewStream(session.conn, session.conn)
-	} else {
-		stream = NewWebsocketStream(session.websocketConn)
+// sendLoop 发送循环,先发送重放的消息,发送踢下线消息后关闭会话
+func (session *GateSession) sendLoop(stream *Stream, done chan struct{}, pending []*Message) {
+	for _, msg := range pending {
+		if err := stream.WriteMessage(msg); err != nil {
+			session.lost(done)
+			log.Debugf("%s session: %s replay err: %s", session.driver, session, err)
+			return
+		}
+	}
+	batch := 0
+	if session.batch {
+		batch = config.SessionBatch()
 	}
-	for msg := range session.cached {
-		err := WriteMessage(stream, msg)
+	for {
+		msg, ok := session.cached.next(done, nil)
+		if !ok {
+			return
+		}
+		// 合并队列中已缓存的消息一起发送
+		msg, kicked := mergeMessages(msg, session.cached, batch)
+		err := stream.WriteMessage(msg)
 		if err != nil {
-			session.Close()
+			session.lost(done)
 			log.Debugf("%s session: %s send loop err: %s", session.driver, session, err)
-			break
+			return
+		}
+		session.heartbeat.sent()
+		if kicked {
+			log.Infof("%s session: %s kicked", session.driver, session)
+			session.Close()
+			return
 		}
 	}
-	// 关闭信号
-	session.exit <- struct{}{}
 }
@@ -0,0 +1,158 @@
+// -------------------------------------------
+// @file      : heartbeat.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/18 上午10:15
+// -------------------------------------------
+
+package network
+
+import (
+	"gogs/base/config"
+	log "gogs/base/logger"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeat 会话心跳,记录最后收发消息的时间和往返时延
+// 写空闲时发送心跳请求,读空闲超时视为对端已断开
+type heartbeat struct {
+	lastRecv int64         // 最后收到消息的时间,单位纳秒
+	lastSend int64         // 最后发送消息的时间,单位纳秒
+	rtt      int64         // 最近一次测得的往返时延,单位纳秒
+	ack      func() uint64 // 获取已收到的最大消息序号,随心跳请求确认,可为nil
+	acked    func(uint64)  // 对端随心跳请求确认的最大消息序号,可为nil
+}
+
+// newHeartbeat 新建会话心跳
+func newHeartbeat() *heartbeat {
+	hb := &heartbeat{}
+	hb.reset()
+	return hb
+}
+
+// reset 连接建立时重置收发时间
+func (hb *heartbeat) reset() {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&hb.lastRecv, now)
+	atomic.StoreInt64(&hb.lastSend, now)
+}
+
+// received 收到消息
+func (hb *heartbeat) received() {
+	atomic.StoreInt64(&hb.lastRecv, time.Now().UnixNano())
+}
+
+// sent 发送消息
+func (hb *heartbeat) sent() {
+	atomic.StoreInt64(&hb.lastSend, time.Now().UnixNano())
+}
+
+// RTT 最近一次测得的往返时延,尚未测得时为0
+func (hb *heartbeat) RTT() time.Duration {
+	if hb == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&hb.rtt))
+}
+
+// handle 处理心跳消息,心跳请求原样应答,心跳应答计算往返时延
+// 返回true表示是心跳消息,不再交给会话处理器
+func (hb *heartbeat) handle(session ISession, msg *Message) bool {
+	if hb == nil {
+		return false
+	}
+	switch msg.Type {
+	case MessageTypePing:
+		if hb.acked != nil {
+			if ping, err := UnmarshalHeartbeat(msg.Data); err == nil && ping != nil && ping.Ack > 0 {
+				hb.acked(ping.Ack)
+			}
+		}
+		pong := &Message{
+			Type: MessageTypePong,
+			Data: msg.Data,
+		}
+		if err := session.Write(pong); err != nil {
+			log.Debugf("session: %s write pong err: %s", session.Name(), err)
+		}
+		return true
+	case MessageTypePong:
+		ping, err := UnmarshalHeartbeat(msg.Data)
+		if err != nil || ping == nil {
+			log.Debugf("session: %s unmarshal pong err: %v", session.Name(), err)
+			return true
+		}
+		if rtt := time.Now().UnixNano() - ping.Timestamp; rtt >= 0 {
+			atomic.StoreInt64(&hb.rtt, rtt)
+		}
+		return true
+	}
+	return false
+}
+
+// ping 发送心跳请求
+func (hb *heartbeat) ping(session ISession, now time.Time) {
+	ping := &Heartbeat{
+		Timestamp: now.UnixNano(),
+	}
+	if hb.ack != nil {
+		ping.Ack = hb.ack()
+	}
+	msg := &Message{
+		Type: MessageTypePing,
+		Data: ping.Marshal(),
+	}
+	if err := session.Write(msg); err != nil {
+		log.Debugf("session: %s write ping err: %s", session.Name(), err)
+	}
+}
+
+// loop 按配置的读写空闲时间运行心跳循环
+func (hb *heartbeat) loop(session ISession, exit chan struct{}, timeout func()) {
+	hb.run(session, exit, timeout, config.ReadIdleTimeout(), config.WriteIdleTimeout())
+}
+
+// run 心跳循环,写空闲超过writeIdle时发送心跳请求
+// 读空闲超过readIdle时调用timeout关闭连接,exit关闭时退出
+func (hb *heartbeat) run(session ISession, exit chan struct{}, timeout func(), readIdle, writeIdle time.Duration) {
+	interval := checkInterval(readIdle, writeIdle)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			lastRecv := time.Unix(0, atomic.LoadInt64(&hb.lastRecv))
+			if readIdle > 0 && now.Sub(lastRecv) > readIdle {
+				log.Warnf("session: %s read idle timeout: %s, close", session.Name(), readIdle)
+				timeout()
+				return
+			}
+			lastSend := time.Unix(0, atomic.LoadInt64(&hb.lastSend))
+			if writeIdle > 0 && now.Sub(lastSend) >= writeIdle {
+				hb.ping(session, now)
+			}
+		case <-exit:
+			return
+		}
+	}
+}
+
+// checkInterval 空闲检查间隔,取读写空闲时间中较小者的一半,都为0时关闭心跳
+func checkInterval(readIdle, writeIdle time.Duration) time.Duration {
+	interval := readIdle
+	if interval <= 0 || (writeIdle > 0 && writeIdle < interval) {
+		interval = writeIdle
+	}
+	if interval <= 0 {
+		return 0
+	}
+	interval /= 2
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	return interval
+}
@@ -0,0 +1,88 @@
+// -------------------------------------------
+// @file      : heartbeat_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/10 下午3:40
+// -------------------------------------------
+
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+// pipeSession 测试用的会话,写入的消息直接交给对端的心跳处理
+type pipeSession struct {
+	hb   *heartbeat
+	peer *pipeSession // 对端,为nil时丢弃写入的消息
+}
+
+func (session *pipeSession) Write(msg *Message) error {
+	session.hb.sent()
+	if peer := session.peer; peer != nil {
+		peer.hb.received()
+		peer.hb.handle(peer, msg)
+	}
+	return nil
+}
+
+func (session *pipeSession) Status() SessionStatus    { return SessionStatusOutConnected }
+func (session *pipeSession) DriverType() DriverType   { return DriverTypeClient }
+func (session *pipeSession) Close()                   {}
+func (session *pipeSession) Handler() ISessionHandler { return nil }
+func (session *pipeSession) Name() string             { return "pipe" }
+func (session *pipeSession) RTT() time.Duration       { return session.hb.RTT() }
+
+func TestHeartbeatIdleTimeout(t *testing.T) {
+	// 对端不应答心跳,读空闲超时后关闭
+	session := &pipeSession{hb: newHeartbeat()}
+	exit, closed := make(chan struct{}), make(chan struct{})
+	defer close(exit)
+	start := time.Now()
+	go session.hb.run(session, exit, func() { close(closed) }, 300*time.Millisecond, 100*time.Millisecond)
+	select {
+	case <-closed:
+		if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+			t.Fatalf("closed before read idle timeout: %s", elapsed)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("idle session not closed")
+	}
+	if session.RTT() != 0 {
+		t.Fatalf("rtt measured without pong: %s", session.RTT())
+	}
+}
+
+func TestHeartbeatKeepAlive(t *testing.T) {
+	// 对端应答心跳,超过读空闲时间仍保持连接,并测得往返时延
+	local, remote := &pipeSession{hb: newHeartbeat()}, &pipeSession{hb: newHeartbeat()}
+	local.peer, remote.peer = remote, local
+	exit, closed := make(chan struct{}), make(chan struct{})
+	go local.hb.run(local, exit, func() { close(closed) }, 400*time.Millisecond, 100*time.Millisecond)
+	select {
+	case <-closed:
+		t.Fatal("session closed while peer answers pings")
+	case <-time.After(1200 * time.Millisecond):
+	}
+	close(exit)
+	if local.RTT() <= 0 {
+		t.Fatalf("rtt not measured: %s", local.RTT())
+	}
+}
+
+func TestCheckInterval(t *testing.T) {
+	for _, c := range []struct {
+		readIdle, writeIdle, expect time.Duration
+	}{
+		{0, 0, 0},
+		{30 * time.Second, 10 * time.Second, 5 * time.Second},
+		{30 * time.Second, 0, 15 * time.Second},
+		{0, 10 * time.Second, 5 * time.Second},
+		{100 * time.Millisecond, 0, 100 * time.Millisecond},
+	} {
+		if interval := checkInterval(c.readIdle, c.writeIdle); interval != c.expect {
+			t.Fatalf("check interval(%s, %s): %s, expect: %s", c.readIdle, c.writeIdle, interval, c.expect)
+		}
+	}
+}
@@ -8,6 +8,7 @@
 package network
 
 import (
+	"errors"
 	"fmt"
 	"gogs/base/cberrors"
 	"gogs/base/config"
@@ -27,20 +28,25 @@ type HostDriver struct {
 	mutexGroup            []sync.Mutex            // 会话互斥锁列表
 	sessionHandlerBuilder SessionHandlerBuilder   // 会话处理器构造器
 	name                  string                  // 驱动名字
+	transport             ITransport              // 传输层
+	listener              net.Listener            // 监听器
+	closing               bool                    // 是否正在关闭
 }
 
-// NewHostDriver 新建tcp集群节点驱动,HostDriver有listen服务接受连内连
-func NewHostDriver(localAddr string, builder SessionHandlerBuilder) *HostDriver {
+// NewHostDriver 新建集群节点驱动,HostDriver有listen服务接受连内连,transport为nil时使用tcp
+func NewHostDriver(localAddr string, builder SessionHandlerBuilder, transport ITransport) *HostDriver {
 	driver := &HostDriver{
 		localAddr:             localAddr,
 		sessions:              make(map[string]*HostSession),
 		mutexGroup:            make([]sync.Mutex, runtime.NumCPU()*4),
 		sessionHandlerBuilder: builder,
 		name:                  fmt.Sprintf("HostDriver(%s)", localAddr),
+		transport:             defaultTransport(transport),
 	}
 	if localAddr != "" {
 		go driver.run()
 	}
+	trackDriver(driver)
 	return driver
 }
 
@@ -90,9 +96,33 @@ func (driver *HostDriver) DelSession(session ISession) {
 	}
 }
 
-// Close 关闭驱动
+// Sessions 所有会话
+func (driver *HostDriver) Sessions() []ISession {
+	driver.RLock()
+	defer driver.RUnlock()
+	sessions := make([]ISession, 0, len(driver.sessions))
+	for _, session := range driver.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Close 关闭驱动,停止监听,发送完各会话已缓存的消息后关闭会话
 func (driver *HostDriver) Close() {
+	untrackDriver(driver)
+	driver.Lock()
+	driver.closing = true
+	listener := driver.listener
+	driver.listener = nil
+	sessions := make([]*HostSession, 0, len(driver.sessions))
 	for _, session := range driver.sessions {
+		sessions = append(sessions, session)
+	}
+	driver.Unlock()
+	if listener != nil {
+		_ = listener.Close()
+	}
+	for _, session := range sessions {
 		session.Close()
 	}
 }
@@ -112,33 +142,44 @@ func (driver *HostDriver) lock(session *HostSession, callback func()) {
 	callback()
 }
 
-// inConnection 内连,远程地址发起对本机的连接
-func (driver *HostDriver) inConnection(whoAmI string, conn net.Conn) (*HostSession, chan struct{}) {
+// inConnection 内连,远程地址发起对本机的连接,remote为发起方握手数据,hs为协商后的会话参数
+func (driver *HostDriver) inConnection(remote, hs *Handshake, conn net.Conn) (*HostSession, chan struct{}) {
 	// 根据对方身份新建一个会话
-	session, err := driver.NewSession(whoAmI, ConnectionTypeIn)
+	session, err := driver.NewSession(remote.WhoAmI, ConnectionTypeIn)
 	// 内连时,可复用以前同地址的断开且未关闭的会话
 	if session == nil && err != nil {
-		log.Errorf("inConnection(%s) err: %s", whoAmI, err)
+		log.Errorf("inConnection(%s) err: %s", remote.WhoAmI, err)
 		return nil, nil
 	}
 	hostSession := session.(*HostSession)
-	return hostSession, hostSession.inConnection(conn)
+	return hostSession, hostSession.inConnection(conn, hs, remote.Credit)
 }
 
 // run 启动驱动
 func (driver *HostDriver) run() {
 	// 使用驱动的本地地址 建立监听
 	log.Infof("start host listen: %s", driver.localAddr)
-	listener, err := net.Listen("tcp", driver.localAddr)
+	listener, err := driver.transport.Listen(driver.localAddr)
 	if err != nil {
 		log.Errorf("host listen: %s err: %s", driver.localAddr, err)
 		time.AfterFunc(config.ListenRetryInterval(), driver.run)
 		return
 	}
+	driver.Lock()
+	if driver.closing {
+		driver.Unlock()
+		_ = listener.Close()
+		return
+	}
+	driver.listener = listener
+	driver.Unlock()
 	for {
 		var conn net.Conn
 		conn, err = listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Errorf("host driver: %s accept err: %s", driver, err)
 			continue
 		}
@@ -148,7 +189,7 @@ func (driver *HostDriver) run() {
 
 // handleAccept 处理新连接
 func (driver *HostDriver) handleAccept(conn net.Conn) {
-	stream := NewStream(conn, conn)
+	stream := NewStream(conn, conn).measure(DriverTypeHost)
 	msg, err := ReadMessage(stream)
 	if err != nil {
 		log.Errorf("host driver: %s read message err: %s", driver, err)
@@ -161,16 +202,30 @@ func (driver *HostDriver) handleAccept(conn net.Conn) {
 		_ = conn.Close()
 		return
 	}
-	session, flag := driver.inConnection(string(msg.Data), conn)
+	remote, err := UnmarshalHandshake(msg.Data)
+	if err != nil || remote == nil {
+		log.Errorf("host driver: %s remote: %s invalid handshake: %v", driver, conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	// 协商压缩和批量参数,随应答返回给发起方,同时告知本地接收窗口
+	hs := negotiate(driver.localAddr, remote)
+	hs.Credit = uint32(config.HostSessionCredit())
+	session, flag := driver.inConnection(remote, hs, conn)
 	if flag != nil {
 		msg.Type = MessageTypeAccept
 	} else {
 		msg.Type = MessageTypeReject
 	}
+	msg.Data = hs.Marshal()
 	err = WriteMessage(stream, msg)
 	if err != nil {
 		log.Errorf("host driver: %s remote: %s write message err: %s", driver, conn.RemoteAddr(), err)
-		session.closeConn(conn)
+		if session != nil {
+			session.closeConn(conn)
+		} else {
+			_ = conn.Close()
+		}
 		return
 	}
 	// 创建会话失败
@@ -180,5 +235,5 @@ func (driver *HostDriver) handleAccept(conn net.Conn) {
 	}
 	log.Debugf("host driver: %s session: %s new connection established", driver, session)
 	go session.recvLoop(conn)
-	go session.sendLoop(conn, flag)
+	session.startSendLoop(conn, flag)
 }
@@ -14,6 +14,7 @@ import (
 	log "gogs/base/logger"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,8 +34,12 @@ type HostSession struct {
 	driver         *HostDriver     // 所属驱动
 	status         SessionStatus   // 状态
 	handler        ISessionHandler // 会话处理器
-	cached         chan *Message   // 发送消息队列
+	cached         *sendQueue      // 发送消息队列
 	connectionType ConnectionType  // 连接类型
+	compress       CompressType    // 协商后的压缩算法
+	batch          bool            // 协商后是否启用批量消息
+	flow           *flowControl    // 基于信用的流量控制
+	closed         int32           // 是否已关闭,供不加锁的写入和发送循环检查
 }
 
 // newHostSession 在指定驱动上创建一个集群节点会话,外连会话,注意此函数外层已经加锁
@@ -43,9 +48,11 @@ func (driver *HostDriver) newHostSession(addr string, ct ConnectionType) (*HostS
 		remoteAddr:     addr,
 		driver:         driver,
 		status:         SessionStatusDisconnected,
-		cached:         make(chan *Message, config.HostSessionCache()),
 		connectionType: ct,
+		flow:           newFlowControl(),
 	}
+	session.cached = newSendQueue(config.HostSessionCache(), OverflowPolicy(config.HostSessionOverflow()),
+		config.OverflowTimeout(), session.disconnect)
 	handler, err := driver.sessionHandlerBuilder(session)
 	if err != nil {
 		return nil, err
@@ -85,15 +92,38 @@ func (session *HostSession) DriverType() DriverType {
 	return session.driver.Type()
 }
 
+// RTT 集群会话未启用应用层心跳,始终为0
+func (session *HostSession) RTT() time.Duration {
+	return 0
+}
+
 // Close 关闭会话
 func (session *HostSession) Close() {
+	closing := false
 	session.driver.lock(session, func() {
+		// 驱动关闭和接收循环出错可能重复关闭
+		if session.status == SessionStatusClosed {
+			return
+		}
 		log.Debugf("host session: %s closing", session)
+		closing = true
 		session.status = SessionStatusClosed
+		atomic.StoreInt32(&session.closed, 1)
 		if session.exit != nil {
 			close(session.exit)
+			session.exit = nil
 		}
-		session.Wait()
+		// 对端不再读取时,发送循环最多阻塞到关闭超时
+		if session.conn != nil {
+			_ = session.conn.SetWriteDeadline(time.Now().Add(config.ShutdownTimeout()))
+		}
+	})
+	if !closing {
+		return
+	}
+	// 不持有锁等待发送循环退出,发送循环出错时需要加锁关闭连接
+	session.Wait()
+	session.driver.lock(session, func() {
 		if session.conn != nil {
 			_ = session.conn.Close()
 		}
@@ -109,14 +139,29 @@ func (session *HostSession) Handler() ISessionHandler {
 
 // Write 向会话写入一个消息
 func (session *HostSession) Write(msg *Message) error {
-	if session.status == SessionStatusClosed {
+	if atomic.LoadInt32(&session.closed) == 1 {
 		return cberrors.New("host %s session: %s closed", session)
 	}
-	select {
-	case session.cached <- msg:
-		return nil
-	default:
-		return cberrors.New("host session: %s sending queue overflow: %d", session, len(session.cached))
+	if err := session.cached.push(msg); err != nil {
+		return cberrors.New("host session: %s %s", session, err)
+	}
+	return nil
+}
+
+// QueueStats implements IQueueStats
+func (session *HostSession) QueueStats() QueueStats {
+	return session.cached.stats()
+}
+
+// disconnect 断开发送过慢的连接
+func (session *HostSession) disconnect() {
+	var conn net.Conn
+	session.driver.lock(session, func() {
+		conn = session.conn
+	})
+	if conn != nil {
+		log.Warnf("host session: %s slow consumer, disconnect", session)
+		session.closeConn(conn)
 	}
 }
 
@@ -134,6 +179,7 @@ func (session *HostSession) changeStatus(status SessionStatus) {
 
 // connect 连接该会话,加锁异步外连
 func (session *HostSession) connect() SessionStatus {
+	var status SessionStatus
 	session.driver.lock(session, func() {
 		switch session.status {
 		case SessionStatusDisconnected:
@@ -142,24 +188,33 @@ func (session *HostSession) connect() SessionStatus {
 			session.changeStatus(SessionStatusConnecting)
 			go session.outConnect()
 		}
+		status = session.status
 	})
-	return session.status
+	return status
 }
 
 // outConnect 外连
 func (session *HostSession) outConnect() {
 	// 连接
-	conn, err := net.Dial("tcp", session.remoteAddr)
+	conn, err := session.driver.transport.Dial(session.remoteAddr)
 	if err != nil {
 		log.Errorf("host session: %s out connect err: %s", session, err)
 		session.closeConn(nil)
 		return
 	}
-	stream := NewStream(conn, conn)
+	stream := NewStream(conn, conn).measure(DriverTypeHost)
 	// 发送握手消息
 	msg := NewMessage()
 	msg.Type = MessageTypeHandshake
-	msg.Data = []byte(conn.LocalAddr().String())
+	// 以本地监听地址表明身份,对端以此命名内连会话,与对端外连本地时的会话同名,同一对节点之间只保留一条连接
+	// 不监听的节点只能外连,使用连接的本地地址
+	whoAmI := session.driver.localAddr
+	if whoAmI == "" {
+		whoAmI = conn.LocalAddr().String()
+	}
+	local := localHandshake(whoAmI)
+	local.Credit = uint32(config.HostSessionCredit())
+	msg.Data = local.Marshal()
 	// 发送
 	err = WriteMessage(stream, msg)
 	if err != nil {
@@ -179,8 +234,15 @@ func (session *HostSession) outConnect() {
 		session.closeConn(conn)
 		return
 	}
+	// 应答中携带协商结果
+	hs, err := UnmarshalHandshake(msg.Data)
+	if err != nil || hs == nil {
+		log.Errorf("host session: %s handshake invalid accept: %v", session, err)
+		session.closeConn(conn)
+		return
+	}
 	// 完成外连握手后的设置
-	exit := session.outConnection(conn)
+	exit := session.outConnection(conn, hs)
 	if exit == nil {
 		log.Errorf("host session: %s drop out connection: %s", session, conn)
 		session.closeConn(conn)
@@ -189,14 +251,37 @@ func (session *HostSession) outConnect() {
 	log.Debugf("host session: %s out connection established", session)
 	// 开始读写
 	go session.recvLoop(conn)
-	go session.sendLoop(conn, exit)
+	session.startSendLoop(conn, exit)
+}
+
+// newStream 根据协商结果创建连接上的消息流
+func (session *HostSession) newStream(conn net.Conn) *Stream {
+	stream := NewStream(conn, conn).measure(DriverTypeHost)
+	if err := stream.SetCompress(session.compress); err != nil {
+		log.Errorf("host session: %s set compress err: %s", session, err)
+	}
+	return stream
 }
 
 // recvLoop 接收循环
 func (session *HostSession) recvLoop(conn net.Conn) {
-	stream := NewStream(conn, conn)
+	stream := session.newStream(conn)
+	read := func(msg *Message) {
+		session.handler.Read(session, msg)
+	}
 	for {
-		msg, err := ReadMessage(stream)
+		msg, err := stream.ReadMessage()
+		if err == nil && msg.Type == MessageTypeCredit {
+			// 对端归还发送信用
+			var credit *Credit
+			if credit, err = UnmarshalCredit(msg.Data); err == nil && credit != nil {
+				session.flow.granted(credit.Count)
+			}
+		} else if err == nil {
+			session.flow.received()
+			// 通知处理器,读取到一个或一批消息
+			err = dispatchMessage(msg, read)
+		}
 		if err != nil {
 			if session.connectionType == ConnectionTypeOut {
 				session.closeConn(conn)
@@ -205,30 +290,63 @@ func (session *HostSession) recvLoop(conn net.Conn) {
 			}
 			break
 		}
-		// 通知处理器,读取到一个消息
-		session.handler.Read(session, msg)
 	}
 }
 
-// sendLoop 发送循环
+// startSendLoop 加锁后启动发送循环,连接已被关闭或替换时不启动,避免计数与Close中的等待并发
+func (session *HostSession) startSendLoop(conn net.Conn, exit chan struct{}) {
+	session.driver.lock(session, func() {
+		if session.exit != exit {
+			return
+		}
+		session.Add(1)
+		go session.sendLoop(conn, exit)
+	})
+}
+
+// sendLoop 发送循环,由startSendLoop启动
 func (session *HostSession) sendLoop(conn net.Conn, exit chan struct{}) {
-	session.Add(1)
 	defer session.Done()
-	stream := NewStream(conn, conn)
+	stream := session.newStream(conn)
+	batch := 0
+	if session.batch {
+		batch = config.SessionBatch()
+	}
+	// 归还对端发送信用
+	flush := func() error {
+		if msg := session.flow.message(); msg != nil {
+			return stream.WriteMessage(msg)
+		}
+		return nil
+	}
 	for {
-		select {
-		case msg, ok := <-session.cached:
-			if !ok {
-				log.Debugf("host session: %s cache closed", session)
-				return
+		msg, ok := session.cached.next(exit, session.flow.notify)
+		if !ok {
+			// 主动关闭时发送完已缓存的消息,断线重连时保留在队列中
+			if atomic.LoadInt32(&session.closed) == 1 {
+				flushMessages(stream, session.cached)
 			}
-			err := WriteMessage(stream, msg)
-			if err != nil {
-				session.closeConn(conn)
-				log.Debugf("host session: %s send loop err: %s", session, err)
+			return
+		}
+		var err error
+		if msg == nil {
+			err = flush()
+		} else {
+			// 合并队列中已缓存的消息一起发送,没有发送信用时等待对端归还
+			msg, _ = mergeMessages(msg, session.cached, batch)
+			if err = session.flow.acquire(exit, flush); err == nil {
+				err = stream.WriteMessage(msg)
+			} else if atomic.LoadInt32(&session.closed) == 1 {
+				// 主动关闭时不再等待发送信用,发送完已取出和已缓存的消息,连接由Close关闭
+				if stream.WriteMessage(msg) == nil {
+					flushMessages(stream, session.cached)
+				}
 				return
 			}
-		case <-exit:
+		}
+		if err != nil {
+			session.closeConn(conn)
+			log.Debugf("host session: %s send loop err: %s", session, err)
 			return
 		}
 	}
@@ -260,12 +378,15 @@ func (session *HostSession) closeConn(conn net.Conn) {
 }
 
 // outConnection 外连成功,加锁异步设置
-func (session *HostSession) outConnection(conn net.Conn) chan struct{} {
+func (session *HostSession) outConnection(conn net.Conn, hs *Handshake) chan struct{} {
 	var exit chan struct{}
 	session.driver.lock(session, func() {
 		switch session.status {
 		case SessionStatusDisconnected, SessionStatusConnecting:
 			session.conn = conn
+			session.compress = hs.Compress
+			session.batch = hs.Batch
+			session.flow.reset(hs.Credit, uint32(config.HostSessionCredit()))
 			session.exit = make(chan struct{})
 			exit = session.exit
 			session.changeStatus(SessionStatusOutConnected)
@@ -276,19 +397,25 @@ func (session *HostSession) outConnection(conn net.Conn) chan struct{} {
 	return exit
 }
 
-// inConnection 内连成功,加锁异步设置
-func (session *HostSession) inConnection(conn net.Conn) chan struct{} {
+// inConnection 内连成功,加锁异步设置,credit为对端接收窗口
+func (session *HostSession) inConnection(conn net.Conn, hs *Handshake, credit uint32) chan struct{} {
 	var exit chan struct{}
 	session.driver.lock(session, func() {
 		switch session.status {
 		case SessionStatusDisconnected:
 			session.conn = conn
+			session.compress = hs.Compress
+			session.batch = hs.Batch
+			session.flow.reset(credit, uint32(config.HostSessionCredit()))
 			session.exit = make(chan struct{})
 			exit = session.exit
 			session.changeStatus(SessionStatusInConnected)
 		case SessionStatusConnecting:
 			if session.driver.localAddr < session.remoteAddr {
 				session.conn = conn
+				session.compress = hs.Compress
+				session.batch = hs.Batch
+				session.flow.reset(credit, uint32(config.HostSessionCredit()))
 				session.exit = make(chan struct{})
 				exit = session.exit
 				session.changeStatus(SessionStatusInConnected)
@@ -0,0 +1,59 @@
+// -------------------------------------------
+// @file      : kcp.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/17 下午3:30
+// -------------------------------------------
+
+package network
+
+import (
+	"gogs/base/config"
+	"gogs/base/kcp"
+	"net"
+)
+
+// kcpOptions 根据rpc配置生成kcp会话参数
+func kcpOptions() *kcp.Options {
+	options := kcp.DefaultOptions()
+	options.NoDelay = config.KCPNoDelay()
+	options.Interval = config.KCPInterval()
+	options.FastResend = config.KCPResend()
+	options.NoCongestion = config.KCPNoCongestion()
+	options.SndWnd = config.KCPSndWnd()
+	options.RcvWnd = config.KCPRcvWnd()
+	options.MTU = config.KCPMTU()
+	options.Timeout = config.KCPTimeout()
+	return options
+}
+
+// KCPTransport kcp传输层,会话参数在监听和连接时从rpc配置读取
+type KCPTransport struct{}
+
+// NewKCPTransport 新建kcp传输层
+func NewKCPTransport() *KCPTransport {
+	return &KCPTransport{}
+}
+
+// Protocol implements ITransport
+func (transport *KCPTransport) Protocol() ProtocolType {
+	return ProtocolKCP
+}
+
+// Listen implements ITransport
+func (transport *KCPTransport) Listen(addr string) (net.Listener, error) {
+	listener, err := kcp.Listen(addr, kcpOptions())
+	if err != nil {
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Dial implements ITransport
+func (transport *KCPTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := kcp.Dial(addr, kcpOptions())
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,145 @@
+// -------------------------------------------
+// @file      : memory.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/21 上午11:30
+// -------------------------------------------
+
+package network
+
+import (
+	"fmt"
+	"gogs/base/cberrors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// MemoryTransport 进程内传输层,基于net.Pipe,不占用端口
+// 地址只在同一个实例内有效,同一进程内的网关,游戏服和模拟器共享一个实例即可互相连接,用于测试
+type MemoryTransport struct {
+	sync.Mutex
+	listeners map[string]*memoryListener // 监听器集合,地址索引
+	idgen     uint64                     // 发起方地址生成器
+}
+
+// NewMemoryTransport 新建进程内传输层
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		listeners: make(map[string]*memoryListener),
+	}
+}
+
+// Protocol implements ITransport
+func (transport *MemoryTransport) Protocol() ProtocolType {
+	return ProtocolMemory
+}
+
+// Listen implements ITransport
+func (transport *MemoryTransport) Listen(addr string) (net.Listener, error) {
+	transport.Lock()
+	defer transport.Unlock()
+	if _, ok := transport.listeners[addr]; ok {
+		return nil, cberrors.New("memory listen: %s address already in use", addr)
+	}
+	listener := &memoryListener{
+		transport: transport,
+		addr:      memoryAddr(addr),
+		conns:     make(chan net.Conn),
+		exit:      make(chan struct{}),
+	}
+	transport.listeners[addr] = listener
+	return listener, nil
+}
+
+// Dial implements ITransport
+func (transport *MemoryTransport) Dial(addr string) (net.Conn, error) {
+	transport.Lock()
+	listener, ok := transport.listeners[addr]
+	transport.Unlock()
+	if !ok {
+		return nil, cberrors.New("memory dial: %s connection refused", addr)
+	}
+	local := memoryAddr(fmt.Sprintf("memory-%d", atomic.AddUint64(&transport.idgen, 1)))
+	client, server := net.Pipe()
+	select {
+	case listener.conns <- &memoryConn{Conn: server, local: listener.addr, remote: local}:
+		return &memoryConn{Conn: client, local: local, remote: listener.addr}, nil
+	case <-listener.exit:
+		_ = client.Close()
+		_ = server.Close()
+		return nil, cberrors.New("memory dial: %s connection refused", addr)
+	}
+}
+
+// remove 删除已关闭的监听器
+func (transport *MemoryTransport) remove(listener *memoryListener) {
+	transport.Lock()
+	defer transport.Unlock()
+	if transport.listeners[listener.addr.String()] == listener {
+		delete(transport.listeners, listener.addr.String())
+	}
+}
+
+// memoryAddr 进程内地址
+type memoryAddr string
+
+// Network implements net.Addr
+func (addr memoryAddr) Network() string {
+	return "memory"
+}
+
+// String implements net.Addr
+func (addr memoryAddr) String() string {
+	return string(addr)
+}
+
+// memoryListener 进程内监听器,实现net.Listener
+type memoryListener struct {
+	transport *MemoryTransport // 所属传输层
+	addr      memoryAddr       // 监听地址
+	conns     chan net.Conn    // 等待Accept的连接
+	exit      chan struct{}    // 关闭信号
+	closeOnce sync.Once        // 关闭一次
+}
+
+// Accept implements net.Listener
+func (listener *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.exit:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener,已建立的连接不受影响
+func (listener *memoryListener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.exit)
+		listener.transport.remove(listener)
+	})
+	return nil
+}
+
+// Addr implements net.Listener
+func (listener *memoryListener) Addr() net.Addr {
+	return listener.addr
+}
+
+// memoryConn 进程内连接,替换net.Pipe的地址,便于区分不同的连接
+type memoryConn struct {
+	net.Conn
+	local  net.Addr // 本地地址
+	remote net.Addr // 远程地址
+}
+
+// LocalAddr implements net.Conn
+func (conn *memoryConn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+// RemoteAddr implements net.Conn
+func (conn *memoryConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
@@ -0,0 +1,74 @@
+// -------------------------------------------
+// @file      : metrics.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/26 下午3:10
+// -------------------------------------------
+
+package network
+
+import (
+	"gogs/base/metrics"
+	"sync"
+)
+
+var (
+	bytesReceived = metrics.NewCounterVec("gogs_network_received_bytes_total",
+		"Bytes read from session connections.", "driver")
+	bytesSent = metrics.NewCounterVec("gogs_network_sent_bytes_total",
+		"Bytes written to session connections.", "driver")
+	sessionCount = metrics.NewGaugeVecFunc("gogs_network_sessions",
+		"Sessions held by drivers.", []string{"driver"}, collectSessions(func(ISession) float64 { return 1 }))
+	queueDepth = metrics.NewGaugeVecFunc("gogs_network_send_queue_depth",
+		"Messages waiting in session send queues.", []string{"driver"}, collectSessions(func(session ISession) float64 {
+			if stats, ok := session.(IQueueStats); ok {
+				s := stats.QueueStats()
+				return float64(s.Depth + s.Priority)
+			}
+			return 0
+		}))
+	queueDropped = metrics.NewGaugeVecFunc("gogs_network_send_queue_dropped",
+		"Messages dropped or rejected by send queues of live sessions.", []string{"driver"}, collectSessions(func(session ISession) float64 {
+			if stats, ok := session.(IQueueStats); ok {
+				s := stats.QueueStats()
+				return float64(s.Dropped + s.Rejected)
+			}
+			return 0
+		}))
+	drivers sync.Map // 未关闭的驱动集合,抓取指标时遍历
+)
+
+func init() {
+	metrics.MustRegister(bytesReceived, bytesSent, sessionCount, queueDepth, queueDropped)
+}
+
+// trackDriver 记录新建的驱动,驱动的会话计入指标
+func trackDriver(driver IDriver) {
+	drivers.Store(driver, struct{}{})
+}
+
+// untrackDriver 驱动关闭后不再计入指标
+func untrackDriver(driver IDriver) {
+	drivers.Delete(driver)
+}
+
+// collectSessions 按驱动类型汇总所有驱动中会话的值
+func collectSessions(value func(ISession) float64) func(set func(float64, ...string)) {
+	return func(set func(float64, ...string)) {
+		sums := make(map[DriverType]float64)
+		drivers.Range(func(key, _ interface{}) bool {
+			driver := key.(IDriver)
+			sum := sums[driver.Type()]
+			for _, session := range driver.Sessions() {
+				sum += value(session)
+			}
+			sums[driver.Type()] = sum
+			return true
+		})
+		for _, driverType := range []DriverType{DriverTypeHost, DriverTypeClient, DriverTypeGate, DriverTypeActor} {
+			if sum, ok := sums[driverType]; ok {
+				set(sum, driverType.String())
+			}
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"gogs/base/cberrors"
 	log "gogs/base/logger"
 	"sync"
+	"time"
 )
 
 // DriverType 驱动类型
@@ -23,12 +24,29 @@ const (
 	DriverTypeActor  DriverType = 4
 )
 
+// String implements fmt.Stringer
+func (driverType DriverType) String() string {
+	switch driverType {
+	case DriverTypeHost:
+		return "host"
+	case DriverTypeClient:
+		return "client"
+	case DriverTypeGate:
+		return "gate"
+	case DriverTypeActor:
+		return "actor"
+	}
+	return "unknown"
+}
+
 // ProtocolType 协议类型
 type ProtocolType int32
 
 const (
 	ProtocolTCP       ProtocolType = 1
 	ProtocolWebsocket ProtocolType = 2
+	ProtocolKCP       ProtocolType = 3 // 基于udp的可靠传输
+	ProtocolMemory    ProtocolType = 4 // 进程内内存管道,用于测试
 )
 
 // ISession 会话接口
@@ -39,6 +57,7 @@ type ISession interface {
 	Close()                   // 关闭会话
 	Handler() ISessionHandler // 会话处理器
 	Name() string             // 会话标识符,唯一
+	RTT() time.Duration       // 最近一次心跳测得的往返时延,未启用心跳时为0
 }
 
 // ISessionHandler 会话处理器
@@ -56,6 +75,7 @@ type IDriver interface {
 	GetSession(string) (ISession, bool)                  // 通过名字获取会话
 	NewSession(string, ConnectionType) (ISession, error) // 创建会话
 	DelSession(ISession)                                 // 删除指定的会话
+	Sessions() []ISession                                // 所有会话
 	SetBuilder(SessionHandlerBuilder)                    // 设置会话句柄构造器
 	Close()                                              // 关闭驱动
 }
@@ -0,0 +1,236 @@
+// -------------------------------------------
+// @file      : queue.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/20 上午10:40
+// -------------------------------------------
+
+package network
+
+import (
+	"gogs/base/cberrors"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy 发送队列满时的处理策略
+type OverflowPolicy int32
+
+const (
+	OverflowPolicyReject     OverflowPolicy = 0 // 拒绝新消息,返回错误
+	OverflowPolicyBlock      OverflowPolicy = 1 // 阻塞等待,超过期限返回错误
+	OverflowPolicyDropOldest OverflowPolicy = 2 // 丢弃队列中最早的消息,涉及已编号的消息时断开连接
+	OverflowPolicyDisconnect OverflowPolicy = 3 // 断开慢消费者
+)
+
+// String implements fmt.Stringer
+func (policy OverflowPolicy) String() string {
+	switch policy {
+	case OverflowPolicyReject:
+		return "Reject"
+	case OverflowPolicyBlock:
+		return "Block"
+	case OverflowPolicyDropOldest:
+		return "DropOldest"
+	case OverflowPolicyDisconnect:
+		return "Disconnect"
+	}
+	return "Unknown"
+}
+
+// QueueStats 发送队列统计
+type QueueStats struct {
+	Depth     int    // 普通通道当前长度
+	Priority  int    // 优先通道当前长度
+	Capacity  int    // 每个通道的容量
+	HighWater int    // 两个通道合计的历史最大长度
+	Dropped   uint64 // 丢弃的消息数量
+	Rejected  uint64 // 拒绝的消息数量
+	Blocked   uint64 // 队列满时阻塞等待的次数
+}
+
+// IQueueStats 可以获取发送队列统计的会话
+type IQueueStats interface {
+	QueueStats() QueueStats
+}
+
+// sendQueue 会话发送队列,分为普通和优先两个通道,发送循环优先发送优先通道中的消息
+type sendQueue struct {
+	normal     chan *Message  // 普通通道
+	priority   chan *Message  // 优先通道,调用返回和控制消息
+	policy     OverflowPolicy // 队列满时的处理策略
+	timeout    time.Duration  // 阻塞策略的等待期限
+	disconnect func()         // 断开慢消费者
+	highWater  int64          // 历史最大长度
+	dropped    uint64         // 丢弃数量
+	rejected   uint64         // 拒绝数量
+	blocked    uint64         // 阻塞次数
+}
+
+// newSendQueue 新建发送队列,disconnect为断开策略下断开连接的方法
+func newSendQueue(size int, policy OverflowPolicy, timeout time.Duration, disconnect func()) *sendQueue {
+	return &sendQueue{
+		normal:     make(chan *Message, size),
+		priority:   make(chan *Message, size),
+		policy:     policy,
+		timeout:    timeout,
+		disconnect: disconnect,
+	}
+}
+
+// isPriority 调用返回和心跳等控制消息走优先通道,避免被大量推送消息阻塞
+// 已编号的消息必须按序号发送,不走优先通道
+func isPriority(msg *Message) bool {
+	if msg.Seq != 0 {
+		return false
+	}
+	switch msg.Type {
+	case MessageTypeReturn, MessageTypePing, MessageTypePong, MessageTypeResume:
+		return true
+	}
+	return false
+}
+
+// push 写入一个消息,队列满时按策略处理
+func (queue *sendQueue) push(msg *Message) error {
+	ch := queue.normal
+	if isPriority(msg) {
+		ch = queue.priority
+	}
+	select {
+	case ch <- msg:
+		queue.mark()
+		return nil
+	default:
+	}
+	switch queue.policy {
+	case OverflowPolicyBlock:
+		atomic.AddUint64(&queue.blocked, 1)
+		timer := time.NewTimer(queue.timeout)
+		defer timer.Stop()
+		select {
+		case ch <- msg:
+			queue.mark()
+			return nil
+		case <-timer.C:
+			atomic.AddUint64(&queue.rejected, 1)
+			return cberrors.New("sending queue overflow: %d, wait timeout: %s", len(ch), queue.timeout)
+		}
+	case OverflowPolicyDropOldest:
+		// 已编号的消息丢弃后客户端无法发现缺失,改为断开连接,恢复会话时从重放缓冲区补发
+		if msg.Seq != 0 {
+			return queue.overflowDisconnect(ch)
+		}
+		for {
+			select {
+			case ch <- msg:
+				queue.mark()
+				return nil
+			default:
+			}
+			select {
+			case old := <-ch:
+				atomic.AddUint64(&queue.dropped, 1)
+				if old.Seq != 0 {
+					return queue.overflowDisconnect(ch)
+				}
+			default:
+			}
+		}
+	case OverflowPolicyDisconnect:
+		return queue.overflowDisconnect(ch)
+	default:
+		atomic.AddUint64(&queue.rejected, 1)
+		return cberrors.New("sending queue overflow: %d", len(ch))
+	}
+}
+
+// overflowDisconnect 队列满时断开慢消费者
+func (queue *sendQueue) overflowDisconnect(ch chan *Message) error {
+	atomic.AddUint64(&queue.rejected, 1)
+	if queue.disconnect != nil {
+		go queue.disconnect()
+	}
+	return cberrors.New("sending queue overflow: %d, disconnect slow consumer", len(ch))
+}
+
+// offer 非阻塞地写入普通通道,不使用溢出策略,队列满时返回false
+func (queue *sendQueue) offer(msg *Message) bool {
+	select {
+	case queue.normal <- msg:
+		queue.mark()
+		return true
+	default:
+		return false
+	}
+}
+
+// mark 记录历史最大长度
+func (queue *sendQueue) mark() {
+	depth := int64(queue.len())
+	for {
+		high := atomic.LoadInt64(&queue.highWater)
+		if depth <= high || atomic.CompareAndSwapInt64(&queue.highWater, high, depth) {
+			return
+		}
+	}
+}
+
+// next 等待下一个消息,优先通道优先
+// wake收到信号时返回nil,exit关闭时返回false
+func (queue *sendQueue) next(exit, wake <-chan struct{}) (*Message, bool) {
+	select {
+	case msg := <-queue.priority:
+		return msg, true
+	default:
+	}
+	select {
+	case msg := <-queue.priority:
+		return msg, true
+	case msg := <-queue.normal:
+		return msg, true
+	case <-wake:
+		return nil, true
+	case <-exit:
+		return nil, false
+	}
+}
+
+// poll 非阻塞地取出一个消息,优先通道优先,队列为空时返回nil
+func (queue *sendQueue) poll() *Message {
+	select {
+	case msg := <-queue.priority:
+		return msg
+	default:
+	}
+	select {
+	case msg := <-queue.normal:
+		return msg
+	default:
+		return nil
+	}
+}
+
+// drain 清空队列
+func (queue *sendQueue) drain() {
+	for queue.poll() != nil {
+	}
+}
+
+// len 两个通道中的消息总数
+func (queue *sendQueue) len() int {
+	return len(queue.normal) + len(queue.priority)
+}
+
+// stats 获取队列统计
+func (queue *sendQueue) stats() QueueStats {
+	return QueueStats{
+		Depth:     len(queue.normal),
+		Priority:  len(queue.priority),
+		Capacity:  cap(queue.normal),
+		HighWater: int(atomic.LoadInt64(&queue.highWater)),
+		Dropped:   atomic.LoadUint64(&queue.dropped),
+		Rejected:  atomic.LoadUint64(&queue.rejected),
+		Blocked:   atomic.LoadUint64(&queue.blocked),
+	}
+}
@@ -0,0 +1,50 @@
+// -------------------------------------------
+// @file      : queue_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/8 下午5:20
+// -------------------------------------------
+
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendQueueDropOldest(t *testing.T) {
+	disconnected := make(chan struct{}, 4)
+	queue := newSendQueue(1, OverflowPolicyDropOldest, 0, func() {
+		disconnected <- struct{}{}
+	})
+
+	// 未编号的消息丢弃最早的
+	for i := 0; i < 3; i++ {
+		if err := queue.push(&Message{Type: MessageTypeCall}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := queue.stats(); stats.Dropped != 2 || stats.Depth != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// 已编号的消息不丢弃,断开连接等待恢复
+	if err := queue.push(&Message{Type: MessageTypeCall, Seq: 1}); err == nil {
+		t.Fatal("sequenced message dropped silently")
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("slow consumer not disconnected")
+	}
+	queue.drain()
+	if err := queue.push(&Message{Type: MessageTypeCall, Seq: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.push(&Message{Type: MessageTypeCall}); err == nil {
+		t.Fatal("queued sequenced message dropped silently")
+	}
+	if stats := queue.stats(); stats.Dropped != 3 || stats.Rejected != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
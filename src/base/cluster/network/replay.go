@@ -0,0 +1,76 @@
+// -------------------------------------------
+// @file      : replay.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/19 下午3:20
+// -------------------------------------------
+
+package network
+
+// replayBuffer 重放缓冲区,按序号保存已发送但客户端未确认的消息
+// 超过容量时丢弃最早的消息,恢复会话时重放客户端未收到的部分
+type replayBuffer struct {
+	messages []*Message // 消息列表,序号递增
+	size     int        // 容量
+	last     uint64     // 最后一个消息的序号
+}
+
+// newReplayBuffer 新建重放缓冲区
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{
+		size: size,
+	}
+}
+
+// push 添加一个带序号的消息
+func (buffer *replayBuffer) push(msg *Message) {
+	buffer.last = msg.Seq
+	if buffer.size <= 0 {
+		return
+	}
+	if len(buffer.messages) >= buffer.size {
+		buffer.messages[0] = nil
+		buffer.messages = buffer.messages[1:]
+	}
+	buffer.messages = append(buffer.messages, msg)
+}
+
+// ack 客户端确认收到seq及之前的消息,从缓冲区删除
+func (buffer *replayBuffer) ack(seq uint64) {
+	i := 0
+	for i < len(buffer.messages) && buffer.messages[i].Seq <= seq {
+		buffer.messages[i] = nil
+		i++
+	}
+	buffer.messages = buffer.messages[i:]
+}
+
+// since 获取序号大于seq的消息,seq之后的消息已被丢弃或seq超出已发送范围时返回false
+func (buffer *replayBuffer) since(seq uint64) ([]*Message, bool) {
+	if seq > buffer.last {
+		return nil, false
+	}
+	if seq == buffer.last {
+		return nil, true
+	}
+	if len(buffer.messages) == 0 || buffer.messages[0].Seq > seq+1 {
+		return nil, false
+	}
+	for i, msg := range buffer.messages {
+		if msg.Seq > seq {
+			result := make([]*Message, len(buffer.messages)-i)
+			copy(result, buffer.messages[i:])
+			return result, true
+		}
+	}
+	return nil, true
+}
+
+// replayable 消息是否需要编号和重放,心跳等控制消息不重放
+func replayable(t MessageType) bool {
+	switch t {
+	case MessageTypePing, MessageTypePong, MessageTypeKick, MessageTypeResume, MessageTypeBatch:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+// -------------------------------------------
+// @file      : resume_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/8 下午3:10
+// -------------------------------------------
+
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+// testHandler 测试用的会话处理器,忽略所有消息
+type testHandler struct{}
+
+func (handler *testHandler) Read(ISession, *Message)            {}
+func (handler *testHandler) SessionStatusChanged(SessionStatus) {}
+
+// clientToken 客户端当前持有的恢复令牌
+func clientToken(session *ClientSession) *ResumeToken {
+	var token *ResumeToken
+	session.driver.lock(session, func() {
+		token = session.token
+	})
+	return token
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("wait %s timeout", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGateSessionResume(t *testing.T) {
+	initTestConfig()
+	transport := NewMemoryTransport()
+	security := &Security{Encrypt: true}
+
+	sessions := make(chan ISession, 4)
+	gateDriver := NewGateDriver("gate", func(session ISession) (ISessionHandler, error) {
+		sessions <- session
+		return &testHandler{}, nil
+	}, transport, security)
+	defer gateDriver.Close()
+	waitUntil(t, "gate listen", func() bool {
+		gateDriver.RLock()
+		defer gateDriver.RUnlock()
+		return gateDriver.listener != nil
+	})
+	clientDriver := NewClientDriver("gate", func(session ISession) (ISessionHandler, error) {
+		return &testHandler{}, nil
+	}, transport, security)
+	defer clientDriver.Close()
+
+	session, err := clientDriver.NewSession("1", ConnectionTypeOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := session.(*ClientSession)
+	gateSession := (<-sessions).(*GateSession)
+	if err = gateSession.EnableResume(); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, "resume token", func() bool { return clientToken(client) != nil })
+	first := clientToken(client)
+
+	// 只知道令牌ID,签名错误时不能恢复,原会话保留
+	conn, err := transport.Dial("gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := newKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := localHandshake("forged")
+	forged.PublicKey = private.PublicKey().Bytes()
+	forged.ResumeID = first.ID
+	forged.ResumeMAC = resumeMAC(&ResumeToken{ID: first.ID, Secret: []byte("guess")}, 0, forged.PublicKey)
+	stream := NewStream(conn, conn)
+	if err = WriteMessage(stream, &Message{Type: MessageTypeHandshake, Data: forged.Marshal()}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ReadMessage(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs, err := UnmarshalHandshake(msg.Data); err != nil || hs == nil || hs.Resumed {
+		t.Fatalf("forged resume accepted: %+v err: %v", hs, err)
+	}
+	_ = conn.Close()
+	<-sessions
+	if _, ok := gateDriver.getResume(first.ID); !ok {
+		t.Fatal("session dropped by forged resume")
+	}
+
+	// 连接断开后客户端恢复原会话,网关签发新令牌,旧令牌失效
+	gateSession.Lock()
+	_ = gateSession.conn.Close()
+	gateSession.Unlock()
+	waitUntil(t, "token rotated", func() bool {
+		token := clientToken(client)
+		return token != nil && token.ID != first.ID
+	})
+	if _, ok := gateDriver.getResume(first.ID); ok {
+		t.Fatal("old token still valid after resume")
+	}
+	if resumed, ok := gateDriver.getResume(clientToken(client).ID); !ok || resumed != gateSession {
+		t.Fatal("session not resumed with new token")
+	}
+	select {
+	case s := <-sessions:
+		t.Fatalf("new session created on resume: %s", s)
+	default:
+	}
+}
@@ -0,0 +1,258 @@
+// -------------------------------------------
+// @file      : security.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/16 上午10:40
+// -------------------------------------------
+
+package network
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"gogs/base/cberrors"
+	"os"
+)
+
+// 加密帧的方向,参与随机数计算,保证两个方向使用同一密钥时随机数不重复
+const (
+	directionClient uint32 = 1 // 客户端发往网关
+	directionGate   uint32 = 2 // 网关发往客户端
+)
+
+// Security 网关传输安全选项,为nil时明文传输
+// 启用加密但不使用tls时,需要网关配置签名私钥、客户端固定网关签名公钥,否则密钥交换可被中间人替换
+type Security struct {
+	Encrypt   bool               // 是否在握手时进行ECDH密钥交换,之后使用AES-GCM加密
+	TLSConfig *tls.Config        // 不为nil时NewTransport创建的tcp传输层使用tls,websocket使用wss
+	SignKey   ed25519.PrivateKey // 网关的静态签名私钥,不为nil时网关对本次交换的公钥签名
+	GateKey   ed25519.PublicKey  // 客户端固定的网关签名公钥,不为nil时校验网关应答的签名
+}
+
+// encrypt 是否启用ECDH+AES-GCM加密
+func (security *Security) encrypt() bool {
+	return security != nil && security.Encrypt
+}
+
+// tlsConfig 获取tls配置
+func (security *Security) tlsConfig() *tls.Config {
+	if security == nil {
+		return nil
+	}
+	return security.TLSConfig
+}
+
+// CheckGate 检查网关的安全选项,启用加密时必须使用tls或配置签名私钥
+func (security *Security) CheckGate() error {
+	if security.encrypt() && security.TLSConfig == nil && security.SignKey == nil {
+		return cberrors.New("encrypt requires tls or a sign key")
+	}
+	return nil
+}
+
+// CheckClient 检查客户端的安全选项,启用加密时必须使用tls或固定网关签名公钥
+func (security *Security) CheckClient() error {
+	if security.encrypt() && security.TLSConfig == nil && security.GateKey == nil {
+		return cberrors.New("encrypt requires tls or a pinned gate key")
+	}
+	return nil
+}
+
+// NewServerTLSConfig 根据证书和私钥文件创建服务端tls配置
+func NewServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// NewClientTLSConfig 创建客户端tls配置,caFile为空时使用系统根证书
+func NewClientTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	c := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure,
+	}
+	if caFile == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, cberrors.New("invalid ca file: %s", caFile)
+	}
+	c.RootCAs = pool
+	return c, nil
+}
+
+// newKeyPair 生成ECDH密钥对
+func newKeyPair() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// deriveKey 根据本地私钥和对端公钥计算AES密钥
+func deriveKey(private *ecdh.PrivateKey, remotePublic []byte) ([]byte, error) {
+	public, err := ecdh.X25519().NewPublicKey(remotePublic)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := private.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256(secret)
+	return key[:], nil
+}
+
+// LoadSignKey 读取PEM格式(PKCS8)的ed25519签名私钥文件
+func LoadSignKey(file string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, cberrors.New("sign key: %s is not ed25519", file)
+	}
+	return private, nil
+}
+
+// LoadGateKey 读取PEM格式(PKIX)的ed25519网关签名公钥文件
+func LoadGateKey(file string) (ed25519.PublicKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, cberrors.New("gate key: %s is not ed25519", file)
+	}
+	return public, nil
+}
+
+// readPEM 读取PEM文件的第一个块
+func readPEM(file string) (*pem.Block, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, cberrors.New("invalid pem file: %s", file)
+	}
+	return block, nil
+}
+
+// handshakeDigest 签名内容,网关公钥和客户端公钥依次拼接
+// 签名绑定双方本次的公钥,中间人无法替换网关公钥,也无法重放其他连接的签名
+func handshakeDigest(gatePublic, clientPublic []byte) []byte {
+	digest := make([]byte, 0, len(gatePublic)+len(clientPublic))
+	digest = append(digest, gatePublic...)
+	return append(digest, clientPublic...)
+}
+
+// signHandshake 网关以静态私钥对本次交换的公钥签名
+func signHandshake(key ed25519.PrivateKey, gatePublic, clientPublic []byte) []byte {
+	return ed25519.Sign(key, handshakeDigest(gatePublic, clientPublic))
+}
+
+// verifyHandshake 客户端以固定的网关公钥校验签名
+func verifyHandshake(key ed25519.PublicKey, gatePublic, clientPublic, signature []byte) bool {
+	return len(signature) == ed25519.SignatureSize && ed25519.Verify(key, handshakeDigest(gatePublic, clientPublic), signature)
+}
+
+// resumeMAC 恢复签名,以令牌密钥对令牌ID、已收到的消息序号和本次握手的公钥做HMAC-SHA256
+// 签名绑定本次密钥交换,截获的握手无法换用其他公钥恢复会话
+func resumeMAC(token *ResumeToken, ackSeq uint64, publicKey []byte) []byte {
+	mac := hmac.New(sha256.New, token.Secret)
+	mac.Write([]byte(token.ID))
+	seq := make([]byte, 8)
+	binary.LittleEndian.PutUint64(seq, ackSeq)
+	mac.Write(seq)
+	mac.Write(publicKey)
+	return mac.Sum(nil)
+}
+
+// frameSealer AES-GCM帧加密器
+// 每帧携带递增序号,序号和方向组成随机数,接收方只接受连续递增的序号,防止重放和乱序
+// 一个流只用于单向的读或写,因此发送序号和接收序号各自独立,无需加锁
+type frameSealer struct {
+	aead    cipher.AEAD // AES-GCM
+	sendDir uint32      // 发送方向
+	recvDir uint32      // 接收方向
+	sendSeq uint64      // 最后发送的序号
+	recvSeq uint64      // 最后接收的序号
+}
+
+// newFrameSealer 根据AES密钥新建帧加密器
+func newFrameSealer(key []byte, sendDir, recvDir uint32) (*frameSealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &frameSealer{
+		aead:    aead,
+		sendDir: sendDir,
+		recvDir: recvDir,
+	}, nil
+}
+
+// nonce 根据方向和序号生成随机数
+func (sealer *frameSealer) nonce(dir uint32, seq uint64) []byte {
+	nonce := make([]byte, sealer.aead.NonceSize())
+	binary.LittleEndian.PutUint32(nonce, dir)
+	binary.LittleEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// seal 加密一帧,返回序号+密文
+func (sealer *frameSealer) seal(plain []byte) []byte {
+	sealer.sendSeq++
+	frame := make([]byte, 8, 8+len(plain)+sealer.aead.Overhead())
+	binary.LittleEndian.PutUint64(frame, sealer.sendSeq)
+	return sealer.aead.Seal(frame, sealer.nonce(sealer.sendDir, sealer.sendSeq), plain, frame[:8])
+}
+
+// open 校验序号并解密一帧
+func (sealer *frameSealer) open(frame []byte) ([]byte, error) {
+	if len(frame) < 8 {
+		return nil, cberrors.New("invalid encrypted frame size: %d", len(frame))
+	}
+	seq := binary.LittleEndian.Uint64(frame)
+	if seq != sealer.recvSeq+1 {
+		return nil, cberrors.New("unexpected frame seq: %d, expect: %d", seq, sealer.recvSeq+1)
+	}
+	plain, err := sealer.aead.Open(nil, sealer.nonce(sealer.recvDir, seq), frame[8:], frame[:8])
+	if err != nil {
+		return nil, err
+	}
+	sealer.recvSeq = seq
+	return plain, nil
+}
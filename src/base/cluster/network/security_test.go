@@ -0,0 +1,156 @@
+// -------------------------------------------
+// @file      : security_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/9 下午4:20
+// -------------------------------------------
+
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"runtime"
+	"testing"
+)
+
+func TestEncryptedHandshake(t *testing.T) {
+	initTestConfig()
+	gateKey, signKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := newTestPair(t, &Security{Encrypt: true, SignKey: signKey, GateKey: gateKey})
+	pair.session.Lock()
+	key := pair.session.key
+	pair.session.Unlock()
+	var clientKey []byte
+	pair.client.driver.lock(pair.client, func() {
+		clientKey = pair.client.key
+	})
+	if len(key) != 32 || !bytes.Equal(key, clientKey) {
+		t.Fatalf("aes key mismatch: %x %x", key, clientKey)
+	}
+	// 加密后的消息往返
+	for _, data := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("gogs"), 1024)} {
+		if err = pair.client.Write(&Message{Type: MessageTypeCall, Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		if msg := pair.receive(t); !bytes.Equal(msg.Data, data) {
+			t.Fatalf("unexpected message: %s len: %d", msg.Type, len(msg.Data))
+		}
+	}
+
+	// 固定的网关公钥不匹配时拒绝握手,不降级为未认证的加密
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDriver := NewClientDriver("gate", func(session ISession) (ISessionHandler, error) {
+		return &testHandler{}, nil
+	}, pair.transport, &Security{Encrypt: true, GateKey: otherKey})
+	t.Cleanup(clientDriver.Close)
+	session, err := clientDriver.NewSession("2", ConnectionTypeOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := pair.transport.Dial("gate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, _, err = session.(*ClientSession).handshake(NewStream(conn, conn)); err == nil {
+		t.Fatal("handshake signed by another key accepted")
+	}
+}
+
+func TestSecurityCheck(t *testing.T) {
+	gateKey, signKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = (&Security{Encrypt: true}).CheckGate(); err == nil {
+		t.Fatal("gate encrypt without tls or sign key accepted")
+	}
+	if err = (&Security{Encrypt: true}).CheckClient(); err == nil {
+		t.Fatal("client encrypt without tls or gate key accepted")
+	}
+	if err = (&Security{Encrypt: true, SignKey: signKey}).CheckGate(); err != nil {
+		t.Fatal(err)
+	}
+	if err = (&Security{Encrypt: true, GateKey: gateKey}).CheckClient(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFrameSealer(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	client, err := newFrameSealer(key, directionClient, directionGate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate, err := newFrameSealer(key, directionGate, directionClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := client.seal([]byte("first")), client.seal([]byte("second"))
+	// 乱序的帧
+	if _, err = gate.open(second); err == nil {
+		t.Fatal("out of order frame accepted")
+	}
+	if plain, err := gate.open(first); err != nil || string(plain) != "first" {
+		t.Fatalf("open first frame: %q err: %v", plain, err)
+	}
+	// 重放的帧
+	if _, err = gate.open(first); err == nil {
+		t.Fatal("replayed frame accepted")
+	}
+	// 篡改的密文和序号
+	tampered := append([]byte(nil), second...)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err = gate.open(tampered); err == nil {
+		t.Fatal("tampered frame accepted")
+	}
+	third := client.seal([]byte("third"))
+	third[0]--
+	if _, err = gate.open(third); err == nil {
+		t.Fatal("frame with tampered seq accepted")
+	}
+	if plain, err := gate.open(second); err != nil || string(plain) != "second" {
+		t.Fatalf("open second frame: %q err: %v", plain, err)
+	}
+	// 反射回发送方的帧方向不同,无法解密
+	echo, err := newFrameSealer(key, directionGate, directionClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = echo.open(gate.seal([]byte("echo"))); err == nil {
+		t.Fatal("reflected frame accepted")
+	}
+}
+
+func TestReadSealedLimit(t *testing.T) {
+	setConfig(t, &rpcConfig().MaxMessageSize, 1<<20)
+	key := make([]byte, 32)
+	var buf bytes.Buffer
+	stream := NewStream(&buf, &buf)
+	if err := stream.SetCipher(key, directionGate, directionClient); err != nil {
+		t.Fatal(err)
+	}
+	// 长度头声明2GB
+	buf.Write(MarshalUint32(1 << 31))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := stream.ReadMessage(); err == nil {
+		t.Fatal("huge encrypted frame accepted")
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+		t.Fatalf("allocated %d bytes for a huge frame", allocated)
+	}
+}
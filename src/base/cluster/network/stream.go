@@ -8,58 +8,157 @@
 package network
 
 import (
-	"github.com/gorilla/websocket"
 	"gogs/base/cberrors"
+	"gogs/base/config"
+	"gogs/base/metrics"
 	"io"
 )
 
 // Stream 流 带缓冲
 type Stream struct {
-	reader        io.Reader
-	writer        io.Writer
-	protocol      ProtocolType
-	websocketConn *websocket.Conn
+	reader     io.Reader
+	writer     io.Writer
+	compressor ICompressor      // 压缩器,为nil时不压缩
+	sealer     *frameSealer     // 加密器,为nil时不加密
+	received   *metrics.Counter // 接收字节数,为nil时不统计
+	sent       *metrics.Counter // 发送字节数,为nil时不统计
 }
 
 // NewStream 创建流
 func NewStream(reader io.Reader, writer io.Writer) *Stream {
 	stream := &Stream{
-		reader:   reader,
-		writer:   writer,
-		protocol: ProtocolTCP,
+		reader: reader,
+		writer: writer,
 	}
 	return stream
 }
 
-// NewWebsocketStream 创建websocket流
-func NewWebsocketStream(wsConn *websocket.Conn) *Stream {
-	stream := &Stream{
-		websocketConn: wsConn,
-		protocol:      ProtocolWebsocket,
-	}
+// measure 按驱动类型统计流的收发字节数
+func (stream *Stream) measure(driverType DriverType) *Stream {
+	stream.received = bytesReceived.With(driverType.String())
+	stream.sent = bytesSent.With(driverType.String())
 	return stream
 }
 
+// SetCompress 设置流的压缩算法,握手协商完成后设置
+func (stream *Stream) SetCompress(compressType CompressType) error {
+	compressor, err := NewCompressor(compressType)
+	if err != nil {
+		return err
+	}
+	stream.compressor = compressor
+	return nil
+}
+
+// SetCipher 设置流的AES密钥和收发方向,密钥交换完成后设置
+func (stream *Stream) SetCipher(key []byte, sendDir, recvDir uint32) error {
+	sealer, err := newFrameSealer(key, sendDir, recvDir)
+	if err != nil {
+		return err
+	}
+	stream.sealer = sealer
+	return nil
+}
+
 // Read 读取数据,先读到缓冲区再读取
 func (stream *Stream) Read(buf []byte) (int, error) {
-	if stream.protocol == ProtocolWebsocket {
-		t, r, err := stream.websocketConn.NextReader()
-		if t != websocket.BinaryMessage {
-			return 0, cberrors.New("invalid websocket message type: %d", t)
+	n, err := io.ReadFull(stream.reader, buf)
+	if stream.received != nil && n > 0 {
+		stream.received.Add(float64(n))
+	}
+	return n, err
+}
+
+// Write 写入数据到缓冲区
+func (stream *Stream) Write(buf []byte) (int, error) {
+	n, err := stream.writer.Write(buf)
+	if stream.sent != nil && n > 0 {
+		stream.sent.Add(float64(n))
+	}
+	return n, err
+}
+
+// ReadMessage 读取一个消息,已压缩的消息解压后返回
+func (stream *Stream) ReadMessage() (*Message, error) {
+	var msg *Message
+	var err error
+	if stream.sealer != nil {
+		msg, err = stream.readSealed()
+	} else {
+		msg, err = ReadMessage(stream)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, cberrors.New("read empty message")
+	}
+	if msg.Compressed {
+		if stream.compressor == nil {
+			return nil, cberrors.New("receive compressed message without compressor")
 		}
+		msg.Data, err = stream.compressor.Decompress(msg.Data)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		return io.ReadFull(r, buf)
+		msg.Compressed = false
 	}
-	return io.ReadFull(stream.reader, buf)
+	return msg, nil
 }
 
-// Write 写入数据到缓冲区
-func (stream *Stream) Write(buf []byte) (int, error) {
-	if stream.protocol == ProtocolWebsocket {
-		length := len(buf)
-		return length, stream.websocketConn.WriteMessage(websocket.BinaryMessage, buf)
+// WriteMessage 写入一个消息,数据超过阈值且压缩有收益时压缩后写入,不修改原消息
+func (stream *Stream) WriteMessage(msg *Message) error {
+	if stream.compressor != nil && len(msg.Data) >= config.CompressThreshold() {
+		data, err := stream.compressor.Compress(msg.Data)
+		if err != nil {
+			return err
+		}
+		if len(data) < len(msg.Data) {
+			msg = &Message{
+				Type:       msg.Type,
+				Data:       data,
+				Compressed: true,
+				Seq:        msg.Seq,
+			}
+		}
+	}
+	if stream.sealer != nil {
+		return stream.writeSealed(msg)
+	}
+	return WriteMessage(stream, msg)
+}
+
+// readSealed 读取并解密一个消息,帧格式为4字节长度+8字节序号+密文
+func (stream *Stream) readSealed() (*Message, error) {
+	buf := make([]byte, 4)
+	if _, err := stream.Read(buf); err != nil {
+		return nil, err
+	}
+	size, err := UnmarshalUint32(buf)
+	if err != nil {
+		return nil, err
+	}
+	// 长度来自未认证的数据,超过最大帧大小时不分配内存
+	if max := config.MaxMessageSize(); max > 0 && int64(size) > int64(max) {
+		return nil, cberrors.New("encrypted frame size: %d exceeds max message size: %d", size, max)
+	}
+	frame := make([]byte, size)
+	if _, err = stream.Read(frame); err != nil {
+		return nil, err
+	}
+	data, err := stream.sealer.open(frame)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalMessage(data)
+}
+
+// writeSealed 加密并写入一个消息
+func (stream *Stream) writeSealed(msg *Message) error {
+	frame := stream.sealer.seal(msg.Marshal())
+	if _, err := stream.Write(MarshalUint32(uint32(len(frame)))); err != nil {
+		return err
 	}
-	return stream.writer.Write(buf)
+	_, err := stream.Write(frame)
+	return err
 }
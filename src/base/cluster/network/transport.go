@@ -0,0 +1,77 @@
+// -------------------------------------------
+// @file      : transport.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/21 上午10:05
+// -------------------------------------------
+
+package network
+
+import (
+	"crypto/tls"
+	"gogs/base/cberrors"
+	"net"
+)
+
+// ITransport 传输层,驱动通过传输层建立监听和发起连接
+// 不同协议的连接统一为net.Conn,驱动和会话不再区分具体协议
+type ITransport interface {
+	Protocol() ProtocolType                   // 协议类型
+	Listen(addr string) (net.Listener, error) // 在指定地址监听
+	Dial(addr string) (net.Conn, error)       // 连接指定地址
+}
+
+// NewTransport 根据协议类型创建传输层,security不为nil且配置了tls时tcp使用tls,websocket使用wss
+// 内存传输层需要在进程内共享同一个实例,请使用NewMemoryTransport
+func NewTransport(protocol ProtocolType, security *Security) (ITransport, error) {
+	switch protocol {
+	case ProtocolTCP:
+		return NewTCPTransport(security.tlsConfig()), nil
+	case ProtocolWebsocket:
+		return NewWebsocketTransport(security.tlsConfig()), nil
+	case ProtocolKCP:
+		return NewKCPTransport(), nil
+	}
+	return nil, cberrors.New("unsupported protocol: %d", protocol)
+}
+
+// defaultTransport 未指定传输层时使用明文tcp
+func defaultTransport(transport ITransport) ITransport {
+	if transport == nil {
+		return NewTCPTransport(nil)
+	}
+	return transport
+}
+
+// TCPTransport tcp传输层
+type TCPTransport struct {
+	tlsConfig *tls.Config // 不为nil时使用tls
+}
+
+// NewTCPTransport 新建tcp传输层,tlsConfig为nil时明文传输
+func NewTCPTransport(tlsConfig *tls.Config) *TCPTransport {
+	return &TCPTransport{
+		tlsConfig: tlsConfig,
+	}
+}
+
+// Protocol implements ITransport
+func (transport *TCPTransport) Protocol() ProtocolType {
+	return ProtocolTCP
+}
+
+// Listen implements ITransport
+func (transport *TCPTransport) Listen(addr string) (net.Listener, error) {
+	if transport.tlsConfig != nil {
+		return tls.Listen("tcp", addr, transport.tlsConfig)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Dial implements ITransport
+func (transport *TCPTransport) Dial(addr string) (net.Conn, error) {
+	if transport.tlsConfig != nil {
+		return tls.Dial("tcp", addr, transport.tlsConfig)
+	}
+	return net.Dial("tcp", addr)
+}
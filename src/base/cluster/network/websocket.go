@@ -0,0 +1,194 @@
+// -------------------------------------------
+// @file      : websocket.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/21 上午10:40
+// -------------------------------------------
+
+package network
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/gorilla/websocket"
+	"gogs/base/cberrors"
+	log "gogs/base/logger"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// websocketPath websocket服务路径
+const websocketPath = "/gate"
+
+// upgrader websocket默认参数
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// WebsocketTransport websocket传输层
+// 监听地址为host:port,服务路径固定为/gate,连接地址为完整url,启用tls时须使用wss://
+type WebsocketTransport struct {
+	tlsConfig *tls.Config // 不为nil时使用wss
+}
+
+// NewWebsocketTransport 新建websocket传输层,tlsConfig为nil时明文传输
+func NewWebsocketTransport(tlsConfig *tls.Config) *WebsocketTransport {
+	return &WebsocketTransport{
+		tlsConfig: tlsConfig,
+	}
+}
+
+// Protocol implements ITransport
+func (transport *WebsocketTransport) Protocol() ProtocolType {
+	return ProtocolWebsocket
+}
+
+// Listen implements ITransport
+func (transport *WebsocketTransport) Listen(addr string) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if transport.tlsConfig != nil {
+		ln, err = tls.Listen("tcp", addr, transport.tlsConfig)
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	listener := &websocketListener{
+		addr:  ln.Addr(),
+		conns: make(chan net.Conn),
+		exit:  make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(websocketPath, listener.handle)
+	listener.server = &http.Server{
+		Handler: mux,
+	}
+	go func() {
+		if err := listener.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("websocket serve: %s err: %s", addr, err)
+		}
+	}()
+	return listener, nil
+}
+
+// Dial implements ITransport
+func (transport *WebsocketTransport) Dial(addr string) (net.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = transport.tlsConfig
+	conn, _, err := dialer.Dial(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newWebsocketConn(conn), nil
+}
+
+// websocketListener websocket监听器,实现net.Listener
+// http服务升级后的连接通过Accept返回,连接的生命周期与http处理函数无关
+type websocketListener struct {
+	addr      net.Addr      // 监听地址
+	server    *http.Server  // http服务器
+	conns     chan net.Conn // 等待Accept的连接
+	exit      chan struct{} // 关闭信号
+	closeOnce sync.Once     // 关闭一次
+}
+
+// handle 升级websocket连接,交给Accept
+func (listener *websocketListener) handle(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorf("websocket upgrade: %s err: %s", listener.addr, err)
+		return
+	}
+	select {
+	case listener.conns <- newWebsocketConn(conn):
+	case <-listener.exit:
+		_ = conn.Close()
+	}
+}
+
+// Accept implements net.Listener
+func (listener *websocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.exit:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener,已升级的连接不受影响
+func (listener *websocketListener) Close() error {
+	var err error
+	listener.closeOnce.Do(func() {
+		close(listener.exit)
+		err = listener.server.Close()
+	})
+	return err
+}
+
+// Addr implements net.Listener
+func (listener *websocketListener) Addr() net.Addr {
+	return listener.addr
+}
+
+// websocketConn 将websocket连接适配为net.Conn
+// 每次写入作为一个二进制消息发送,读取时依次读取各个消息的内容
+type websocketConn struct {
+	*websocket.Conn
+	reader io.Reader // 当前正在读取的消息
+}
+
+// newWebsocketConn 新建websocket连接适配器
+func newWebsocketConn(conn *websocket.Conn) *websocketConn {
+	return &websocketConn{
+		Conn: conn,
+	}
+}
+
+// Read implements net.Conn
+func (conn *websocketConn) Read(buf []byte) (int, error) {
+	for {
+		if conn.reader == nil {
+			t, reader, err := conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if t != websocket.BinaryMessage {
+				return 0, cberrors.New("invalid websocket message type: %d", t)
+			}
+			conn.reader = reader
+		}
+		n, err := conn.reader.Read(buf)
+		if errors.Is(err, io.EOF) {
+			conn.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write implements net.Conn
+func (conn *websocketConn) Write(buf []byte) (int, error) {
+	if err := conn.WriteMessage(websocket.BinaryMessage, buf); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// SetDeadline implements net.Conn
+func (conn *websocketConn) SetDeadline(t time.Time) error {
+	if err := conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(t)
+}
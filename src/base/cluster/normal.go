@@ -8,7 +8,7 @@
 package cluster
 
 import (
-	"gogs/base/etcd"
+	"gogs/base/cluster/network"
 	log "gogs/base/logger"
 	"sync"
 	"sync/atomic"
@@ -24,24 +24,23 @@ type Normal struct {
 	serverName   string                     // 服务器名字
 }
 
-// NewNormal 新建普通功能服务器
-func NewNormal(name string, builders map[string]IServiceBuilder, localAddr string) *Normal {
+// NewNormal 新建普通功能服务器,transport为nil时使用tcp
+func NewNormal(name string, builders map[string]IServiceBuilder, localAddr string, transport network.ITransport) *Normal {
+	host := NewHost(localAddr, transport)
 	normal := &Normal{
-		RPC:        NewRPC(),
-		Host:       NewHost(localAddr),
+		RPC:        host.RPC,
+		Host:       host,
 		builders:   builders,
 		serverName: name,
 	}
 	return normal
 }
 
-// Shutdown 关闭服务器
+// Shutdown 关闭服务器,etcd由启动框架在之后注销
 func (normal *Normal) Shutdown() {
 	log.Infof("%s shutdown start:", normal.serverName)
 	log.Infof("%s:Host closing...", normal.serverName)
 	normal.Host.Close()
-	log.Infof("%s:Etcd closing....", normal.serverName)
-	etcd.Exit()
 	log.Infof("%s shutdown finished.", normal.serverName)
 }
 
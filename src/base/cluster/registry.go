@@ -0,0 +1,238 @@
+// -------------------------------------------
+// @file      : registry.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/31 上午10:30
+// -------------------------------------------
+
+package cluster
+
+import (
+	"fmt"
+	"gogs/base/cluster/network"
+	log "gogs/base/logger"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// registry 本地已发布的服务注册表
+// 每次向邻居发送增量时序号加1,邻居发现序号不连续或摘要不一致时请求全量快照
+// 发送增量和快照都在锁内进行,保证同一会话上快照与之后的增量按序号先后到达
+type registry struct {
+	sync.Mutex
+	epoch    int64                               // 纪元,每次启动重新生成
+	seq      uint64                              // 最新序号
+	services map[string]*network.ServiceRegistry // 已发布的本地服务,通过服务名字索引
+}
+
+// newRegistry 新建服务注册表
+func newRegistry() *registry {
+	return &registry{
+		epoch:    time.Now().UnixNano(),
+		services: make(map[string]*network.ServiceRegistry),
+	}
+}
+
+// applyRegistry 将一条服务注册应用到按名字索引的注册表,注销时只删除ID和类型一致的服务
+func applyRegistry(services map[string]*network.ServiceRegistry, r *network.ServiceRegistry) {
+	if r.Add {
+		services[r.ServiceName] = r
+		return
+	}
+	if old, ok := services[r.ServiceName]; ok && old.ServiceID == r.ServiceID && old.ServiceType == r.ServiceType {
+		delete(services, r.ServiceName)
+	}
+}
+
+// registryDigest 注册表摘要,与遍历顺序无关
+func registryDigest(services map[string]*network.ServiceRegistry) uint64 {
+	var digest uint64
+	for _, r := range services {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(r.ServiceName))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(r.ServiceType))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(strconv.FormatUint(uint64(r.ServiceID), 10)))
+		digest += h.Sum64()
+	}
+	return digest
+}
+
+// publish 发布一批本地服务变更,序号加1后发送给所有邻居
+func (host *Host) publish(content []*network.ServiceRegistry) {
+	host.registry.Lock()
+	defer host.registry.Unlock()
+	for _, r := range content {
+		applyRegistry(host.registry.services, r)
+	}
+	host.registry.seq++
+	srd := &network.ServiceRegistryData{
+		Data:  content,
+		Epoch: host.registry.epoch,
+		Seq:   host.registry.seq,
+	}
+	msg := &network.Message{
+		Type: network.MessageTypeRegistry,
+		Data: srd.Marshal(),
+	}
+	host.neighborMutex.RLock()
+	defer host.neighborMutex.RUnlock()
+	for _, neighbor := range host.neighbors {
+		if err := neighbor.agent.Write(msg); err != nil {
+			log.Errorf("neighbors agent write msg err: %s", err)
+		}
+	}
+	log.Infof("Host service registry data sent, seq: %d", srd.Seq)
+}
+
+// snapshotLocked 已发布服务的全量快照,需要持有注册表锁
+func (host *Host) snapshotLocked() *network.Message {
+	srd := &network.ServiceRegistryData{
+		Data:     make([]*network.ServiceRegistry, 0, len(host.registry.services)),
+		Epoch:    host.registry.epoch,
+		Seq:      host.registry.seq,
+		Snapshot: true,
+	}
+	for _, r := range host.registry.services {
+		srd.Data = append(srd.Data, r)
+	}
+	return &network.Message{
+		Type: network.MessageTypeRegistry,
+		Data: srd.Marshal(),
+	}
+}
+
+// sendSnapshot 向邻居发送全量快照
+func (host *Host) sendSnapshot(remote *HostAgent) {
+	host.registry.Lock()
+	defer host.registry.Unlock()
+	if err := remote.Write(host.snapshotLocked()); err != nil {
+		log.Errorf("agent: %s write registry snapshot err: %s", remote, err)
+	}
+}
+
+// sendDigest 向所有邻居发送注册表摘要
+func (host *Host) sendDigest() {
+	host.registry.Lock()
+	defer host.registry.Unlock()
+	digest := &network.RegistryDigest{
+		Epoch:  host.registry.epoch,
+		Seq:    host.registry.seq,
+		Digest: registryDigest(host.registry.services),
+	}
+	msg := &network.Message{
+		Type: network.MessageTypeRegistryDigest,
+		Data: digest.Marshal(),
+	}
+	host.neighborMutex.RLock()
+	defer host.neighborMutex.RUnlock()
+	for _, neighbor := range host.neighbors {
+		if err := neighbor.agent.Write(msg); err != nil {
+			log.Errorf("neighbors agent write msg err: %s", err)
+		}
+	}
+}
+
+// requestSync 请求邻居发送全量快照,等待快照期间不重复请求,需要持有邻居锁
+func (host *Host) requestSync(neighbor *Neighbor, reason string) {
+	if neighbor.syncing {
+		return
+	}
+	log.Warnf("request registry snapshot from: %s, %s", neighbor.agent, reason)
+	neighbor.syncing = true
+	err := neighbor.agent.Write(&network.Message{Type: network.MessageTypeRegistrySync})
+	if err != nil {
+		neighbor.syncing = false
+		log.Errorf("agent: %s write registry sync err: %s", neighbor.agent, err)
+	}
+}
+
+// handleServiceRegistry 处理来自邻居节点的服务注册消息
+// 快照替换该邻居的全部服务,增量必须与上一个序号连续,否则丢弃并请求快照
+func (host *Host) handleServiceRegistry(remote *HostAgent, srd *network.ServiceRegistryData) {
+	host.neighborMutex.Lock()
+	defer host.neighborMutex.Unlock()
+	neighbor, ok := host.neighbors[remote.Name()]
+	if !ok {
+		return
+	}
+	if srd.Snapshot {
+		snapshot := make(map[string]*network.ServiceRegistry, len(srd.Data))
+		for _, r := range srd.Data {
+			snapshot[r.ServiceName] = r
+		}
+		// 快照中没有或已变更的服务下线
+		for name, service := range neighbor.services {
+			if r, ok := snapshot[name]; !ok || service.RemoteID() != ID(r.ServiceID) || service.Type() != r.ServiceType {
+				neighbor.removeService(service)
+				host.ServiceStatusChanged(service, network.ServiceStatusOffline)
+			}
+		}
+		neighbor.registry = make(map[string]*network.ServiceRegistry, len(srd.Data))
+		neighbor.syncing = false
+	} else if srd.Epoch != neighbor.epoch || srd.Seq != neighbor.seq+1 {
+		if srd.Epoch == neighbor.epoch && srd.Seq <= neighbor.seq {
+			// 重复或过期的增量
+			return
+		}
+		host.requestSync(neighbor, fmt.Sprintf("registry gap, epoch: %d seq: %d expect: %d", srd.Epoch, srd.Seq, neighbor.seq+1))
+		return
+	}
+	neighbor.epoch = srd.Epoch
+	neighbor.seq = srd.Seq
+	for _, r := range srd.Data {
+		applyRegistry(neighbor.registry, r)
+		if r.Add {
+			// 服务注册
+			if host.hasLocalService(r.ServiceName) {
+				log.Warnf("service name: %s from: %s conflicts with local service, use NewSingleton for cluster unique service",
+					r.ServiceName, remote)
+			}
+			if service, ok := neighbor.services[r.ServiceName]; ok {
+				if service.RemoteID() == ID(r.ServiceID) && service.Type() == r.ServiceType {
+					continue
+				}
+				neighbor.removeService(service)
+				host.ServiceStatusChanged(service, network.ServiceStatusOffline)
+			}
+			host.builderMutex.RLock()
+			builder, ok := host.builders[r.ServiceType]
+			host.builderMutex.RUnlock()
+			if ok {
+				remoteService := builder.NewRemoteService(
+					remote, r.ServiceName, host.newID(), ID(r.ServiceID), nil,
+				)
+				neighbor.services[r.ServiceName] = remoteService
+				neighbor.servicesByID[remoteService.RemoteID()] = remoteService
+				host.ServiceStatusChanged(remoteService, network.ServiceStatusOnline)
+			}
+		} else {
+			// 服务注销
+			if service, ok := neighbor.services[r.ServiceName]; ok {
+				if service.RemoteID() == ID(r.ServiceID) && service.Type() == r.ServiceType {
+					neighbor.removeService(service)
+					host.ServiceStatusChanged(service, network.ServiceStatusOffline)
+				}
+			}
+		}
+	}
+}
+
+// handleRegistryDigest 反熵校验,邻居的纪元、序号或摘要与本地保存的不一致时请求快照
+func (host *Host) handleRegistryDigest(remote *HostAgent, digest *network.RegistryDigest) {
+	host.neighborMutex.Lock()
+	defer host.neighborMutex.Unlock()
+	neighbor, ok := host.neighbors[remote.Name()]
+	if !ok {
+		return
+	}
+	if digest.Epoch == neighbor.epoch && digest.Seq == neighbor.seq && digest.Digest == registryDigest(neighbor.registry) {
+		return
+	}
+	// 之前的快照请求可能已丢失,重新请求
+	neighbor.syncing = false
+	host.requestSync(neighbor, fmt.Sprintf("registry digest mismatch, epoch: %d seq: %d", digest.Epoch, digest.Seq))
+}
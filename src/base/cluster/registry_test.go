@@ -0,0 +1,135 @@
+// -------------------------------------------
+// @file      : registry_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/31 下午3:10
+// -------------------------------------------
+
+package cluster
+
+import (
+	"errors"
+	"gogs/base/cluster/network"
+	"testing"
+	"time"
+)
+
+// testService 测试用的本地或远程服务
+type testService struct {
+	typename string
+	name     string
+	id       ID
+	remoteID ID
+	agent    IAgent
+}
+
+func (service *testService) Type() string                                     { return service.typename }
+func (service *testService) Name() string                                     { return service.name }
+func (service *testService) ID() ID                                           { return service.id }
+func (service *testService) Call(call *network.Call) (*network.Return, error) { return nil, nil }
+func (service *testService) Context() interface{}                             { return nil }
+func (service *testService) RemoteID() ID                                     { return service.remoteID }
+func (service *testService) Agent() IAgent                                    { return service.agent }
+
+// testBuilder 测试用的服务构造器,值为服务类型
+type testBuilder string
+
+func (builder testBuilder) ServiceType() string { return string(builder) }
+
+func (builder testBuilder) NewService(name string, id ID, context interface{}) (IService, error) {
+	return &testService{typename: string(builder), name: name, id: id}, nil
+}
+
+func (builder testBuilder) NewRemoteService(remote IAgent, name string, lid ID, rid ID, context interface{}) IRemoteService {
+	return &testService{typename: string(builder), name: name, id: lid, remoteID: rid, agent: remote}
+}
+
+// neighborRegistry 邻居注册表中是否有指定服务
+func neighborRegistry(host *Host, name string) bool {
+	host.neighborMutex.RLock()
+	defer host.neighborMutex.RUnlock()
+	for _, neighbor := range host.neighbors {
+		if _, ok := neighbor.registry[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRegistryDigest(t *testing.T) {
+	a := map[string]*network.ServiceRegistry{}
+	b := map[string]*network.ServiceRegistry{}
+	for _, r := range []*network.ServiceRegistry{
+		{Add: true, ServiceID: 1, ServiceType: "Test", ServiceName: "Test:1"},
+		{Add: true, ServiceID: 2, ServiceType: "Test", ServiceName: "Test:2"},
+	} {
+		applyRegistry(a, r)
+	}
+	applyRegistry(b, &network.ServiceRegistry{Add: true, ServiceID: 2, ServiceType: "Test", ServiceName: "Test:2"})
+	applyRegistry(b, &network.ServiceRegistry{Add: true, ServiceID: 1, ServiceType: "Test", ServiceName: "Test:1"})
+	if registryDigest(a) != registryDigest(b) {
+		t.Fatal("digest depends on order")
+	}
+	// ID不一致的注销不生效
+	applyRegistry(b, &network.ServiceRegistry{ServiceID: 3, ServiceType: "Test", ServiceName: "Test:1"})
+	if registryDigest(a) != registryDigest(b) {
+		t.Fatal("unregister with stale id applied")
+	}
+	applyRegistry(b, &network.ServiceRegistry{Add: true, ServiceID: 3, ServiceType: "Test", ServiceName: "Test:1"})
+	if registryDigest(a) == registryDigest(b) {
+		t.Fatal("digest ignores service id")
+	}
+}
+
+func TestRegistrySync(t *testing.T) {
+	initTestConfig()
+	transport := network.NewMemoryTransport()
+	a := NewHost("a:1", transport)
+	defer a.Close()
+	b := NewHost("b:1", transport)
+	defer b.Close()
+	for _, host := range []*Host{a, b} {
+		if _, err := host.RegisterBuilder(testBuilder("Test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "a listening", func() bool {
+		_, err := b.Connect("a:1")
+		return err == nil
+	})
+
+	if _, err := a.NewService("Test", "Test:1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.WaitForService("Test:1", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// 丢失一个增量,下一个增量序号不连续,请求快照后补齐
+	a.registry.Lock()
+	a.registry.seq++
+	a.registry.Unlock()
+	if _, err := a.NewService("Test", "Test:2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.WaitForService("Test:2", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// 邻居注册表不一致,摘要校验后请求快照
+	b.neighborMutex.Lock()
+	for _, neighbor := range b.neighbors {
+		delete(neighbor.registry, "Test:1")
+	}
+	b.neighborMutex.Unlock()
+	a.sendDigest()
+	waitFor(t, "digest resync", func() bool { return neighborRegistry(b, "Test:1") })
+
+	if _, err := b.WaitForService("Test:3", 50*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("unexpected wait result: %v", err)
+	}
+	// 超时后监听器已移除
+	if stats := b.ListenerStats(); stats.ByName["Test:3"] != 0 {
+		t.Fatalf("listener left after timeout: %v", stats.ByName)
+	}
+}
@@ -0,0 +1,304 @@
+// -------------------------------------------
+// @file      : router.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/24 上午10:30
+// -------------------------------------------
+
+package cluster
+
+import (
+	"gogs/base/cberrors"
+	"gogs/base/etcd"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// RoutePolicyType 路由策略类型
+type RoutePolicyType int32
+
+const (
+	RoutePolicyRoundRobin     RoutePolicyType = 0 // 轮询
+	RoutePolicyLeastInflight  RoutePolicyType = 1 // 最少进行中调用
+	RoutePolicyConsistentHash RoutePolicyType = 2 // 按键一致性哈希
+	RoutePolicyWeightedOnline RoutePolicyType = 3 // 按在线人数加权,在线越少权重越大
+)
+
+// RouteNode 路由的候选节点
+type RouteNode struct {
+	Service  IService // 服务
+	ServerID int64    // 服务器ID,从服务名字解析
+	online   int64    // 当前在线人数,来自节点状态
+	inflight int64    // 通过路由器发起的进行中调用数
+}
+
+// Online 当前在线人数
+func (node *RouteNode) Online() int64 {
+	return atomic.LoadInt64(&node.online)
+}
+
+// Inflight 进行中的调用数
+func (node *RouteNode) Inflight() int64 {
+	return atomic.LoadInt64(&node.inflight)
+}
+
+// IRoutePolicy 路由策略,在可用节点中选择一个,nodes不为空且按服务名字排序
+type IRoutePolicy interface {
+	Pick(nodes []*RouteNode, key int64) *RouteNode
+}
+
+// NewRoutePolicy 根据类型创建路由策略,未知类型使用轮询
+func NewRoutePolicy(policyType RoutePolicyType) IRoutePolicy {
+	switch policyType {
+	case RoutePolicyLeastInflight:
+		return LeastInflightPolicy{}
+	case RoutePolicyConsistentHash:
+		return ConsistentHashPolicy{}
+	case RoutePolicyWeightedOnline:
+		return WeightedOnlinePolicy{}
+	}
+	return &RoundRobinPolicy{}
+}
+
+// RoundRobinPolicy 轮询
+type RoundRobinPolicy struct {
+	next uint64 // 下一次选择的序号
+}
+
+// Pick implements IRoutePolicy
+func (policy *RoundRobinPolicy) Pick(nodes []*RouteNode, key int64) *RouteNode {
+	return nodes[(atomic.AddUint64(&policy.next, 1)-1)%uint64(len(nodes))]
+}
+
+// LeastInflightPolicy 选择进行中调用最少的节点,相同时选择第一个
+type LeastInflightPolicy struct{}
+
+// Pick implements IRoutePolicy
+func (policy LeastInflightPolicy) Pick(nodes []*RouteNode, key int64) *RouteNode {
+	picked := nodes[0]
+	for _, node := range nodes[1:] {
+		if node.Inflight() < picked.Inflight() {
+			picked = node
+		}
+	}
+	return picked
+}
+
+// ConsistentHashPolicy 按键一致性哈希,使用最高随机权重算法
+// 节点增减时只有原本落在该节点上的键会改变去向
+type ConsistentHashPolicy struct{}
+
+// Pick implements IRoutePolicy
+func (policy ConsistentHashPolicy) Pick(nodes []*RouteNode, key int64) *RouteNode {
+	var picked *RouteNode
+	var max uint64
+	for _, node := range nodes {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(node.Service.Name()))
+		_, _ = h.Write([]byte(strconv.FormatInt(key, 10)))
+		if score := mix64(h.Sum64()); picked == nil || score > max {
+			picked, max = node, score
+		}
+	}
+	return picked
+}
+
+// mix64 64位终结混合(murmur3 fmix64),fnv的高位对末尾几个字节不敏感,混合后各节点的得分分布均匀
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// WeightedOnlinePolicy 按在线人数加权随机,节点权重为最大在线人数与自身在线人数之差加1
+type WeightedOnlinePolicy struct{}
+
+// Pick implements IRoutePolicy
+func (policy WeightedOnlinePolicy) Pick(nodes []*RouteNode, key int64) *RouteNode {
+	online := make([]int64, len(nodes))
+	var max int64
+	for i, node := range nodes {
+		online[i] = node.Online()
+		if online[i] > max {
+			max = online[i]
+		}
+	}
+	var total int64
+	for i := range nodes {
+		total += max - online[i] + 1
+	}
+	n := rand.Int63n(total)
+	for i, node := range nodes {
+		n -= max - online[i] + 1
+		if n < 0 {
+			return node
+		}
+	}
+	return nodes[len(nodes)-1]
+}
+
+// NodeStateFunc 获取节点状态,返回在线人数和是否可以接受新的请求
+type NodeStateFunc func(service IService) (online int64, available bool)
+
+// EtcdNodeState 从etcd节点信息中获取节点状态,服务名字为 服务器类型:服务器ID
+// 维护中或正在关闭的节点不可用,etcd未初始化或找不到节点时视为可用
+func EtcdNodeState(service IService) (int64, bool) {
+	if !etcd.IsInit() {
+		return 0, true
+	}
+	s := strings.Split(service.Name(), ":")
+	if len(s) != 2 {
+		return 0, true
+	}
+	id, err := strconv.ParseInt(s[1], 10, 64)
+	if err != nil {
+		return 0, true
+	}
+	node, err := etcd.GetDepByTypeAndID(s[0], id)
+	if err != nil {
+		return 0, true
+	}
+	online, _ := node.GetInt64(etcd.NodeInfoKeyCurOnline)
+	available := !node.GetBool(etcd.NodeInfoKeyMaintain, false) && !node.GetBool(etcd.NodeInfoKeyDraining, false)
+	return online, available
+}
+
+// Router 在同一类型的多个服务中按策略选择一个,跳过维护中和正在关闭的节点
+type Router struct {
+	sync.RWMutex
+	policy   IRoutePolicy        // 路由策略
+	state    NodeStateFunc       // 节点状态
+	nodes    map[ID]*RouteNode   // 候选节点,服务ID索引
+	draining map[string]struct{} // 本地标记为正在关闭的服务名字
+}
+
+// NewRouter 新建路由器,policy为nil时使用轮询,state为nil时所有节点可用
+func NewRouter(policy IRoutePolicy, state NodeStateFunc) *Router {
+	if policy == nil {
+		policy = &RoundRobinPolicy{}
+	}
+	return &Router{
+		policy:   policy,
+		state:    state,
+		nodes:    make(map[ID]*RouteNode),
+		draining: make(map[string]struct{}),
+	}
+}
+
+// SetPolicy 更换路由策略
+func (router *Router) SetPolicy(policy IRoutePolicy) {
+	router.Lock()
+	defer router.Unlock()
+	router.policy = policy
+}
+
+// Add 添加候选服务
+func (router *Router) Add(service IService) {
+	router.Lock()
+	defer router.Unlock()
+	router.nodes[service.ID()] = &RouteNode{
+		Service:  service,
+		ServerID: GetIDByName(service.Name()),
+	}
+}
+
+// Remove 删除候选服务
+func (router *Router) Remove(service IService) {
+	router.Lock()
+	defer router.Unlock()
+	delete(router.nodes, service.ID())
+}
+
+// SetDraining 在本地标记服务是否正在关闭,不再接受新的请求
+func (router *Router) SetDraining(name string, draining bool) {
+	router.Lock()
+	defer router.Unlock()
+	if draining {
+		router.draining[name] = struct{}{}
+	} else {
+		delete(router.draining, name)
+	}
+}
+
+// Services 所有候选服务
+func (router *Router) Services() []IService {
+	router.RLock()
+	defer router.RUnlock()
+	services := make([]IService, 0, len(router.nodes))
+	for _, node := range router.nodes {
+		services = append(services, node.Service)
+	}
+	return services
+}
+
+// available 可用的候选节点,按服务名字排序,保证策略的结果稳定
+func (router *Router) available() ([]*RouteNode, IRoutePolicy) {
+	router.RLock()
+	defer router.RUnlock()
+	nodes := make([]*RouteNode, 0, len(router.nodes))
+	for _, node := range router.nodes {
+		if _, ok := router.draining[node.Service.Name()]; ok {
+			continue
+		}
+		if router.state != nil {
+			online, ok := router.state(node.Service)
+			if !ok {
+				continue
+			}
+			atomic.StoreInt64(&node.online, online)
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Service.Name() < nodes[j].Service.Name()
+	})
+	return nodes, router.policy
+}
+
+// pick 按策略选择节点
+func (router *Router) pick(key int64) (*RouteNode, error) {
+	nodes, policy := router.available()
+	if len(nodes) == 0 {
+		return nil, cberrors.New("no available service, total: %d", len(router.Services()))
+	}
+	return policy.Pick(nodes, key), nil
+}
+
+// Pick 按策略选择一个可用的服务,key用于一致性哈希,通常为用户ID
+func (router *Router) Pick(key int64) (IService, error) {
+	node, err := router.pick(key)
+	if err != nil {
+		return nil, err
+	}
+	return node.Service, nil
+}
+
+// PickServer 选择指定服务器ID的服务,该服务器不可用时返回错误
+func (router *Router) PickServer(serverID int64) (IService, error) {
+	nodes, _ := router.available()
+	for _, node := range nodes {
+		if node.ServerID == serverID {
+			return node.Service, nil
+		}
+	}
+	return nil, cberrors.New("service of server: %d not available", serverID)
+}
+
+// Do 按策略选择一个可用的服务执行f,执行期间计入该节点的进行中调用数
+func (router *Router) Do(key int64, f func(service IService) error) error {
+	node, err := router.pick(key)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&node.inflight, 1)
+	defer atomic.AddInt64(&node.inflight, -1)
+	return f(node.Service)
+}
@@ -0,0 +1,148 @@
+// -------------------------------------------
+// @file      : router_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/11 上午10:20
+// -------------------------------------------
+
+package cluster
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newTestRouter 新建路由器,候选服务为game:1到game:n
+func newTestRouter(policy IRoutePolicy, state NodeStateFunc, n int) *Router {
+	router := NewRouter(policy, state)
+	for i := 1; i <= n; i++ {
+		router.Add(&testService{typename: "game", name: fmt.Sprintf("game:%d", i), id: ID(i)})
+	}
+	return router
+}
+
+// pickName 选择服务并返回其名字
+func pickName(t *testing.T, router *Router, key int64) string {
+	service, err := router.Pick(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service.Name()
+}
+
+func TestRoundRobinPolicy(t *testing.T) {
+	router := newTestRouter(NewRoutePolicy(RoutePolicyRoundRobin), nil, 3)
+	for i, expect := range []string{"game:1", "game:2", "game:3", "game:1", "game:2", "game:3"} {
+		if name := pickName(t, router, 0); name != expect {
+			t.Fatalf("pick %d: %s, expect: %s", i, name, expect)
+		}
+	}
+}
+
+func TestLeastInflightPolicy(t *testing.T) {
+	router := newTestRouter(NewRoutePolicy(RoutePolicyLeastInflight), nil, 3)
+	var picked []string
+	// 进行中的调用计入节点,嵌套调用依次选择进行中调用最少的节点
+	err := router.Do(0, func(first IService) error {
+		picked = append(picked, first.Name())
+		return router.Do(0, func(second IService) error {
+			picked = append(picked, second.Name())
+			return router.Do(0, func(third IService) error {
+				picked = append(picked, third.Name())
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(picked) != "[game:1 game:2 game:3]" {
+		t.Fatalf("unexpected picks: %v", picked)
+	}
+	// 调用结束后进行中调用数归零
+	if name := pickName(t, router, 0); name != "game:1" {
+		t.Fatalf("pick after calls done: %s", name)
+	}
+}
+
+func TestConsistentHashPolicy(t *testing.T) {
+	router := newTestRouter(NewRoutePolicy(RoutePolicyConsistentHash), nil, 3)
+	before := make(map[int64]string)
+	counts := make(map[string]int)
+	for key := int64(0); key < 1000; key++ {
+		before[key] = pickName(t, router, key)
+		counts[before[key]]++
+		if name := pickName(t, router, key); name != before[key] {
+			t.Fatalf("key %d picked %s then %s", key, before[key], name)
+		}
+	}
+	for _, name := range []string{"game:1", "game:2", "game:3"} {
+		if counts[name] < 200 {
+			t.Fatalf("keys not spread over all nodes: %v", counts)
+		}
+	}
+
+	// 删除节点后只有原本落在该节点上的键改变去向
+	router.Remove(&testService{id: 2})
+	for key, name := range before {
+		after := pickName(t, router, key)
+		if name != "game:2" && after != name {
+			t.Fatalf("key %d moved from %s to %s", key, name, after)
+		}
+		if after == "game:2" {
+			t.Fatalf("key %d picked removed node", key)
+		}
+	}
+}
+
+func TestWeightedOnlinePolicy(t *testing.T) {
+	online := map[string]int64{"game:1": 0, "game:2": 9}
+	state := func(service IService) (int64, bool) {
+		return online[service.Name()], true
+	}
+	router := newTestRouter(NewRoutePolicy(RoutePolicyWeightedOnline), state, 2)
+	// 权重分别为10和1
+	counts := make(map[string]int)
+	for i := 0; i < 2200; i++ {
+		counts[pickName(t, router, 0)]++
+	}
+	if counts["game:2"] == 0 || counts["game:1"] < 5*counts["game:2"] {
+		t.Fatalf("unexpected distribution: %v", counts)
+	}
+}
+
+func TestRouterSkipUnavailable(t *testing.T) {
+	maintain := map[string]bool{"game:2": true}
+	state := func(service IService) (int64, bool) {
+		return 0, !maintain[service.Name()]
+	}
+	router := newTestRouter(NewRoutePolicy(RoutePolicyRoundRobin), state, 3)
+	router.SetDraining("game:1", true)
+	for i := 0; i < 6; i++ {
+		if name := pickName(t, router, 0); name != "game:3" {
+			t.Fatalf("picked unavailable node: %s", name)
+		}
+	}
+	if _, err := router.PickServer(1); err == nil {
+		t.Fatal("picked draining server")
+	}
+	if _, err := router.PickServer(2); err == nil {
+		t.Fatal("picked server in maintenance")
+	}
+	if service, err := router.PickServer(3); err != nil || service.Name() != "game:3" {
+		t.Fatalf("pick server 3: %v err: %v", service, err)
+	}
+	if _, err := router.PickServer(9); err == nil {
+		t.Fatal("picked unknown server")
+	}
+
+	// 全部不可用时返回错误,恢复后重新参与路由
+	maintain["game:3"] = true
+	if _, err := router.Pick(0); err == nil {
+		t.Fatal("picked with no available node")
+	}
+	router.SetDraining("game:1", false)
+	if name := pickName(t, router, 0); name != "game:1" {
+		t.Fatalf("picked %s after draining cleared", name)
+	}
+}
@@ -8,6 +8,8 @@
 package cluster
 
 import (
+	"context"
+	"errors"
 	"gogs/base/cluster/network"
 	"runtime"
 	"sync"
@@ -17,20 +19,87 @@ import (
 
 // rpcMonitor 远程调用返回值监控器
 type rpcMonitor struct {
-	future Future
-	timer  *time.Timer
+	complete func(result *ReturnVal) // 结果回调
+	timer    *time.Timer
+	done     chan struct{} // 结束信号,只有ctx可以取消时创建
+}
+
+// finish 结束监控,调用方须已在锁内将其从监控器集合中删除,回调在锁外执行,result为nil时不回调
+func (monitor *rpcMonitor) finish(result *ReturnVal) {
+	monitor.timer.Stop()
+	if monitor.done != nil {
+		close(monitor.done)
+	}
+	if result != nil {
+		monitor.complete(result)
+	}
+}
+
+// pendingCounter 进行中的调用计数,计数归零时唤醒等待者
+type pendingCounter struct {
+	sync.Mutex
+	count int
+	idle  chan struct{} // 计数从0增加时创建,归零时关闭
+}
+
+// add 开始一个调用
+func (counter *pendingCounter) add() {
+	counter.Lock()
+	defer counter.Unlock()
+	if counter.count == 0 {
+		counter.idle = make(chan struct{})
+	}
+	counter.count++
+}
+
+// done 结束一个调用
+func (counter *pendingCounter) done() {
+	counter.Lock()
+	defer counter.Unlock()
+	counter.count--
+	if counter.count == 0 {
+		close(counter.idle)
+	}
+}
+
+// load 进行中的调用数量
+func (counter *pendingCounter) load() int {
+	counter.Lock()
+	defer counter.Unlock()
+	return counter.count
+}
+
+// wait 等待计数归零或超时,超时返回false
+func (counter *pendingCounter) wait(timeout time.Duration) bool {
+	counter.Lock()
+	if counter.count == 0 {
+		counter.Unlock()
+		return true
+	}
+	idle := counter.idle
+	counter.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return true
+	case <-timer.C:
+		return false
+	}
 }
 
 // rpcService 远程调用服务
 type rpcService struct {
 	idgen    uint32                 // id生成器
 	monitors map[uint32]*rpcMonitor // 返回值监控器
+	pending  *pendingCounter        // 所属管理器的进行中调用计数
 }
 
 // newRPCService 新建远程调用服务
-func newRPCService() *rpcService {
+func newRPCService(pending *pendingCounter) *rpcService {
 	return &rpcService{
 		monitors: make(map[uint32]*rpcMonitor),
+		pending:  pending,
 	}
 }
 
@@ -48,58 +117,100 @@ func (rpc *rpcService) post(session network.ISession, call *network.Call) error
 	return nil
 }
 
-// wait 远程调用,有返回值,使用监控器处理超时
-func (rpc *rpcService) wait(lock *sync.Mutex, session network.ISession, call *network.Call, timeout time.Duration) (Future, error) {
+// wait 远程调用,有返回值,使用监控器处理超时,监控器在返回、超时或取消时回调complete
+// 期限取timeout和ctx期限中较早的一个,并随调用发给对端,ctx取消时删除监控器
+// 发送失败时返回错误,不回调complete
+func (rpc *rpcService) wait(ctx context.Context, lock *sync.Mutex, session network.ISession, call *network.Call,
+	timeout time.Duration, complete func(result *ReturnVal)) error {
 	monitor := &rpcMonitor{
-		future: make(Future, 1),
+		complete: complete,
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
 	}
 	call.ID = atomic.AddUint32(&rpc.idgen, 1)
+	call.Deadline = deadline.UnixNano()
+	id := call.ID
+	ctxDone := ctx.Done()
+	if ctxDone != nil {
+		monitor.done = make(chan struct{})
+	}
 	lock.Lock()
-	rpc.monitors[call.ID] = monitor
+	rpc.monitors[id] = monitor
+	rpc.pending.add()
+	pendingCalls.Inc()
+	// 调用超时
+	monitor.timer = time.AfterFunc(time.Until(deadline), func() {
+		rpc.remove(lock, id, &ReturnVal{
+			Timeout: true,
+		})
+	})
 	lock.Unlock()
-	id := call.ID
-	monitor.timer = time.AfterFunc(timeout, func() {
-		lock.Lock()
-		defer lock.Unlock()
-		// 调用超时
-		if monitor1, ok := rpc.monitors[id]; ok {
-			delete(rpc.monitors, id)
-			monitor1.future <- &ReturnVal{
-				Timeout: true,
+	if ctxDone != nil {
+		go func() {
+			select {
+			case <-ctxDone:
+				rpc.remove(lock, id, &ReturnVal{
+					Timeout:  errors.Is(ctx.Err(), context.DeadlineExceeded),
+					Canceled: errors.Is(ctx.Err(), context.Canceled),
+				})
+			case <-monitor.done:
 			}
-		}
-	})
+		}()
+	}
 	data := call.Marshal()
 	msg := &network.Message{
 		Type: network.MessageTypeCall,
 		Data: data,
 	}
 	if err := session.Write(msg); err != nil {
-		return nil, err
+		rpc.remove(lock, id, nil)
+		return err
 	}
-	return monitor.future, nil
+	return nil
 }
 
-// notify 异步调用的返回通知,找到对应的监控器,将结果写入监控器的结果通道中
-func (rpc *rpcService) notify(lock *sync.Mutex, callReturn *network.Return) bool {
+// take 在锁内删除并返回指定id的监控器,监控器已结束时返回nil
+func (rpc *rpcService) take(lock *sync.Mutex, id uint32) *rpcMonitor {
 	lock.Lock()
 	defer lock.Unlock()
-	// 查找对应id的结果监控器,如果存在则将结果写入监控器的结果通道中,非超时
-	if monitor, ok := rpc.monitors[callReturn.ID]; ok {
-		delete(rpc.monitors, callReturn.ID)
-		monitor.timer.Stop()
-		monitor.future <- &ReturnVal{
-			CallReturn: callReturn,
-		}
-		return true
+	monitor, ok := rpc.monitors[id]
+	if !ok {
+		return nil
 	}
-	return false
+	delete(rpc.monitors, id)
+	rpc.pending.done()
+	pendingCalls.Dec()
+	return monitor
+}
+
+// remove 删除指定id的监控器并回调结果,监控器已结束时忽略
+func (rpc *rpcService) remove(lock *sync.Mutex, id uint32, result *ReturnVal) {
+	if monitor := rpc.take(lock, id); monitor != nil {
+		monitor.finish(result)
+	}
+}
+
+// notify 异步调用的返回通知,找到对应的监控器,以结果回调,非超时
+// 类型化的异步调用在此解码结果并完成Future,不需要等待协程
+func (rpc *rpcService) notify(lock *sync.Mutex, callReturn *network.Return) bool {
+	monitor := rpc.take(lock, callReturn.ID)
+	if monitor == nil {
+		return false
+	}
+	monitor.finish(&ReturnVal{
+		CallReturn: callReturn,
+	})
+	return true
 }
 
 // RPC 远程调用集中管理器
 type RPC struct {
-	locks []sync.Mutex  // 预分配的互斥锁列表,与rpc服务器一一对应
-	group []*rpcService // rpc服务器列表,多个服务按照其id取模后取对应的rpc服务器
+	*Middlewares                // 调用中间件,收到和发出的调用经过这些中间件
+	locks        []sync.Mutex   // 预分配的互斥锁列表,与rpc服务器一一对应
+	group        []*rpcService  // rpc服务器列表,多个服务按照其id取模后取对应的rpc服务器
+	pending      pendingCounter // 进行中的调用,包括等待返回的调用和正在处理的调用
 }
 
 // NewRPC 新建远程调用集中管理器
@@ -107,11 +218,12 @@ func NewRPC() *RPC {
 	// 单个管理器下的远程调用服务数量等于CPU数量的8倍
 	groups := runtime.NumCPU() * 8
 	rpc := &RPC{
-		locks: make([]sync.Mutex, groups),
-		group: make([]*rpcService, groups),
+		Middlewares: NewMiddlewares(),
+		locks:       make([]sync.Mutex, groups),
+		group:       make([]*rpcService, groups),
 	}
 	for i := 0; i < groups; i++ {
-		rpc.group[i] = newRPCService()
+		rpc.group[i] = newRPCService(&rpc.pending)
 	}
 	return rpc
 }
@@ -123,9 +235,10 @@ func (rpc *RPC) Post(session network.ISession, call *network.Call) error {
 }
 
 // Wait 简单取模hash,获取对应的rpc服务器,并调用其wait方法
-func (rpc *RPC) Wait(session network.ISession, call *network.Call, timeout time.Duration) (Future, error) {
+func (rpc *RPC) Wait(ctx context.Context, session network.ISession, call *network.Call, timeout time.Duration,
+	complete func(result *ReturnVal)) error {
 	group := ID(call.ServiceID) % ID(len(rpc.locks))
-	return rpc.group[group].wait(&rpc.locks[group], session, call, timeout)
+	return rpc.group[group].wait(ctx, &rpc.locks[group], session, call, timeout, complete)
 }
 
 // Notify 简单取模hash,获取对应的rpc服务器,并调用其notify方法
@@ -133,3 +246,13 @@ func (rpc *RPC) Notify(callReturn *network.Return) bool {
 	group := ID(callReturn.ServiceID) % ID(len(rpc.locks))
 	return rpc.group[group].notify(&rpc.locks[group], callReturn)
 }
+
+// Pending 进行中的远程调用数量,包括等待返回的调用和正在处理的调用
+func (rpc *RPC) Pending() int {
+	return rpc.pending.load()
+}
+
+// WaitPending 等待进行中的远程调用全部返回并处理完成或超时,超时返回false
+func (rpc *RPC) WaitPending(timeout time.Duration) bool {
+	return rpc.pending.wait(timeout)
+}
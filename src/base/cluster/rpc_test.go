@@ -0,0 +1,351 @@
+// -------------------------------------------
+// @file      : rpc_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/8 上午10:30
+// -------------------------------------------
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gogs/base/cluster/network"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockService 测试用的服务,调用阻塞到release关闭
+type blockService struct {
+	testService
+	release chan struct{}
+}
+
+func (service *blockService) Call(call *network.Call) (*network.Return, error) {
+	<-service.release
+	return &network.Return{ID: call.ID, ServiceID: call.ServiceID}, nil
+}
+
+func TestWaitPendingServing(t *testing.T) {
+	initTestConfig()
+	rpc := NewRPC()
+	service := &blockService{
+		testService: testService{typename: "Block", name: "Block", id: 1},
+		release:     make(chan struct{}),
+	}
+	served := make(chan struct{})
+	go func() {
+		_, _ = rpc.serveCall(service, &network.Call{ID: 1, ServiceID: 1}, nil)
+		close(served)
+	}()
+	waitFor(t, "serving call", func() bool { return rpc.Pending() == 1 })
+
+	// 正在处理的调用完成前等待超时
+	if rpc.WaitPending(50 * time.Millisecond) {
+		t.Fatal("wait pending returned while serving call")
+	}
+	close(service.release)
+	if !rpc.WaitPending(time.Second) {
+		t.Fatalf("wait pending timeout, pending: %d", rpc.Pending())
+	}
+	<-served
+}
+
+// middlewareAgent 测试用的代理,只投递调用,属于指定的中间件
+type middlewareAgent struct {
+	middlewares *Middlewares
+}
+
+func (agent *middlewareAgent) Middlewares() *Middlewares                       { return agent.middlewares }
+func (agent *middlewareAgent) Post(service IService, call *network.Call) error { return nil }
+func (agent *middlewareAgent) Write(msg *network.Message) error                { return nil }
+func (agent *middlewareAgent) Session() network.ISession                       { return nil }
+func (agent *middlewareAgent) Close()                                          {}
+func (agent *middlewareAgent) Wait(ctx context.Context, service IService, call *network.Call,
+	timeout time.Duration, complete func(result *ReturnVal)) error {
+	return nil
+}
+
+func TestInterceptorsPerHost(t *testing.T) {
+	initTestConfig()
+	owner, other := NewRPC(), NewRPC()
+	var served, invoked int32
+	owner.UseServerInterceptor(func(info *CallInfo, next func() (*network.Return, error)) (*network.Return, error) {
+		atomic.AddInt32(&served, 1)
+		return next()
+	})
+	owner.UseClientInterceptor(func(ctx context.Context, info *CallInfo,
+		next func(ctx context.Context) (*network.Return, error)) (*network.Return, error) {
+		atomic.AddInt32(&invoked, 1)
+		return next(ctx)
+	})
+
+	// 只有注册了拦截器的管理器处理的调用经过拦截器
+	service := &testService{typename: "Test", name: "Test", id: 1}
+	for _, rpc := range []*RPC{owner, other} {
+		if _, err := rpc.serveCall(service, &network.Call{ID: 1, ServiceID: 1}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if served != 1 {
+		t.Fatalf("server interceptor served %d calls, expect 1", served)
+	}
+
+	// 发出的调用经过代理所属管理器的拦截器
+	opts := &CallOptions{Name: "Test#1", OneWay: true}
+	for _, rpc := range []*RPC{owner, other} {
+		remote := &testService{typename: "Test", name: "Test", id: 1, agent: &middlewareAgent{rpc.Middlewares}}
+		if _, err := Invoke(context.Background(), remote, &network.Call{ID: 1, ServiceID: 1}, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if invoked != 1 {
+		t.Fatalf("client interceptor invoked %d calls, expect 1", invoked)
+	}
+}
+
+// rpcAgent 测试用的代理,通过管理器向会话发起调用
+type rpcAgent struct {
+	middlewareAgent
+	rpc     *RPC
+	session network.ISession
+}
+
+func (agent *rpcAgent) Wait(ctx context.Context, service IService, call *network.Call,
+	timeout time.Duration, complete func(result *ReturnVal)) error {
+	return agent.rpc.Wait(ctx, agent.session, call, timeout, complete)
+}
+
+func TestInvokeAsync(t *testing.T) {
+	initTestConfig()
+	rpc := NewRPC()
+	session := &recordSession{name: "Test:1"}
+	remote := &testService{typename: "Test", name: "Test", id: 1, remoteID: 1,
+		agent: &rpcAgent{middlewareAgent{rpc.Middlewares}, rpc, session}}
+	decode := func(callReturn *network.Return) (int, error) {
+		return len(callReturn.Params), nil
+	}
+	opts := &CallOptions{Name: "Test#1", Timeout: time.Second}
+
+	// 收到返回时监控器直接解码并完成,不需要等待协程
+	future := InvokeAsync(context.Background(), remote, &network.Call{ServiceID: 1, MethodID: 1}, opts, nil, decode)
+	session.Lock()
+	call, err := network.UnmarshalCall(session.messages[0].Data)
+	session.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rpc.Notify(&network.Return{ID: call.ID, ServiceID: 1, Params: [][]byte{{1}, {2}}}) {
+		t.Fatal("return not matched")
+	}
+	select {
+	case <-future.Done():
+	default:
+		t.Fatal("future not completed by notify")
+	}
+	if value, err := future.Get(); err != nil || value != 2 {
+		t.Fatalf("unexpected result: %d err: %v", value, err)
+	}
+
+	// 超时由监控器的定时器完成
+	opts.Timeout = 20 * time.Millisecond
+	future = InvokeAsync(context.Background(), remote, &network.Call{ServiceID: 1, MethodID: 1}, opts, nil, decode)
+	if _, err = future.Wait(context.Background(), time.Second); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("unexpected result: %v", err)
+	}
+	if rpc.Pending() != 0 {
+		t.Fatalf("pending calls left: %d", rpc.Pending())
+	}
+}
+
+func TestInvokeCancel(t *testing.T) {
+	initTestConfig()
+	rpc := NewRPC()
+	session := &recordSession{name: "Test:1"}
+	remote := &testService{typename: "Test", name: "Test", id: 1, remoteID: 1,
+		agent: &rpcAgent{middlewareAgent{rpc.Middlewares}, rpc, session}}
+	decode := func(callReturn *network.Return) (int, error) {
+		return len(callReturn.Params), nil
+	}
+	opts := &CallOptions{Name: "Test#1", Timeout: 5 * time.Second}
+
+	// 取消ctx时Future立即以取消完成,监控器随之删除
+	ctx, cancel := context.WithCancel(context.Background())
+	future := InvokeAsync(ctx, remote, &network.Call{ServiceID: 1, MethodID: 1}, opts, nil, decode)
+	if rpc.Pending() != 1 {
+		t.Fatalf("pending calls: %d, expect 1", rpc.Pending())
+	}
+	cancel()
+	if _, err := future.Wait(context.Background(), time.Second); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected result: %v", err)
+	}
+	if rpc.Pending() != 0 {
+		t.Fatalf("pending calls left: %d", rpc.Pending())
+	}
+
+	// 同步调用同样立即返回取消,不等到超时
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := Invoke(ctx, remote, &network.Call{ServiceID: 1, MethodID: 1}, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected result: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("canceled call returned after %s", elapsed)
+	}
+	if rpc.Pending() != 0 {
+		t.Fatalf("pending calls left: %d", rpc.Pending())
+	}
+
+	// ctx期限早于调用超时,发给对端的期限取ctx期限
+	deadline := time.Now().Add(50 * time.Millisecond)
+	ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	future = InvokeAsync(ctx, remote, &network.Call{ServiceID: 1, MethodID: 1}, opts, nil, decode)
+	session.Lock()
+	call, err := network.UnmarshalCall(session.messages[len(session.messages)-1].Data)
+	session.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call.Deadline != deadline.UnixNano() {
+		t.Fatalf("wire deadline: %d, expect: %d", call.Deadline, deadline.UnixNano())
+	}
+	if _, err = future.Wait(context.Background(), time.Second); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("unexpected result: %v", err)
+	}
+	if rpc.Pending() != 0 {
+		t.Fatalf("pending calls left: %d", rpc.Pending())
+	}
+}
+
+// countService 测试用的服务,记录处理的调用数
+type countService struct {
+	testService
+	calls int32
+}
+
+func (service *countService) Call(call *network.Call) (*network.Return, error) {
+	atomic.AddInt32(&service.calls, 1)
+	return &network.Return{ID: call.ID, ServiceID: call.ServiceID}, nil
+}
+
+func TestServeExpiredCall(t *testing.T) {
+	initTestConfig()
+	rpc := NewRPC()
+	service := &countService{testService: testService{typename: "Test", name: "Test", id: 1}}
+
+	// 发起方期限已过的调用不再处理
+	expired := &network.Call{ID: 1, ServiceID: 1, Deadline: time.Now().Add(-time.Millisecond).UnixNano()}
+	if _, err := rpc.serveCall(service, expired, nil); err == nil {
+		t.Fatal("expired call served")
+	}
+	// 期限未到的调用正常处理
+	call := &network.Call{ID: 2, ServiceID: 1, Deadline: time.Now().Add(time.Second).UnixNano()}
+	if callReturn, err := rpc.serveCall(service, call, nil); err != nil || callReturn == nil || callReturn.ID != 2 {
+		t.Fatalf("unexpected result: %+v err: %v", callReturn, err)
+	}
+	if calls := atomic.LoadInt32(&service.calls); calls != 1 {
+		t.Fatalf("service handled %d calls, expect 1", calls)
+	}
+	if rpc.Pending() != 0 {
+		t.Fatalf("pending calls left: %d", rpc.Pending())
+	}
+}
+
+// testCode 测试用的错误码枚举
+type testCode int32
+
+func (code testCode) Error() string              { return fmt.Sprintf("testCode(%d)", int32(code)) }
+func (code testCode) ErrorCode() (string, int32) { return "cluster.testCode", int32(code) }
+
+// failService 测试用的服务,按方法返回错误、崩溃或返回错误码,和生成代码一样将错误转换为返回
+type failService struct {
+	testService
+}
+
+func (service *failService) Call(call *network.Call) (callReturn *network.Return, err error) {
+	defer func() {
+		if err != nil {
+			callReturn = ErrorReturn(call, err)
+		}
+	}()
+	switch call.MethodID {
+	case 1:
+		err = errors.New("handler failed")
+	case 2:
+		panic("handler panic")
+	case 3:
+		err = testCode(7)
+	}
+	return
+}
+
+// serveSession 测试用的会话,写入的调用交给serve处理
+type serveSession struct {
+	recordSession
+	serve func(call *network.Call)
+}
+
+func (session *serveSession) Write(msg *network.Message) error {
+	call, err := network.UnmarshalCall(msg.Data)
+	if err != nil {
+		return err
+	}
+	go session.serve(call)
+	return nil
+}
+
+func TestInvokeTypedError(t *testing.T) {
+	initTestConfig()
+	RegisterErrorCode("cluster.testCode", func(code int32) error { return testCode(code) })
+	server, client := NewRPC(), NewRPC()
+	service := &failService{testService{typename: "Fail", name: "Fail", id: 1}}
+	session := &serveSession{serve: func(call *network.Call) {
+		if callReturn, _ := server.serveCall(service, call, nil); callReturn != nil {
+			client.Notify(callReturn)
+		}
+	}}
+	remote := &testService{typename: "Fail", name: "Fail", id: 1, remoteID: 1,
+		agent: &rpcAgent{middlewareAgent{client.Middlewares}, client, session}}
+	opts := &CallOptions{Name: "Fail#1", Timeout: 5 * time.Second}
+
+	// 处理失败、崩溃和错误码都立即以类型化的错误返回,不等到超时
+	for method, check := range map[uint32]func(err error) bool{
+		1: func(err error) bool {
+			var remote *RemoteError
+			return errors.As(err, &remote) && remote.Status == network.ReturnStatusError && remote.Message == "handler failed"
+		},
+		2: func(err error) bool {
+			var remote *RemoteError
+			return errors.As(err, &remote) && remote.Status == network.ReturnStatusPanic
+		},
+		3: func(err error) bool {
+			return errors.Is(err, testCode(7))
+		},
+	} {
+		start := time.Now()
+		callReturn, err := Invoke(context.Background(), remote, &network.Call{ServiceID: 1, MethodID: method}, opts)
+		if err != nil {
+			t.Fatalf("method %d invoke err: %s", method, err)
+		}
+		if err = ReturnError(callReturn); !check(err) {
+			t.Fatalf("method %d unexpected err: %#v", method, err)
+		}
+		decode := func(callReturn *network.Return) (int, error) {
+			return 0, ReturnError(callReturn)
+		}
+		future := InvokeAsync(context.Background(), remote, &network.Call{ServiceID: 1, MethodID: method}, opts, nil, decode)
+		if _, err = future.Wait(context.Background(), time.Second); !check(err) {
+			t.Fatalf("method %d unexpected async err: %#v", method, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("method %d err returned after %s", method, elapsed)
+		}
+	}
+	if client.Pending() != 0 || server.Pending() != 0 {
+		t.Fatalf("pending calls left: %d %d", client.Pending(), server.Pending())
+	}
+}
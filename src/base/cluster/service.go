@@ -8,6 +8,7 @@
 package cluster
 
 import (
+	"context"
 	"gogs/base/cluster/network"
 	"time"
 )
@@ -24,13 +25,58 @@ type IService interface {
 	Context() interface{}                             // 服务上下文
 }
 
+// IServiceStarter 可选的服务启动钩子,服务公布上线前调用,返回错误时服务不会上线
+type IServiceStarter interface {
+	Start(ctx context.Context) error
+}
+
+// IServiceStopper 可选的服务停止钩子,服务下线并等待进行中的调用结束后调用
+type IServiceStopper interface {
+	Stop(ctx context.Context) error
+}
+
+// IServiceHealth 可选的服务健康检查
+type IServiceHealth interface {
+	Health() HealthStatus
+}
+
+// HealthStatus 服务健康状态
+type HealthStatus int8
+
+const (
+	HealthStatusHealthy   HealthStatus = 0 // 健康
+	HealthStatusDegraded  HealthStatus = 1 // 降级,可以提供服务
+	HealthStatusUnhealthy HealthStatus = 2 // 不健康
+)
+
+// String implements fmt.Stringer
+func (status HealthStatus) String() string {
+	switch status {
+	case HealthStatusHealthy:
+		return "Healthy"
+	case HealthStatusDegraded:
+		return "Degraded"
+	case HealthStatusUnhealthy:
+		return "Unhealthy"
+	}
+	return "Unknown"
+}
+
+// ServiceHealth 服务健康状态,未实现IServiceHealth时视为健康
+func ServiceHealth(service IService) HealthStatus {
+	if health, ok := service.(IServiceHealth); ok {
+		return health.Health()
+	}
+	return HealthStatusHealthy
+}
+
 // IAgent 会话代理
 type IAgent interface {
-	Post(service IService, call *network.Call) error                                  // 远程调用
-	Wait(service IService, call *network.Call, timeout time.Duration) (Future, error) // 远程调用,需要返回结果
-	Write(msg *network.Message) error                                                 // 写入消息
-	Session() network.ISession                                                        // 代理的会话
-	Close()                                                                           // 关闭
+	Post(service IService, call *network.Call) error                                                                               // 远程调用
+	Wait(ctx context.Context, service IService, call *network.Call, timeout time.Duration, complete func(result *ReturnVal)) error // 远程调用,需要返回结果,监控器在返回、超时或取消时回调complete,ctx的期限早于timeout时以ctx为准
+	Write(msg *network.Message) error                                                                                              // 写入消息
+	Session() network.ISession                                                                                                     // 代理的会话
+	Close()                                                                                                                        // 关闭
 }
 
 // IRemoteService 远程服务
@@ -50,8 +96,9 @@ type IServiceBuilder interface {
 // ReturnVal RPC调用返回值结构
 type ReturnVal struct {
 	Timeout    bool            // 结果是否超时
+	Canceled   bool            // 调用方是否取消了等待
 	CallReturn *network.Return // 调用结果
 }
 
-// Future RPC调用结果返回chan
-type Future chan *ReturnVal
+// ReturnFuture RPC调用原始结果返回chan,同步调用等待结果时使用,类型化的结果见Future
+type ReturnFuture chan *ReturnVal
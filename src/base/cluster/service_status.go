@@ -7,7 +7,12 @@
 
 package cluster
 
-import "gogs/base/cluster/network"
+import (
+	"gogs/base/cluster/network"
+	"sort"
+	"sync/atomic"
+	"time"
+)
 
 // ServiceListener 服务状态监听器,返回false则停止监听
 type ServiceListener func(service IService, status network.ServiceStatus) bool
@@ -18,6 +23,12 @@ type eventListenService struct {
 	listener ServiceListener // 监听器
 }
 
+// eventUnlistenService 移除监听器(通过服务名)
+type eventUnlistenService struct {
+	name     string           // 监听的服务名称
+	listener *ServiceListener // 注册时事件中的监听器
+}
+
 // eventListenServiceType 监听服务事件(通过服务类型)
 type eventListenServiceType struct {
 	typename string          // 监听的服务类型
@@ -30,19 +41,31 @@ type eventServiceStatusChanged struct {
 	status  network.ServiceStatus // 需要监听的状态
 }
 
+// eventListenerStats 获取监听器统计
+type eventListenerStats struct {
+	reply chan *ListenerStats // 结果通道
+}
+
+// ListenerStats 服务状态监听器统计
+type ListenerStats struct {
+	Services []string       `json:"services"` // 已上线的服务名字
+	ByName   map[string]int `json:"byName"`   // 按服务名字统计的监听器数量
+	ByType   map[string]int `json:"byType"`   // 按服务类型统计的监听器数量
+}
+
 // ServiceStatusPublisher 服务状态发布器
 type ServiceStatusPublisher struct {
-	serviceListeners     map[string][]ServiceListener // 按服务名字分类的监听器列表
-	serviceTypeListeners map[string][]ServiceListener // 按服务类型分类的监听器列表
-	services             map[string]IService          // 已上线的服务
-	events               chan interface{}             // 事件通道
+	serviceListeners     map[string][]*ServiceListener // 按服务名字分类的监听器列表
+	serviceTypeListeners map[string][]*ServiceListener // 按服务类型分类的监听器列表
+	services             map[string]IService           // 已上线的服务
+	events               chan interface{}              // 事件通道
 }
 
 // NewServiceStatusPublisher 新建服务状态发布器
 func NewServiceStatusPublisher() *ServiceStatusPublisher {
 	publisher := &ServiceStatusPublisher{
-		serviceListeners:     make(map[string][]ServiceListener),
-		serviceTypeListeners: make(map[string][]ServiceListener),
+		serviceListeners:     make(map[string][]*ServiceListener),
+		serviceTypeListeners: make(map[string][]*ServiceListener),
 		services:             make(map[string]IService),
 		events:               make(chan interface{}, 1024),
 	}
@@ -69,8 +92,17 @@ func (publisher *ServiceStatusPublisher) handleEvent() {
 				}
 			}
 			if mark {
-				publisher.serviceListeners[e.name] = append(publisher.serviceListeners[e.name], e.listener)
+				publisher.serviceListeners[e.name] = append(publisher.serviceListeners[e.name], &e.listener)
 			}
+		case *eventUnlistenService:
+			e := event.(*eventUnlistenService)
+			var tmp []*ServiceListener
+			for _, listener := range publisher.serviceListeners[e.name] {
+				if listener != e.listener {
+					tmp = append(tmp, listener)
+				}
+			}
+			publisher.serviceListeners[e.name] = tmp
 		case *eventListenServiceType:
 			mark = true
 			e := event.(*eventListenServiceType)
@@ -82,8 +114,29 @@ func (publisher *ServiceStatusPublisher) handleEvent() {
 				}
 			}
 			if mark {
-				publisher.serviceTypeListeners[e.typename] = append(publisher.serviceTypeListeners[e.typename], e.listener)
+				publisher.serviceTypeListeners[e.typename] = append(publisher.serviceTypeListeners[e.typename], &e.listener)
+			}
+		case *eventListenerStats:
+			e := event.(*eventListenerStats)
+			stats := &ListenerStats{
+				Services: make([]string, 0, len(publisher.services)),
+				ByName:   make(map[string]int),
+				ByType:   make(map[string]int),
+			}
+			for name := range publisher.services {
+				stats.Services = append(stats.Services, name)
+			}
+			for name, listeners := range publisher.serviceListeners {
+				if len(listeners) > 0 {
+					stats.ByName[name] = len(listeners)
+				}
 			}
+			for typename, listeners := range publisher.serviceTypeListeners {
+				if len(listeners) > 0 {
+					stats.ByType[typename] = len(listeners)
+				}
+			}
+			e.reply <- stats
 		case *eventServiceStatusChanged:
 			e := event.(*eventServiceStatusChanged)
 			if e.status == network.ServiceStatusOnline {
@@ -92,9 +145,9 @@ func (publisher *ServiceStatusPublisher) handleEvent() {
 				delete(publisher.services, e.service.Name())
 			}
 			listeners := publisher.serviceListeners[e.service.Name()]
-			var tmp []ServiceListener
+			var tmp []*ServiceListener
 			for _, listener := range listeners {
-				if listener(e.service, e.status) {
+				if (*listener)(e.service, e.status) {
 					tmp = append(tmp, listener)
 				}
 			}
@@ -102,7 +155,7 @@ func (publisher *ServiceStatusPublisher) handleEvent() {
 			listeners = publisher.serviceTypeListeners[e.service.Type()]
 			tmp = nil
 			for _, listener := range listeners {
-				if listener(e.service, e.status) {
+				if (*listener)(e.service, e.status) {
 					tmp = append(tmp, listener)
 				}
 			}
@@ -134,3 +187,50 @@ func (publisher *ServiceStatusPublisher) ListenServiceType(typename string, list
 		listener: listener,
 	}
 }
+
+// ListenerStats 获取监听器统计,在事件处理协程中统计,不能在监听器中调用
+func (publisher *ServiceStatusPublisher) ListenerStats() *ListenerStats {
+	reply := make(chan *ListenerStats, 1)
+	publisher.events <- &eventListenerStats{
+		reply: reply,
+	}
+	stats := <-reply
+	sort.Strings(stats.Services)
+	return stats
+}
+
+// WaitForService 等待指定名字的服务上线,本地服务和邻居节点上的远程服务均可,超时返回ErrTimeout
+// 启动时调用远程服务前使用,避免与服务注册的传播竞争,不能在监听器中调用
+func (publisher *ServiceStatusPublisher) WaitForService(name string, timeout time.Duration) (IService, error) {
+	online := make(chan IService, 1)
+	var done int32
+	listen := &eventListenService{
+		name: name,
+		listener: func(service IService, status network.ServiceStatus) bool {
+			if atomic.LoadInt32(&done) == 1 {
+				return false
+			}
+			if status != network.ServiceStatusOnline {
+				return true
+			}
+			atomic.StoreInt32(&done, 1)
+			online <- service
+			return false
+		},
+	}
+	publisher.events <- listen
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case service := <-online:
+		return service, nil
+	case <-timer.C:
+		// 移除前收到的事件也不再投递
+		atomic.StoreInt32(&done, 1)
+		publisher.events <- &eventUnlistenService{
+			name:     name,
+			listener: &listen.listener,
+		}
+		return nil, ErrTimeout
+	}
+}
@@ -38,8 +38,8 @@ type Simulator struct {
 	idgen                   uint32                     // serviceID生成器
 }
 
-// NewSimulator 生成客户端模拟器
-func NewSimulator(remoteAddr string, builders map[string]IServiceBuilder, protocol network.ProtocolType) (*Simulator, error) {
+// NewSimulator 生成客户端模拟器,transport为nil时使用tcp
+func NewSimulator(remoteAddr string, builders map[string]IServiceBuilder, transport network.ITransport, security *network.Security) (*Simulator, error) {
 	simulator := &Simulator{
 		RPC:                    NewRPC(),
 		ServiceStatusPublisher: NewServiceStatusPublisher(),
@@ -51,7 +51,8 @@ func NewSimulator(remoteAddr string, builders map[string]IServiceBuilder, protoc
 		func(session network.ISession) (network.ISessionHandler, error) {
 			return NewSimulatorAgent(simulator, session), nil
 		},
-		protocol,
+		transport,
+		security,
 	)
 	return simulator, nil
 }
@@ -100,6 +101,11 @@ func (simulator *Simulator) newServiceID() ID {
 func (simulator *Simulator) sessionStatusChanged(agent *SimulatorAgent, status network.SessionStatus) {
 	switch status {
 	case network.SessionStatusOutConnected:
+		// 恢复会话后继续使用原客户端
+		if client := agent.Client(); client != nil {
+			simulator.ServiceStatusChanged(client.ClientService, network.ServiceStatusOnline)
+			return
+		}
 		// 连接成功生成一个客户端
 		csBuilder, ok := simulator.builders["client"]
 		if !ok {
@@ -122,7 +128,7 @@ func (simulator *Simulator) sessionStatusChanged(agent *SimulatorAgent, status n
 			GateServer: gateServerBuilder.NewRemoteService(agent, "Gate", simulator.newServiceID(), gateID, nil),
 			GameServer: gameServerBuilder.NewRemoteService(agent, "game", simulator.newServiceID(), gameID, nil),
 		}
-		clientService, err := csBuilder.NewService(agent.Name(), simulator.newServiceID(), client)
+		clientService, err := newService(csBuilder, simulator.Middlewares, agent.Name(), simulator.newServiceID(), client)
 		if err != nil {
 			log.Errorf("create local client service err: %s", err)
 			return
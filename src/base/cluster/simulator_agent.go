@@ -8,6 +8,7 @@
 package cluster
 
 import (
+	"context"
 	"gogs/base/cluster/network"
 	log "gogs/base/logger"
 	"time"
@@ -44,14 +45,20 @@ func (agent *SimulatorAgent) Client() *Client {
 	return agent.client
 }
 
+// Middlewares implements IMiddlewareAgent
+func (agent *SimulatorAgent) Middlewares() *Middlewares {
+	return agent.simulator.Middlewares
+}
+
 // Post implements IAgent
 func (agent *SimulatorAgent) Post(service IService, call *network.Call) error {
 	return agent.simulator.Post(agent.session, call)
 }
 
 // Wait implements IAgent
-func (agent *SimulatorAgent) Wait(service IService, call *network.Call, timeout time.Duration) (Future, error) {
-	return agent.simulator.Wait(agent.session, call, timeout)
+func (agent *SimulatorAgent) Wait(ctx context.Context, service IService, call *network.Call, timeout time.Duration,
+	complete func(result *ReturnVal)) error {
+	return agent.simulator.Wait(ctx, agent.session, call, timeout, complete)
 }
 
 // Write implements IAgent
@@ -80,9 +87,21 @@ func (agent *SimulatorAgent) Read(session network.ISession, msg *network.Message
 		go agent.handleCall(msg.Data)
 	case network.MessageTypeReturn:
 		go agent.handleReturn(msg.Data)
+	case network.MessageTypeKick:
+		agent.handleKick(msg.Data)
 	}
 }
 
+// handleKick 处理踢下线通知,服务端随后关闭连接
+func (agent *SimulatorAgent) handleKick(data []byte) {
+	kick, err := network.UnmarshalKick(data)
+	if err != nil || kick == nil {
+		log.Errorf("unmarshal kick err: %v", err)
+		return
+	}
+	log.Warnf("client session: %s kicked, reason: %s, message: %s", agent.session, kick.Reason, kick.Message)
+}
+
 // handleCall 处理调用
 func (agent *SimulatorAgent) handleCall(data []byte) {
 	call, err := network.UnmarshalCall(data)
@@ -90,10 +109,11 @@ func (agent *SimulatorAgent) handleCall(data []byte) {
 		log.Error("%s", err)
 		return
 	}
-	callReturn, err := agent.client.ClientService.Call(call)
+	// 服务器与客户端的时钟不一定同步,不使用其期限
+	call.Deadline = 0
+	callReturn, err := agent.simulator.serveCall(agent.client.ClientService, call, nil)
 	if err != nil {
 		log.Error("handle call service: %d, method: %d, err: %s", call.ServiceID, call.MethodID, err)
-		return
 	}
 	if callReturn == nil {
 		return
@@ -0,0 +1,122 @@
+// -------------------------------------------
+// @file      : singleton.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/1 上午10:20
+// -------------------------------------------
+
+package cluster
+
+import (
+	"gogs/base/cberrors"
+	"gogs/base/etcd"
+	log "gogs/base/logger"
+	"sync"
+)
+
+// IElection 一次集群唯一名字的竞选
+type IElection interface {
+	Resign() // 停止竞选,持有期间先回调失去持有权
+}
+
+// IElector 集群唯一名字的选举来源
+// 当选后调用onElected,返回错误时放弃本次持有,失去持有权后调用onRevoked,之后自动重新竞选
+type IElector interface {
+	Campaign(name string, onElected func() error, onRevoked func()) (IElection, error)
+}
+
+// etcdElector 通过全局etcd组件选举
+type etcdElector struct{}
+
+// Campaign implements IElector
+func (etcdElector) Campaign(name string, onElected func() error, onRevoked func()) (IElection, error) {
+	election, err := etcd.Campaign(name, onElected, onRevoked)
+	if err != nil {
+		return nil, err
+	}
+	return election, nil
+}
+
+// Singleton 集群唯一的命名服务,同一时刻只在竞选成功的集群服务器上存在
+// 当选后通过Host.NewService新建本地服务,失去持有权后下线本地服务,由其他集群服务器当选后重新新建
+type Singleton struct {
+	sync.Mutex
+	host        *Host       // 集群服务器
+	serviceType string      // 服务类型
+	name        string      // 服务名字,同时也是竞选的名字
+	context     interface{} // 新建服务的上下文
+	election    IElection   // 竞选
+	service     IService    // 当选期间的本地服务
+}
+
+// NewSingleton 新建集群唯一的命名服务,通过etcd竞选,当选前服务不在本地存在
+func (host *Host) NewSingleton(serviceType string, name string, context interface{}) (*Singleton, error) {
+	return host.newSingleton(etcdElector{}, serviceType, name, context)
+}
+
+// newSingleton 使用指定的选举来源新建集群唯一的命名服务
+func (host *Host) newSingleton(elector IElector, serviceType string, name string, context interface{}) (*Singleton, error) {
+	host.builderMutex.RLock()
+	_, ok := host.builders[serviceType]
+	host.builderMutex.RUnlock()
+	if !ok {
+		return nil, cberrors.New("service builder not found for type: %s", serviceType)
+	}
+	singleton := &Singleton{
+		host:        host,
+		serviceType: serviceType,
+		name:        name,
+		context:     context,
+	}
+	election, err := elector.Campaign(name, singleton.elected, singleton.revoked)
+	if err != nil {
+		return nil, err
+	}
+	singleton.election = election
+	return singleton, nil
+}
+
+// Name 服务名字
+func (singleton *Singleton) Name() string {
+	return singleton.name
+}
+
+// Service 当选期间的本地服务,未当选时返回false
+func (singleton *Singleton) Service() (IService, bool) {
+	singleton.Lock()
+	defer singleton.Unlock()
+	return singleton.service, singleton.service != nil
+}
+
+// Close 停止竞选,当选期间下线本地服务
+func (singleton *Singleton) Close() {
+	singleton.election.Resign()
+}
+
+// elected 当选,新建本地服务
+func (singleton *Singleton) elected() error {
+	service, err := singleton.host.NewService(singleton.serviceType, singleton.name, singleton.context)
+	if err != nil {
+		return err
+	}
+	singleton.Lock()
+	singleton.service = service
+	singleton.Unlock()
+	log.Infof("singleton service: %s elected, id: %d", singleton.name, service.ID())
+	return nil
+}
+
+// revoked 失去持有权,下线本地服务
+func (singleton *Singleton) revoked() {
+	singleton.Lock()
+	service := singleton.service
+	singleton.service = nil
+	singleton.Unlock()
+	if service == nil {
+		return
+	}
+	if err := singleton.host.removeService(service); err != nil {
+		log.Errorf("singleton service: %s remove error: %v", singleton.name, err)
+	}
+	log.Warnf("singleton service: %s revoked, id: %d", singleton.name, service.ID())
+}
@@ -0,0 +1,148 @@
+// -------------------------------------------
+// @file      : singleton_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/1 下午2:30
+// -------------------------------------------
+
+package cluster
+
+import (
+	"gogs/base/cluster/network"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeElector 测试用的选举来源,按竞选顺序排队,队首持有名字
+type fakeElector struct {
+	sync.Mutex
+	queue []*fakeElection
+}
+
+// fakeElection 测试用的竞选
+type fakeElection struct {
+	elector   *fakeElector
+	onElected func() error
+	onRevoked func()
+	elected   bool
+}
+
+func (elector *fakeElector) Campaign(name string, onElected func() error, onRevoked func()) (IElection, error) {
+	elector.Lock()
+	defer elector.Unlock()
+	election := &fakeElection{elector: elector, onElected: onElected, onRevoked: onRevoked}
+	elector.queue = append(elector.queue, election)
+	elector.electLocked()
+	return election, nil
+}
+
+// electLocked 队首当选
+func (elector *fakeElector) electLocked() {
+	if len(elector.queue) > 0 && !elector.queue[0].elected {
+		elector.queue[0].elected = elector.queue[0].onElected() == nil
+	}
+}
+
+// expire 队首租约过期,失去持有权后重新排队竞选
+func (elector *fakeElector) expire() {
+	elector.Lock()
+	defer elector.Unlock()
+	head := elector.queue[0]
+	elector.queue = append(elector.queue[1:], head)
+	if head.elected {
+		head.elected = false
+		head.onRevoked()
+	}
+	elector.electLocked()
+}
+
+func (election *fakeElection) Resign() {
+	elector := election.elector
+	elector.Lock()
+	defer elector.Unlock()
+	for i, e := range elector.queue {
+		if e == election {
+			elector.queue = append(elector.queue[:i], elector.queue[i+1:]...)
+			break
+		}
+	}
+	if election.elected {
+		election.elected = false
+		election.onRevoked()
+	}
+	elector.electLocked()
+}
+
+// remoteOnline 是否有指定名字的远程服务
+func remoteOnline(host *Host, name string) bool {
+	host.neighborMutex.RLock()
+	defer host.neighborMutex.RUnlock()
+	for _, neighbor := range host.neighbors {
+		if _, ok := neighbor.services[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSingleton(t *testing.T) {
+	initTestConfig()
+	transport := network.NewMemoryTransport()
+	a := NewHost("a:1", transport)
+	defer a.Close()
+	b := NewHost("b:1", transport)
+	defer b.Close()
+	for _, host := range []*Host{a, b} {
+		if _, err := host.RegisterBuilder(testBuilder("Test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "a listening", func() bool {
+		_, err := b.Connect("a:1")
+		return err == nil
+	})
+
+	elector := &fakeElector{}
+	if _, err := a.newSingleton(elector, "Unknown", "Unknown", nil); err == nil {
+		t.Fatal("singleton without builder")
+	}
+	sa, err := a.newSingleton(elector, "Test", "Test:Manager", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := b.newSingleton(elector, "Test", "Test:Manager", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sa.Service(); !ok {
+		t.Fatal("first campaigner not elected")
+	}
+	if _, ok := sb.Service(); ok || b.hasLocalService("Test:Manager") {
+		t.Fatal("singleton exists on both hosts")
+	}
+	waitFor(t, "b sees remote singleton", func() bool { return remoteOnline(b, "Test:Manager") })
+
+	// 持有者租约过期,服务迁移到另一个集群服务器
+	elector.expire()
+	if a.hasLocalService("Test:Manager") || !b.hasLocalService("Test:Manager") {
+		t.Fatal("singleton not failed over")
+	}
+	waitFor(t, "a sees remote singleton", func() bool { return remoteOnline(a, "Test:Manager") })
+	if _, err := a.WaitForService("Test:Manager", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// 持有者停止竞选,服务回到原来的集群服务器
+	sb.Close()
+	if b.hasLocalService("Test:Manager") || !a.hasLocalService("Test:Manager") {
+		t.Fatal("singleton not moved back after resign")
+	}
+	waitFor(t, "b drops remote singleton", func() bool {
+		return !b.hasLocalService("Test:Manager") && remoteOnline(b, "Test:Manager")
+	})
+	sa.Close()
+	if a.hasLocalService("Test:Manager") {
+		t.Fatal("singleton alive after close")
+	}
+}
@@ -0,0 +1,390 @@
+// -------------------------------------------
+// @file      : trace.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/22 上午10:15
+// -------------------------------------------
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"gogs/base/cberrors"
+	"gogs/base/cluster/network"
+	"gogs/base/config"
+	log "gogs/base/logger"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceFlagSampled 采样标志
+const TraceFlagSampled = byte(0x01)
+
+// SpanContext 跨度上下文,在进程之间传递的链路信息
+type SpanContext struct {
+	TraceID [16]byte // 链路ID
+	SpanID  [8]byte  // 跨度ID
+	Flags   byte     // 追踪标志
+}
+
+// IsValid 链路ID和跨度ID都不为0时有效
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Sampled 是否被采样
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&TraceFlagSampled != 0
+}
+
+// Traceparent W3C traceparent格式,version-traceid-spanid-flags
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%x-%x-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// String implements fmt.Stringer
+func (sc SpanContext) String() string {
+	return sc.Traceparent()
+}
+
+// ParseTraceparent 解析W3C traceparent格式的跨度上下文
+func ParseTraceparent(traceparent string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, cberrors.New("invalid traceparent: %s", traceparent)
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, cberrors.New("invalid traceparent: %s", traceparent)
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, cberrors.New("invalid traceparent: %s", traceparent)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, cberrors.New("invalid traceparent: %s trace id err: %s", traceparent, err)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, cberrors.New("invalid traceparent: %s span id err: %s", traceparent, err)
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, cberrors.New("invalid traceparent: %s flags err: %s", traceparent, err)
+	}
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, cberrors.New("invalid traceparent: %s all zero id", traceparent)
+	}
+	return sc, nil
+}
+
+// Header 转换为消息中的追踪头,caller为发起方身份,上下文无效时只携带发起方身份
+func (sc SpanContext) Header(caller string) *network.TraceHeader {
+	if !sc.IsValid() {
+		return &network.TraceHeader{
+			Caller: caller,
+		}
+	}
+	return &network.TraceHeader{
+		TraceID: append([]byte(nil), sc.TraceID[:]...),
+		SpanID:  append([]byte(nil), sc.SpanID[:]...),
+		Flags:   uint32(sc.Flags),
+		Caller:  caller,
+	}
+}
+
+// SpanContextFromHeader 从消息中的追踪头解析跨度上下文
+func SpanContextFromHeader(header *network.TraceHeader) (SpanContext, bool) {
+	var sc SpanContext
+	if header == nil || len(header.TraceID) != len(sc.TraceID) || len(header.SpanID) != len(sc.SpanID) {
+		return sc, false
+	}
+	copy(sc.TraceID[:], header.TraceID)
+	copy(sc.SpanID[:], header.SpanID)
+	sc.Flags = byte(header.Flags)
+	return sc, sc.IsValid()
+}
+
+// clientTraceHeader 重建客户端调用的追踪头,只保留链路和跨度ID,发起方身份由网关填写
+// 客户端不可信,不能伪造发起方身份
+func clientTraceHeader(header *network.TraceHeader, caller string) *network.TraceHeader {
+	sc, _ := SpanContextFromHeader(header)
+	return sc.Header(caller)
+}
+
+// Traceparent 追踪头的W3C traceparent格式,没有追踪头时返回空字符串,用于日志
+func Traceparent(header *network.TraceHeader) string {
+	sc, ok := SpanContextFromHeader(header)
+	if !ok {
+		return ""
+	}
+	return sc.Traceparent()
+}
+
+// SpanKind 跨度类型
+type SpanKind int32
+
+const (
+	SpanKindClient SpanKind = 1 // 发起调用
+	SpanKindServer SpanKind = 2 // 处理调用
+)
+
+// String implements fmt.Stringer
+func (kind SpanKind) String() string {
+	switch kind {
+	case SpanKindClient:
+		return "Client"
+	case SpanKindServer:
+		return "Server"
+	}
+	return "Unknown"
+}
+
+// Span 跨度,一次调用的发起或处理过程
+type Span struct {
+	SpanContext           // 本跨度的上下文
+	ParentID    [8]byte   // 父跨度ID,根跨度为0
+	Name        string    // 名字,服务类型#方法ID
+	Kind        SpanKind  // 类型
+	Caller      string    // 发起方身份
+	Start       time.Time // 开始时间
+	End         time.Time // 结束时间
+	Err         error     // 调用错误
+	finished    int32     // 是否已结束
+}
+
+// Finish 结束跨度并导出,span为nil时忽略,重复调用只有第一次有效
+func (span *Span) Finish(err error) {
+	if span == nil || !atomic.CompareAndSwapInt32(&span.finished, 0, 1) {
+		return
+	}
+	span.End = time.Now()
+	span.Err = err
+	if !span.Sampled() {
+		return
+	}
+	if exporter := getTraceExporter(); exporter != nil {
+		exporter.Export(span)
+	}
+}
+
+// Duration 跨度耗时
+func (span *Span) Duration() time.Duration {
+	return span.End.Sub(span.Start)
+}
+
+// Parent 父跨度的上下文
+func (span *Span) Parent() SpanContext {
+	return SpanContext{
+		TraceID: span.TraceID,
+		SpanID:  span.ParentID,
+		Flags:   span.Flags,
+	}
+}
+
+// ITraceExporter 跨度导出器,Export在调用结束的协程中执行,不应阻塞
+type ITraceExporter interface {
+	Export(span *Span) // 导出已结束的跨度
+}
+
+var (
+	traceExporter     ITraceExporter // 当前导出器
+	traceExporterLock sync.RWMutex   // 导出器读写锁
+)
+
+// SetTraceExporter 设置跨度导出器,nil关闭导出,追踪头仍然正常传递
+func SetTraceExporter(exporter ITraceExporter) {
+	traceExporterLock.Lock()
+	defer traceExporterLock.Unlock()
+	traceExporter = exporter
+}
+
+// getTraceExporter 获取当前的跨度导出器
+func getTraceExporter() ITraceExporter {
+	traceExporterLock.RLock()
+	defer traceExporterLock.RUnlock()
+	return traceExporter
+}
+
+// LogTraceExporter 将跨度以traceparent格式输出到日志
+type LogTraceExporter struct{}
+
+// Export implements ITraceExporter
+func (exporter LogTraceExporter) Export(span *Span) {
+	if span.Err != nil {
+		log.Infof("trace %s parent: %x kind: %s name: %s caller: %s cost: %s err: %s",
+			span.Traceparent(), span.ParentID, span.Kind, span.Name, span.Caller, span.Duration(), span.Err)
+		return
+	}
+	log.Infof("trace %s parent: %x kind: %s name: %s caller: %s cost: %s",
+		span.Traceparent(), span.ParentID, span.Kind, span.Name, span.Caller, span.Duration())
+}
+
+// traceContextKey 上下文中保存链路信息的键
+type traceContextKey struct{}
+
+// traceContextValue 上下文中保存的链路信息
+type traceContextValue struct {
+	sc     SpanContext // 当前跨度上下文
+	caller string      // 调用发起方身份
+}
+
+// ContextWithSpan 将跨度保存到上下文,在此上下文中发起的调用作为其子跨度
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, traceContextKey{}, &traceContextValue{
+		sc:     span.SpanContext,
+		caller: span.Caller,
+	})
+}
+
+// ContextFromCall 将调用携带的追踪头和发起方身份保存到上下文
+func ContextFromCall(ctx context.Context, call *network.Call) context.Context {
+	if call.Header == nil {
+		return ctx
+	}
+	sc, _ := SpanContextFromHeader(call.Header)
+	return context.WithValue(ctx, traceContextKey{}, &traceContextValue{
+		sc:     sc,
+		caller: call.Header.Caller,
+	})
+}
+
+// CallContext 为处理调用的函数构造上下文,携带链路信息,发起方身份和发起方的期限
+// 发起方放弃等待后上下文随之结束,处理函数可以据此中止,用完须调用cancel
+func CallContext(call *network.Call) (context.Context, context.CancelFunc) {
+	ctx := ContextFromCall(context.Background(), call)
+	if call.Deadline != 0 {
+		return context.WithDeadline(ctx, time.Unix(0, call.Deadline))
+	}
+	return context.WithCancel(ctx)
+}
+
+// ContextToCall 将ctx中的链路信息和期限写入调用,用于进程内直接调用本地服务
+func ContextToCall(ctx context.Context, call *network.Call) {
+	sc, _ := SpanContextFromContext(ctx)
+	call.Header = sc.Header(TraceCaller())
+	if deadline, ok := ctx.Deadline(); ok {
+		call.Deadline = deadline.UnixNano()
+	}
+}
+
+// SpanContextFromContext 获取上下文中的跨度上下文,没有或无效时返回false
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	if value, ok := ctx.Value(traceContextKey{}).(*traceContextValue); ok {
+		return value.sc, value.sc.IsValid()
+	}
+	return SpanContext{}, false
+}
+
+// CallerFromContext 获取上下文中的调用发起方身份
+func CallerFromContext(ctx context.Context) string {
+	if value, ok := ctx.Value(traceContextKey{}).(*traceContextValue); ok {
+		return value.caller
+	}
+	return ""
+}
+
+// TraceCaller 本进程的身份,服务器类型:服务器ID
+func TraceCaller() string {
+	return fmt.Sprintf("%s:%d", config.ServerType, config.ServerID)
+}
+
+// StartCallSpan 为即将发出的调用开始一个发起方跨度,并将追踪头写入调用
+// 父跨度依次取自ctx和调用已有的追踪头,都没有时只有开启追踪才新建链路,否则只写入发起方身份并返回nil
+func StartCallSpan(ctx context.Context, call *network.Call, name string) *Span {
+	parent, ok := SpanContextFromContext(ctx)
+	if !ok {
+		parent, ok = SpanContextFromHeader(call.Header)
+	}
+	if !ok && !config.Trace() {
+		if call.Header == nil {
+			call.Header = parent.Header(TraceCaller())
+		}
+		return nil
+	}
+	span := newSpan(parent, ok, name, SpanKindClient, TraceCaller())
+	call.Header = span.SpanContext.Header(span.Caller)
+	return span
+}
+
+// startServeSpan 为收到的调用开始一个处理方跨度
+// 优先使用调用携带的追踪头,其次是外层消息的追踪头,都没有时只有开启追踪才新建链路
+func startServeSpan(call *network.Call, name string, header *network.TraceHeader) *Span {
+	if call.Header != nil {
+		header = call.Header
+	}
+	parent, ok := SpanContextFromHeader(header)
+	if !ok && !config.Trace() {
+		return nil
+	}
+	caller := ""
+	if header != nil {
+		caller = header.Caller
+	}
+	return newSpan(parent, ok, name, SpanKindServer, caller)
+}
+
+// serveCall 调用本地服务,记录处理方跨度并将其写入返回的追踪头
+// header为外层消息的追踪头,调用本身没有追踪头时使用
+// 处理方跨度会替换调用的追踪头,本地服务据此构造处理函数的上下文;发起方已放弃等待的调用不再处理
+// 处理期间计入管理器进行中的调用,关闭时等待其完成
+func (rpc *RPC) serveCall(service IService, call *network.Call, header *network.TraceHeader) (*network.Return, error) {
+	if call.Deadline != 0 && time.Now().UnixNano() > call.Deadline {
+		return nil, cberrors.New("call %s#%d id: %d caller deadline exceeded", service.Type(), call.MethodID, call.ID)
+	}
+	rpc.pending.add()
+	defer rpc.pending.done()
+	span := startServeSpan(call, methodName(service.Type(), call.MethodID), header)
+	if call.Header == nil {
+		call.Header = header
+	}
+	if span != nil {
+		call.Header = span.SpanContext.Header(span.Caller)
+	}
+	callReturn, err := rpc.Serve(service, call)
+	if span != nil && callReturn != nil {
+		callReturn.Header = span.SpanContext.Header(TraceCaller())
+	}
+	span.Finish(err)
+	return callReturn, err
+}
+
+// newSpan 新建跨度,hasParent为false时新建链路并默认采样
+func newSpan(parent SpanContext, hasParent bool, name string, kind SpanKind, caller string) *Span {
+	span := &Span{
+		Name:   name,
+		Kind:   kind,
+		Caller: caller,
+		Start:  time.Now(),
+	}
+	if hasParent {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+		span.Flags = parent.Flags
+	} else {
+		randomID(span.TraceID[:])
+		span.Flags = TraceFlagSampled
+	}
+	randomID(span.SpanID[:])
+	return span
+}
+
+// randomID 生成不全为0的随机ID
+func randomID(buf []byte) {
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			cberrors.Panic("generate trace id err: %s", err)
+		}
+		if !bytes.Equal(buf, make([]byte, len(buf))) {
+			return
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// -------------------------------------------
+// @file      : trace_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/9 上午10:15
+// -------------------------------------------
+
+package cluster
+
+import (
+	"bytes"
+	"gogs/base/cluster/network"
+	"testing"
+)
+
+func TestClientTraceHeader(t *testing.T) {
+	spoofed := &network.TraceHeader{
+		TraceID: bytes.Repeat([]byte{1}, 16),
+		SpanID:  bytes.Repeat([]byte{2}, 8),
+		Flags:   1,
+		Caller:  "Game:1",
+	}
+	header := clientTraceHeader(spoofed, "user:1@Gate:1")
+	if header.Caller != "user:1@Gate:1" {
+		t.Fatalf("caller not replaced: %s", header.Caller)
+	}
+	if !bytes.Equal(header.TraceID, spoofed.TraceID) || !bytes.Equal(header.SpanID, spoofed.SpanID) || header.Flags != 1 {
+		t.Fatalf("trace context lost: %+v", header)
+	}
+
+	// 非法的追踪头只保留网关填写的发起方身份
+	header = clientTraceHeader(&network.TraceHeader{TraceID: []byte{1}, Caller: "Game:1"}, "user:1@Gate:1")
+	if len(header.TraceID) != 0 || header.Caller != "user:1@Gate:1" {
+		t.Fatalf("invalid header kept: %+v", header)
+	}
+	if header = clientTraceHeader(nil, "user:1@Gate:1"); header.Caller != "user:1@Gate:1" {
+		t.Fatalf("missing caller: %+v", header)
+	}
+}
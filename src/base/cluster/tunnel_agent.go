@@ -8,6 +8,7 @@
 package cluster
 
 import (
+	"context"
 	"gogs/base/cluster/network"
 	"time"
 )
@@ -34,14 +35,20 @@ func (agent *TunnelAgent) Session() network.ISession {
 	return nil
 }
 
+// Middlewares implement IMiddlewareAgent
+func (agent *TunnelAgent) Middlewares() *Middlewares {
+	return agent.game.Middlewares
+}
+
 // Post implement IAgent
 func (agent *TunnelAgent) Post(service IService, call *network.Call) error {
 	return agent.game.Post(agent, call)
 }
 
 // Wait implement IAgent
-func (agent *TunnelAgent) Wait(service IService, call *network.Call, timeout time.Duration) (Future, error) {
-	return agent.game.Wait(agent, call, timeout)
+func (agent *TunnelAgent) Wait(ctx context.Context, service IService, call *network.Call, timeout time.Duration,
+	complete func(result *ReturnVal)) error {
+	return agent.game.Wait(ctx, agent, call, timeout, complete)
 }
 
 // Write implement IAgent
@@ -69,6 +76,11 @@ func (agent *TunnelAgent) Handler() network.ISessionHandler {
 	return nil
 }
 
+// RTT implement network.ISession
+func (agent *TunnelAgent) RTT() time.Duration {
+	return 0
+}
+
 // Close implement network.ISession
 func (agent *TunnelAgent) Close() {
 }
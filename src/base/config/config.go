@@ -110,22 +110,28 @@ func Adjust(options ...Option) {
 // LoadGlobalConfig 读取yaml配置文件
 // 配置读取完成前不使用logger
 func LoadGlobalConfig(cfgFilename string) {
+	if err := ReloadGlobalConfig(cfgFilename); err != nil {
+		cberrors.Panic("LoadGlobalConfig err: %s", err)
+	}
+}
+
+// ReloadGlobalConfig 重新读取yaml配置文件,覆盖已有配置中文件里出现的字段,失败时返回错误
+func ReloadGlobalConfig(cfgFilename string) error {
 	baseFilename := path.Join(basePath, "base.yml")
 	baseData, err := os.ReadFile(baseFilename)
 	if err != nil {
-		cberrors.Panic("LoadGlobalConfig ReadFile(%s) err: %s", baseFilename, err)
-		return
+		return fmt.Errorf("ReadFile(%s) err: %s", baseFilename, err)
 	}
 	filename := path.Join(basePath, cfgFilename)
 	data, err := os.ReadFile(filename)
 	if err != nil {
-		cberrors.Panic("LoadGlobalConfig ReadFile(%s) err: %s", filename, err)
-		return
+		return fmt.Errorf("ReadFile(%s) err: %s", filename, err)
 	}
 	content := os.ExpandEnv(string(baseData) + string(data))
 	if err = ParseGlobalConfig(content); err != nil {
-		cberrors.Panic("ParseGlobalConfig err: %s", err)
+		return fmt.Errorf("ParseGlobalConfig err: %s", err)
 	}
+	return nil
 }
 
 // ParseGlobalConfig 解析配置
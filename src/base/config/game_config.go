@@ -7,10 +7,17 @@
 
 package config
 
+import "fmt"
+
 // GameConfig 游戏服配置
 type GameConfig struct {
-	LogPath string `yaml:"logPath"`
-	DBName  string `yaml:"dbName"`
+	LogPath        string `yaml:"logPath"`
+	DBName         string `yaml:"dbName"`
+	Addr           string `yaml:"addr"`
+	Port           string `yaml:"port"`
+	ReportInterval int    `yaml:"reportInterval"`
+	MetricsAddr    string `yaml:"metricsAddr"`
+	AdminAddr      string `yaml:"adminAddr"`
 }
 
 // NewGameConfig 创建游戏服配置
@@ -32,3 +39,8 @@ func GetGameConfig() *GameConfig {
 func (c *GameConfig) GetType() string {
 	return KeyGame
 }
+
+// FullAddr 游戏服集群节点的监听地址 addr:port
+func (c *GameConfig) FullAddr() string {
+	return fmt.Sprintf("%s:%s", c.Addr, c.Port)
+}
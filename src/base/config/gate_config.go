@@ -11,11 +11,19 @@ import "fmt"
 
 // GateConfig 网关配置
 type GateConfig struct {
-	InnerAddr string `yaml:"innerAddr"`
-	InnerPort string `yaml:"innerPort"`
-	Addr      string `yaml:"addr"`
-	Port      string `yaml:"port"`
-	LogPath   string `yaml:"logPath"`
+	InnerAddr   string `yaml:"innerAddr"`
+	InnerPort   string `yaml:"innerPort"`
+	Addr        string `yaml:"addr"`
+	Port        string `yaml:"port"`
+	LogPath     string `yaml:"logPath"`
+	Protocol    int32  `yaml:"protocol"`
+	Encrypt     bool   `yaml:"encrypt"`
+	TLSCert     string `yaml:"tlsCert"`
+	TLSKey      string `yaml:"tlsKey"`
+	SignKey     string `yaml:"signKey"`
+	RoutePolicy int32  `yaml:"routePolicy"`
+	MetricsAddr string `yaml:"metricsAddr"`
+	AdminAddr   string `yaml:"adminAddr"`
 }
 
 // NewGateConfig 创建网关配置
@@ -45,3 +53,8 @@ func (c *GateConfig) FullAddr() string {
 func (c *GateConfig) FullInnerAddr() string {
 	return fmt.Sprintf("%s:%s", c.InnerAddr, c.InnerPort)
 }
+
+// TLS 是否启用tls,tcp使用tls,websocket使用wss
+func (c *GateConfig) TLS() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
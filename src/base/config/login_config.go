@@ -9,8 +9,10 @@ package config
 
 // LoginConfig 登录服务器配置
 type LoginConfig struct {
-	LogPath string `yaml:"logPath"`
-	DBName  string `yaml:"dbName"`
+	LogPath     string `yaml:"logPath"`
+	DBName      string `yaml:"dbName"`
+	TestToken   string `yaml:"testToken"`   // 测试账号的token,为空时不允许测试账号登录
+	TokenSecret string `yaml:"tokenSecret"` // 平台账号token的HMAC签名密钥,为空时不允许平台账号登录
 }
 
 // NewLoginConfig 创建登录服务器配置
@@ -18,7 +18,43 @@ type RPCConfig struct {
 	ClientSessionCache      int   `yaml:"clientSessionCache"`      // 客户端会话消息发送缓存大小
 	ClusterRegistryInterval int   `yaml:"clusterRegistryInterval"` // 集群服务注册时间间隔,单位秒
 	ClusterRegistryMax      int   `yaml:"clusterRegistryMax"`      // 集群单次注册服务的最大数量
+	ClusterRegistryDigest   int   `yaml:"clusterRegistryDigest"`   // 集群向邻居发送服务注册摘要的间隔,邻居发现不一致时请求全量快照,单位秒,0不发送
 	ActorGroups             int   `yaml:"actorGroups"`             // 用户散列分组数量
+	Compress                int32 `yaml:"compress"`                // 会话压缩算法 0:不压缩,1:snappy,2:zstd
+	CompressThreshold       int   `yaml:"compressThreshold"`       // 消息压缩阈值,单位字节
+	SessionBatch            int   `yaml:"sessionBatch"`            // 发送循环单帧合并的最大消息数,小于2不合并
+	MaxMessageSize          int   `yaml:"maxMessageSize"`          // 单个消息解压后和单个加密帧的最大字节数,超过时断开连接,0不限制
+	KCPNoDelay              bool  `yaml:"kcpNoDelay"`              // kcp是否启用nodelay模式
+	KCPInterval             int   `yaml:"kcpInterval"`             // kcp内部刷新间隔,单位毫秒
+	KCPResend               int   `yaml:"kcpResend"`               // kcp快速重传阈值,0关闭
+	KCPNoCongestion         bool  `yaml:"kcpNoCongestion"`         // kcp是否关闭拥塞控制
+	KCPSndWnd               int   `yaml:"kcpSndWnd"`               // kcp发送窗口
+	KCPRcvWnd               int   `yaml:"kcpRcvWnd"`               // kcp接收窗口
+	KCPMTU                  int   `yaml:"kcpMTU"`                  // kcp最大传输单元
+	KCPTimeout              int   `yaml:"kcpTimeout"`              // kcp空闲断开时间,单位秒
+	ShutdownTimeout         int   `yaml:"shutdownTimeout"`         // 优雅关闭时等待调用返回和消息发送的最长时间,单位秒
+	ServiceTimeout          int   `yaml:"serviceTimeout"`          // 本地服务启动和停止钩子的最长执行时间,单位秒
+	ReadIdleTimeout         int   `yaml:"readIdleTimeout"`         // 客户端会话读空闲超时,超时未收到任何消息关闭连接,单位秒,0关闭
+	WriteIdleTimeout        int   `yaml:"writeIdleTimeout"`        // 客户端会话写空闲时间,超时未发送任何消息时发送心跳,单位秒,0关闭
+	ResumeGrace             int   `yaml:"resumeGrace"`             // 网关会话断线后等待客户端恢复的时间,单位秒,0关闭会话恢复
+	ResumeBuffer            int   `yaml:"resumeBuffer"`            // 网关会话重放缓冲区大小,保存客户端未确认的消息数量
+	ResumeRetryInterval     int   `yaml:"resumeRetryInterval"`     // 客户端会话断线后尝试恢复的间隔,单位秒
+	GateSessionOverflow     int32 `yaml:"gateSessionOverflow"`     // 网关会话发送队列满时的策略 0:拒绝,1:阻塞等待,2:丢弃最早,3:断开连接
+	HostSessionOverflow     int32 `yaml:"hostSessionOverflow"`     // 集群会话发送队列满时的策略
+	ClientSessionOverflow   int32 `yaml:"clientSessionOverflow"`   // 客户端会话发送队列满时的策略
+	OverflowTimeout         int   `yaml:"overflowTimeout"`         // 阻塞策略等待发送队列的最长时间,单位毫秒
+	HostSessionCredit       int   `yaml:"hostSessionCredit"`       // 集群会话接收窗口,单位帧,0不启用流量控制
+	Trace                   bool  `yaml:"trace"`                   // 是否为没有追踪头的调用开启新的链路
+	RetryMax                int   `yaml:"retryMax"`                // 幂等函数超时或发送失败时的最大重试次数,0不重试
+	RetryBackoff            int   `yaml:"retryBackoff"`            // 第一次重试前的退避时间,之后每次翻倍,单位毫秒
+	RetryBackoffMax         int   `yaml:"retryBackoffMax"`         // 重试退避时间的上限,单位毫秒
+	BreakerThreshold        int   `yaml:"breakerThreshold"`        // 对同一集群节点连续超时多少次后熔断,0不熔断
+	BreakerTimeout          int   `yaml:"breakerTimeout"`          // 熔断持续时间,之后放行一个试探调用,单位秒
+	BulkheadLimit           int   `yaml:"bulkheadLimit"`           // 对同一集群节点进行中调用数的上限,0不限制
+	RateLimit               int   `yaml:"rateLimit"`               // 单个服务类型每秒处理的调用数上限,0不限制
+	RateBurst               int   `yaml:"rateBurst"`               // 单个服务类型允许的突发调用数,小于rateLimit时取rateLimit
+	SlowCall                int   `yaml:"slowCall"`                // 处理时间超过多少毫秒的调用记录警告日志,0不记录
+	MembershipSync          int   `yaml:"membershipSync"`          // 集群成员与etcd全量对账的间隔,补连缺失的邻居并关闭过期的邻居,单位秒,0只处理etcd事件
 }
 
 // NewRPCConfig 创建RPC配置
@@ -33,6 +69,42 @@ func NewRPCConfig() *RPCConfig {
 		ClusterRegistryInterval: 2,
 		ClusterRegistryMax:      128,
 		ActorGroups:             128,
+		Compress:                0,
+		CompressThreshold:       512,
+		SessionBatch:            0,
+		MaxMessageSize:          4 << 20,
+		KCPNoDelay:              true,
+		KCPInterval:             10,
+		KCPResend:               2,
+		KCPNoCongestion:         true,
+		KCPSndWnd:               128,
+		KCPRcvWnd:               128,
+		KCPMTU:                  1400,
+		KCPTimeout:              30,
+		ShutdownTimeout:         10,
+		ServiceTimeout:          10,
+		ReadIdleTimeout:         30,
+		WriteIdleTimeout:        10,
+		ResumeGrace:             60,
+		ResumeBuffer:            256,
+		ResumeRetryInterval:     1,
+		GateSessionOverflow:     3,
+		HostSessionOverflow:     1,
+		ClientSessionOverflow:   1,
+		OverflowTimeout:         1000,
+		HostSessionCredit:       1024,
+		Trace:                   false,
+		RetryMax:                2,
+		RetryBackoff:            100,
+		RetryBackoffMax:         1000,
+		BreakerThreshold:        5,
+		BreakerTimeout:          10,
+		BulkheadLimit:           1024,
+		RateLimit:               0,
+		RateBurst:               0,
+		SlowCall:                500,
+		ClusterRegistryDigest:   30,
+		MembershipSync:          10,
 	}
 	return c
 }
@@ -83,6 +155,150 @@ func ClusterRegistryMax() int {
 	return GetRPCConfig().ClusterRegistryMax
 }
 
+func ClusterRegistryDigest() time.Duration {
+	return time.Duration(GetRPCConfig().ClusterRegistryDigest) * time.Second
+}
+
 func ActorGroups() int {
 	return GetRPCConfig().ActorGroups
 }
+
+func Compress() int32 {
+	return GetRPCConfig().Compress
+}
+
+func CompressThreshold() int {
+	return GetRPCConfig().CompressThreshold
+}
+
+func SessionBatch() int {
+	return GetRPCConfig().SessionBatch
+}
+
+func MaxMessageSize() int {
+	return GetRPCConfig().MaxMessageSize
+}
+
+func KCPNoDelay() bool {
+	return GetRPCConfig().KCPNoDelay
+}
+
+func KCPInterval() time.Duration {
+	return time.Duration(GetRPCConfig().KCPInterval) * time.Millisecond
+}
+
+func KCPResend() int {
+	return GetRPCConfig().KCPResend
+}
+
+func KCPNoCongestion() bool {
+	return GetRPCConfig().KCPNoCongestion
+}
+
+func KCPSndWnd() int {
+	return GetRPCConfig().KCPSndWnd
+}
+
+func KCPRcvWnd() int {
+	return GetRPCConfig().KCPRcvWnd
+}
+
+func KCPMTU() int {
+	return GetRPCConfig().KCPMTU
+}
+
+func KCPTimeout() time.Duration {
+	return time.Duration(GetRPCConfig().KCPTimeout) * time.Second
+}
+
+func ShutdownTimeout() time.Duration {
+	return time.Duration(GetRPCConfig().ShutdownTimeout) * time.Second
+}
+
+func ServiceTimeout() time.Duration {
+	return time.Duration(GetRPCConfig().ServiceTimeout) * time.Second
+}
+
+func ReadIdleTimeout() time.Duration {
+	return time.Duration(GetRPCConfig().ReadIdleTimeout) * time.Second
+}
+
+func WriteIdleTimeout() time.Duration {
+	return time.Duration(GetRPCConfig().WriteIdleTimeout) * time.Second
+}
+
+func ResumeGrace() time.Duration {
+	return time.Duration(GetRPCConfig().ResumeGrace) * time.Second
+}
+
+func ResumeBuffer() int {
+	return GetRPCConfig().ResumeBuffer
+}
+
+func ResumeRetryInterval() time.Duration {
+	return time.Duration(GetRPCConfig().ResumeRetryInterval) * time.Second
+}
+
+func GateSessionOverflow() int32 {
+	return GetRPCConfig().GateSessionOverflow
+}
+
+func HostSessionOverflow() int32 {
+	return GetRPCConfig().HostSessionOverflow
+}
+
+func ClientSessionOverflow() int32 {
+	return GetRPCConfig().ClientSessionOverflow
+}
+
+func OverflowTimeout() time.Duration {
+	return time.Duration(GetRPCConfig().OverflowTimeout) * time.Millisecond
+}
+
+func HostSessionCredit() int {
+	return GetRPCConfig().HostSessionCredit
+}
+
+func Trace() bool {
+	return GetRPCConfig().Trace
+}
+
+func RetryMax() int {
+	return GetRPCConfig().RetryMax
+}
+
+func RetryBackoff() time.Duration {
+	return time.Duration(GetRPCConfig().RetryBackoff) * time.Millisecond
+}
+
+func RetryBackoffMax() time.Duration {
+	return time.Duration(GetRPCConfig().RetryBackoffMax) * time.Millisecond
+}
+
+func BreakerThreshold() int {
+	return GetRPCConfig().BreakerThreshold
+}
+
+func BreakerTimeout() time.Duration {
+	return time.Duration(GetRPCConfig().BreakerTimeout) * time.Second
+}
+
+func BulkheadLimit() int {
+	return GetRPCConfig().BulkheadLimit
+}
+
+func RateLimit() int {
+	return GetRPCConfig().RateLimit
+}
+
+func RateBurst() int {
+	return GetRPCConfig().RateBurst
+}
+
+func SlowCall() time.Duration {
+	return time.Duration(GetRPCConfig().SlowCall) * time.Millisecond
+}
+
+func MembershipSync() time.Duration {
+	return time.Duration(GetRPCConfig().MembershipSync) * time.Second
+}
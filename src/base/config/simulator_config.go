@@ -9,7 +9,14 @@ package config
 
 // SimulatorConfig 游戏服配置
 type SimulatorConfig struct {
-	LogPath string `yaml:"logPath"`
+	LogPath     string `yaml:"logPath"`
+	GateAddr    string `yaml:"gateAddr"`
+	Protocol    int32  `yaml:"protocol"`
+	Encrypt     bool   `yaml:"encrypt"`
+	TLS         bool   `yaml:"tls"`
+	TLSCA       string `yaml:"tlsCA"`
+	TLSInsecure bool   `yaml:"tlsInsecure"`
+	GateKey     string `yaml:"gateKey"`
 }
 
 // NewSimulatorConfig 创建模拟器
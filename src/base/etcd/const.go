@@ -58,6 +58,7 @@ const (
 	NodeInfoKeyHide         = "Hide"
 	NodeInfoKeyMaintain     = "Maintain"
 	NodeInfoKeyCurOnline    = "CurOnline"
+	NodeInfoKeyDraining     = "Draining"     // 正在关闭,不再接受新的请求
 	NodeInfoKeyIsBlockLogin = "IsBlockLogin" // Login
 )
 
@@ -0,0 +1,165 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	log "gogs/base/logger"
+	"time"
+)
+
+// Election 集群唯一名字的竞选,同一时刻只有一个实例持有该名字
+// 持有期间租约过期、etcd断开或重连都会失去持有权,之后自动重新竞选
+type Election struct {
+	service   *Service           // 所属etcd服务
+	name      string             // 竞选的名字
+	value     string             // 当选后写入的值,为本实例的类型和id
+	onElected func() error       // 当选回调,返回错误时放弃本次持有并稍后重新竞选
+	onRevoked func()             // 失去持有权回调,只在当选回调成功后调用
+	cancel    context.CancelFunc // 停止竞选
+	done      chan struct{}      // 竞选协程退出信号
+}
+
+// electionKey 竞选名字的key前缀,不在服务注册前缀下,避免被当作节点信息监听
+func (s *Service) electionKey(name string) string {
+	return fmt.Sprintf("%s_election/%s", s.Root, name)
+}
+
+// getClient 获取当前的etcd连接,重连后会被替换
+func (s *Service) getClient() *clientv3.Client {
+	s.RLock()
+	defer s.RUnlock()
+	return s.client
+}
+
+// Campaign 竞选集群唯一的名字,当选后调用onElected,失去持有权后调用onRevoked
+// 回调在竞选协程中依次调用,不会并发
+func (s *Service) Campaign(name string, onElected func() error, onRevoked func()) *Election {
+	ctx, cancel := context.WithCancel(context.Background())
+	election := &Election{
+		service:   s,
+		name:      name,
+		value:     fmt.Sprintf("%s:%d", s.serviceType, s.serviceID),
+		onElected: onElected,
+		onRevoked: onRevoked,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	go election.run(ctx)
+	return election
+}
+
+// Campaign 竞选集群唯一的名字
+func Campaign(name string, onElected func() error, onRevoked func()) (*Election, error) {
+	if global == nil {
+		return nil, fmt.Errorf("[ETCD] etcd not init")
+	}
+	return global.Campaign(name, onElected, onRevoked), nil
+}
+
+// Leader 获取集群唯一名字当前的持有者
+func (s *Service) Leader(name string) (string, error) {
+	client := s.getClient()
+	if client == nil {
+		return "", fmt.Errorf("[ETCD] etcd is not connected")
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), Timeout)
+	defer cancel()
+	rsp, err := client.Get(ctx, s.electionKey(name)+"/", clientv3.WithFirstCreate()...)
+	if err != nil {
+		return "", fmt.Errorf("[ETCD] get leader err:%s", err)
+	}
+	if len(rsp.Kvs) == 0 {
+		return "", fmt.Errorf("[ETCD] no leader. name:%s", name)
+	}
+	return string(rsp.Kvs[0].Value), nil
+}
+
+// Leader 获取集群唯一名字当前的持有者
+func Leader(name string) (string, error) {
+	if global == nil {
+		return "", fmt.Errorf("[ETCD] etcd not init")
+	}
+	return global.Leader(name)
+}
+
+// Resign 停止竞选,持有期间会先调用onRevoked再删除持有记录,同步等待竞选协程退出
+func (e *Election) Resign() {
+	e.cancel()
+	<-e.done
+}
+
+// run 竞选循环,每轮竞选结束后间隔ReconnectDuration重新竞选
+func (e *Election) run(ctx context.Context) {
+	defer close(e.done)
+	for {
+		if err := e.campaign(ctx); err != nil {
+			log.Errorf("[ETCD] campaign name:%s err:%s", e.name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ReconnectDuration):
+		}
+	}
+}
+
+// campaign 一轮竞选,在独立的租约上等待当选,持有期间直到租约失效或停止竞选才返回
+func (e *Election) campaign(ctx context.Context) error {
+	client := e.service.getClient()
+	if client == nil {
+		return fmt.Errorf("etcd is not connected")
+	}
+	ttl := e.service.TTL
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	// 会话使用连接的上下文,停止竞选后仍能撤销租约
+	grantCtx, grantCancel := context.WithTimeout(ctx, Timeout)
+	lease, err := client.Grant(grantCtx, ttl)
+	grantCancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("grant lease err:%s", err)
+	}
+	session, err := concurrency.NewSession(client, concurrency.WithLease(lease.ID), concurrency.WithTTL(int(ttl)))
+	if err != nil {
+		return err
+	}
+	// 关闭会话时撤销租约,持有记录随之删除
+	defer func() {
+		_ = session.Close()
+	}()
+	// 等待当选期间租约失效也要退出等待
+	campaignCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-session.Done():
+			cancel()
+		case <-campaignCtx.Done():
+		}
+	}()
+	election := concurrency.NewElection(session, e.service.electionKey(e.name))
+	if err = election.Campaign(campaignCtx, e.value); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	log.Infof("[ETCD] elected name:%s value:%s", e.name, e.value)
+	if err = e.onElected(); err != nil {
+		return fmt.Errorf("on elected err:%s", err)
+	}
+	select {
+	case <-ctx.Done():
+		log.Infof("[ETCD] resign name:%s value:%s", e.name, e.value)
+	case <-session.Done():
+		log.Warnf("[ETCD] lost leadership name:%s value:%s", e.name, e.value)
+	}
+	e.onRevoked()
+	return nil
+}
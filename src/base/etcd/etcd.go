@@ -8,6 +8,7 @@ import (
 	"go.uber.org/zap"
 	"gogs/base/config"
 	log "gogs/base/logger"
+	"gogs/base/metrics"
 	"net"
 	"os"
 	"strings"
@@ -19,6 +20,18 @@ import (
 var global *Service
 var once sync.Once
 
+// stateGauge 服务注册状态,etcd未初始化时不输出
+var stateGauge = metrics.NewGaugeVecFunc("gogs_etcd_state",
+	"Etcd registration state, 0:disconnected, 1:connected, 2:closed.", nil, func(set func(float64, ...string)) {
+		if global != nil {
+			set(float64(atomic.LoadInt32(&global.state)))
+		}
+	})
+
+func init() {
+	metrics.MustRegister(stateGauge)
+}
+
 type EventHandler func(event *NodeEvent)
 
 // Service etcd服务配置
@@ -97,6 +110,11 @@ func Init(c *config.EtcdConfig, eventHandler EventHandler) error {
 	return err
 }
 
+// IsInit 服务是否已经初始化
+func IsInit() bool {
+	return global != nil
+}
+
 // UpdateNodeWithExtra 注册本服务信息带额外信息
 func (s *Service) UpdateNodeWithExtra(extra NodeInfo) {
 	nodeInfo := s.GenNodeInfo()
@@ -508,7 +526,9 @@ func (s *Service) registrationAndDiscovery() (clientv3.WatchChan, <-chan *client
 		s.TTL = DefaultTTL
 	}
 	s.clearDependence()
+	s.Lock()
 	s.client = client
+	s.Unlock()
 	err = s.fetchRemoteCfg()
 	if err != nil {
 		return nil, nil, err
@@ -0,0 +1,578 @@
+// -------------------------------------------
+// @file      : arq.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/17 上午11:02
+// -------------------------------------------
+
+package kcp
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// 分段命令
+const (
+	cmdPush uint8 = 81 // 数据
+	cmdAck  uint8 = 82 // 确认
+	cmdWask uint8 = 83 // 询问远端窗口
+	cmdWins uint8 = 84 // 告知本地窗口
+	cmdFin  uint8 = 85 // 关闭会话
+)
+
+// 探测标记
+const (
+	askSend uint32 = 1 // 需要发送窗口询问
+	askTell uint32 = 2 // 需要告知本地窗口
+)
+
+const (
+	overhead   = 24     // 分段头长度
+	rtoNoDelay = 30     // nodelay模式下最小rto
+	rtoMin     = 100    // 普通模式下最小rto
+	rtoDefault = 200    // 初始rto
+	rtoMax     = 60000  // 最大rto
+	threshInit = 2      // 初始慢启动阈值
+	threshMin  = 2      // 最小慢启动阈值
+	probeInit  = 7000   // 初始窗口探测间隔
+	probeLimit = 120000 // 最大窗口探测间隔
+	deadLink   = 20     // 单个分段最大发送次数,超过视为断开
+)
+
+// epoch 计时起点
+var epoch = time.Now()
+
+// currentMs 获取当前毫秒时间
+func currentMs() uint32 {
+	return uint32(time.Since(epoch) / time.Millisecond)
+}
+
+// segment 分段
+type segment struct {
+	cmd      uint8  // 命令
+	wnd      uint16 // 发送方剩余接收窗口
+	ts       uint32 // 发送时间
+	sn       uint32 // 序号
+	una      uint32 // 发送方待接收的序号,之前的分段都已收到
+	resendts uint32 // 下次重传时间
+	rto      uint32 // 超时重传时间
+	fastack  uint32 // 被跳过确认的次数
+	xmit     uint32 // 发送次数
+	data     []byte // 数据
+}
+
+// encode 编码分段头到buf,返回剩余缓冲区
+func (seg *segment) encode(conv uint32, buf []byte) []byte {
+	binary.LittleEndian.PutUint32(buf, conv)
+	buf[4] = seg.cmd
+	buf[5] = 0
+	binary.LittleEndian.PutUint16(buf[6:], seg.wnd)
+	binary.LittleEndian.PutUint32(buf[8:], seg.ts)
+	binary.LittleEndian.PutUint32(buf[12:], seg.sn)
+	binary.LittleEndian.PutUint32(buf[16:], seg.una)
+	binary.LittleEndian.PutUint32(buf[20:], uint32(len(seg.data)))
+	return buf[overhead:]
+}
+
+// ackItem 待发送的确认
+type ackItem struct {
+	sn uint32
+	ts uint32
+}
+
+// arq 自动重传请求协议状态机,算法与KCP一致,以流模式工作
+// 非线程安全,由Conn加锁调用
+type arq struct {
+	conv       uint32           // 会话编号
+	mtu        uint32           // 最大传输单元
+	mss        uint32           // 最大分段数据长度
+	sndUna     uint32           // 第一个未确认的发送序号
+	sndNxt     uint32           // 下一个发送序号
+	rcvNxt     uint32           // 下一个待接收序号
+	ssthresh   uint32           // 慢启动阈值
+	rxRttval   int32            // rtt偏差
+	rxSrtt     int32            // 平滑rtt
+	rxRto      uint32           // 重传超时
+	rxMinrto   uint32           // 最小重传超时
+	sndWnd     uint32           // 发送窗口
+	rcvWnd     uint32           // 接收窗口
+	rmtWnd     uint32           // 远端接收窗口
+	cwnd       uint32           // 拥塞窗口
+	incr       uint32           // 拥塞窗口增量
+	probe      uint32           // 探测标记
+	probeWait  uint32           // 窗口探测间隔
+	tsProbe    uint32           // 下次窗口探测时间
+	nodelay    bool             // nodelay模式
+	nocwnd     bool             // 关闭拥塞控制
+	fastresend uint32           // 快速重传阈值
+	dead       bool             // 重传次数超限
+	finished   bool             // 收到对端关闭
+	sndQueue   []*segment       // 发送队列
+	sndBuf     []*segment       // 发送缓冲,已发送待确认
+	rcvQueue   []*segment       // 接收队列,按序可读
+	rcvBuf     []*segment       // 接收缓冲,乱序待整理
+	ackList    []ackItem        // 待发送确认
+	buffer     []byte           // 发送缓冲区
+	output     func(buf []byte) // 底层发送函数
+}
+
+// newARQ 新建自动重传请求状态机
+func newARQ(conv uint32, options *Options, output func(buf []byte)) *arq {
+	mtu := uint32(options.MTU)
+	k := &arq{
+		conv:       conv,
+		mtu:        mtu,
+		mss:        mtu - overhead,
+		ssthresh:   threshInit,
+		rxRto:      rtoDefault,
+		rxMinrto:   rtoMin,
+		sndWnd:     uint32(options.SndWnd),
+		rcvWnd:     uint32(options.RcvWnd),
+		rmtWnd:     uint32(options.RcvWnd),
+		cwnd:       1,
+		nodelay:    options.NoDelay,
+		nocwnd:     options.NoCongestion,
+		fastresend: uint32(options.FastResend),
+		buffer:     make([]byte, mtu),
+		output:     output,
+	}
+	if k.nodelay {
+		k.rxMinrto = rtoNoDelay
+	}
+	return k
+}
+
+// peekSize 可读取的数据长度
+func (k *arq) peekSize() int {
+	size := 0
+	for _, seg := range k.rcvQueue {
+		size += len(seg.data)
+	}
+	return size
+}
+
+// recv 读取数据到buf,没有数据时返回0
+func (k *arq) recv(buf []byte) int {
+	full := uint32(len(k.rcvQueue)) >= k.rcvWnd
+	n := 0
+	count := 0
+	for _, seg := range k.rcvQueue {
+		copied := copy(buf[n:], seg.data)
+		n += copied
+		if copied < len(seg.data) {
+			seg.data = seg.data[copied:]
+			break
+		}
+		count++
+		if n == len(buf) {
+			break
+		}
+	}
+	k.rcvQueue = k.rcvQueue[count:]
+	k.moveRcvBuf()
+	// 接收窗口从满变为有空闲,主动告知远端
+	if full && uint32(len(k.rcvQueue)) < k.rcvWnd {
+		k.probe |= askTell
+	}
+	return n
+}
+
+// moveRcvBuf 将接收缓冲中已连续的分段移到接收队列
+func (k *arq) moveRcvBuf() {
+	count := 0
+	for _, seg := range k.rcvBuf {
+		if seg.sn != k.rcvNxt || uint32(len(k.rcvQueue)+count) >= k.rcvWnd {
+			break
+		}
+		k.rcvNxt++
+		count++
+	}
+	if count > 0 {
+		k.rcvQueue = append(k.rcvQueue, k.rcvBuf[:count]...)
+		k.rcvBuf = k.rcvBuf[count:]
+	}
+}
+
+// send 写入待发送数据,流模式下优先填满发送队列最后一个分段
+func (k *arq) send(data []byte) {
+	if n := len(k.sndQueue); n > 0 {
+		last := k.sndQueue[n-1]
+		if room := int(k.mss) - len(last.data); room > 0 {
+			if room > len(data) {
+				room = len(data)
+			}
+			last.data = append(last.data, data[:room]...)
+			data = data[room:]
+		}
+	}
+	for len(data) > 0 {
+		size := len(data)
+		if size > int(k.mss) {
+			size = int(k.mss)
+		}
+		seg := &segment{
+			data: make([]byte, size, k.mss),
+		}
+		copy(seg.data, data)
+		k.sndQueue = append(k.sndQueue, seg)
+		data = data[size:]
+	}
+}
+
+// waitSnd 待发送和待确认的分段数量
+func (k *arq) waitSnd() int {
+	return len(k.sndBuf) + len(k.sndQueue)
+}
+
+// updateAck 根据rtt更新rto
+func (k *arq) updateAck(rtt int32) {
+	if k.rxSrtt == 0 {
+		k.rxSrtt = rtt
+		k.rxRttval = rtt / 2
+	} else {
+		delta := rtt - k.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+		k.rxRttval = (3*k.rxRttval + delta) / 4
+		k.rxSrtt = (7*k.rxSrtt + rtt) / 8
+		if k.rxSrtt < 1 {
+			k.rxSrtt = 1
+		}
+	}
+	rto := uint32(k.rxSrtt) + maxUint32(1, 4*uint32(k.rxRttval))
+	k.rxRto = minUint32(maxUint32(k.rxMinrto, rto), rtoMax)
+}
+
+// shrinkBuf 更新第一个未确认的序号
+func (k *arq) shrinkBuf() {
+	if len(k.sndBuf) > 0 {
+		k.sndUna = k.sndBuf[0].sn
+	} else {
+		k.sndUna = k.sndNxt
+	}
+}
+
+// parseAck 删除被确认的分段
+func (k *arq) parseAck(sn uint32) {
+	if timeDiff(sn, k.sndUna) < 0 || timeDiff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for i, seg := range k.sndBuf {
+		if sn == seg.sn {
+			k.sndBuf = append(k.sndBuf[:i], k.sndBuf[i+1:]...)
+			break
+		}
+		if timeDiff(sn, seg.sn) < 0 {
+			break
+		}
+	}
+}
+
+// parseFastack 序号小于maxack的分段被跳过一次确认
+func (k *arq) parseFastack(maxack uint32) {
+	if timeDiff(maxack, k.sndUna) < 0 || timeDiff(maxack, k.sndNxt) >= 0 {
+		return
+	}
+	for _, seg := range k.sndBuf {
+		if timeDiff(maxack, seg.sn) <= 0 {
+			break
+		}
+		seg.fastack++
+	}
+}
+
+// parseUna 删除una之前的分段
+func (k *arq) parseUna(una uint32) {
+	count := 0
+	for _, seg := range k.sndBuf {
+		if timeDiff(una, seg.sn) <= 0 {
+			break
+		}
+		count++
+	}
+	k.sndBuf = k.sndBuf[count:]
+}
+
+// parseData 收到数据分段,插入接收缓冲
+func (k *arq) parseData(newSeg *segment) {
+	sn := newSeg.sn
+	if timeDiff(sn, k.rcvNxt+k.rcvWnd) >= 0 || timeDiff(sn, k.rcvNxt) < 0 {
+		return
+	}
+	insert := len(k.rcvBuf)
+	for i := len(k.rcvBuf) - 1; i >= 0; i-- {
+		seg := k.rcvBuf[i]
+		if seg.sn == sn {
+			return
+		}
+		if timeDiff(sn, seg.sn) > 0 {
+			break
+		}
+		insert = i
+	}
+	k.rcvBuf = append(k.rcvBuf, nil)
+	copy(k.rcvBuf[insert+1:], k.rcvBuf[insert:])
+	k.rcvBuf[insert] = newSeg
+	k.moveRcvBuf()
+}
+
+// input 处理收到的数据包,返回是否有效
+func (k *arq) input(data []byte) bool {
+	prevUna := k.sndUna
+	var maxack uint32
+	flag := false
+	if len(data) < overhead {
+		return false
+	}
+	for len(data) >= overhead {
+		conv := binary.LittleEndian.Uint32(data)
+		if conv != k.conv {
+			return false
+		}
+		seg := &segment{
+			cmd: data[4],
+			wnd: binary.LittleEndian.Uint16(data[6:]),
+			ts:  binary.LittleEndian.Uint32(data[8:]),
+			sn:  binary.LittleEndian.Uint32(data[12:]),
+			una: binary.LittleEndian.Uint32(data[16:]),
+		}
+		length := binary.LittleEndian.Uint32(data[20:])
+		data = data[overhead:]
+		if uint32(len(data)) < length {
+			return false
+		}
+		k.rmtWnd = uint32(seg.wnd)
+		k.parseUna(seg.una)
+		k.shrinkBuf()
+		switch seg.cmd {
+		case cmdAck:
+			if rtt := timeDiff(currentMs(), seg.ts); rtt >= 0 {
+				k.updateAck(rtt)
+			}
+			k.parseAck(seg.sn)
+			k.shrinkBuf()
+			if !flag || timeDiff(seg.sn, maxack) > 0 {
+				flag = true
+				maxack = seg.sn
+			}
+		case cmdPush:
+			if timeDiff(seg.sn, k.rcvNxt+k.rcvWnd) < 0 {
+				k.ackList = append(k.ackList, ackItem{sn: seg.sn, ts: seg.ts})
+				if timeDiff(seg.sn, k.rcvNxt) >= 0 {
+					seg.data = make([]byte, length)
+					copy(seg.data, data[:length])
+					k.parseData(seg)
+				}
+			}
+		case cmdWask:
+			k.probe |= askTell
+		case cmdWins:
+		case cmdFin:
+			k.finished = true
+		default:
+			return false
+		}
+		data = data[length:]
+	}
+	if flag {
+		k.parseFastack(maxack)
+	}
+	// 拥塞窗口增长
+	if timeDiff(k.sndUna, prevUna) > 0 && k.cwnd < k.rmtWnd {
+		if k.cwnd < k.ssthresh {
+			k.cwnd++
+			k.incr += k.mss
+		} else {
+			if k.incr < k.mss {
+				k.incr = k.mss
+			}
+			k.incr += (k.mss*k.mss)/k.incr + k.mss/16
+			if (k.cwnd+1)*k.mss <= k.incr {
+				k.cwnd++
+			}
+		}
+		if k.cwnd > k.rmtWnd {
+			k.cwnd = k.rmtWnd
+			k.incr = k.rmtWnd * k.mss
+		}
+	}
+	return true
+}
+
+// wndUnused 剩余接收窗口
+func (k *arq) wndUnused() uint16 {
+	if n := uint32(len(k.rcvQueue)); n < k.rcvWnd {
+		return uint16(k.rcvWnd - n)
+	}
+	return 0
+}
+
+// flush 发送确认,窗口探测和数据,ackOnly为true时只发送确认
+func (k *arq) flush(ackOnly bool) {
+	seg := &segment{
+		wnd: k.wndUnused(),
+		una: k.rcvNxt,
+	}
+	buf := k.buffer
+	ptr := buf
+	// 缓冲区不足时先发送
+	makeSpace := func(space int) {
+		if len(buf)-len(ptr)+space > int(k.mtu) {
+			k.output(buf[:len(buf)-len(ptr)])
+			ptr = buf
+		}
+	}
+	// 确认
+	seg.cmd = cmdAck
+	for _, ack := range k.ackList {
+		makeSpace(overhead)
+		seg.sn, seg.ts = ack.sn, ack.ts
+		ptr = seg.encode(k.conv, ptr)
+	}
+	k.ackList = k.ackList[:0]
+	if ackOnly {
+		if size := len(buf) - len(ptr); size > 0 {
+			k.output(buf[:size])
+		}
+		return
+	}
+	current := currentMs()
+	// 远端窗口为0时定时探测
+	if k.rmtWnd == 0 {
+		if k.probeWait == 0 {
+			k.probeWait = probeInit
+			k.tsProbe = current + k.probeWait
+		} else if timeDiff(current, k.tsProbe) >= 0 {
+			k.probeWait = minUint32(maxUint32(k.probeWait+k.probeWait/2, probeInit), probeLimit)
+			k.tsProbe = current + k.probeWait
+			k.probe |= askSend
+		}
+	} else {
+		k.tsProbe = 0
+		k.probeWait = 0
+	}
+	seg.sn, seg.ts = 0, 0
+	if k.probe&askSend != 0 {
+		seg.cmd = cmdWask
+		makeSpace(overhead)
+		ptr = seg.encode(k.conv, ptr)
+	}
+	if k.probe&askTell != 0 {
+		seg.cmd = cmdWins
+		makeSpace(overhead)
+		ptr = seg.encode(k.conv, ptr)
+	}
+	k.probe = 0
+	// 计算发送窗口,将发送队列移入发送缓冲
+	cwnd := minUint32(k.sndWnd, k.rmtWnd)
+	if !k.nocwnd {
+		cwnd = minUint32(k.cwnd, cwnd)
+	}
+	count := 0
+	for _, newSeg := range k.sndQueue {
+		if timeDiff(k.sndNxt, k.sndUna+cwnd) >= 0 {
+			break
+		}
+		newSeg.cmd = cmdPush
+		newSeg.sn = k.sndNxt
+		k.sndBuf = append(k.sndBuf, newSeg)
+		k.sndNxt++
+		count++
+	}
+	k.sndQueue = k.sndQueue[count:]
+	// 首次发送,超时重传,快速重传
+	change := false
+	lost := false
+	for _, segment := range k.sndBuf {
+		needSend := false
+		if segment.xmit == 0 {
+			needSend = true
+			segment.rto = k.rxRto
+			segment.resendts = current + segment.rto
+			if !k.nodelay {
+				segment.resendts += k.rxMinrto
+			}
+		} else if timeDiff(current, segment.resendts) >= 0 {
+			needSend = true
+			if k.nodelay {
+				segment.rto += k.rxRto / 2
+			} else {
+				segment.rto += k.rxRto
+			}
+			segment.resendts = current + segment.rto
+			lost = true
+		} else if k.fastresend > 0 && segment.fastack >= k.fastresend {
+			needSend = true
+			segment.fastack = 0
+			segment.resendts = current + segment.rto
+			change = true
+		}
+		if !needSend {
+			continue
+		}
+		segment.xmit++
+		segment.ts = current
+		segment.wnd = seg.wnd
+		segment.una = k.rcvNxt
+		makeSpace(overhead + len(segment.data))
+		ptr = segment.encode(k.conv, ptr)
+		copy(ptr, segment.data)
+		ptr = ptr[len(segment.data):]
+		if segment.xmit >= deadLink {
+			k.dead = true
+		}
+	}
+	if size := len(buf) - len(ptr); size > 0 {
+		k.output(buf[:size])
+	}
+	// 快速重传后进入快速恢复,超时重传后重新慢启动
+	if change {
+		inflight := k.sndNxt - k.sndUna
+		k.ssthresh = maxUint32(inflight/2, threshMin)
+		k.cwnd = k.ssthresh + k.fastresend
+		k.incr = k.cwnd * k.mss
+	}
+	if lost {
+		k.ssthresh = maxUint32(cwnd/2, threshMin)
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+	if k.cwnd < 1 {
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+}
+
+// fin 立即发送关闭分段
+func (k *arq) fin() {
+	seg := &segment{
+		cmd: cmdFin,
+		wnd: k.wndUnused(),
+		una: k.rcvNxt,
+	}
+	seg.encode(k.conv, k.buffer)
+	k.output(k.buffer[:overhead])
+}
+
+// timeDiff 计算序号或时间差,处理回绕
+func timeDiff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+// minUint32 取较小值
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// maxUint32 取较大值
+func maxUint32(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
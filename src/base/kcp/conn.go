@@ -0,0 +1,313 @@
+// -------------------------------------------
+// @file      : conn.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/17 上午11:40
+// -------------------------------------------
+
+package kcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClosed   = net.ErrClosed
+	ErrDeadLink = errors.New("kcp: dead link")
+	ErrTimeout  = errors.New("kcp: idle timeout")
+
+	ErrHandshakeTimeout = errors.New("kcp: handshake timeout")
+)
+
+// Conn 基于udp的可靠连接,实现net.Conn
+type Conn struct {
+	sync.Mutex
+	conv          uint32         // 会话编号
+	arq           *arq           // 自动重传请求状态机
+	options       *Options       // 参数
+	udp           net.PacketConn // udp连接,服务端会话与监听器共享
+	remote        net.Addr       // 远程地址
+	listener      *Listener      // 服务端会话所属监听器,客户端为nil
+	readEvent     chan struct{}  // 可读通知
+	writeEvent    chan struct{}  // 可写通知
+	die           chan struct{}  // 关闭信号
+	closeOnce     sync.Once      // 关闭一次
+	err           error          // 关闭原因
+	lastRecv      time.Time      // 最后收到数据包时间
+	lastSend      time.Time      // 最后发送数据包时间
+	readDeadline  time.Time      // 读超时
+	writeDeadline time.Time      // 写超时
+}
+
+// newConn 新建连接并启动刷新循环
+func newConn(conv uint32, options *Options, udp net.PacketConn, remote net.Addr, listener *Listener) *Conn {
+	conn := &Conn{
+		conv:       conv,
+		options:    options,
+		udp:        udp,
+		remote:     remote,
+		listener:   listener,
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+		die:        make(chan struct{}),
+		lastRecv:   time.Now(),
+		lastSend:   time.Now(),
+	}
+	conn.arq = newARQ(conv, options, conn.output)
+	go conn.updateLoop()
+	return conn
+}
+
+// Dial 连接远程地址,会话编号随机生成,完成握手后返回
+func Dial(addr string, options *Options) (*Conn, error) {
+	if options == nil {
+		options = DefaultOptions()
+	}
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	var buf [4]byte
+	if _, err = rand.Read(buf[:]); err != nil {
+		_ = udp.Close()
+		return nil, err
+	}
+	conv := binary.LittleEndian.Uint32(buf[:]) | 1
+	if err = handshake(udp, remote, conv, options); err != nil {
+		_ = udp.Close()
+		return nil, err
+	}
+	conn := newConn(conv, options, udp, remote, nil)
+	go conn.readLoop()
+	return conn, nil
+}
+
+// Conv 获取会话编号
+func (conn *Conn) Conv() uint32 {
+	return conn.conv
+}
+
+// output arq底层发送
+func (conn *Conn) output(buf []byte) {
+	conn.lastSend = time.Now()
+	_, _ = conn.udp.WriteTo(buf, conn.remote)
+}
+
+// notify 非阻塞通知
+func notify(event chan struct{}) {
+	select {
+	case event <- struct{}{}:
+	default:
+	}
+}
+
+// input 处理收到的数据包
+func (conn *Conn) input(data []byte) {
+	conn.Lock()
+	if !conn.arq.input(data) {
+		conn.Unlock()
+		return
+	}
+	conn.lastRecv = time.Now()
+	conn.arq.flush(true)
+	readable := conn.arq.peekSize() > 0 || conn.arq.finished
+	writable := conn.arq.waitSnd() < int(conn.arq.sndWnd)
+	conn.Unlock()
+	if readable {
+		notify(conn.readEvent)
+	}
+	if writable {
+		notify(conn.writeEvent)
+	}
+}
+
+// readLoop 客户端读取循环
+func (conn *Conn) readLoop() {
+	buf := make([]byte, conn.options.MTU)
+	for {
+		n, _, err := conn.udp.ReadFrom(buf)
+		if err != nil {
+			conn.close(err)
+			return
+		}
+		conn.input(buf[:n])
+	}
+}
+
+// updateLoop 定时刷新,检查断线和空闲超时
+func (conn *Conn) updateLoop() {
+	ticker := time.NewTicker(conn.options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			conn.Lock()
+			// 空闲时发送窗口告知作为保活
+			if time.Since(conn.lastSend) > conn.options.Timeout/3 {
+				conn.arq.probe |= askTell
+			}
+			conn.arq.flush(false)
+			dead := conn.arq.dead
+			idle := time.Since(conn.lastRecv) > conn.options.Timeout
+			writable := conn.arq.waitSnd() < int(conn.arq.sndWnd)
+			conn.Unlock()
+			if dead {
+				conn.close(ErrDeadLink)
+				return
+			}
+			if idle {
+				conn.close(ErrTimeout)
+				return
+			}
+			if writable {
+				notify(conn.writeEvent)
+			}
+		case <-conn.die:
+			return
+		}
+	}
+}
+
+// deadline 获取超时通道
+func deadline(t time.Time) (<-chan time.Time, *time.Timer) {
+	if t.IsZero() {
+		return nil, nil
+	}
+	timer := time.NewTimer(time.Until(t))
+	return timer.C, timer
+}
+
+// Read implements net.Conn
+func (conn *Conn) Read(b []byte) (int, error) {
+	for {
+		conn.Lock()
+		if n := conn.arq.recv(b); n > 0 {
+			conn.Unlock()
+			return n, nil
+		}
+		finished := conn.arq.finished
+		readDeadline := conn.readDeadline
+		conn.Unlock()
+		if finished {
+			return 0, io.EOF
+		}
+		select {
+		case <-conn.die:
+			return 0, conn.err
+		default:
+		}
+		timeout, timer := deadline(readDeadline)
+		select {
+		case <-conn.readEvent:
+		case <-conn.die:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Write implements net.Conn,发送窗口满时阻塞
+func (conn *Conn) Write(b []byte) (int, error) {
+	for {
+		select {
+		case <-conn.die:
+			return 0, conn.err
+		default:
+		}
+		conn.Lock()
+		if conn.arq.waitSnd() < int(conn.arq.sndWnd)*2 {
+			conn.arq.send(b)
+			conn.arq.flush(false)
+			conn.Unlock()
+			return len(b), nil
+		}
+		writeDeadline := conn.writeDeadline
+		conn.Unlock()
+		timeout, timer := deadline(writeDeadline)
+		select {
+		case <-conn.writeEvent:
+		case <-conn.die:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Close implements net.Conn,尽力发送剩余数据和关闭分段
+func (conn *Conn) Close() error {
+	conn.Lock()
+	select {
+	case <-conn.die:
+	default:
+		conn.arq.flush(false)
+		conn.arq.fin()
+	}
+	conn.Unlock()
+	conn.close(ErrClosed)
+	return nil
+}
+
+// close 关闭连接
+func (conn *Conn) close(err error) {
+	conn.closeOnce.Do(func() {
+		conn.err = err
+		close(conn.die)
+		if conn.listener != nil {
+			conn.listener.remove(conn)
+		} else {
+			_ = conn.udp.Close()
+		}
+	})
+}
+
+// LocalAddr implements net.Conn
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.udp.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+// SetDeadline implements net.Conn
+func (conn *Conn) SetDeadline(t time.Time) error {
+	conn.Lock()
+	defer conn.Unlock()
+	conn.readDeadline = t
+	conn.writeDeadline = t
+	return nil
+}
+
+// SetReadDeadline implements net.Conn
+func (conn *Conn) SetReadDeadline(t time.Time) error {
+	conn.Lock()
+	defer conn.Unlock()
+	conn.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn
+func (conn *Conn) SetWriteDeadline(t time.Time) error {
+	conn.Lock()
+	defer conn.Unlock()
+	conn.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,142 @@
+// -------------------------------------------
+// @file      : handshake.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/10 上午10:30
+// -------------------------------------------
+
+package kcp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// 握手命令,握手包都补齐到helloSize,应答不大于请求,不能被用来放大反射攻击
+const (
+	cmdHello  uint8 = 86 // 客户端请求建立会话,未携带有效cookie时服务端下发cookie
+	cmdCookie uint8 = 87 // 服务端下发cookie
+	cmdAccept uint8 = 88 // 服务端已建立会话
+)
+
+const (
+	cookieSize     = 16                     // cookie长度
+	helloSize      = overhead + cookieSize  // 握手包长度
+	cookieLifetime = 10                     // cookie有效期,单位秒
+	helloInterval  = 200 * time.Millisecond // 客户端重发握手的间隔
+)
+
+// handshakePacket 编码握手包,分段头的时间字段为cookie的签发时间
+func handshakePacket(conv uint32, cmd uint8, ts uint32, cookie []byte) []byte {
+	packet := make([]byte, helloSize)
+	seg := &segment{cmd: cmd, ts: ts, data: packet[overhead:]}
+	copy(seg.encode(conv, packet), cookie)
+	return packet
+}
+
+// handshake 客户端握手,先请求cookie,再携带cookie请求建立会话,收到接受应答后返回
+func handshake(udp net.PacketConn, remote net.Addr, conv uint32, options *Options) error {
+	defer func() {
+		_ = udp.SetReadDeadline(time.Time{})
+	}()
+	hello := handshakePacket(conv, cmdHello, 0, nil)
+	buf := make([]byte, options.MTU)
+	deadline := time.Now().Add(options.Timeout)
+	for time.Now().Before(deadline) {
+		if _, err := udp.WriteTo(hello, remote); err != nil {
+			return err
+		}
+		if err := udp.SetReadDeadline(time.Now().Add(helloInterval)); err != nil {
+			return err
+		}
+	wait:
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return err
+			}
+			if n < helloSize || addr.String() != remote.String() || binary.LittleEndian.Uint32(buf) != conv {
+				continue
+			}
+			switch buf[4] {
+			case cmdCookie:
+				// 携带cookie立即重发
+				hello = handshakePacket(conv, cmdHello, binary.LittleEndian.Uint32(buf[8:]), buf[overhead:helloSize])
+				break wait
+			case cmdAccept:
+				return nil
+			}
+		}
+	}
+	return ErrHandshakeTimeout
+}
+
+// cookie 以监听器密钥对远程地址、会话编号和签发时间做HMAC
+func (listener *Listener) cookie(addr net.Addr, conv, ts uint32) []byte {
+	mac := hmac.New(sha256.New, listener.secret)
+	mac.Write([]byte(addr.String()))
+	var buf [8]byte
+	binary.LittleEndian.PutUint32(buf[:], conv)
+	binary.LittleEndian.PutUint32(buf[4:], ts)
+	mac.Write(buf[:])
+	return mac.Sum(nil)[:cookieSize]
+}
+
+// verify 校验cookie,过期或签名不符时返回false
+func (listener *Listener) verify(addr net.Addr, conv, ts uint32, cookie []byte) bool {
+	now := uint32(time.Now().Unix())
+	if ts > now || now-ts > cookieLifetime {
+		return false
+	}
+	return hmac.Equal(cookie, listener.cookie(addr, conv, ts))
+}
+
+// hello 处理握手请求,cookie有效时建立会话并应答接受,否则下发cookie
+// 会话只在对端证明能收到该地址的数据包后创建,伪造源地址无法占用会话
+func (listener *Listener) hello(packet []byte, conv uint32, addr net.Addr) {
+	if len(packet) < helloSize {
+		return
+	}
+	ts := binary.LittleEndian.Uint32(packet[8:])
+	if !listener.verify(addr, conv, ts, packet[overhead:helloSize]) {
+		ts = uint32(time.Now().Unix())
+		listener.reply(addr, handshakePacket(conv, cmdCookie, ts, listener.cookie(addr, conv, ts)))
+		return
+	}
+	key := addr.String()
+	listener.Lock()
+	old, ok := listener.sessions[key]
+	if ok && old.conv == conv {
+		// 接受应答丢失,客户端重发了握手
+		listener.Unlock()
+		listener.reply(addr, handshakePacket(conv, cmdAccept, ts, nil))
+		return
+	}
+	// 等待Accept的会话已满时不分配会话,客户端稍后重试
+	if len(listener.accepting) >= cap(listener.accepting) {
+		listener.Unlock()
+		return
+	}
+	conn := newConn(conv, listener.options, listener.udp, addr, listener)
+	listener.sessions[key] = conn
+	listener.accepting <- conn
+	listener.Unlock()
+	// 同一地址换了会话编号,视为客户端重新连接,关闭原会话
+	if ok {
+		old.close(ErrClosed)
+	}
+	listener.reply(addr, handshakePacket(conv, cmdAccept, ts, nil))
+}
+
+// reply 发送握手应答
+func (listener *Listener) reply(addr net.Addr, packet []byte) {
+	_, _ = listener.udp.WriteTo(packet, addr)
+}
@@ -0,0 +1,173 @@
+package kcp
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// echo 启动回显服务
+func echo(listener *Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, _ = io.Copy(conn, conn)
+			_ = conn.Close()
+		}()
+	}
+}
+
+// lossyProxy 在客户端和服务端之间转发udp数据包,按比例丢包
+func lossyProxy(target string, loss float64) (string, func()) {
+	proxy, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	server, _ := net.ResolveUDPAddr("udp", target)
+	upstream, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	var client atomic.Value
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := proxy.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			client.Store(addr)
+			if rand.Float64() >= loss {
+				_, _ = upstream.WriteTo(buf[:n], server)
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, _, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			addr, ok := client.Load().(net.Addr)
+			if ok && rand.Float64() >= loss {
+				_, _ = proxy.WriteTo(buf[:n], addr)
+			}
+		}
+	}()
+	return proxy.LocalAddr().String(), func() {
+		_ = proxy.Close()
+		_ = upstream.Close()
+	}
+}
+
+func TestConn(t *testing.T) {
+	Convey("kcp回环连接", t, func() {
+		listener, err := Listen("127.0.0.1:0", nil)
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		go echo(listener)
+		data := make([]byte, 256*1024)
+		rand.Read(data)
+		Convey("收发数据", func() {
+			conn, err := Dial(listener.Addr().String(), nil)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			go func() {
+				_, _ = conn.Write(data)
+			}()
+			buf := make([]byte, len(data))
+			_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			_, err = io.ReadFull(conn, buf)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(buf, data), ShouldBeTrue)
+		})
+		Convey("丢包重传", func() {
+			addr, stop := lossyProxy(listener.Addr().String(), 0.1)
+			defer stop()
+			conn, err := Dial(addr, nil)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			go func() {
+				_, _ = conn.Write(data)
+			}()
+			buf := make([]byte, len(data))
+			_ = conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+			_, err = io.ReadFull(conn, buf)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(buf, data), ShouldBeTrue)
+		})
+	})
+	Convey("kcp关闭连接", t, func() {
+		listener, err := Listen("127.0.0.1:0", nil)
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		conn, err := Dial(listener.Addr().String(), nil)
+		So(err, ShouldBeNil)
+		_, err = conn.Write([]byte("hello"))
+		So(err, ShouldBeNil)
+		remote, err := listener.Accept()
+		So(err, ShouldBeNil)
+		So(remote.(*Conn).Conv(), ShouldEqual, conn.Conv())
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(remote, buf)
+		So(err, ShouldBeNil)
+		So(string(buf), ShouldEqual, "hello")
+		_ = conn.Close()
+		_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = remote.Read(buf)
+		So(err, ShouldEqual, io.EOF)
+	})
+	Convey("kcp握手", t, func() {
+		listener, err := Listen("127.0.0.1:0", nil)
+		So(err, ShouldBeNil)
+		defer listener.Close()
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		So(err, ShouldBeNil)
+		defer udp.Close()
+		sessions := func() int {
+			listener.Lock()
+			defer listener.Unlock()
+			return len(listener.sessions)
+		}
+		Convey("未握手的数据包不创建会话", func() {
+			packet := make([]byte, overhead+5)
+			seg := &segment{cmd: cmdPush, data: []byte("hello")}
+			copy(seg.encode(7, packet), seg.data)
+			_, err = udp.WriteTo(packet, listener.Addr())
+			So(err, ShouldBeNil)
+			// 无效的cookie只会收到新的cookie
+			_, err = udp.WriteTo(handshakePacket(7, cmdHello, uint32(time.Now().Unix()), []byte("0123456789abcdef")), listener.Addr())
+			So(err, ShouldBeNil)
+			buf := make([]byte, 1500)
+			_ = udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := udp.ReadFrom(buf)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, helloSize)
+			So(buf[4], ShouldEqual, cmdCookie)
+			So(sessions(), ShouldEqual, 0)
+			So(len(listener.accepting), ShouldEqual, 0)
+		})
+		Convey("同一地址换会话编号关闭原会话", func() {
+			So(handshake(udp, listener.Addr(), 7, DefaultOptions()), ShouldBeNil)
+			first, err := listener.Accept()
+			So(err, ShouldBeNil)
+			// 重发握手不重复创建会话
+			So(handshake(udp, listener.Addr(), 7, DefaultOptions()), ShouldBeNil)
+			So(sessions(), ShouldEqual, 1)
+			So(len(listener.accepting), ShouldEqual, 0)
+
+			So(handshake(udp, listener.Addr(), 9, DefaultOptions()), ShouldBeNil)
+			second, err := listener.Accept()
+			So(err, ShouldBeNil)
+			So(second.(*Conn).Conv(), ShouldEqual, 9)
+			_ = first.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = first.Read(make([]byte, 1))
+			So(err, ShouldEqual, ErrClosed)
+			So(sessions(), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,130 @@
+// -------------------------------------------
+// @file      : listener.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/17 下午2:10
+// -------------------------------------------
+
+package kcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+// Listener 服务端监听器,实现net.Listener
+// 所有会话共享一个udp连接,按远程地址和会话编号分发数据包
+// 新会话需要先完成cookie握手,未握手的数据包直接丢弃
+type Listener struct {
+	sync.Mutex
+	udp       net.PacketConn   // udp连接
+	secret    []byte           // 签发cookie的密钥,每次监听随机生成
+	options   *Options         // 会话参数
+	sessions  map[string]*Conn // 会话集合,远程地址索引
+	accepting chan *Conn       // 等待Accept的会话
+	die       chan struct{}    // 关闭信号
+	closeOnce sync.Once        // 关闭一次
+}
+
+// Listen 在指定地址监听
+func Listen(addr string, options *Options) (*Listener, error) {
+	if options == nil {
+		options = DefaultOptions()
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		_ = udp.Close()
+		return nil, err
+	}
+	listener := &Listener{
+		udp:       udp,
+		secret:    secret,
+		options:   options,
+		sessions:  make(map[string]*Conn),
+		accepting: make(chan *Conn, options.Backlog),
+		die:       make(chan struct{}),
+	}
+	go listener.readLoop()
+	return listener, nil
+}
+
+// readLoop 读取循环,握手请求交给hello处理,其他数据包按远程地址分发给已建立的会话
+func (listener *Listener) readLoop() {
+	buf := make([]byte, listener.options.MTU)
+	for {
+		n, addr, err := listener.udp.ReadFrom(buf)
+		if err != nil {
+			_ = listener.Close()
+			return
+		}
+		if n < overhead {
+			continue
+		}
+		conv := binary.LittleEndian.Uint32(buf)
+		if buf[4] == cmdHello {
+			listener.hello(buf[:n], conv, addr)
+			continue
+		}
+		listener.Lock()
+		conn, ok := listener.sessions[addr.String()]
+		listener.Unlock()
+		// 未握手的地址或会话编号
+		if !ok || conn.conv != conv {
+			continue
+		}
+		conn.input(buf[:n])
+	}
+}
+
+// remove 会话关闭后从监听器删除
+func (listener *Listener) remove(conn *Conn) {
+	listener.Lock()
+	defer listener.Unlock()
+	key := conn.remote.String()
+	if listener.sessions[key] == conn {
+		delete(listener.sessions, key)
+	}
+}
+
+// Accept implements net.Listener
+func (listener *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.accepting:
+		return conn, nil
+	case <-listener.die:
+		return nil, ErrClosed
+	}
+}
+
+// Close implements net.Listener,关闭监听器同时关闭所有会话
+func (listener *Listener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.die)
+		_ = listener.udp.Close()
+		listener.Lock()
+		sessions := make([]*Conn, 0, len(listener.sessions))
+		for _, conn := range listener.sessions {
+			sessions = append(sessions, conn)
+		}
+		listener.Unlock()
+		for _, conn := range sessions {
+			conn.close(ErrClosed)
+		}
+	})
+	return nil
+}
+
+// Addr implements net.Listener
+func (listener *Listener) Addr() net.Addr {
+	return listener.udp.LocalAddr()
+}
@@ -0,0 +1,38 @@
+// -------------------------------------------
+// @file      : options.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/17 上午11:02
+// -------------------------------------------
+
+package kcp
+
+import "time"
+
+// Options 会话参数
+type Options struct {
+	NoDelay      bool          // nodelay模式,最小rto更小,超时重传时rto增长更慢
+	Interval     time.Duration // 内部刷新间隔
+	FastResend   int           // 快速重传阈值,分段被跳过确认该次数后立即重传,0关闭
+	NoCongestion bool          // 关闭拥塞控制
+	SndWnd       int           // 发送窗口,单位分段
+	RcvWnd       int           // 接收窗口,单位分段
+	MTU          int           // 最大传输单元
+	Timeout      time.Duration // 超过该时间未收到对端任何数据包视为断开
+	Backlog      int           // 监听器等待Accept的会话数量
+}
+
+// DefaultOptions 默认参数,低延迟模式
+func DefaultOptions() *Options {
+	return &Options{
+		NoDelay:      true,
+		Interval:     10 * time.Millisecond,
+		FastResend:   2,
+		NoCongestion: true,
+		SndWnd:       128,
+		RcvWnd:       128,
+		MTU:          1400,
+		Timeout:      30 * time.Second,
+		Backlog:      128,
+	}
+}
@@ -0,0 +1,131 @@
+// -------------------------------------------
+// @file      : histogram.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/26 上午11:20
+// -------------------------------------------
+
+package metrics
+
+import (
+	"gogs/base/cberrors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets 默认的直方图桶上限,单位秒,覆盖1毫秒到10秒的调用耗时
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram 直方图
+type Histogram struct {
+	desc    Desc      // 指标描述,标签向量中的子直方图为空
+	buckets []float64 // 桶上限,升序
+	counts  []uint64  // 各桶的计数,不累加,最后一个为超过所有上限的计数
+	sum     uint64    // 所有观测值之和
+}
+
+// checkBuckets 检查桶上限是否升序,为空时使用默认值
+func checkBuckets(name string, buckets []float64) []float64 {
+	if len(buckets) == 0 {
+		return DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		cberrors.Panic("histogram %s buckets not sorted: %v", name, buckets)
+	}
+	return buckets
+}
+
+// newHistogram 新建直方图
+func newHistogram(desc Desc, buckets []float64) *Histogram {
+	return &Histogram{
+		desc:    desc,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+// NewHistogram 新建没有标签的直方图,buckets为空时使用DefaultBuckets
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return newHistogram(newDesc(name, help, TypeHistogram, nil), checkBuckets(name, buckets))
+}
+
+// Observe 记录一个观测值
+func (histogram *Histogram) Observe(v float64) {
+	atomic.AddUint64(&histogram.counts[sort.SearchFloat64s(histogram.buckets, v)], 1)
+	addFloat(&histogram.sum, v)
+}
+
+// ObserveDuration 以秒为单位记录一个耗时
+func (histogram *Histogram) ObserveDuration(d time.Duration) {
+	histogram.Observe(d.Seconds())
+}
+
+// collect 输出累加后的各桶计数、总和与总数
+func (histogram *Histogram) collect(name string, labels, values []string, emit func(*Sample)) {
+	bucketLabels := append(append(make([]string, 0, len(labels)+1), labels...), "le")
+	var count uint64
+	for i := range histogram.counts {
+		count += atomic.LoadUint64(&histogram.counts[i])
+		le := "+Inf"
+		if i < len(histogram.buckets) {
+			le = formatFloat(histogram.buckets[i])
+		}
+		emit(&Sample{
+			Name:   name + "_bucket",
+			Labels: bucketLabels,
+			Values: append(append(make([]string, 0, len(values)+1), values...), le),
+			Value:  float64(count),
+		})
+	}
+	emit(&Sample{Name: name + "_sum", Labels: labels, Values: values, Value: loadFloat(&histogram.sum)})
+	emit(&Sample{Name: name + "_count", Labels: labels, Values: values, Value: float64(count)})
+}
+
+// Describe implements ICollector
+func (histogram *Histogram) Describe() Desc {
+	return histogram.desc
+}
+
+// Collect implements ICollector
+func (histogram *Histogram) Collect(emit func(*Sample)) {
+	histogram.collect(histogram.desc.Name, nil, nil, emit)
+}
+
+// HistogramVec 按标签区分的直方图
+type HistogramVec struct {
+	*children
+	buckets []float64 // 桶上限
+}
+
+// NewHistogramVec 新建按标签区分的直方图,buckets为空时使用DefaultBuckets
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		children: newChildren(newDesc(name, help, TypeHistogram, labels)),
+		buckets:  checkBuckets(name, buckets),
+	}
+}
+
+// With 获取标签值对应的直方图,不存在时创建
+func (vec *HistogramVec) With(values ...string) *Histogram {
+	return vec.get(values, func() interface{} {
+		return newHistogram(Desc{}, vec.buckets)
+	}).(*Histogram)
+}
+
+// Delete 删除标签值对应的直方图
+func (vec *HistogramVec) Delete(values ...string) {
+	vec.delete(values)
+}
+
+// Describe implements ICollector
+func (vec *HistogramVec) Describe() Desc {
+	return vec.desc
+}
+
+// Collect implements ICollector
+func (vec *HistogramVec) Collect(emit func(*Sample)) {
+	vec.each(func(values []string, metric interface{}) {
+		metric.(*Histogram).collect(vec.desc.Name, vec.desc.Labels, values, emit)
+	})
+}
@@ -0,0 +1,241 @@
+// -------------------------------------------
+// @file      : metrics.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/26 上午10:05
+// -------------------------------------------
+
+// Package metrics 进程内指标,以Prometheus文本格式通过http的/metrics输出,不依赖外部服务
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"gogs/base/cberrors"
+	log "gogs/base/logger"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 指标类型
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// ContentType 文本格式的内容类型
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var namePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Desc 指标描述
+type Desc struct {
+	Name   string   // 指标名字
+	Help   string   // 说明
+	Type   string   // 指标类型
+	Labels []string // 标签名字
+}
+
+// newDesc 新建指标描述,名字或标签不合法时panic
+func newDesc(name, help, typ string, labels []string) Desc {
+	if !namePattern.MatchString(name) {
+		cberrors.Panic("invalid metric name: %q", name)
+	}
+	for _, label := range labels {
+		if !namePattern.MatchString(label) || strings.HasPrefix(label, "__") || label == "le" {
+			cberrors.Panic("invalid label name: %q of metric: %s", label, name)
+		}
+	}
+	return Desc{
+		Name:   name,
+		Help:   help,
+		Type:   typ,
+		Labels: labels,
+	}
+}
+
+// Sample 一个样本
+type Sample struct {
+	Name   string   // 样本名字,直方图为指标名字加_bucket、_sum、_count后缀
+	Labels []string // 标签名字
+	Values []string // 标签值,与标签名字一一对应
+	Value  float64  // 值
+}
+
+// ICollector 指标收集器,抓取时输出其所有样本
+type ICollector interface {
+	Describe() Desc             // 指标描述
+	Collect(emit func(*Sample)) // 输出样本
+}
+
+// Registry 指标注册表
+type Registry struct {
+	sync.RWMutex
+	collectors map[string]ICollector // 收集器集合,指标名字索引
+}
+
+// NewRegistry 新建指标注册表
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[string]ICollector),
+	}
+}
+
+// Register 注册收集器,指标名字重复时返回错误
+func (registry *Registry) Register(collector ICollector) error {
+	registry.Lock()
+	defer registry.Unlock()
+	name := collector.Describe().Name
+	if _, ok := registry.collectors[name]; ok {
+		return cberrors.New("duplicate metric: %s", name)
+	}
+	registry.collectors[name] = collector
+	return nil
+}
+
+// MustRegister 注册收集器,失败时panic
+func (registry *Registry) MustRegister(collectors ...ICollector) {
+	for _, collector := range collectors {
+		if err := registry.Register(collector); err != nil {
+			cberrors.Panic(err.Error())
+		}
+	}
+}
+
+// Unregister 删除指定名字的收集器
+func (registry *Registry) Unregister(name string) {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.collectors, name)
+}
+
+// WriteText 按名字顺序以文本格式写出所有指标
+func (registry *Registry) WriteText(w io.Writer) error {
+	registry.RLock()
+	collectors := make([]ICollector, 0, len(registry.collectors))
+	for _, collector := range registry.collectors {
+		collectors = append(collectors, collector)
+	}
+	registry.RUnlock()
+	sort.Slice(collectors, func(i, j int) bool {
+		return collectors[i].Describe().Name < collectors[j].Describe().Name
+	})
+	writer := bufio.NewWriter(w)
+	for _, collector := range collectors {
+		desc := collector.Describe()
+		writer.WriteString("# HELP ")
+		writer.WriteString(desc.Name)
+		writer.WriteByte(' ')
+		writer.WriteString(escapeHelp(desc.Help))
+		writer.WriteString("\n# TYPE ")
+		writer.WriteString(desc.Name)
+		writer.WriteByte(' ')
+		writer.WriteString(desc.Type)
+		writer.WriteByte('\n')
+		collector.Collect(func(sample *Sample) {
+			writeSample(writer, sample)
+		})
+	}
+	return writer.Flush()
+}
+
+// ServeHTTP implements http.Handler
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	if err := registry.WriteText(w); err != nil {
+		log.Warnf("write metrics to %s err: %s", r.RemoteAddr, err)
+	}
+}
+
+// writeSample 写出一个样本 name{label="value",...} value
+func writeSample(writer *bufio.Writer, sample *Sample) {
+	writer.WriteString(sample.Name)
+	if len(sample.Labels) > 0 {
+		writer.WriteByte('{')
+		for i, label := range sample.Labels {
+			if i > 0 {
+				writer.WriteByte(',')
+			}
+			writer.WriteString(label)
+			writer.WriteString(`="`)
+			writer.WriteString(escapeValue(sample.Values[i]))
+			writer.WriteByte('"')
+		}
+		writer.WriteByte('}')
+	}
+	writer.WriteByte(' ')
+	writer.WriteString(formatFloat(sample.Value))
+	writer.WriteByte('\n')
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	valueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// escapeHelp 转义说明中的反斜杠和换行
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// escapeValue 转义标签值中的反斜杠、换行和双引号
+func escapeValue(s string) string {
+	return valueEscaper.Replace(s)
+}
+
+// formatFloat 格式化样本值
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Default 默认注册表,各模块的指标注册到这里
+var Default = NewRegistry()
+
+// Register 注册收集器到默认注册表
+func Register(collector ICollector) error {
+	return Default.Register(collector)
+}
+
+// MustRegister 注册收集器到默认注册表,失败时panic
+func MustRegister(collectors ...ICollector) {
+	Default.MustRegister(collectors...)
+}
+
+// Handler 输出默认注册表的http处理器
+func Handler() http.Handler {
+	return Default
+}
+
+// Serve 监听addr并在/metrics输出默认注册表的指标,监听失败时返回错误,返回的服务器用于关闭
+func Serve(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default)
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("metrics server: %s err: %s", addr, err)
+		}
+	}()
+	log.Infof("metrics server listen on: %s", listener.Addr())
+	return server, nil
+}
@@ -0,0 +1,95 @@
+// -------------------------------------------
+// @file      : metrics_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/26 下午2:30
+// -------------------------------------------
+
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	registry := NewRegistry()
+	counter := NewCounterVec("test_bytes_total", "bytes\nsent", "driver")
+	gauge := NewGauge("test_pending", "pending calls")
+	histogram := NewHistogramVec("test_duration_seconds", "call duration", []float64{0.1, 1}, "method")
+	sessions := NewGaugeVecFunc("test_sessions", "sessions", []string{"driver"}, func(set func(float64, ...string)) {
+		set(2, "gate")
+		set(1, `a"b`)
+	})
+	registry.MustRegister(counter, gauge, histogram, sessions)
+	counter.With("host").Add(10)
+	counter.With("host").Inc()
+	counter.With("gate").Inc()
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+	histogram.With("Game#Login").Observe(0.05)
+	histogram.With("Game#Login").Observe(0.5)
+	histogram.With("Game#Login").Observe(3)
+	var buf bytes.Buffer
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expect := `# HELP test_bytes_total bytes\nsent
+# TYPE test_bytes_total counter
+test_bytes_total{driver="gate"} 1
+test_bytes_total{driver="host"} 11
+# HELP test_duration_seconds call duration
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{method="Game#Login",le="0.1"} 1
+test_duration_seconds_bucket{method="Game#Login",le="1"} 2
+test_duration_seconds_bucket{method="Game#Login",le="+Inf"} 3
+test_duration_seconds_sum{method="Game#Login"} 3.55
+test_duration_seconds_count{method="Game#Login"} 3
+# HELP test_pending pending calls
+# TYPE test_pending gauge
+test_pending 1
+# HELP test_sessions sessions
+# TYPE test_sessions gauge
+test_sessions{driver="gate"} 2
+test_sessions{driver="a\"b"} 1
+`
+	if buf.String() != expect {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	registry := NewRegistry()
+	if err := registry.Register(NewCounter("test_total", "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register(NewGauge("test_total", "")); err == nil {
+		t.Fatal("duplicate metric registered")
+	}
+}
+
+func TestLabelMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("label mismatch not panic")
+		}
+	}()
+	NewCounterVec("test_total", "", "driver").With("host", "extra")
+}
+
+func TestServeHTTP(t *testing.T) {
+	registry := NewRegistry()
+	registry.MustRegister(NewGaugeFunc("test_value", "value", func() float64 { return 42 }))
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Header().Get("Content-Type") != ContentType {
+		t.Fatalf("unexpected content type: %s", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "test_value 42\n") {
+		t.Fatalf("unexpected body:\n%s", w.Body.String())
+	}
+}
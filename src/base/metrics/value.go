@@ -0,0 +1,319 @@
+// -------------------------------------------
+// @file      : value.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/26 上午10:40
+// -------------------------------------------
+
+package metrics
+
+import (
+	"gogs/base/cberrors"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// addFloat 原子地为以位存储的浮点数加上v
+func addFloat(bits *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		if atomic.CompareAndSwapUint64(bits, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// loadFloat 原子地读取以位存储的浮点数
+func loadFloat(bits *uint64) float64 {
+	return math.Float64frombits(atomic.LoadUint64(bits))
+}
+
+// Counter 只增不减的计数器
+type Counter struct {
+	desc Desc   // 指标描述,标签向量中的子计数器为空
+	bits uint64 // 当前值
+}
+
+// NewCounter 新建没有标签的计数器
+func NewCounter(name, help string) *Counter {
+	return &Counter{desc: newDesc(name, help, TypeCounter, nil)}
+}
+
+// Inc 加1
+func (counter *Counter) Inc() {
+	addFloat(&counter.bits, 1)
+}
+
+// Add 加上v,v不能为负数
+func (counter *Counter) Add(v float64) {
+	if v < 0 {
+		cberrors.Panic("counter %s can not decrease: %f", counter.desc.Name, v)
+	}
+	addFloat(&counter.bits, v)
+}
+
+// Value 当前值
+func (counter *Counter) Value() float64 {
+	return loadFloat(&counter.bits)
+}
+
+// Describe implements ICollector
+func (counter *Counter) Describe() Desc {
+	return counter.desc
+}
+
+// Collect implements ICollector
+func (counter *Counter) Collect(emit func(*Sample)) {
+	emit(&Sample{Name: counter.desc.Name, Value: counter.Value()})
+}
+
+// Gauge 可增可减的仪表
+type Gauge struct {
+	desc Desc   // 指标描述,标签向量中的子仪表为空
+	bits uint64 // 当前值
+}
+
+// NewGauge 新建没有标签的仪表
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{desc: newDesc(name, help, TypeGauge, nil)}
+}
+
+// Set 设置为v
+func (gauge *Gauge) Set(v float64) {
+	atomic.StoreUint64(&gauge.bits, math.Float64bits(v))
+}
+
+// Add 加上v
+func (gauge *Gauge) Add(v float64) {
+	addFloat(&gauge.bits, v)
+}
+
+// Inc 加1
+func (gauge *Gauge) Inc() {
+	addFloat(&gauge.bits, 1)
+}
+
+// Dec 减1
+func (gauge *Gauge) Dec() {
+	addFloat(&gauge.bits, -1)
+}
+
+// Value 当前值
+func (gauge *Gauge) Value() float64 {
+	return loadFloat(&gauge.bits)
+}
+
+// Describe implements ICollector
+func (gauge *Gauge) Describe() Desc {
+	return gauge.desc
+}
+
+// Collect implements ICollector
+func (gauge *Gauge) Collect(emit func(*Sample)) {
+	emit(&Sample{Name: gauge.desc.Name, Value: gauge.Value()})
+}
+
+// child 标签向量中的一个子指标
+type child struct {
+	values []string    // 标签值
+	metric interface{} // 子指标
+}
+
+// children 标签向量的子指标集合
+type children struct {
+	sync.RWMutex
+	desc  Desc              // 指标描述
+	items map[string]*child // 子指标,标签值拼接后索引
+}
+
+// newChildren 新建子指标集合
+func newChildren(desc Desc) *children {
+	return &children{
+		desc:  desc,
+		items: make(map[string]*child),
+	}
+}
+
+// get 获取标签值对应的子指标,不存在时创建,标签值数量不匹配时panic
+func (c *children) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(c.desc.Labels) {
+		cberrors.Panic("metric %s expects %d label values, got: %d", c.desc.Name, len(c.desc.Labels), len(values))
+	}
+	key := strings.Join(values, "\xff")
+	c.RLock()
+	item, ok := c.items[key]
+	c.RUnlock()
+	if ok {
+		return item.metric
+	}
+	c.Lock()
+	defer c.Unlock()
+	if item, ok = c.items[key]; !ok {
+		item = &child{
+			values: append([]string(nil), values...),
+			metric: create(),
+		}
+		c.items[key] = item
+	}
+	return item.metric
+}
+
+// delete 删除标签值对应的子指标
+func (c *children) delete(values []string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.items, strings.Join(values, "\xff"))
+}
+
+// each 按标签值顺序遍历子指标
+func (c *children) each(f func(values []string, metric interface{})) {
+	c.RLock()
+	keys := make([]string, 0, len(c.items))
+	for key := range c.items {
+		keys = append(keys, key)
+	}
+	items := make([]*child, 0, len(keys))
+	sort.Strings(keys)
+	for _, key := range keys {
+		items = append(items, c.items[key])
+	}
+	c.RUnlock()
+	for _, item := range items {
+		f(item.values, item.metric)
+	}
+}
+
+// CounterVec 按标签区分的计数器
+type CounterVec struct {
+	*children
+}
+
+// NewCounterVec 新建按标签区分的计数器
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{children: newChildren(newDesc(name, help, TypeCounter, labels))}
+}
+
+// With 获取标签值对应的计数器,不存在时创建
+func (vec *CounterVec) With(values ...string) *Counter {
+	return vec.get(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+// Delete 删除标签值对应的计数器
+func (vec *CounterVec) Delete(values ...string) {
+	vec.delete(values)
+}
+
+// Describe implements ICollector
+func (vec *CounterVec) Describe() Desc {
+	return vec.desc
+}
+
+// Collect implements ICollector
+func (vec *CounterVec) Collect(emit func(*Sample)) {
+	vec.each(func(values []string, metric interface{}) {
+		emit(&Sample{
+			Name:   vec.desc.Name,
+			Labels: vec.desc.Labels,
+			Values: values,
+			Value:  metric.(*Counter).Value(),
+		})
+	})
+}
+
+// GaugeVec 按标签区分的仪表
+type GaugeVec struct {
+	*children
+}
+
+// NewGaugeVec 新建按标签区分的仪表
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{children: newChildren(newDesc(name, help, TypeGauge, labels))}
+}
+
+// With 获取标签值对应的仪表,不存在时创建
+func (vec *GaugeVec) With(values ...string) *Gauge {
+	return vec.get(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+// Delete 删除标签值对应的仪表
+func (vec *GaugeVec) Delete(values ...string) {
+	vec.delete(values)
+}
+
+// Describe implements ICollector
+func (vec *GaugeVec) Describe() Desc {
+	return vec.desc
+}
+
+// Collect implements ICollector
+func (vec *GaugeVec) Collect(emit func(*Sample)) {
+	vec.each(func(values []string, metric interface{}) {
+		emit(&Sample{
+			Name:   vec.desc.Name,
+			Labels: vec.desc.Labels,
+			Values: values,
+			Value:  metric.(*Gauge).Value(),
+		})
+	})
+}
+
+// GaugeFunc 抓取时调用函数取值的仪表
+type GaugeFunc struct {
+	desc Desc           // 指标描述
+	f    func() float64 // 取值函数
+}
+
+// NewGaugeFunc 新建抓取时调用f取值的仪表
+func NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	return &GaugeFunc{
+		desc: newDesc(name, help, TypeGauge, nil),
+		f:    f,
+	}
+}
+
+// Describe implements ICollector
+func (gauge *GaugeFunc) Describe() Desc {
+	return gauge.desc
+}
+
+// Collect implements ICollector
+func (gauge *GaugeFunc) Collect(emit func(*Sample)) {
+	emit(&Sample{Name: gauge.desc.Name, Value: gauge.f()})
+}
+
+// GaugeVecFunc 抓取时调用函数输出各标签值的仪表,适合统计已有的集合
+type GaugeVecFunc struct {
+	desc    Desc                                            // 指标描述
+	collect func(set func(value float64, values ...string)) // 输出函数,每组标签值调用一次set
+}
+
+// NewGaugeVecFunc 新建抓取时调用collect输出各标签值的仪表,collect不调用set时不输出样本
+func NewGaugeVecFunc(name, help string, labels []string, collect func(set func(value float64, values ...string))) *GaugeVecFunc {
+	return &GaugeVecFunc{
+		desc:    newDesc(name, help, TypeGauge, labels),
+		collect: collect,
+	}
+}
+
+// Describe implements ICollector
+func (gauge *GaugeVecFunc) Describe() Desc {
+	return gauge.desc
+}
+
+// Collect implements ICollector
+func (gauge *GaugeVecFunc) Collect(emit func(*Sample)) {
+	gauge.collect(func(value float64, values ...string) {
+		if len(values) != len(gauge.desc.Labels) {
+			cberrors.Panic("metric %s expects %d label values, got: %d", gauge.desc.Name, len(gauge.desc.Labels), len(values))
+		}
+		emit(&Sample{
+			Name:   gauge.desc.Name,
+			Labels: gauge.desc.Labels,
+			Values: values,
+			Value:  value,
+		})
+	})
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"go.uber.org/zap"
 	log "gogs/base/logger"
+	"gogs/base/metrics"
 	"runtime/debug"
+	"sync"
 )
 
 const (
@@ -12,6 +14,22 @@ const (
 	DefaultAsyncRetChanLength = 1024 // Ret
 )
 
+var (
+	asyncClients sync.Map // 已开始异步工作的客户端,抓取指标时遍历
+	asyncQueue   = metrics.NewGaugeVecFunc("gogs_mongo_async_queue_length",
+		"Requests waiting in mongo async queues.", []string{"db"}, func(set func(float64, ...string)) {
+			asyncClients.Range(func(key, _ interface{}) bool {
+				mc := key.(*MongoClient)
+				set(float64(len(mc.reqChan)), mc.dbName)
+				return true
+			})
+		})
+)
+
+func init() {
+	metrics.MustRegister(asyncQueue)
+}
+
 type Event int32
 
 const (
@@ -31,10 +49,12 @@ func (mc *MongoClient) AsyncStartWork() {
 	mc.closeChan = make(chan struct{}, 1)
 	mc.async = true
 	mc.AsyncRetChan = make(chan *AsyncRet, DefaultAsyncRetChanLength)
+	asyncClients.Store(mc, struct{}{})
 	go mc.loop()
 }
 
 func (mc *MongoClient) AsyncEndWork() {
+	asyncClients.Delete(mc)
 	close(mc.reqChan)
 	<-mc.closeChan
 	close(mc.closeChan)
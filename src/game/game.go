@@ -8,112 +8,123 @@
 package game
 
 import (
+	"context"
 	"fmt"
-	"go.uber.org/zap"
+	"gogs/base/app"
 	"gogs/base/cberrors"
 	"gogs/base/cluster"
-	"gogs/base/cluster/network"
 	"gogs/base/config"
 	"gogs/base/etcd"
 	log "gogs/base/logger"
+	"gogs/cb"
 	"gogs/game/model"
-	"runtime"
+	"net/http"
+	"time"
 )
 
 var server *cluster.Game
 
+// admin 调试服务器,未配置地址或监听失败时为nil
+var admin *http.Server
+
 func Main() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	// 日志配置
-	logConfig := config.GetLogConfig()
-	// 游戏服配置
-	gameConfig := config.GetGameConfig()
-	if logConfig == nil {
-		cberrors.Panic("unable to find log config")
-	}
-	if gameConfig == nil {
-		cberrors.Panic("unable to find game config")
-	}
-	// 初始化日志
-	log.Init(
-		log.SetFilename(gameConfig.LogPath),
-		log.SetIsOpenFile(logConfig.IsOpenFile),
-		log.SetIsOpenErrorFile(logConfig.IsOpenErrorFile),
-		log.SetIsOpenConsole(logConfig.IsOpenConsole),
-		log.SetIsAsync(logConfig.IsAsync),
-		log.SetMaxFileSize(int(logConfig.Maxsize)),
-		log.SetStacktrace(zap.PanicLevel),
-	)
-	etcdConfig := config.GetEtcdConfig()
-	if etcdConfig == nil {
-		cberrors.Panic("unable to find etcd config")
-	}
-	if err := etcd.Init(etcdConfig, nil); err != nil {
-		cberrors.Panic("etcd init err:%s", err)
+	gameApp := app.New(etcd.ServerTypeGame).
+		Config("game.yml", config.KeyEtcd, config.KeyLog, config.KeyRPC, config.KeyGame).
+		Log(func() string { return config.GetGameConfig().LogPath }).
+		Builder("client", cb.NewUserBuilder(func(service cluster.IService) (cb.IUser, error) {
+			return NewUser(service.Context().(*cluster.ClientAgent))
+		})).
+		Etcd().
+		Mongo(func() error {
+			model.InitMongoDB(config.ServerID)
+			return nil
+		}, model.CloseMongoDB).
+		Metrics(func() string { return config.GetGameConfig().MetricsAddr })
+	gameApp.Phase(app.Phase{
+		Name: "game",
+		Start: func(ctx context.Context) error {
+			return startGame(gameApp.Builders())
+		},
+		Stop: func(ctx context.Context) error {
+			if admin != nil {
+				_ = admin.Shutdown(ctx)
+			}
+			server.Shutdown()
+			return nil
+		},
+	}).
+		// 由集群成员管理连接网关
+		Cluster(func() *cluster.Membership {
+			return cluster.NewMembership(server.Host, config.ServerType, config.ServerID, cluster.DefaultMembershipRules)
+		})
+	var stopReport func()
+	gameApp.Phase(app.Phase{
+		Name: "report",
+		Start: func(ctx context.Context) error {
+			stopReport = ReportOnline(time.Duration(config.GetGameConfig().ReportInterval) * time.Second)
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			// 先通知网关不再路由新的登录
+			stopReport()
+			etcd.UpdateNodeWithExtra(etcd.NodeInfo{
+				etcd.NodeInfoKeyCurOnline: server.Online(),
+				etcd.NodeInfoKeyDraining:  true,
+			})
+			return nil
+		},
+	})
+	if err := gameApp.Run(); err != nil {
+		cberrors.Panic("game run err:%s", err)
 	}
-	defer func() {
-		// 等待异步日志写入完成
-		_ = log.Close()
-	}()
-	model.InitMongoDB(config.ServerID)
-	RegisterBuilders()
+}
+
+// startGame 新建游戏服并启动调试服务器
+func startGame(builders map[string]cluster.IServiceBuilder) error {
+	gameConfig := config.GetGameConfig()
 	var err error
 	name := fmt.Sprintf("%s:%d", config.ServerType, config.ServerID)
 	server, err = cluster.NewGame(
 		name,
 		builders,
-		"localhost:9102",
+		gameConfig.FullAddr(),
+		nil,
 	)
 	if err != nil {
-		cberrors.Panic("new game err:%s", err)
+		return err
 	}
-	etcd.SetServiceCallback(EtcdNodeEventListener)
-	CheckGateConn()
-	// 处理系统信号
-	ProcessSignal()
-	<-exitChan
-	server.Shutdown()
-	model.CloseMongoDB()
-}
-
-// CheckGateConn 检查网关连接
-func CheckGateConn() {
-	nodes, err := etcd.GetDepListByType(etcd.ServerTypeGate)
-	if err != nil {
-		log.Errorf("get etcd gate list err:%s", err)
-		return
-	}
-	for _, node := range nodes {
-		if _, ok := server.Host.Node.GetSession(network.DriverTypeHost, node.GetConnectURL()); !ok {
-			_, err := server.Host.Connect(node.GetConnectURL())
-			if err != nil {
-				log.Errorf("connect to gate err:%s", err)
-			}
+	if gameConfig.AdminAddr != "" {
+		if admin, err = server.NewAdmin().Serve(gameConfig.AdminAddr); err != nil {
+			log.Errorf("admin serve err:%s", err)
 		}
 	}
+	return nil
 }
 
-// EtcdNodeEventListener 注册到etcd组件的节点状态变更事件处理器
-func EtcdNodeEventListener(nodeEvent *etcd.NodeEvent) {
-	switch nodeEvent.Event {
-	case etcd.EventAdd:
-		if nodeEvent.Node.GetType() == etcd.ServerTypeGate {
-			if _, ok := server.Host.Node.GetSession(network.DriverTypeHost, nodeEvent.Node.GetConnectURL()); !ok {
-				_, err := server.Host.Connect(nodeEvent.Node.GetConnectURL())
-				if err != nil {
-					log.Errorf("connect to gate err:%s", err)
-				}
-			}
-		}
-	case etcd.EventDelete:
-		if nodeEvent.Node.GetType() == etcd.ServerTypeGate {
-			session, ok := server.Host.Node.GetSession(network.DriverTypeHost, nodeEvent.Node.GetConnectURL())
-			if ok {
-				session.Close()
+// ReportOnline 定时向etcd上报在线人数,网关按在线人数加权路由时使用,返回的函数停止上报并等待上报协程退出
+func ReportOnline(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	stopChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				etcd.UpdateNodeWithExtra(etcd.NodeInfo{
+					etcd.NodeInfoKeyCurOnline: server.Online(),
+				})
+			case <-stopChan:
+				return
 			}
 		}
-	default:
-		log.Errorf("unknown etcd event:%+v", nodeEvent)
+	}()
+	return func() {
+		close(stopChan)
+		<-done
 	}
-
 }
@@ -8,7 +8,9 @@
 package gate
 
 import (
+	"context"
 	"fmt"
+	"gogs/base/app"
 	"gogs/base/cberrors"
 	"gogs/base/cluster"
 	"gogs/base/cluster/network"
@@ -16,71 +18,123 @@ import (
 	"gogs/base/etcd"
 	log "gogs/base/logger"
 	"gogs/cb"
-	"runtime"
+	"net/http"
 )
 
-var (
-	// exitChan 退出信号
-	exitChan = make(chan struct{}, 1)
-)
+var server *cluster.Gate
+
+// admin 调试服务器,未配置地址或监听失败时为nil
+var admin *http.Server
 
 func Main() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	// 日志配置
-	logConfig := config.GetLogConfig()
-	// 网关配置
-	gateConfig := config.GetGateConfig()
-	if logConfig == nil {
-		cberrors.Panic("unable to find log config")
+	gateApp := app.New(etcd.ServerTypeGate).
+		Config("gate.yml", config.KeyEtcd, config.KeyLog, config.KeyRPC, config.KeyGate).
+		Log(func() string { return config.GetGateConfig().LogPath }).
+		Metrics(func() string { return config.GetGateConfig().MetricsAddr }).
+		// 启动监听后再启动etcd组件
+		Phase(app.Phase{
+			Name: "gate",
+			Start: func(ctx context.Context) error {
+				return startGate()
+			},
+			Stop: func(ctx context.Context) error {
+				if admin != nil {
+					_ = admin.Shutdown(ctx)
+				}
+				server.Close()
+				return nil
+			},
+		}).
+		Etcd().
+		// 网关只接受连接,集群成员管理负责关闭已下线游戏服的会话
+		Cluster(func() *cluster.Membership {
+			return server.NewMembership(config.ServerType, config.ServerID, cluster.DefaultMembershipRules).
+				WithHandler(EtcdNodeEventListener)
+		}).
+		OnReload(func() error {
+			server.SetRoutePolicy(cluster.NewRoutePolicy(cluster.RoutePolicyType(config.GetGateConfig().RoutePolicy)))
+			return nil
+		})
+	if err := gateApp.Run(); err != nil {
+		cberrors.Panic("gate run err:%s", err)
 	}
-	if gateConfig == nil {
-		cberrors.Panic("unable to find gate config")
-	}
-	// 初始化日志
-	log.Init(
-		log.SetFilename(gateConfig.LogPath),
-		log.SetIsOpenFile(logConfig.IsOpenFile),
-		log.SetIsOpenErrorFile(logConfig.IsOpenErrorFile),
-		log.SetIsOpenConsole(logConfig.IsOpenConsole),
-		log.SetIsAsync(logConfig.IsAsync),
-		log.SetMaxFileSize(int(logConfig.Maxsize)),
-	)
-	defer func() {
-		// 等待异步日志写入完成
-		_ = log.Close()
-	}()
-	// 处理系统信号
-	ProcessSignal()
+}
+
+// startGate 新建网关并开始监听,设置注册到etcd的内部地址
+func startGate() error {
+	gateConfig := config.GetGateConfig()
 	// 外部地址
 	addr := gateConfig.FullAddr()
 	// 内部地址
 	hostAddr := gateConfig.FullInnerAddr()
 	// 网关名字
 	name := fmt.Sprintf("%s:%d", config.ServerType, config.ServerID)
-	// 网关服务构造器
+	// 网关服务构造器,登录服在网关创建后才能监听
+	var loginServers *cluster.Router
 	builder := cb.NewGateBuilder(func(service cluster.IService) (cb.IGate, error) {
-		return NewAPI(service.Context().(*cluster.GateAgent)), nil
+		return NewAPI(service.Context().(*cluster.GateAgent), loginServers), nil
 	})
 	log.Infof("gate: %s addr: %s inner addr: %s", name, addr, hostAddr)
-	server, err := cluster.NewGate(name, addr, hostAddr, builder, network.ProtocolTCP)
+	security, err := newSecurity(gateConfig)
 	if err != nil {
-		cberrors.Panic(err.Error())
+		return cberrors.New("gate security err: %s", err)
 	}
-	// 启动监听后再启动etcd组件
-	etcdConfig := config.GetEtcdConfig()
-	if etcdConfig == nil {
-		cberrors.Panic("unable to find etcd config")
+	protocol := network.ProtocolType(gateConfig.Protocol)
+	if protocol == 0 {
+		protocol = network.ProtocolTCP
+	}
+	transport, err := network.NewTransport(protocol, security)
+	if err != nil {
+		return cberrors.New("gate transport err: %s", err)
+	}
+	server, err = cluster.NewGate(name, addr, hostAddr, builder, transport, nil, security)
+	if err != nil {
+		return err
+	}
+	server.SetRoutePolicy(cluster.NewRoutePolicy(cluster.RoutePolicyType(gateConfig.RoutePolicy)))
+	// 登录前通过登录服鉴权
+	if loginServers, err = server.RouteServices(cb.NewLoginBuilder(nil), nil); err != nil {
+		return err
+	}
+	if gateConfig.AdminAddr != "" {
+		if admin, err = server.NewAdmin().Serve(gateConfig.AdminAddr); err != nil {
+			log.Errorf("admin serve err:%s", err)
+		}
 	}
 	config.Adjust(
-		config.SetEtcdServiceType(config.ServerType),
-		config.SetEtcdServiceID(config.ServerID),
 		config.SetEtcdServiceAddr(gateConfig.InnerAddr),
 		config.SetEtcdServicePort(gateConfig.InnerPort),
 	)
-	if err := etcd.Init(etcdConfig, nil); err != nil {
-		cberrors.Panic("etcd init err:%s", err)
+	return nil
+}
+
+// EtcdNodeEventListener 集群成员管理之外的节点状态变更事件处理器
+// 游戏服的在线人数和状态在登录路由时直接从etcd读取,这里只记录日志
+func EtcdNodeEventListener(nodeEvent *etcd.NodeEvent) {
+	log.Debugf("etcd event: %s node: %v", nodeEvent.Event, nodeEvent.Node)
+}
+
+// newSecurity 根据网关配置创建对客户端的传输安全选项
+func newSecurity(gateConfig *config.GateConfig) (*network.Security, error) {
+	security := &network.Security{
+		Encrypt: gateConfig.Encrypt,
+	}
+	if gateConfig.TLS() {
+		tlsConfig, err := network.NewServerTLSConfig(gateConfig.TLSCert, gateConfig.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		security.TLSConfig = tlsConfig
+	}
+	if gateConfig.SignKey != "" {
+		signKey, err := network.LoadSignKey(gateConfig.SignKey)
+		if err != nil {
+			return nil, err
+		}
+		security.SignKey = signKey
+	}
+	if err := security.CheckGate(); err != nil {
+		return nil, err
 	}
-	<-exitChan
-	server.Close()
-	etcd.Exit()
+	return security, nil
 }
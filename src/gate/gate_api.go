@@ -15,18 +15,20 @@ import (
 
 // API 网关对Client提供的API
 type API struct {
-	GateAgent *cluster.GateAgent
-	authed    bool
+	GateAgent    *cluster.GateAgent
+	loginServers *cluster.Router // 登录服,登录前鉴权
+	authed       bool
 }
 
 // NewAPI 新建网关服务提供者
-func NewAPI(agent *cluster.GateAgent) *API {
+func NewAPI(agent *cluster.GateAgent, loginServers *cluster.Router) *API {
 	return &API{
-		GateAgent: agent,
+		GateAgent:    agent,
+		loginServers: loginServers,
 	}
 }
 
-// Login 登录
+// Login 登录,通过登录服鉴权后登录到用户所在的游戏服
 func (api *API) Login(req *cb.LoginReq, clientInfo *cb.ClientInfo) (*cb.LoginAck, cb.Code, error) {
 	log.Debugf("login req:%+v, clientInfo:%+v", req, clientInfo)
 	if api.GateAgent.GameServer() != nil {
@@ -35,10 +37,13 @@ func (api *API) Login(req *cb.LoginReq, clientInfo *cb.ClientInfo) (*cb.LoginAck
 	if api.authed {
 		return nil, cb.CodeDuplicateLogin, nil
 	}
-	// TODO Login服务器处理登录
+	user, code := api.auth(req)
+	if code != cb.CodeOK {
+		return nil, code, nil
+	}
 	ntf := &cluster.UserLoginNtf{
-		UserID:    req.UserID,
-		ServerID:  req.ServerID,
+		UserID:    user.UserID,
+		ServerID:  user.ServerID,
 		AccountID: req.AccountID,
 	}
 	ci := &cluster.ClientInfo{
@@ -60,10 +65,45 @@ func (api *API) Login(req *cb.LoginReq, clientInfo *cb.ClientInfo) (*cb.LoginAck
 		log.Errorf("login internal err: %s", internalErr)
 		return nil, cb.CodeSystemErr, nil
 	}
+	api.authed = true
 	ack := &cb.LoginAck{
-		UserID:    req.UserID,
+		UserID:    user.UserID,
 		AccountID: req.AccountID,
-		ServerID:  req.ServerID,
+		ServerID:  user.ServerID,
 	}
 	return ack, cb.CodeOK, nil
 }
+
+// auth 通过登录服验证token,返回登录的用户,新用户没有指定游戏服时先按路由策略选择
+func (api *API) auth(req *cb.LoginReq) (*cb.AccountUser, cb.Code) {
+	if req.AccountID == 0 {
+		return nil, cb.CodeBadParam
+	}
+	serverID := req.ServerID
+	if req.UserID == 0 && serverID == 0 {
+		var err error
+		if serverID, err = api.GateAgent.Gate.PickGameServer(req.AccountID); err != nil {
+			log.Errorf("account: %d pick game server err: %s", req.AccountID, err)
+			return nil, cb.CodeSystemErr
+		}
+	}
+	data := &cb.AuthData{
+		UserID:      req.UserID,
+		AccountID:   req.AccountID,
+		ServerID:    serverID,
+		Token:       req.Token,
+		AccountType: req.AccountType,
+	}
+	var user *cb.AccountUser
+	code := cb.CodeOK
+	err := api.loginServers.Do(req.AccountID, func(service cluster.IService) error {
+		var err error
+		user, code, err = service.(cb.ILogin).Auth(data)
+		return err
+	})
+	if err != nil {
+		log.Errorf("account: %d auth err: %s", req.AccountID, err)
+		return nil, cb.CodeSystemErr
+	}
+	return user, code
+}
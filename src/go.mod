@@ -6,7 +6,9 @@ require (
 	github.com/agiledragon/gomonkey/v2 v2.11.0
 	github.com/gogo/protobuf v1.3.2
 	github.com/golang/protobuf v1.5.3
+	github.com/golang/snappy v0.0.1
 	github.com/gorilla/websocket v1.5.1
+	github.com/klauspost/compress v1.13.6
 	github.com/natefinch/lumberjack v2.0.0+incompatible
 	github.com/smartystreets/goconvey v1.8.1
 	go.etcd.io/etcd/client/v3 v3.5.11
@@ -20,10 +22,8 @@ require (
 	github.com/BurntSushi/toml v1.3.2 // indirect
 	github.com/coreos/go-semver v0.3.0 // indirect
 	github.com/coreos/go-systemd/v22 v22.3.2 // indirect
-	github.com/golang/snappy v0.0.1 // indirect
 	github.com/gopherjs/gopherjs v1.17.2 // indirect
 	github.com/jtolds/gls v4.20.0+incompatible // indirect
-	github.com/klauspost/compress v1.13.6 // indirect
 	github.com/montanaflynn/stats v0.0.0-20171201202039-1bf9dbcd8cbe // indirect
 	github.com/smarty/assertions v1.15.0 // indirect
 	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
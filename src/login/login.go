@@ -8,105 +8,77 @@
 package login
 
 import (
+	"context"
 	"fmt"
-	"go.uber.org/zap"
+	"gogs/base/app"
 	"gogs/base/cberrors"
 	"gogs/base/cluster"
-	"gogs/base/cluster/network"
 	"gogs/base/config"
 	"gogs/base/etcd"
-	log "gogs/base/logger"
-	"gogs/game/model"
-	"runtime"
+	"gogs/base/misc"
+	"gogs/cb"
+	"gogs/login/model"
 )
 
-var server *cluster.Normal
+var (
+	server       *cluster.Normal
+	loginService *Service
+)
 
 func Main() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	// 日志配置
-	logConfig := config.GetLogConfig()
-	// 登录服配置
-	loginConfig := config.GetLoginConfig()
-	if logConfig == nil {
-		cberrors.Panic("unable to find log config")
-	}
-	if loginConfig == nil {
-		cberrors.Panic("unable to find login config")
-	}
-	// 初始化日志
-	log.Init(
-		log.SetFilename(loginConfig.LogPath),
-		log.SetIsOpenFile(logConfig.IsOpenFile),
-		log.SetIsOpenErrorFile(logConfig.IsOpenErrorFile),
-		log.SetIsOpenConsole(logConfig.IsOpenConsole),
-		log.SetIsAsync(logConfig.IsAsync),
-		log.SetMaxFileSize(int(logConfig.Maxsize)),
-		log.SetStacktrace(zap.PanicLevel),
-	)
-	etcdConfig := config.GetEtcdConfig()
-	if etcdConfig == nil {
-		cberrors.Panic("unable to find etcd config")
+	loginApp := app.New(etcd.ServerTypeLogin).
+		Config("login.yml", config.KeyEtcd, config.KeyLog, config.KeyRPC, config.KeyLogin).
+		Log(func() string { return config.GetLoginConfig().LogPath }).
+		Builder(cb.LoginTypeName, cb.NewLoginBuilder(func(service cluster.IService) (cb.ILogin, error) {
+			return loginService, nil
+		})).
+		Etcd().
+		Mongo(func() error {
+			model.InitMongoDB(config.ServerID)
+			return nil
+		}, model.CloseMongoDB)
+	loginApp.Phase(app.Phase{
+		Name: "login",
+		Start: func(ctx context.Context) error {
+			return startLogin(loginApp.Builders())
+		},
+		Stop: func(ctx context.Context) error {
+			server.Shutdown()
+			return nil
+		},
+	}).
+		// 由集群成员管理连接网关
+		Cluster(func() *cluster.Membership {
+			return cluster.NewMembership(server.Host, config.ServerType, config.ServerID, cluster.DefaultMembershipRules)
+		})
+	if err := loginApp.Run(); err != nil {
+		cberrors.Panic("login run err:%s", err)
 	}
-	if err := etcd.Init(etcdConfig, nil); err != nil {
-		cberrors.Panic("etcd init err:%s", err)
-	}
-	defer func() {
-		// 等待异步日志写入完成
-		_ = log.Close()
-	}()
-	model.InitMongoDB(config.ServerID)
-	RegisterBuilders()
-	name := fmt.Sprintf("%s:%d", config.ServerType, config.ServerID)
-	server = cluster.NewNormal(name, builders, "")
-	server.Host.NewService()
-	etcd.SetServiceCallback(EtcdNodeEventListener)
-	CheckGateConn()
-	// 处理系统信号
-	ProcessSignal()
-	<-exitChan
-	server.Shutdown()
-	model.CloseMongoDB()
 }
 
-// CheckGateConn 检查网关连接
-func CheckGateConn() {
-	nodes, err := etcd.GetDepListByType(etcd.ServerTypeGate)
-	if err != nil {
-		log.Errorf("get etcd gate list err:%s", err)
-		return
-	}
-	for _, node := range nodes {
-		if _, ok := server.Host.Node.GetSession(network.DriverTypeHost, node.GetConnectURL()); !ok {
-			_, err := server.Host.Connect(node.GetConnectURL())
-			if err != nil {
-				log.Errorf("connect to gate err:%s", err)
-			}
+// startLogin 新建登录服务器和本地登录服务,登录服务的名字与服务器相同,网关按名字路由
+func startLogin(builders map[string]cluster.IServiceBuilder) error {
+	misc.InitIDGen(config.ServerID)
+	loginService = newService(config.GetLoginConfig(), model.NewMongoAccountStore(model.MongoClient()))
+	name := fmt.Sprintf("%s:%d", config.ServerType, config.ServerID)
+	server = cluster.NewNormal(name, builders, "", nil)
+	for _, builder := range builders {
+		if _, err := server.Host.RegisterBuilder(builder); err != nil {
+			return err
 		}
 	}
+	_, err := server.Host.NewService(cb.LoginTypeName, name, nil)
+	return err
 }
 
-// EtcdNodeEventListener 注册到etcd组件的节点状态变更事件处理器
-func EtcdNodeEventListener(nodeEvent *etcd.NodeEvent) {
-	switch nodeEvent.Event {
-	case etcd.EventAdd:
-		if nodeEvent.Node.GetType() == etcd.ServerTypeGate {
-			if _, ok := server.Host.Node.GetSession(network.DriverTypeHost, nodeEvent.Node.GetConnectURL()); !ok {
-				_, err := server.Host.Connect(nodeEvent.Node.GetConnectURL())
-				if err != nil {
-					log.Errorf("connect to gate err:%s", err)
-				}
-			}
-		}
-	case etcd.EventDelete:
-		if nodeEvent.Node.GetType() == etcd.ServerTypeGate {
-			session, ok := server.Host.Node.GetSession(network.DriverTypeHost, nodeEvent.Node.GetConnectURL())
-			if ok {
-				session.Close()
-			}
-		}
-	default:
-		log.Errorf("unknown etcd event:%+v", nodeEvent)
+// newService 按配置注册允许登录的账号类型
+func newService(loginConfig *config.LoginConfig, store model.IAccountStore) *Service {
+	service := NewService(store, misc.NewID)
+	if loginConfig.TestToken != "" {
+		service.WithVerifier(cb.AccountTypeTest, &TestVerifier{Token: loginConfig.TestToken})
 	}
-
+	if loginConfig.TokenSecret != "" {
+		service.WithVerifier(cb.AccountTypePlatform, NewHMACVerifier(loginConfig.TokenSecret))
+	}
+	return service
 }
@@ -0,0 +1,139 @@
+// -------------------------------------------
+// @file      : account.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/6 上午10:15
+// -------------------------------------------
+
+package model
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gogs/base/mongodb"
+	"sync"
+)
+
+// DBAccount 账号及其下的用户,每个服务器上最多一个用户
+type DBAccount struct {
+	AccountID int64            `bson:"accountID"` // 账号ID
+	Users     []*DBAccountUser `bson:"users"`     // 账号下的用户
+}
+
+// DBAccountUser 账号下的一个用户
+type DBAccountUser struct {
+	UserID   int64 `bson:"userID"`   // 用户ID
+	ServerID int64 `bson:"serverID"` // 用户所在服务器ID
+}
+
+// IAccountStore 账号到用户的映射存储
+type IAccountStore interface {
+	GetUsers(accountID int64) ([]*DBAccountUser, error)         // 账号下的用户,账号不存在时返回空
+	AddUser(accountID int64, user *DBAccountUser) (bool, error) // 账号在用户的服务器上还没有用户时添加,返回是否添加
+	DelUsers(userIDs []int64) error                             // 从所属账号中删除用户
+}
+
+// MongoAccountStore 保存在mongodb的账号存储,需要accountID的唯一索引
+type MongoAccountStore struct {
+	client *mongodb.MongoClient
+}
+
+// NewMongoAccountStore 新建保存在mongodb的账号存储
+func NewMongoAccountStore(client *mongodb.MongoClient) *MongoAccountStore {
+	return &MongoAccountStore{client: client}
+}
+
+// GetUsers implements IAccountStore
+func (store *MongoAccountStore) GetUsers(accountID int64) ([]*DBAccountUser, error) {
+	account := &DBAccount{}
+	err := store.client.FindOneDecode(AccountCollection, bson.M{"accountID": accountID}, account)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return account.Users, nil
+}
+
+// AddUser implements IAccountStore
+// 条件更新保证并发的登录在同一服务器上只添加一个用户,账号不存在时插入,已有该服务器的用户时插入违反唯一索引
+func (store *MongoAccountStore) AddUser(accountID int64, user *DBAccountUser) (bool, error) {
+	filter := bson.M{"accountID": accountID, "users.serverID": bson.M{"$ne": user.ServerID}}
+	update := bson.M{"$push": bson.M{"users": user}}
+	_, err := store.client.Collection(AccountCollection).UpdateOne(context.Background(), filter, update,
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// DelUsers implements IAccountStore
+func (store *MongoAccountStore) DelUsers(userIDs []int64) error {
+	filter := bson.M{"users.userID": bson.M{"$in": userIDs}}
+	update := bson.M{"$pull": bson.M{"users": bson.M{"userID": bson.M{"$in": userIDs}}}}
+	_, err := store.client.Collection(AccountCollection).UpdateMany(context.Background(), filter, update)
+	return err
+}
+
+// MemoryAccountStore 内存中的账号存储,用于测试和没有mongodb的本地环境
+type MemoryAccountStore struct {
+	sync.Mutex
+	accounts map[int64][]*DBAccountUser
+}
+
+// NewMemoryAccountStore 新建内存中的账号存储
+func NewMemoryAccountStore() *MemoryAccountStore {
+	return &MemoryAccountStore{
+		accounts: make(map[int64][]*DBAccountUser),
+	}
+}
+
+// GetUsers implements IAccountStore
+func (store *MemoryAccountStore) GetUsers(accountID int64) ([]*DBAccountUser, error) {
+	store.Lock()
+	defer store.Unlock()
+	users := make([]*DBAccountUser, 0, len(store.accounts[accountID]))
+	for _, user := range store.accounts[accountID] {
+		copied := *user
+		users = append(users, &copied)
+	}
+	return users, nil
+}
+
+// AddUser implements IAccountStore
+func (store *MemoryAccountStore) AddUser(accountID int64, user *DBAccountUser) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+	for _, exist := range store.accounts[accountID] {
+		if exist.ServerID == user.ServerID {
+			return false, nil
+		}
+	}
+	copied := *user
+	store.accounts[accountID] = append(store.accounts[accountID], &copied)
+	return true, nil
+}
+
+// DelUsers implements IAccountStore
+func (store *MemoryAccountStore) DelUsers(userIDs []int64) error {
+	store.Lock()
+	defer store.Unlock()
+	deleted := make(map[int64]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		deleted[userID] = struct{}{}
+	}
+	for accountID, users := range store.accounts {
+		remain := users[:0]
+		for _, user := range users {
+			if _, ok := deleted[user.UserID]; !ok {
+				remain = append(remain, user)
+			}
+		}
+		store.accounts[accountID] = remain
+	}
+	return nil
+}
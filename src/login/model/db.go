@@ -16,7 +16,7 @@ import (
 )
 
 const (
-	UserCollection = "users"
+	AccountCollection = "accounts"
 )
 
 var (
@@ -24,14 +24,14 @@ var (
 )
 
 func InitMongoDB(serverID int64) {
-	gameConfigNode, err := etcd.GetDepByTypeAndID(etcd.ServerTypeGameConfig, serverID)
+	loginConfigNode, err := etcd.GetDepByTypeAndID(etcd.ServerTypeLoginConfig, serverID)
 	if err != nil {
-		cberrors.Panic("unable to find game_config in etcd. serverID:%d. err:%s", serverID, err)
+		cberrors.Panic("unable to find login_config in etcd. serverID:%d. err:%s", serverID, err)
 	}
-	if gameConfigNode == nil {
-		cberrors.Panic("unable to find game_config in etcd. serverID:%d", serverID)
+	if loginConfigNode == nil {
+		cberrors.Panic("unable to find login_config in etcd. serverID:%d", serverID)
 	}
-	mongoID := gameConfigNode.GetMongoID()
+	mongoID := loginConfigNode.GetMongoID()
 	mongoNode, err := etcd.GetDepByTypeAndID(etcd.ServerTypeMongo, mongoID)
 	if err != nil {
 		cberrors.Panic("unable to find mongo in etcd. mongoID:%d. err:%s", mongoID, err)
@@ -39,18 +39,18 @@ func InitMongoDB(serverID int64) {
 	if mongoNode == nil {
 		cberrors.Panic("unable to find mongo in etcd. mongoID:%d", mongoID)
 	}
-	dbName := config.GetGameConfig().DBName
+	dbName := config.GetLoginConfig().DBName
 	url := mongoNode.GetMongoConnectURL()
 	log.Infof("start connecting to mongodb: %s", url)
 	err = mongoClient.Connect(url, dbName)
 	if err != nil {
 		cberrors.Panic("mongoClient connect err:%s", err)
 	}
-	err = mongoClient.CreateIndex(UserCollection, "id", true)
+	err = mongoClient.CreateIndex(AccountCollection, "accountID", true)
 	if err != nil {
 		cberrors.Panic("mongoClient CreateIndex err:%s", err)
 	}
-	err = mongoClient.CreateIndex(UserCollection, "username", false)
+	err = mongoClient.CreateIndex(AccountCollection, "users.userID", false)
 	if err != nil {
 		cberrors.Panic("mongoClient CreateIndex err:%s", err)
 	}
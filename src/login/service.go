@@ -0,0 +1,145 @@
+// -------------------------------------------
+// @file      : service.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/6 下午2:05
+// -------------------------------------------
+
+package login
+
+import (
+	log "gogs/base/logger"
+	"gogs/cb"
+	"gogs/login/model"
+)
+
+// Service 登录服务的实现,验证账号token并维护账号下的用户
+type Service struct {
+	store     model.IAccountStore               // 账号存储
+	verifiers map[cb.AccountType]ITokenVerifier // token验证,通过账号类型索引
+	newID     func() int64                      // 新用户ID生成器,返回0表示失败
+}
+
+// NewService 新建登录服务,没有注册验证的账号类型不能登录
+func NewService(store model.IAccountStore, newID func() int64) *Service {
+	return &Service{
+		store:     store,
+		verifiers: make(map[cb.AccountType]ITokenVerifier),
+		newID:     newID,
+	}
+}
+
+// WithVerifier 注册账号类型的token验证
+func (service *Service) WithVerifier(accountType cb.AccountType, verifier ITokenVerifier) *Service {
+	service.verifiers[accountType] = verifier
+	return service
+}
+
+// Auth 验证token,返回登录的用户
+// 指定了用户时该用户必须属于账号,否则返回账号在指定服务器上的用户,没有时新建
+// 只验证token时只返回验证结果,不返回用户,调用方传入的用户未经检查不能信任
+func (service *Service) Auth(data *cb.AuthData) (*cb.AccountUser, cb.Code, error) {
+	if data.AccountID == 0 {
+		return nil, cb.CodeBadParam, nil
+	}
+	verifier, ok := service.verifiers[data.AccountType]
+	if !ok {
+		log.Warnf("account: %d type: %s not allowed", data.AccountID, data.AccountType)
+		return nil, cb.CodeAuthFailed, nil
+	}
+	if err := verifier.Verify(data.AccountID, data.Token); err != nil {
+		log.Warnf("account: %d auth failed: %s", data.AccountID, err)
+		return nil, cb.CodeAuthFailed, nil
+	}
+	if data.OnlyVerify {
+		return nil, cb.CodeOK, nil
+	}
+	users, err := service.store.GetUsers(data.AccountID)
+	if err != nil {
+		log.Errorf("account: %d get users err: %s", data.AccountID, err)
+		return nil, cb.CodeSystemErr, nil
+	}
+	if data.UserID != 0 {
+		if user := findUser(users, func(user *model.DBAccountUser) bool { return user.UserID == data.UserID }); user != nil {
+			return user, cb.CodeOK, nil
+		}
+		log.Warnf("account: %d has no user: %d", data.AccountID, data.UserID)
+		return nil, cb.CodeBadParam, nil
+	}
+	if data.ServerID == 0 {
+		return nil, cb.CodeBadParam, nil
+	}
+	if user := findUser(users, onServer(data.ServerID)); user != nil {
+		return user, cb.CodeOK, nil
+	}
+	return service.newUser(data.AccountID, data.ServerID)
+}
+
+// newUser 在服务器上为账号新建用户,并发登录已经新建时返回已有的用户
+func (service *Service) newUser(accountID, serverID int64) (*cb.AccountUser, cb.Code, error) {
+	userID := service.newID()
+	if userID == 0 {
+		log.Errorf("account: %d new user id failed", accountID)
+		return nil, cb.CodeSystemErr, nil
+	}
+	added, err := service.store.AddUser(accountID, &model.DBAccountUser{UserID: userID, ServerID: serverID})
+	if err != nil {
+		log.Errorf("account: %d add user err: %s", accountID, err)
+		return nil, cb.CodeSystemErr, nil
+	}
+	if added {
+		log.Infof("account: %d new user: %d on server: %d", accountID, userID, serverID)
+		return &cb.AccountUser{UserID: userID, ServerID: serverID}, cb.CodeOK, nil
+	}
+	users, err := service.store.GetUsers(accountID)
+	if err != nil {
+		log.Errorf("account: %d get users err: %s", accountID, err)
+		return nil, cb.CodeSystemErr, nil
+	}
+	if user := findUser(users, onServer(serverID)); user != nil {
+		return user, cb.CodeOK, nil
+	}
+	log.Errorf("account: %d user on server: %d not found after add", accountID, serverID)
+	return nil, cb.CodeSystemErr, nil
+}
+
+// DelAccountUsers 删除多个用户
+func (service *Service) DelAccountUsers(userIDs []int64) error {
+	if err := service.store.DelUsers(userIDs); err != nil {
+		log.Errorf("delete users: %v err: %s", userIDs, err)
+		return err
+	}
+	log.Infof("users: %v deleted", userIDs)
+	return nil
+}
+
+// GetAccountUsers 账号下的所有用户
+func (service *Service) GetAccountUsers(accountID int64) ([]*cb.AccountUser, cb.Code, error) {
+	users, err := service.store.GetUsers(accountID)
+	if err != nil {
+		log.Errorf("account: %d get users err: %s", accountID, err)
+		return nil, cb.CodeSystemErr, nil
+	}
+	accountUsers := make([]*cb.AccountUser, 0, len(users))
+	for _, user := range users {
+		accountUsers = append(accountUsers, &cb.AccountUser{UserID: user.UserID, ServerID: user.ServerID})
+	}
+	return accountUsers, cb.CodeOK, nil
+}
+
+// findUser 第一个满足条件的用户
+func findUser(users []*model.DBAccountUser, match func(user *model.DBAccountUser) bool) *cb.AccountUser {
+	for _, user := range users {
+		if match(user) {
+			return &cb.AccountUser{UserID: user.UserID, ServerID: user.ServerID}
+		}
+	}
+	return nil
+}
+
+// onServer 用户是否在指定服务器上
+func onServer(serverID int64) func(user *model.DBAccountUser) bool {
+	return func(user *model.DBAccountUser) bool {
+		return user.ServerID == serverID
+	}
+}
@@ -0,0 +1,121 @@
+// -------------------------------------------
+// @file      : service_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/6 下午4:10
+// -------------------------------------------
+
+package login
+
+import (
+	"gogs/cb"
+	"gogs/login/model"
+	"testing"
+	"time"
+)
+
+// newTestService 使用内存存储和递增ID的登录服务,测试账号的token为test
+func newTestService() *Service {
+	var id int64
+	return NewService(model.NewMemoryAccountStore(), func() int64 {
+		id++
+		return id
+	}).WithVerifier(cb.AccountTypeTest, &TestVerifier{Token: "test"})
+}
+
+func TestHMACVerifier(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	verifier := NewHMACVerifier("secret")
+	verifier.Now = func() time.Time { return now }
+	token := verifier.Sign(1, now.Add(time.Minute))
+	if err := verifier.Verify(1, token); err != nil {
+		t.Fatal(err)
+	}
+	// 其他账号、篡改、其他密钥签发和过期的token都不能通过
+	other := NewHMACVerifier("other")
+	tokens := map[string]string{
+		"account":   token,
+		"malformed": "token",
+		"tampered":  verifier.Sign(1, now.Add(time.Hour))[:10] + token[10:],
+		"secret":    other.Sign(1, now.Add(time.Minute)),
+		"expired":   verifier.Sign(1, now.Add(-time.Second)),
+	}
+	for name, token := range tokens {
+		accountID := int64(1)
+		if name == "account" {
+			accountID = 2
+		}
+		if err := verifier.Verify(accountID, token); err == nil {
+			t.Fatalf("%s: token verified", name)
+		}
+	}
+}
+
+func TestServiceAuth(t *testing.T) {
+	service := newTestService()
+	auth := func(data *cb.AuthData) (*cb.AccountUser, cb.Code) {
+		user, code, err := service.Auth(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user, code
+	}
+
+	// token错误或者账号类型未注册时鉴权失败
+	if _, code := auth(&cb.AuthData{AccountID: 1, ServerID: 1, Token: "wrong", AccountType: cb.AccountTypeTest}); code != cb.CodeAuthFailed {
+		t.Fatalf("wrong token code: %s", code)
+	}
+	if _, code := auth(&cb.AuthData{AccountID: 1, ServerID: 1, Token: "test", AccountType: cb.AccountTypePlatform}); code != cb.CodeAuthFailed {
+		t.Fatalf("unregistered type code: %s", code)
+	}
+	if _, code := auth(&cb.AuthData{Token: "test", AccountType: cb.AccountTypeTest}); code != cb.CodeBadParam {
+		t.Fatalf("no account code: %s", code)
+	}
+
+	// 首次登录新建用户,再次登录返回同一用户
+	user, code := auth(&cb.AuthData{AccountID: 1, ServerID: 1, Token: "test", AccountType: cb.AccountTypeTest})
+	if code != cb.CodeOK || user.UserID == 0 || user.ServerID != 1 {
+		t.Fatalf("new user: %+v code: %s", user, code)
+	}
+	again, code := auth(&cb.AuthData{AccountID: 1, ServerID: 1, Token: "test", AccountType: cb.AccountTypeTest})
+	if code != cb.CodeOK || again.UserID != user.UserID {
+		t.Fatalf("existing user: %+v code: %s", again, code)
+	}
+	byID, code := auth(&cb.AuthData{AccountID: 1, UserID: user.UserID, Token: "test", AccountType: cb.AccountTypeTest})
+	if code != cb.CodeOK || byID.UserID != user.UserID || byID.ServerID != 1 {
+		t.Fatalf("user by id: %+v code: %s", byID, code)
+	}
+
+	// 只验证token时不返回用户,不能借此冒用其他账号的用户
+	if verified, code := auth(&cb.AuthData{AccountID: 2, UserID: user.UserID, ServerID: 1, Token: "test",
+		AccountType: cb.AccountTypeTest, OnlyVerify: true}); code != cb.CodeOK || verified != nil {
+		t.Fatalf("only verify: %+v code: %s", verified, code)
+	}
+	if _, code := auth(&cb.AuthData{AccountID: 2, Token: "wrong", AccountType: cb.AccountTypeTest, OnlyVerify: true}); code != cb.CodeAuthFailed {
+		t.Fatalf("only verify wrong token code: %s", code)
+	}
+
+	// 不属于账号的用户不能登录
+	if _, code := auth(&cb.AuthData{AccountID: 2, UserID: user.UserID, Token: "test", AccountType: cb.AccountTypeTest}); code != cb.CodeBadParam {
+		t.Fatalf("other account user code: %s", code)
+	}
+
+	// 其他服务器上新建另一个用户
+	second, code := auth(&cb.AuthData{AccountID: 1, ServerID: 2, Token: "test", AccountType: cb.AccountTypeTest})
+	if code != cb.CodeOK || second.UserID == user.UserID || second.ServerID != 2 {
+		t.Fatalf("second user: %+v code: %s", second, code)
+	}
+	users, code, err := service.GetAccountUsers(1)
+	if err != nil || code != cb.CodeOK || len(users) != 2 {
+		t.Fatalf("account users: %v code: %s err: %v", users, code, err)
+	}
+
+	// 删除后在该服务器上重新新建
+	if err := service.DelAccountUsers([]int64{user.UserID}); err != nil {
+		t.Fatal(err)
+	}
+	renewed, code := auth(&cb.AuthData{AccountID: 1, ServerID: 1, Token: "test", AccountType: cb.AccountTypeTest})
+	if code != cb.CodeOK || renewed.UserID == user.UserID {
+		t.Fatalf("renewed user: %+v code: %s", renewed, code)
+	}
+}
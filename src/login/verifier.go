@@ -0,0 +1,85 @@
+// -------------------------------------------
+// @file      : verifier.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/2/6 上午11:20
+// -------------------------------------------
+
+package login
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"gogs/base/cberrors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ITokenVerifier 登录token验证,按账号类型注册到登录服务
+type ITokenVerifier interface {
+	Verify(accountID int64, token string) error // 验证账号的token,失败时返回原因
+}
+
+// TestVerifier 测试账号,所有测试账号使用同一个配置的token
+type TestVerifier struct {
+	Token string // 测试账号的token
+}
+
+// Verify implements ITokenVerifier
+func (verifier *TestVerifier) Verify(accountID int64, token string) error {
+	if !hmac.Equal([]byte(token), []byte(verifier.Token)) {
+		return cberrors.New("test account: %d token mismatch", accountID)
+	}
+	return nil
+}
+
+// HMACVerifier 平台签发的token,格式为 过期时间戳.签名
+// 签名为以共享密钥对 账号ID.过期时间戳 做HMAC-SHA256的十六进制
+type HMACVerifier struct {
+	Secret []byte           // 与平台共享的签名密钥
+	Now    func() time.Time // 当前时间,为nil时使用time.Now
+}
+
+// NewHMACVerifier 新建平台token验证
+func NewHMACVerifier(secret string) *HMACVerifier {
+	return &HMACVerifier{Secret: []byte(secret)}
+}
+
+// Sign 签发账号的token,由平台或测试工具使用
+func (verifier *HMACVerifier) Sign(accountID int64, expire time.Time) string {
+	expireAt := strconv.FormatInt(expire.Unix(), 10)
+	return expireAt + "." + hex.EncodeToString(verifier.signature(accountID, expireAt))
+}
+
+// Verify implements ITokenVerifier
+func (verifier *HMACVerifier) Verify(accountID int64, token string) error {
+	expireAt, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return cberrors.New("account: %d malformed token", accountID)
+	}
+	expire, err := strconv.ParseInt(expireAt, 10, 64)
+	if err != nil {
+		return cberrors.New("account: %d malformed token expire: %s", accountID, expireAt)
+	}
+	mac, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, verifier.signature(accountID, expireAt)) {
+		return cberrors.New("account: %d token signature mismatch", accountID)
+	}
+	now := time.Now
+	if verifier.Now != nil {
+		now = verifier.Now
+	}
+	if now().Unix() > expire {
+		return cberrors.New("account: %d token expired at: %d", accountID, expire)
+	}
+	return nil
+}
+
+// signature 账号ID和过期时间的签名
+func (verifier *HMACVerifier) signature(accountID int64, expireAt string) []byte {
+	mac := hmac.New(sha256.New, verifier.Secret)
+	mac.Write([]byte(strconv.FormatInt(accountID, 10) + "." + expireAt))
+	return mac.Sum(nil)
+}
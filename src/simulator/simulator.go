@@ -8,64 +8,96 @@
 package simulator
 
 import (
-	"go.uber.org/zap"
+	"context"
+	"gogs/base/app"
 	"gogs/base/cberrors"
 	"gogs/base/cluster"
 	"gogs/base/cluster/network"
 	"gogs/base/config"
+	"gogs/base/etcd"
 	log "gogs/base/logger"
 	"gogs/cb"
 	"strconv"
 )
 
 func Main() {
-	// 日志配置
-	logConfig := config.GetLogConfig()
-	// 模拟器配置
+	simulatorApp := app.New(etcd.ServerTypeGame).
+		Config("simulator.yml", config.KeyLog, config.KeyRPC, config.KeySimulator).
+		Log(func() string { return config.GetSimulatorConfig().LogPath }).
+		Builder("gate", cb.NewGateBuilder(nil)).
+		Builder("game", cb.NewGameBuilder(nil)).
+		Builder("client", cb.NewClientAPIBuilder(func(service cluster.IService) (cb.IClientAPI, error) {
+			return NewClientAPI(), nil
+		}))
+	simulatorApp.Phase(app.Phase{
+		Name: "simulator",
+		Start: func(ctx context.Context) error {
+			return startSimulator(simulatorApp.Builders())
+		},
+	})
+	if err := simulatorApp.Run(); err != nil {
+		cberrors.Panic("simulator run err:%s", err)
+	}
+}
+
+// startSimulator 连接网关并登录
+func startSimulator(builders map[string]cluster.IServiceBuilder) error {
 	simulatorConfig := config.GetSimulatorConfig()
-	if logConfig == nil {
-		cberrors.Panic("unable to find log config")
+	security, err := newSecurity(simulatorConfig)
+	if err != nil {
+		return cberrors.New("simulator security err:%s", err)
 	}
-	if simulatorConfig == nil {
-		cberrors.Panic("unable to find game config")
+	protocol := network.ProtocolType(simulatorConfig.Protocol)
+	if protocol == 0 {
+		protocol = network.ProtocolTCP
 	}
-	// 初始化日志
-	log.Init(
-		log.SetFilename(simulatorConfig.LogPath),
-		log.SetIsOpenFile(logConfig.IsOpenFile),
-		log.SetIsOpenErrorFile(logConfig.IsOpenErrorFile),
-		log.SetIsOpenConsole(logConfig.IsOpenConsole),
-		log.SetIsAsync(logConfig.IsAsync),
-		log.SetMaxFileSize(int(logConfig.Maxsize)),
-		log.SetStacktrace(zap.PanicLevel),
-	)
-	builders := map[string]cluster.IServiceBuilder{
-		"gate": cb.NewGateBuilder(nil),
-		"game": cb.NewGameBuilder(nil),
-		"client": cb.NewClientAPIBuilder(func(service cluster.IService) (cb.IClientAPI, error) {
-			return NewClientAPI(), nil
-		}),
+	transport, err := network.NewTransport(protocol, security)
+	if err != nil {
+		return cberrors.New("simulator transport err:%s", err)
 	}
 	simulator, err := cluster.NewSimulator(
-		"localhost:9100",
+		simulatorConfig.GateAddr,
 		builders,
-		network.ProtocolTCP,
+		transport,
+		security,
 	)
 	if err != nil {
-		log.Errorf("new simulator err:%s", err)
-		return
+		return cberrors.New("new simulator err:%s", err)
 	}
 	userID := 1
 	client, err := simulator.Connect(strconv.Itoa(userID))
 	if err != nil {
-		log.Errorf("connect err:%s", err)
-		return
+		return cberrors.New("connect err:%s", err)
 	}
 	ack, code, err := client.GateServer.(*cb.GateRemoteService).Login(&cb.LoginReq{}, &cb.ClientInfo{})
 	if err != nil {
-		log.Errorf("login err:%s", err)
-		return
+		return cberrors.New("login err:%s", err)
 	}
 	log.Debugf("login ack:%+v code:%d", ack, code)
-	<-make(chan struct{})
+	return nil
+}
+
+// newSecurity 根据模拟器配置创建连接网关的传输安全选项
+func newSecurity(simulatorConfig *config.SimulatorConfig) (*network.Security, error) {
+	security := &network.Security{
+		Encrypt: simulatorConfig.Encrypt,
+	}
+	if simulatorConfig.TLS {
+		tlsConfig, err := network.NewClientTLSConfig(simulatorConfig.TLSCA, simulatorConfig.TLSInsecure)
+		if err != nil {
+			return nil, err
+		}
+		security.TLSConfig = tlsConfig
+	}
+	if simulatorConfig.GateKey != "" {
+		gateKey, err := network.LoadGateKey(simulatorConfig.GateKey)
+		if err != nil {
+			return nil, err
+		}
+		security.GateKey = gateKey
+	}
+	if err := security.CheckClient(); err != nil {
+		return nil, err
+	}
+	return security, nil
 }
@@ -0,0 +1,105 @@
+// -------------------------------------------
+// @file      : simulator_test.go
+// @author    : 蔡波
+// @contact   : caibo923@gmail.com
+// @time      : 2024/1/21 下午3:20
+// -------------------------------------------
+
+package simulator
+
+import (
+	"gogs/base/cluster"
+	"gogs/base/cluster/network"
+	"gogs/base/config"
+	"gogs/cb"
+	"gogs/game"
+	"gogs/gate"
+	"gogs/login"
+	"gogs/login/model"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCluster 在一个进程内通过内存传输层启动网关、游戏服和模拟器,登录后经网关调用游戏服
+func TestCluster(t *testing.T) {
+	config.With(config.KeyRPC, config.KeyLog)
+	// 服务注册按间隔批量发送,缩短间隔加快上线和下线
+	config.GetRPCConfig().ClusterRegistryInterval = 1
+	transport := network.NewMemoryTransport()
+
+	// 登录服务在本进程内,测试账号使用固定的token
+	var userID int64
+	loginService, err := cb.NewLoginBuilder(func(service cluster.IService) (cb.ILogin, error) {
+		return login.NewService(model.NewMemoryAccountStore(), func() int64 {
+			return atomic.AddInt64(&userID, 1)
+		}).WithVerifier(cb.AccountTypeTest, &login.TestVerifier{Token: "test"}), nil
+	}).NewService("Login:1", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginServers := cluster.NewRouter(nil, nil)
+	loginServers.Add(loginService)
+
+	gateServer, err := cluster.NewGate("Gate:1", "gate", "gate-host",
+		cb.NewGateBuilder(func(service cluster.IService) (cb.IGate, error) {
+			return gate.NewAPI(service.Context().(*cluster.GateAgent), loginServers), nil
+		}),
+		transport, transport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gateServer.Close()
+
+	gameServer, err := cluster.NewGame("Game:1", map[string]cluster.IServiceBuilder{
+		"client": cb.NewUserBuilder(func(service cluster.IService) (cb.IUser, error) {
+			return game.NewUser(service.Context().(*cluster.ClientAgent))
+		}),
+	}, "game-host", transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gameServer.ActorSystem.Close()
+	defer gameServer.Host.Close()
+	if _, err = gameServer.Host.Connect("gate-host"); err != nil {
+		t.Fatal(err)
+	}
+
+	simulator, err := cluster.NewSimulator("gate", map[string]cluster.IServiceBuilder{
+		"gate": cb.NewGateBuilder(nil),
+		"game": cb.NewGameBuilder(nil),
+		"client": cb.NewClientAPIBuilder(func(service cluster.IService) (cb.IClientAPI, error) {
+			return NewClientAPI(), nil
+		}),
+	}, transport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := simulator.Connect("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 游戏服和网关互相注册服务后才能登录成功
+	var ack *cb.LoginAck
+	var code cb.Code
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		ack, code, err = client.GateServer.(*cb.GateRemoteService).Login(&cb.LoginReq{AccountID: 1, Token: "test", AccountType: cb.AccountTypeTest}, &cb.ClientInfo{})
+		if err == nil && code == cb.CodeOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("login code: %s err: %v", code, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ack.UserID != 1 {
+		t.Fatalf("unexpected login ack: %+v", ack)
+	}
+
+	// 经网关转发到游戏服上的用户角色
+	if _, code, err = client.GameServer.(*cb.GameRemoteService).GetServerTime(); err != nil || code != cb.CodeOK {
+		t.Fatalf("tunnel call code: %s err: %v", code, err)
+	}
+}